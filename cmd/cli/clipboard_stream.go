@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rupor-github/gclpr/server"
+	"github.com/rupor-github/gclpr/util"
+)
+
+// progress reports transfer progress on terminal for payloads which are streamed.
+type progress struct {
+	out   io.Writer
+	op    string
+	total int64
+	last  int
+}
+
+func newProgress(op string, total int64) *progress {
+	if total <= server.MaxClipboardSize || !isTerminal(os.Stderr) {
+		return &progress{}
+	}
+	return &progress{out: os.Stderr, op: op, total: total, last: -1}
+}
+
+func (p *progress) update(done int64) {
+	if p.out == nil || p.total <= 0 {
+		return
+	}
+	percent := int(done * 100 / p.total)
+	if percent == p.last {
+		return
+	}
+	p.last = percent
+	fmt.Fprintf(p.out, "\r%s: %s / %s (%d%%)", p.op, formatSize(done), formatSize(p.total), percent)
+}
+
+func (p *progress) done() {
+	if p.out == nil {
+		return
+	}
+	fmt.Fprintln(p.out)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// typed tells whether data of MIME type needs typed clipboard calls, plain text does not.
+func typed(mimeType string) bool {
+	if mimeType == "" {
+		return false
+	}
+	mt, _, _ := mime.ParseMediaType(mimeType)
+	return mt != server.MIMEText
+}
+
+// otherSelection reports whether sel is not the clipboard, plain text copy and paste do not know about selections.
+func otherSelection(sel string) bool {
+	return sel != "" && sel != server.SelectionClipboard
+}
+
+// isUnknownMethod detects servers which predate rpc method being called.
+func isUnknownMethod(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "rpc: can't find")
+}
+
+// copyText sends text to server clipboard, streaming it in chunks when it does not fit into single call.
+func copyText(rc *rpc.Client, text string) error {
+	if len(text) <= server.MaxClipboardSize {
+		return rc.Call("Clipboard.Copy", text, &struct{}{})
+	}
+
+	var tr server.TransferResponse
+	if err := rc.Call("Clipboard.CopyBegin", server.CopyBeginRequest{Size: int64(len(text))}, &tr); err != nil {
+		if isUnknownMethod(err) {
+			return fmt.Errorf("server does not support payloads larger than %d bytes: %w", server.MaxClipboardSize, err)
+		}
+		return err
+	}
+	return copyChunks(rc, tr, text)
+}
+
+// copyType sends data of MIME type to server selection, typed data is always streamed.
+func copyType(rc *rpc.Client, mime, sel, data string) error {
+	var tr server.TransferResponse
+	if err := rc.Call("Clipboard.CopyTypeBegin", server.CopyTypeRequest{Type: mime, Size: int64(len(data)), Selection: sel}, &tr); err != nil {
+		if isUnknownMethod(err) {
+			return fmt.Errorf("server does not support clipboard types and selections: %w", err)
+		}
+		return err
+	}
+	return copyChunks(rc, tr, data)
+}
+
+// copyExpiring sends data of MIME type to server selection, server takes it back after ttl.
+func copyExpiring(rc *rpc.Client, mime, sel, data string, ttl time.Duration) error {
+	var tr server.TransferResponse
+	req := server.ExpiringCopyRequest{CopyTypeRequest: server.CopyTypeRequest{Type: mime, Size: int64(len(data)), Selection: sel}, TTL: ttl}
+	if err := rc.Call("Clipboard.CopyExpiringBegin", req, &tr); err != nil {
+		if isUnknownMethod(err) {
+			return fmt.Errorf("server does not support expiring copies: %w", err)
+		}
+		return err
+	}
+	return copyChunks(rc, tr, data)
+}
+
+// copyChunks sends text of started copy transfer and completes it.
+func copyChunks(rc *rpc.Client, tr server.TransferResponse, text string) error {
+	logger(util.SubsysClipboard).Debugf("Streaming copy transfer=%s size=%d chunk=%d", tr.TransferID, tr.Size, tr.ChunkSize)
+
+	chunk := tr.ChunkSize
+	if chunk <= 0 {
+		chunk = server.ClipboardChunkSize
+	}
+	pr := newProgress("copy", int64(len(text)))
+	defer pr.done()
+	for off := 0; off < len(text); off += chunk {
+		end := min(off+chunk, len(text))
+		req := server.ChunkRequest{TransferID: tr.TransferID, Offset: int64(off), Data: []byte(text[off:end])}
+		if err := rc.Call("Clipboard.CopyChunk", req, &struct{}{}); err != nil {
+			return err
+		}
+		pr.update(int64(end))
+	}
+	return rc.Call("Clipboard.CopyEnd", tr.TransferID, &struct{}{})
+}
+
+// pasteText reads server clipboard, falling back to single call for servers without streaming support.
+func pasteText(rc *rpc.Client) (string, error) {
+	var tr server.TransferResponse
+	if err := rc.Call("Clipboard.PasteBegin", struct{}{}, &tr); err != nil {
+		if !isUnknownMethod(err) {
+			return "", err
+		}
+		logger(util.SubsysClipboard).Debugf("Server does not support streaming paste, using single call")
+		var resp string
+		err = rc.Call("Clipboard.Paste", struct{}{}, &resp)
+		return resp, err
+	}
+	return pasteChunks(rc, tr)
+}
+
+// pasteType reads content of MIME type from server selection.
+func pasteType(rc *rpc.Client, mime, sel string) (string, error) {
+	var tr server.TransferResponse
+	if err := rc.Call("Clipboard.PasteTypeBegin", server.PasteTypeRequest{Type: mime, Selection: sel}, &tr); err != nil {
+		if isUnknownMethod(err) {
+			return "", fmt.Errorf("server does not support clipboard types and selections: %w", err)
+		}
+		return "", err
+	}
+	return pasteChunks(rc, tr)
+}
+
+// pasteHistory reads clipboard history entry n as content of MIME type.
+func pasteHistory(rc *rpc.Client, n int, mime string) (string, error) {
+	var tr server.TransferResponse
+	if err := rc.Call("Clipboard.HistoryPasteBegin", server.HistoryPasteRequest{Entry: n, Type: mime}, &tr); err != nil {
+		if isUnknownMethod(err) {
+			return "", fmt.Errorf("server does not support clipboard history: %w", err)
+		}
+		return "", err
+	}
+	return pasteChunks(rc, tr)
+}
+
+// clipboardHistory lists entries of server clipboard history, the latest first.
+func clipboardHistory(rc *rpc.Client) ([]server.HistoryEntry, error) {
+	var entries []server.HistoryEntry
+	if err := rc.Call("Clipboard.History", struct{}{}, &entries); err != nil {
+		if isUnknownMethod(err) {
+			return nil, fmt.Errorf("server does not support clipboard history: %w", err)
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+var errNoWatch = errors.New("server does not support clipboard watch")
+
+// watchClipboard calls emit for every change of server clipboard until watch ends.
+func watchClipboard(rc *rpc.Client, sc *secConn, content bool, emit func(server.ClipboardEvent) error) error {
+	m := sc.muxer()
+	if m == nil {
+		return errNoWatch
+	}
+	ch, err := m.Open(m.NextID())
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := rc.Call("Clipboard.Watch", server.WatchRequest{Channel: ch.ID(), Content: content}, &struct{}{}); err != nil {
+		if isUnknownMethod(err) {
+			return fmt.Errorf("%w: %w", errNoWatch, err)
+		}
+		return err
+	}
+	logger(util.SubsysClipboard).Debugf("Watching server clipboard on channel %d", ch.ID())
+	dec := json.NewDecoder(ch)
+	for {
+		var ev server.ClipboardEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("server ended clipboard watch")
+			}
+			return err
+		}
+		if err := emit(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// clipboardTypes lists MIME types content of server selection is offered as.
+func clipboardTypes(rc *rpc.Client, sel string) ([]string, error) {
+	var types []string
+	if err := rc.Call("Clipboard.Types", server.TypesRequest{Selection: sel}, &types); err != nil {
+		if isUnknownMethod(err) {
+			return nil, fmt.Errorf("server does not support clipboard types: %w", err)
+		}
+		return nil, err
+	}
+	return types, nil
+}
+
+// pasteChunks receives the rest of started paste transfer. Size server announces is checked against -max-size
+// before anything is allocated for it, server which sends more than it announced is cut off.
+func pasteChunks(rc *rpc.Client, tr server.TransferResponse) (string, error) {
+	limit := aMaxSize
+	if limit <= 0 {
+		limit = server.DefaultMaxClipboardSize
+	}
+	if tr.Size < 0 {
+		return "", fmt.Errorf("server sent invalid clipboard payload size %d", tr.Size)
+	}
+	if tr.Size > limit {
+		return "", fmt.Errorf("clipboard payload size %d exceeds maximum %d", tr.Size, limit)
+	}
+	if int64(len(tr.Data)) > tr.Size {
+		return "", fmt.Errorf("server sent %d bytes of %d bytes clipboard transfer", len(tr.Data), tr.Size)
+	}
+	if int64(len(tr.Data)) == tr.Size {
+		return string(tr.Data), nil
+	}
+	logger(util.SubsysClipboard).Debugf("Streaming paste transfer=%s size=%d chunk=%d", tr.TransferID, tr.Size, tr.ChunkSize)
+
+	var buf strings.Builder
+	buf.Grow(int(tr.Size))
+	buf.Write(tr.Data)
+	pr := newProgress("paste", tr.Size)
+	defer pr.done()
+	for int64(buf.Len()) < tr.Size {
+		var data []byte
+		if err := rc.Call("Clipboard.PasteChunk", server.PasteChunkRequest{TransferID: tr.TransferID, Offset: int64(buf.Len())}, &data); err != nil {
+			return "", err
+		}
+		if len(data) == 0 {
+			return "", fmt.Errorf("clipboard transfer ended after %d of %d bytes", buf.Len(), tr.Size)
+		}
+		if int64(buf.Len()+len(data)) > tr.Size {
+			return "", fmt.Errorf("server sent %d bytes of %d bytes clipboard transfer", buf.Len()+len(data), tr.Size)
+		}
+		buf.Write(data)
+		pr.update(int64(buf.Len()))
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"github.com/rupor-github/gclpr/server"
+)
+
+// legacyClipboard mimics server which does not support streaming.
+type legacyClipboard struct {
+	content string
+}
+
+func (c *legacyClipboard) Copy(text string, _ *struct{}) error {
+	c.content = text
+	return nil
+}
+
+func (c *legacyClipboard) Paste(_ struct{}, resp *string) error {
+	*resp = c.content
+	return nil
+}
+
+// memClipboard implements streaming protocol over in-memory content.
+type memClipboard struct {
+	legacyClipboard
+	buf    []byte
+	chunks int
+}
+
+func (c *memClipboard) CopyBegin(req server.CopyBeginRequest, resp *server.TransferResponse) error {
+	c.buf = c.buf[:0]
+	resp.TransferID, resp.Size, resp.ChunkSize = "copy", req.Size, 1000
+	return nil
+}
+
+func (c *memClipboard) CopyChunk(req server.ChunkRequest, _ *struct{}) error {
+	c.chunks++
+	c.buf = append(c.buf, req.Data...)
+	return nil
+}
+
+func (c *memClipboard) CopyEnd(_ string, _ *struct{}) error {
+	c.content = string(c.buf)
+	return nil
+}
+
+func (c *memClipboard) PasteBegin(_ struct{}, resp *server.TransferResponse) error {
+	resp.TransferID, resp.Size, resp.ChunkSize = "paste", int64(len(c.content)), 1000
+	resp.Data = []byte(c.content[:min(len(c.content), 1000)])
+	return nil
+}
+
+func (c *memClipboard) PasteChunk(req server.PasteChunkRequest, resp *[]byte) error {
+	*resp = []byte(c.content[req.Offset:min(int(req.Offset)+1000, len(c.content))])
+	return nil
+}
+
+func startClipboardRPC(t *testing.T, name string, rcvr any) *rpc.Client {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(name, rcvr); err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go srv.ServeConn(serverConn)
+	rc := rpc.NewClient(clientConn)
+	t.Cleanup(func() { rc.Close() })
+	return rc
+}
+
+func TestCopyPasteStreaming(t *testing.T) {
+	mem := &memClipboard{}
+	rc := startClipboardRPC(t, "Clipboard", mem)
+
+	text := strings.Repeat("0123456789", server.MaxClipboardSize/5)
+	if err := copyText(rc, text); err != nil {
+		t.Fatalf("copyText: %v", err)
+	}
+	if mem.content != text {
+		t.Fatalf("content length = %d, want %d", len(mem.content), len(text))
+	}
+	if mem.chunks < 2 {
+		t.Fatalf("chunks = %d, expected streaming", mem.chunks)
+	}
+	got, err := pasteText(rc)
+	if err != nil {
+		t.Fatalf("pasteText: %v", err)
+	}
+	if got != text {
+		t.Fatalf("pasteText length = %d, want %d", len(got), len(text))
+	}
+}
+
+func TestCopyPasteFallBackToLegacyServer(t *testing.T) {
+	legacy := &legacyClipboard{}
+	rc := startClipboardRPC(t, "Clipboard", legacy)
+
+	if err := copyText(rc, "hello"); err != nil {
+		t.Fatalf("copyText: %v", err)
+	}
+	if legacy.content != "hello" {
+		t.Fatalf("content = %q, want %q", legacy.content, "hello")
+	}
+	got, err := pasteText(rc)
+	if err != nil {
+		t.Fatalf("pasteText: %v", err)
+	}
+	if got != "hello" {
+		t.Fatalf("pasteText = %q, want %q", got, "hello")
+	}
+
+	err = copyText(rc, strings.Repeat("z", server.MaxClipboardSize+1))
+	if err == nil || !strings.Contains(err.Error(), "does not support payloads larger") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCopyPasteTypes(t *testing.T) {
+	rc := startClipboardRPC(t, "Clipboard", server.NewClipboard("", 0))
+
+	html := "<p>" + strings.Repeat("x", server.ClipboardChunkSize) + "</p>"
+	if err := copyType(rc, "text/html", server.SelectionClipboard, html); err != nil {
+		t.Fatalf("copyType: %v", err)
+	}
+	types, err := clipboardTypes(rc, server.SelectionClipboard)
+	if err != nil || len(types) != 1 || types[0] != "text/html" {
+		t.Fatalf("clipboardTypes = %v, %v", types, err)
+	}
+	got, err := pasteType(rc, "text/html", server.SelectionClipboard)
+	if err != nil || got != html {
+		t.Fatalf("pasteType length = %d, %v", len(got), err)
+	}
+	if _, err := pasteType(rc, "image/png", server.SelectionClipboard); err == nil || !strings.Contains(err.Error(), "clipboard has no image/png, it has text/html") {
+		t.Fatalf("pasteType image: %v", err)
+	}
+
+	if err := copyType(rc, server.MIMEText, server.SelectionPrimary, "selected"); err != nil {
+		t.Fatalf("copyType primary: %v", err)
+	}
+	if got, err := pasteType(rc, server.MIMEText, server.SelectionPrimary); err != nil || got != "selected" {
+		t.Fatalf("pasteType primary = %q, %v", got, err)
+	}
+	if got, err := pasteType(rc, "text/html", server.SelectionClipboard); err != nil || got != html {
+		t.Fatalf("copy to primary changed clipboard: %v", err)
+	}
+
+	legacy := startClipboardRPC(t, "Clipboard", &memClipboard{})
+	if err := copyType(legacy, "image/png", server.SelectionClipboard, "png"); err == nil || !strings.Contains(err.Error(), "does not support clipboard types") {
+		t.Fatalf("copyType on legacy server: %v", err)
+	}
+	if typed("") || typed("text/plain; charset=utf-8") || !typed("text/html") {
+		t.Fatal("typed")
+	}
+}
+
+// lyingClipboard starts paste transfers of announced size and sends chunks of its own choosing.
+type lyingClipboard struct {
+	legacyClipboard
+	size  int64
+	first []byte
+	chunk []byte
+}
+
+func (c *lyingClipboard) PasteBegin(_ struct{}, resp *server.TransferResponse) error {
+	resp.TransferID, resp.Size, resp.ChunkSize, resp.Data = "paste", c.size, 1000, c.first
+	return nil
+}
+
+func (c *lyingClipboard) PasteChunk(_ server.PasteChunkRequest, resp *[]byte) error {
+	*resp = c.chunk
+	return nil
+}
+
+func TestPasteRefusesBadTransferSize(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		clip lyingClipboard
+		want string
+	}{
+		{"negative", lyingClipboard{size: -1}, "invalid clipboard payload size"},
+		{"over limit", lyingClipboard{size: server.DefaultMaxClipboardSize + 1}, "exceeds maximum"},
+		{"huge", lyingClipboard{size: 1 << 62}, "exceeds maximum"},
+		{"first chunk too long", lyingClipboard{size: 3, first: []byte("abcd")}, "sent 4 bytes of 3"},
+		{"chunk too long", lyingClipboard{size: 1500, first: []byte(strings.Repeat("a", 1000)), chunk: []byte(strings.Repeat("b", 1000))}, "sent 2000 bytes of 1500"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rc := startClipboardRPC(t, "Clipboard", &tc.clip)
+			if got, err := pasteText(rc); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("pasteText = %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/rupor-github/gclpr/server"
+	"github.com/rupor-github/gclpr/util"
+)
+
+// serverConfigName is server configuration file in gclpr directory of user home.
+const serverConfigName = "server.toml"
+
+// serverConfig is content of server configuration file. Values which have matching command line flags
+// are applied to flags, the rest go directly to server options.
+type serverConfig struct {
+	Listen struct {
+		Port             int  `toml:"port"`
+		LemonadePort     int  `toml:"lemonade_port"`
+		LemonadeCopyOnly bool `toml:"lemonade_copy_only"`
+		MetricsPort      int  `toml:"metrics_port"`
+		DashboardPort    int  `toml:"dashboard_port"`
+	} `toml:"listen"`
+	Limits struct {
+		MaxClipboardSize  size   `toml:"max_clipboard_size"`
+		Compress          string `toml:"compress"`
+		CompressThreshold size   `toml:"compress_threshold"`
+	} `toml:"limits"`
+	Timeouts struct {
+		IO       duration `toml:"io"`
+		Shutdown duration `toml:"shutdown"`
+	} `toml:"timeouts"`
+	Clipboard struct {
+		Backend    string `toml:"backend"`
+		File       string `toml:"file"`
+		LineEnding string `toml:"line_ending"`
+	} `toml:"clipboard"`
+	History struct {
+		Size    int  `toml:"size"`
+		MaxSize size `toml:"max_size"`
+	} `toml:"history"`
+	URI struct {
+		BlockedSchemes []string `toml:"blocked_schemes"`
+		AllowedSchemes []string `toml:"allowed_schemes"`
+	} `toml:"uri"`
+	Tunnel struct {
+		AttachTimeout duration `toml:"attach_timeout"`
+		IdleTimeout   duration `toml:"idle_timeout"`
+		MaxSessions   int      `toml:"max_sessions"`
+		BufferSize    size     `toml:"buffer_size"`
+	} `toml:"tunnel"`
+	Log struct {
+		Level   string `toml:"level"`
+		JSON    bool   `toml:"json"`
+		File    string `toml:"file"`
+		MaxSize size   `toml:"max_size"`
+		Backups int    `toml:"backups"`
+	} `toml:"log"`
+	Audit struct {
+		File    string `toml:"file"`
+		MaxSize size   `toml:"max_size"`
+		Backups int    `toml:"backups"`
+	} `toml:"audit"`
+	Approval struct {
+		Timeout  duration `toml:"timeout"`
+		Remember duration `toml:"remember"`
+	} `toml:"approval"`
+	Hooks struct {
+		Timeout     duration     `toml:"timeout"`
+		AfterCopy   []hookConfig `toml:"after_copy"`
+		BeforeOpen  []hookConfig `toml:"before_open"`
+		TunnelOpen  []hookConfig `toml:"tunnel_open"`
+		TunnelClose []hookConfig `toml:"tunnel_close"`
+		AuthFailure []hookConfig `toml:"auth_failure"`
+	} `toml:"hooks"`
+
+	path string
+	data string
+	md   toml.MetaData
+}
+
+// hookConfig is single [[hooks.<event>]] entry, timeout defaults to hooks.timeout.
+type hookConfig struct {
+	Command []string `toml:"command"`
+	Stdin   string   `toml:"stdin"`
+	Timeout duration `toml:"timeout"`
+}
+
+// size is number of bytes, either integer or string with KiB, MiB or GiB suffix, i.e. "64MiB".
+type size int64
+
+func (s *size) UnmarshalTOML(v any) error {
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return errors.New("size must not be negative")
+		}
+		*s = size(v)
+		return nil
+	case string:
+		n, err := parseSize(v)
+		if err != nil {
+			return err
+		}
+		*s = size(n)
+		return nil
+	default:
+		return fmt.Errorf("size must be integer or string, i.e. \"64MiB\", not %T", v)
+	}
+}
+
+func parseSize(s string) (int64, error) {
+	num, mult := strings.TrimSpace(s), int64(1)
+	for suffix, m := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if n, ok := strings.CutSuffix(num, suffix); ok {
+			num, mult = strings.TrimSpace(n), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/mult {
+		return 0, fmt.Errorf("invalid size %q, expected number of bytes optionally followed by KiB, MiB or GiB", s)
+	}
+	return n * mult, nil
+}
+
+// duration is time.ParseDuration string, i.e. "30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return errors.New("duration must not be negative")
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadServerConfig reads and validates server configuration file. When file does not exist nil config
+// is returned unless required is set.
+func loadServerConfig(path string, required bool) (*serverConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !required && errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to read configuration: %w", err)
+	}
+	// hooks run commands as server user, so file must not be open to changes by anybody else
+	if err := util.CheckConfigFile(path); err != nil {
+		return nil, fmt.Errorf("configuration file permissions are too open: %w", err)
+	}
+	cfg := &serverConfig{path: path, data: string(data)}
+	if cfg.md, err = toml.Decode(cfg.data, cfg); err != nil {
+		return nil, cfg.decodeError(err)
+	}
+	if keys := cfg.md.Undecoded(); len(keys) > 0 {
+		return nil, cfg.errorf(keys[0].String(), "unknown key")
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// reTOMLError matches errors decoder reports without ParseError.
+var reTOMLError = regexp.MustCompile(`^toml: line (\d+) \(last key "([^"]*)"\): (.*)$`)
+
+// decodeError reports decoding error as "file:line: key: message".
+func (c *serverConfig) decodeError(err error) error {
+	var pe toml.ParseError
+	if errors.As(err, &pe) {
+		if pe.LastKey != "" {
+			return fmt.Errorf("%s:%d: %s: %s", c.path, pe.Position.Line, pe.LastKey, pe.Message)
+		}
+		return fmt.Errorf("%s:%d: %s", c.path, pe.Position.Line, pe.Message)
+	}
+	if m := reTOMLError.FindStringSubmatch(err.Error()); m != nil {
+		return fmt.Errorf("%s:%s: %s: %s", c.path, m[1], m[2], m[3])
+	}
+	return fmt.Errorf("%s: %w", c.path, err)
+}
+
+// errorf reports problem with value of key pointing at line where key is defined.
+func (c *serverConfig) errorf(key, format string, args ...any) error {
+	if line := keyLine(c.data, key); line > 0 {
+		return fmt.Errorf("%s:%d: %s: %s", c.path, line, key, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%s: %s: %s", c.path, key, fmt.Sprintf(format, args...))
+}
+
+// keyLine returns line where key or table is defined or 0 when it cannot be found. Decoder does not
+// expose positions of keys, document is known to be valid TOML at this point, so simple scan is enough.
+func keyLine(doc, key string) int {
+	table := ""
+	for i, line := range strings.Split(doc, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			name, _, _ := strings.Cut(line, "]")
+			table = normalizeKey(strings.TrimLeft(name, "["))
+			if table == key {
+				return i + 1
+			}
+			continue
+		}
+		name, _, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		full := normalizeKey(name)
+		if table != "" {
+			full = table + "." + full
+		}
+		if full == key {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// entryLine returns line of n-th [[table]] header or line where table is defined when entries are not
+// written as headers.
+func entryLine(doc, table string, n int) int {
+	for i, line := range strings.Split(doc, "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, "[["); ok {
+			name, _, _ = strings.Cut(name, "]]")
+			if normalizeKey(name) == table {
+				if n == 0 {
+					return i + 1
+				}
+				n--
+			}
+		}
+	}
+	return keyLine(doc, table)
+}
+
+func normalizeKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, p := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(p), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (c *serverConfig) defined(key string) bool {
+	return c.md.IsDefined(strings.Split(key, ".")...)
+}
+
+var reScheme = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*$`)
+
+func (c *serverConfig) validate() error {
+	for _, p := range []struct {
+		key      string
+		port, lo int
+	}{{"listen.port", c.Listen.Port, 1}, {"listen.lemonade_port", c.Listen.LemonadePort, 0}, {"listen.metrics_port", c.Listen.MetricsPort, 0}, {"listen.dashboard_port", c.Listen.DashboardPort, 0}} {
+		if c.defined(p.key) && (p.port < p.lo || p.port > 65535) {
+			return c.errorf(p.key, "port %d is out of range", p.port)
+		}
+	}
+	if c.defined("limits.max_clipboard_size") && c.Limits.MaxClipboardSize == 0 {
+		return c.errorf("limits.max_clipboard_size", "size must be positive")
+	}
+	if _, err := util.ParseCodecs(c.Limits.Compress); err != nil {
+		return c.errorf("limits.compress", "%v", err)
+	}
+	if c.Limits.CompressThreshold > util.MaxFrameSize {
+		return c.errorf("limits.compress_threshold", "threshold must not exceed %d", util.MaxFrameSize)
+	}
+	if c.defined("clipboard.backend") && !slices.Contains(server.ClipboardBackends, c.Clipboard.Backend) {
+		return c.errorf("clipboard.backend", "unknown backend %q, expected one of %s", c.Clipboard.Backend, strings.Join(server.ClipboardBackends, ", "))
+	}
+	if le := c.Clipboard.LineEnding; le != "" && !strings.EqualFold(le, "lf") && !strings.EqualFold(le, "crlf") {
+		return c.errorf("clipboard.line_ending", "unknown line ending %q, expected LF or CRLF", le)
+	}
+	if c.History.Size < 0 {
+		return c.errorf("history.size", "size must not be negative")
+	}
+	if c.defined("history.max_size") && c.History.MaxSize == 0 {
+		return c.errorf("history.max_size", "size must be positive")
+	}
+	for _, list := range []struct {
+		key     string
+		schemes []string
+	}{{"uri.blocked_schemes", c.URI.BlockedSchemes}, {"uri.allowed_schemes", c.URI.AllowedSchemes}} {
+		for _, s := range list.schemes {
+			if !reScheme.MatchString(s) {
+				return c.errorf(list.key, "invalid URI scheme %q", s)
+			}
+		}
+	}
+	if c.Tunnel.MaxSessions < 0 {
+		return c.errorf("tunnel.max_sessions", "number of sessions must not be negative")
+	}
+	if c.defined("tunnel.buffer_size") && (c.Tunnel.BufferSize < 1<<10 || c.Tunnel.BufferSize > 1<<20) {
+		return c.errorf("tunnel.buffer_size", "size must be between 1KiB and 1MiB")
+	}
+	if _, _, err := util.ParseLogLevels(c.Log.Level, util.DefaultLogLevel); err != nil {
+		return c.errorf("log.level", "%v", err)
+	}
+	for _, key := range []string{"log", "audit"} {
+		maxSize, backups := c.Log.MaxSize, c.Log.Backups
+		if key == "audit" {
+			maxSize, backups = c.Audit.MaxSize, c.Audit.Backups
+		}
+		if c.defined(key+".max_size") && maxSize < 1<<20 {
+			return c.errorf(key+".max_size", "size must be at least 1MiB")
+		}
+		// -log-max-size counts MiB, the rest would be lost on the way
+		if key == "log" && maxSize%(1<<20) != 0 {
+			return c.errorf(key+".max_size", "size must be whole number of MiB")
+		}
+		if backups < 0 {
+			return c.errorf(key+".backups", "number of backups must not be negative")
+		}
+	}
+	if c.defined("approval.timeout") && c.Approval.Timeout < duration(time.Second) {
+		return c.errorf("approval.timeout", "timeout must be at least 1s")
+	}
+	for _, list := range c.hookLists() {
+		event, key := list.event, "hooks."+list.event
+		for i, h := range list.hooks {
+			switch {
+			case len(h.Command) == 0 || h.Command[0] == "":
+				return c.entryErrorf(key, i, "command is required")
+			case h.Stdin != "" && h.Stdin != server.HookStdinJSON && h.Stdin != server.HookStdinText:
+				return c.entryErrorf(key, i, "unknown stdin %q, expected json or text", h.Stdin)
+			case h.Stdin == server.HookStdinText && event != "after_copy":
+				return c.entryErrorf(key, i, "stdin text is only available for after_copy hooks")
+			}
+		}
+	}
+	return nil
+}
+
+type hookList struct {
+	event string
+	hooks []hookConfig
+}
+
+// hookLists returns hook entries of every event in order they are listed in [hooks].
+func (c *serverConfig) hookLists() []hookList {
+	return []hookList{
+		{"after_copy", c.Hooks.AfterCopy},
+		{"before_open", c.Hooks.BeforeOpen},
+		{"tunnel_open", c.Hooks.TunnelOpen},
+		{"tunnel_close", c.Hooks.TunnelClose},
+		{"auth_failure", c.Hooks.AuthFailure},
+	}
+}
+
+// entryErrorf reports problem with n-th entry of array of tables.
+func (c *serverConfig) entryErrorf(key string, n int, format string, args ...any) error {
+	if line := entryLine(c.data, key, n); line > 0 {
+		return fmt.Errorf("%s:%d: %s[%d]: %s", c.path, line, key, n, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%s: %s[%d]: %s", c.path, key, n, fmt.Sprintf(format, args...))
+}
+
+// resolve makes path relative to configuration file directory, "~/" is replaced with home.
+func (c *serverConfig) resolve(path, home string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return filepath.Join(home, rest)
+	}
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(c.path), path)
+}
+
+// apply sets flags from configuration unless they were given on command line.
+func (c *serverConfig) apply(fs *flag.FlagSet, home string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	// -debug is the same as -log-level debug
+	set["log-level"] = set["log-level"] || aDebug
+
+	for _, v := range []struct{ key, flag, value string }{
+		{"listen.port", "port", strconv.Itoa(c.Listen.Port)},
+		{"listen.lemonade_port", "lemonade-port", strconv.Itoa(c.Listen.LemonadePort)},
+		{"listen.lemonade_copy_only", "lemonade-copy-only", strconv.FormatBool(c.Listen.LemonadeCopyOnly)},
+		{"listen.metrics_port", "metrics-port", strconv.Itoa(c.Listen.MetricsPort)},
+		{"listen.dashboard_port", "dashboard-port", strconv.Itoa(c.Listen.DashboardPort)},
+		{"limits.max_clipboard_size", "max-size", strconv.FormatInt(int64(c.Limits.MaxClipboardSize), 10)},
+		{"limits.compress", "compress", c.Limits.Compress},
+		{"limits.compress_threshold", "compress-threshold", strconv.FormatInt(int64(c.Limits.CompressThreshold), 10)},
+		{"timeouts.io", "timeout", time.Duration(c.Timeouts.IO).String()},
+		{"timeouts.shutdown", "shutdown-timeout", time.Duration(c.Timeouts.Shutdown).String()},
+		{"clipboard.backend", "clipboard-backend", c.Clipboard.Backend},
+		{"clipboard.file", "clipboard-file", c.resolve(c.Clipboard.File, home)},
+		{"clipboard.line_ending", "line-ending", c.Clipboard.LineEnding},
+		{"history.size", "history", strconv.Itoa(c.History.Size)},
+		{"history.max_size", "history-max-size", strconv.FormatInt(int64(c.History.MaxSize), 10)},
+		{"log.level", "log-level", c.Log.Level},
+		{"log.json", "log-json", strconv.FormatBool(c.Log.JSON)},
+		{"log.file", "log-file", c.resolve(c.Log.File, home)},
+		{"log.max_size", "log-max-size", strconv.FormatInt(int64(c.Log.MaxSize)>>20, 10)},
+		{"log.backups", "log-backups", strconv.Itoa(c.Log.Backups)},
+	} {
+		if !c.defined(v.key) || set[v.flag] {
+			continue
+		}
+		if err := fs.Set(v.flag, v.value); err != nil {
+			return c.errorf(v.key, "%v", err)
+		}
+	}
+	return nil
+}
+
+// options copies settings which have no command line flags to server options.
+func (c *serverConfig) options(opts *server.Options, home string) {
+	if c == nil {
+		return
+	}
+	if c.defined("uri.blocked_schemes") {
+		opts.BlockedSchemes = append([]string{}, c.URI.BlockedSchemes...)
+	}
+	opts.AllowedSchemes = c.URI.AllowedSchemes
+	opts.Tunnel = server.TunnelLimits{
+		AttachTimeout: time.Duration(c.Tunnel.AttachTimeout),
+		IdleTimeout:   time.Duration(c.Tunnel.IdleTimeout),
+		MaxSessions:   c.Tunnel.MaxSessions,
+		BufferSize:    int(c.Tunnel.BufferSize),
+	}
+	opts.Approval.Timeout = time.Duration(c.Approval.Timeout)
+	opts.Approval.Remember = time.Duration(c.Approval.Remember)
+	opts.Hooks = server.Hooks{
+		AfterCopy:   c.hooks(c.Hooks.AfterCopy, home),
+		BeforeOpen:  c.hooks(c.Hooks.BeforeOpen, home),
+		TunnelOpen:  c.hooks(c.Hooks.TunnelOpen, home),
+		TunnelClose: c.hooks(c.Hooks.TunnelClose, home),
+		AuthFailure: c.hooks(c.Hooks.AuthFailure, home),
+	}
+}
+
+// hooks converts hook entries to server hooks, "~/" in program path is replaced with home.
+func (c *serverConfig) hooks(entries []hookConfig, home string) []server.Hook {
+	var hooks []server.Hook
+	for _, h := range entries {
+		command := slices.Clone(h.Command)
+		if rest, ok := strings.CutPrefix(command[0], "~/"); ok {
+			command[0] = filepath.Join(home, rest)
+		}
+		hooks = append(hooks, server.Hook{Command: command, Stdin: h.Stdin, Timeout: time.Duration(cmp.Or(h.Timeout, c.Hooks.Timeout))})
+	}
+	return hooks
+}
+
+// loadConfig reads server configuration file, -config or the one in gclpr directory, and applies it
+// to flags which were not given on command line.
+func loadConfig() error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	path := aConfig
+	if path == "" {
+		path = filepath.Join(home, ".gclpr", serverConfigName)
+	}
+	if serverCfg, err = loadServerConfig(path, aConfig != ""); err != nil || serverCfg == nil {
+		return err
+	}
+	if err = serverCfg.apply(cli, home); err != nil {
+		return err
+	}
+	compressCodecs, err = util.ParseCodecs(aCompress)
+	return err
+}
+
+// openAudit opens audit log file when configuration asks for one.
+func (c *serverConfig) openAudit(home string) (*util.RotatingFile, error) {
+	if c == nil || c.Audit.File == "" {
+		return nil, nil
+	}
+	backups := c.Audit.Backups
+	if !c.defined("audit.backups") {
+		backups = -1
+	}
+	f, err := util.NewRotatingFile(c.resolve(c.Audit.File, home), int64(c.Audit.MaxSize), backups)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	return f, nil
+}
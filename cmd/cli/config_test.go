@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/server"
+)
+
+func writeConfig(t *testing.T, doc string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), serverConfigName)
+	if err := os.WriteFile(path, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestServerConfigApply(t *testing.T) {
+	path := writeConfig(t, `
+[listen]
+port = 3850
+metrics_port = 9850
+
+[limits]
+max_clipboard_size = "8MiB"
+
+[timeouts]
+io = "45s"
+
+[clipboard]
+backend = "file"
+file = "shared/clipboard"
+
+[uri]
+allowed_schemes = ["https", "mailto"]
+
+[tunnel]
+idle_timeout = "10m"
+max_sessions = 4
+buffer_size = "16KiB"
+
+[log]
+level = "info,tunnel=debug"
+file = "logs/server.log"
+
+[audit]
+file = "~/audit.log"
+
+[approval]
+timeout = "1m"
+remember = "30m"
+
+[hooks]
+timeout = "2s"
+
+[[hooks.after_copy]]
+command = ["~/bin/notify", "copied"]
+stdin = "text"
+
+[[hooks.before_open]]
+command = ["url-filter"]
+timeout = "500ms"
+`)
+	cfg, err := loadServerConfig(path, true)
+	if err != nil {
+		t.Fatalf("loadServerConfig: %v", err)
+	}
+
+	var (
+		port, metricsPort int
+		maxSize           int64
+		timeout           time.Duration
+		level, logFile    string
+		backend, clipFile string
+	)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.IntVar(&port, "port", 2850, "")
+	fs.IntVar(&metricsPort, "metrics-port", 0, "")
+	fs.Int64Var(&maxSize, "max-size", 0, "")
+	fs.DurationVar(&timeout, "timeout", time.Minute, "")
+	fs.StringVar(&level, "log-level", "", "")
+	fs.StringVar(&logFile, "log-file", "", "")
+	fs.StringVar(&backend, "clipboard-backend", "auto", "")
+	fs.StringVar(&clipFile, "clipboard-file", "", "")
+	if err := fs.Parse([]string{"-timeout", "5s", "-metrics-port", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.apply(fs, "/home/me"); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	// command line wins over file
+	if port != 3850 || metricsPort != 0 || maxSize != 8<<20 || timeout != 5*time.Second || level != "info,tunnel=debug" {
+		t.Fatalf("flags = %d %d %d %s %q", port, metricsPort, maxSize, timeout, level)
+	}
+	if want := filepath.Join(filepath.Dir(path), "logs", "server.log"); logFile != want {
+		t.Fatalf("log file = %q, want %q", logFile, want)
+	}
+	if want := filepath.Join(filepath.Dir(path), "shared", "clipboard"); backend != "file" || clipFile != want {
+		t.Fatalf("clipboard = %q %q, want file %q", backend, clipFile, want)
+	}
+	if got := cfg.resolve(cfg.Audit.File, "/home/me"); got != filepath.Join("/home/me", "audit.log") {
+		t.Fatalf("audit file = %q", got)
+	}
+
+	var opts server.Options
+	cfg.options(&opts, "/home/me")
+	if opts.BlockedSchemes != nil || strings.Join(opts.AllowedSchemes, ",") != "https,mailto" {
+		t.Fatalf("schemes = %v %v", opts.BlockedSchemes, opts.AllowedSchemes)
+	}
+	if opts.Tunnel != (server.TunnelLimits{IdleTimeout: 10 * time.Minute, MaxSessions: 4, BufferSize: 16 << 10}) {
+		t.Fatalf("tunnel limits = %+v", opts.Tunnel)
+	}
+	if opts.Approval.Timeout != time.Minute || opts.Approval.Remember != 30*time.Minute {
+		t.Fatalf("approval = %+v", opts.Approval)
+	}
+	wantHooks := server.Hooks{
+		AfterCopy:  []server.Hook{{Command: []string{filepath.Join("/home/me", "bin", "notify"), "copied"}, Stdin: server.HookStdinText, Timeout: 2 * time.Second}},
+		BeforeOpen: []server.Hook{{Command: []string{"url-filter"}, Timeout: 500 * time.Millisecond}},
+	}
+	if !reflect.DeepEqual(opts.Hooks, wantHooks) {
+		t.Fatalf("hooks = %+v", opts.Hooks)
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		doc, want string
+	}{
+		{"[listen]\nport = 70000\n", ":2: listen.port: port 70000 is out of range"},
+		{"[listen]\nport = \"x\"\n", ":2: listen.port: incompatible types"},
+		{"[timeouts]\n\nio = \"soon\"\n", `:3: timeouts.io: time: invalid duration "soon"`},
+		{"[limits]\nmax_clipboard_size = \"12 parsecs\"\n", `:2: limits.max_clipboard_size: invalid size "12 parsecs"`},
+		{"[tunnel]\nbuffer_size = 100\n", ":2: tunnel.buffer_size: size must be between 1KiB and 1MiB"},
+		{"[clipboard]\nbackend = \"xclip\"\nline_ending = \"cr\"\n", `:3: clipboard.line_ending: unknown line ending "cr"`},
+		{"[clipboard]\nbackend = \"pasteboard\"\n", `:2: clipboard.backend: unknown backend "pasteboard"`},
+		{"[uri]\nblocked_schemes = [\"file\", \"no scheme\"]\n", `:2: uri.blocked_schemes: invalid URI scheme "no scheme"`},
+		{"[log]\nlevel = \"info,x=debug\"\n", `:2: log.level: unknown log subsystem "x"`},
+		{"[log]\nfile = \"a.log\"\n\n[audit]\nmax_size = \"1KiB\"\n", ":5: audit.max_size: size must be at least 1MiB"},
+		{"[log]\nfile = \"a.log\"\nmax_size = \"1536KiB\"\n", ":3: log.max_size: size must be whole number of MiB"},
+		{"[log]\nmax_size = 1000\n", ":2: log.max_size: size must be at least 1MiB"},
+		{"[listen]\nport = 3000\nprot = 3001\n", ":3: listen.prot: unknown key"},
+		{"[listen]\nport = 3000\n[server]\nhost = \"x\"\n", ":3: server: unknown key"},
+		{"[listen]\nport = = 3000\n", ":2: "},
+		{"[approval]\ntimeout = \"0s\"\n", ":2: approval.timeout: timeout must be at least 1s"},
+		{"[history]\nsize = -1\n", ":2: history.size: size must not be negative"},
+		{"[history]\nsize = 10\nmax_size = 0\n", ":3: history.max_size: size must be positive"},
+		{"[[hooks.after_copy]]\ncommand = [\"a\"]\n\n[[hooks.after_copy]]\nstdin = \"text\"\n", ":4: hooks.after_copy[1]: command is required"},
+		{"[[hooks.before_open]]\ncommand = [\"a\"]\nstdin = \"text\"\n", ":1: hooks.before_open[0]: stdin text is only available for after_copy hooks"},
+		{"[[hooks.auth_failure]]\ncommand = [\"a\"]\nargs = [\"b\"]\n", ":3: hooks.auth_failure.args: unknown key"},
+	} {
+		path := writeConfig(t, tc.doc)
+		_, err := loadServerConfig(path, true)
+		if err == nil || !strings.HasPrefix(err.Error(), path+tc.want) {
+			t.Errorf("config %q: err = %v, want %q", tc.doc, err, tc.want)
+		}
+	}
+}
+
+func TestLoadServerConfigMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), serverConfigName)
+	if cfg, err := loadServerConfig(path, false); cfg != nil || err != nil {
+		t.Fatalf("optional config = %v, %v", cfg, err)
+	}
+	if _, err := loadServerConfig(path, true); err == nil {
+		t.Fatal("expected error for missing -config file")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadServerConfigWritableByOthers(t *testing.T) {
+	path := writeConfig(t, "[[hooks.after_copy]]\ncommand = [\"touch\", \"/tmp/owned\"]\n")
+	if err := os.Chmod(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadServerConfig(path, true); err == nil || !strings.Contains(err.Error(), "permissions are too open") {
+		t.Fatalf("config writable by others: err = %v", err)
+	}
+}
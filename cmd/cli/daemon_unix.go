@@ -0,0 +1,203 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// daemonEnv marks detached server process started by -daemon, readiness is reported on daemonReadyFd.
+const (
+	daemonEnv     = "GCLPR_DAEMON"
+	daemonReadyFd = 3
+)
+
+// daemonChild is set in detached server process started by -daemon.
+var daemonChild = os.Getenv(daemonEnv) != ""
+
+func init() {
+	// processes started by server must not take themselves for detached server
+	os.Unsetenv(daemonEnv)
+}
+
+// errDaemonized tells caller that detached server is started and this process is done.
+var errDaemonized = errors.New("server is detached")
+
+// daemonStartTimeout limits time detached server has to report it is ready.
+const daemonStartTimeout = 30 * time.Second
+
+// serverFiles returns pid file and log file names for server listening on port.
+func serverFiles(port int) (pidFile, logFile string, err error) {
+	dir, err := util.RuntimeDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("server-%d.pid", port)), filepath.Join(dir, fmt.Sprintf("server-%d.log", port)), nil
+}
+
+// prepareServer makes sure this is the only server on port and returns functions to report server readiness
+// and to release its pid file. With -daemon it starts detached copy of itself instead and returns errDaemonized
+// once that copy is ready.
+func prepareServer() (ready func(), release func(), err error) {
+
+	pidName, logName, err := serverFiles(aPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	if aDaemon && !daemonChild {
+		return nil, nil, startDaemon(logName)
+	}
+
+	var readyPipe *os.File
+	if daemonChild {
+		readyPipe = os.NewFile(daemonReadyFd, "ready")
+	}
+	// process started with -daemon does not lock, detached and foreground servers do, so two -daemon starts
+	// cannot both get past pid file
+	pf, err := util.LockPidFile(pidName)
+	if err != nil {
+		if errors.Is(err, util.ErrAlreadyRunning) {
+			err = fmt.Errorf("gclpr server on port %d is %w", aPort, err)
+		}
+		if readyPipe != nil {
+			fmt.Fprintf(readyPipe, "%s%v\n", daemonFailed, err)
+			readyPipe.Close()
+		}
+		return nil, nil, err
+	}
+	logger("").Debugf("Server pid file %s", pidName)
+
+	ready = func() {
+		if err := util.SdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+			logger("").Warnf("Unable to notify service manager: %v", err)
+		}
+		if readyPipe != nil {
+			readyPipe.Write([]byte("ready\n"))
+			readyPipe.Close()
+		}
+	}
+	release = func() {
+		if err := util.SdNotify("STOPPING=1"); err != nil {
+			logger("").Warnf("Unable to notify service manager: %v", err)
+		}
+		if err := pf.Release(); err != nil {
+			logger("").Warnf("Unable to remove pid file: %v", err)
+		}
+	}
+	return ready, release, nil
+}
+
+// daemonFailed starts line detached server writes to daemonReadyFd instead of "ready" when it cannot take
+// pid file, the rest of the line is the reason.
+const daemonFailed = "error: "
+
+// daemonRefused is reason detached server gave for not starting.
+type daemonRefused string
+
+func (e daemonRefused) Error() string { return string(e) }
+
+// readDaemonReady waits for detached server to report on ready pipe.
+func readDaemonReady(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	line := strings.TrimSpace(string(b))
+	switch {
+	case line == "":
+		return errors.New("server exited")
+	case strings.HasPrefix(line, daemonFailed):
+		return daemonRefused(strings.TrimPrefix(line, daemonFailed))
+	}
+	return nil
+}
+
+// startDaemon runs server in new session with output going to log file and waits for it to become ready.
+func startDaemon(logName string) error {
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(logName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = nil
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{w} // becomes daemonReadyFd
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- readDaemonReady(r)
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(daemonStartTimeout):
+		err = fmt.Errorf("server did not become ready in %s", daemonStartTimeout)
+	}
+	var refused daemonRefused
+	if errors.As(err, &refused) {
+		// detached server did not start, there is nothing in log file to read
+		return refused
+	}
+	if err != nil {
+		return fmt.Errorf("detached server failed to start: %w, see %s", err, logName)
+	}
+	outName := logName // stderr of detached server
+	if aLogFile != "" {
+		logName = aLogFile
+	}
+	fmt.Printf("gclpr server started with pid %d, log file %s\n", pid, logName)
+	if aDashboardPort != 0 {
+		// token is made by detached server, it is only known to its output
+		fmt.Printf("Dashboard address with token is in %s\n", outName)
+	}
+	return errDaemonized
+}
+
+// detachedLogging makes detached server log at least at info level to its log file unless -log-file is given,
+// there is no one to read stderr anyway.
+func detachedLogging(opts *util.LogOptions) error {
+	if !daemonChild {
+		return nil
+	}
+	if opts.File == "" {
+		_, logName, err := serverFiles(aPort)
+		if err != nil {
+			return err
+		}
+		opts.File = logName
+	}
+	opts.DefaultLevel = min(opts.DefaultLevel, slog.LevelInfo)
+	return nil
+}
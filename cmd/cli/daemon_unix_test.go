@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadDaemonReady(t *testing.T) {
+	if err := readDaemonReady(strings.NewReader("ready\n")); err != nil {
+		t.Fatalf("ready: %v", err)
+	}
+	if err := readDaemonReady(strings.NewReader("")); err == nil || err.Error() != "server exited" {
+		t.Fatalf("nothing reported: %v", err)
+	}
+	var refused daemonRefused
+	err := readDaemonReady(strings.NewReader(daemonFailed + "gclpr server on port 2850 is already running\n"))
+	if !errors.As(err, &refused) || err.Error() != "gclpr server on port 2850 is already running" {
+		t.Fatalf("refused: %v", err)
+	}
+}
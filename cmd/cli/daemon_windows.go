@@ -0,0 +1,22 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// errDaemonized is never returned on Windows, server runs detached as gui.exe there.
+var errDaemonized = errors.New("server is detached")
+
+// prepareServer does nothing on Windows, gui.exe takes care of single instance.
+func prepareServer() (ready func(), release func(), err error) {
+	if aDaemon {
+		return nil, nil, errors.New("-daemon is not supported on Windows, use gui.exe instead")
+	}
+	return func() {}, func() {}, nil
+}
+
+func detachedLogging(*util.LogOptions) error { return nil }
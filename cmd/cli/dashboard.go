@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// dashboard makes random token for server web dashboard and wraps ready to print dashboard address
+// with token once server listens. Detached server prints it to its log file.
+func dashboard(ready func()) (string, func(), error) {
+	var raw [24]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", nil, fmt.Errorf("unable to create dashboard token: %w", err)
+	}
+	token := hex.EncodeToString(raw[:])
+	return token, func() {
+		fmt.Fprintf(os.Stderr, "gclpr dashboard: http://localhost:%d/?token=%s\n", aDashboardPort, token)
+		ready()
+	}, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -9,17 +10,25 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net"
 	"net/rpc"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/crypto/nacl/sign"
+	"golang.org/x/term"
 
 	"github.com/rupor-github/gclpr/misc"
 	"github.com/rupor-github/gclpr/server"
@@ -48,6 +57,16 @@ const (
 	cmdServer
 	cmdGenKey
 	cmdOAuthWorker
+	cmdStatus
+	cmdTunnelList
+	cmdTunnelKill
+	cmdPause
+	cmdResume
+	cmdInstallUnit
+	cmdHistory
+	cmdHistoryClear
+	cmdWatch
+	cmdSync
 )
 
 func (c command) String() string {
@@ -64,6 +83,26 @@ func (c command) String() string {
 		return "generate key pair for signing"
 	case cmdOAuthWorker:
 		return "run detached oauth tunnel worker"
+	case cmdStatus:
+		return "show server status"
+	case cmdTunnelList:
+		return "list tunnel sessions (admin)"
+	case cmdTunnelKill:
+		return "close tunnel session (admin)"
+	case cmdPause:
+		return "make server refuse requests (admin)"
+	case cmdResume:
+		return "make paused server serve requests (admin)"
+	case cmdInstallUnit:
+		return "write systemd user unit or launchd agent running server with given options"
+	case cmdHistory:
+		return "list server clipboard history"
+	case cmdHistoryClear:
+		return "forget server clipboard history (admin)"
+	case cmdWatch:
+		return "print server clipboard changes as they happen"
+	case cmdSync:
+		return "keep local clipboard and server clipboard in sync"
 	default:
 		return fmt.Sprintf("bad command %d", c)
 	}
@@ -80,6 +119,40 @@ var (
 	aData             string
 	aConnectTimeout   time.Duration
 	aIOTimeout        time.Duration
+	aMaxSize          int64
+	aCompress         string
+	aLemonadePort     int
+	aLemonadeCopyOnly bool
+	aMetricsPort      int
+	aDashboardPort    int
+	aClipBackend      string
+	aClipFile         string
+	aType             string
+	aListTypes        bool
+	aSelection        string
+	aTTL              time.Duration
+	aEntry            int
+	aHistory          int
+	aHistoryMaxSize   int64
+	aContent          bool
+	aDirection        string
+	aDebounce         time.Duration
+	aCompressMin      int
+	aRelay            bool
+	aUpstreamPort     int
+	aJSON             bool
+	aShutdownTimeout  time.Duration
+	aDaemon           bool
+	aUnlocked         bool
+	aLogLevel         string
+	aLogJSON          bool
+	aLogFile          string
+	aLogMaxSize       int64
+	aLogBackups       int
+	aConfig           string
+	serverCfg         *serverConfig // server configuration file, nil when there is none
+	compressCodecs    []string
+	requestID         string // correlates client, worker and server log lines of one operation
 	cli               = flag.NewFlagSet("gclpr", flag.ContinueOnError)
 
 	reOpen  = regexp.MustCompile(`/?xdg-open$`)
@@ -119,6 +192,16 @@ func getCommand(args []string) (cmd command, aliased bool, err error) {
 			cmd = cmdServer
 		case "genkey":
 			cmd = cmdGenKey
+		case "status":
+			cmd = cmdStatus
+		case "tunnel":
+			cmd = cmdTunnelList // actual command is decided by subcommand
+		case "history":
+			cmd = cmdHistory
+		case "watch":
+			cmd = cmdWatch
+		case "sync":
+			cmd = cmdSync
 		case "internal-oauth-worker":
 			cmd = cmdOAuthWorker
 		default:
@@ -153,8 +236,38 @@ func processCommandLine(args []string) (cmd command, err error) {
 	if !aDebug && envDebugEnabled() {
 		aDebug = true
 	}
+	if compressCodecs, err = util.ParseCodecs(aCompress); err != nil {
+		return
+	}
+	if aType != "" {
+		if _, _, err = mime.ParseMediaType(aType); err != nil {
+			err = fmt.Errorf("invalid -type %q: %w", aType, err)
+			return
+		}
+	}
+	switch aSelection {
+	case "", server.SelectionClipboard, server.SelectionPrimary, server.SelectionBoth:
+	default:
+		err = fmt.Errorf("invalid -selection %q, expected %s, %s or %s", aSelection, server.SelectionClipboard, server.SelectionPrimary, server.SelectionBoth)
+		return
+	}
+	if aTTL < 0 {
+		return 0, fmt.Errorf("invalid -ttl %s", aTTL)
+	}
+	if aEntry < 0 {
+		return 0, fmt.Errorf("invalid -n %d, history entries are numbered from 1", aEntry)
+	}
+	if aEntry > 0 && otherSelection(aSelection) {
+		return 0, errors.New("-n and -selection cannot be used together")
+	}
 
-	if cmd == cmdPaste || cmd == cmdServer || cmd == cmdGenKey || cmd == cmdOAuthWorker {
+	if cmd == cmdServer || cmd == cmdTunnelList || cmd == cmdHistory {
+		if cmd, err = subCommand(cmd); err == nil && cmd == cmdServer && !aHelp {
+			err = loadConfig()
+		}
+		return
+	}
+	if cmd == cmdPaste || cmd == cmdGenKey || cmd == cmdOAuthWorker || cmd == cmdStatus || cmd == cmdWatch || cmd == cmdSync {
 		return
 	}
 
@@ -188,6 +301,50 @@ func processCommandLine(args []string) (cmd command, err error) {
 	return
 }
 
+// subCommand picks command from arguments following "server", "tunnel" or "history", flags may be mixed with them.
+func subCommand(cmd command) (command, error) {
+	var args []string
+	for 0 < cli.NArg() {
+		args = append(args, cli.Arg(0))
+		if err := cli.Parse(cli.Args()[1:]); err != nil {
+			return 0, err
+		}
+	}
+	if aHelp {
+		return cmd, nil
+	}
+
+	sub := ""
+	if len(args) > 0 {
+		sub = args[0]
+	}
+	switch {
+	case cmd == cmdServer && sub == "":
+		return cmdServer, nil
+	case cmd == cmdServer && sub == "pause" && len(args) == 1:
+		return cmdPause, nil
+	case cmd == cmdServer && sub == "resume" && len(args) == 1:
+		return cmdResume, nil
+	case cmd == cmdServer && sub == "install-unit" && len(args) == 1:
+		return cmdInstallUnit, nil
+	case cmd == cmdTunnelList && sub == "ls" && len(args) == 1:
+		return cmdTunnelList, nil
+	case cmd == cmdTunnelList && sub == "kill" && len(args) == 2:
+		aData = args[1]
+		return cmdTunnelKill, nil
+	case cmd == cmdHistory && sub == "":
+		return cmdHistory, nil
+	case cmd == cmdHistory && sub == "clear" && len(args) == 1:
+		return cmdHistoryClear, nil
+	case cmd == cmdServer:
+		return 0, fmt.Errorf("unknown server command %q, expected pause, resume or install-unit", strings.Join(args, " "))
+	case cmd == cmdHistory:
+		return 0, fmt.Errorf("unknown history command %q, expected clear", strings.Join(args, " "))
+	default:
+		return 0, fmt.Errorf("unknown tunnel command %q, expected ls or kill <id>", strings.Join(args, " "))
+	}
+}
+
 func parseTunnelTarget(raw string) (*url.URL, error) {
 	parsed, err := server.ParseTunnelURL(raw)
 	if err != nil {
@@ -197,36 +354,138 @@ func parseTunnelTarget(raw string) (*url.URL, error) {
 }
 
 type secConn struct {
-	conn net.Conn
-	br   *bufio.Reader
-	hpk  [32]byte
-	k    *[64]byte
+	conn    net.Conn
+	br      *bufio.Reader
+	hpk     [32]byte
+	k       *[64]byte
+	pending []byte
+	wmu     sync.Mutex // serializes frames written by rpc and channels
+
+	mu        sync.Mutex
+	codec     string // compression codec negotiated by Hello
+	threshold int
+	mux       *util.Mux // session layer negotiated by Hello
+}
+
+func (sc *secConn) compression() (string, int) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.codec, sc.threshold
+}
+
+func (sc *secConn) muxer() *util.Mux {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.mux
 }
 
 func (sc *secConn) Read(p []byte) (n int, err error) {
-	data, err := util.ReadFrame(sc.br)
-	if err != nil {
-		return 0, err
+	// previously received frame may not fit into caller's buffer
+	if len(sc.pending) > 0 {
+		n = copy(p, sc.pending)
+		sc.pending = sc.pending[n:]
+		return n, nil
+	}
+	for {
+		data, err := util.ReadFrame(sc.br)
+		if err != nil {
+			// channels end along with connection
+			if m := sc.muxer(); m != nil {
+				m.Close()
+			}
+			return 0, err
+		}
+		if codec, _ := sc.compression(); codec != "" {
+			if data, err = util.Decompress(data); err != nil {
+				return 0, err
+			}
+		}
+		if m := sc.muxer(); m != nil {
+			var ok bool
+			if data, ok, err = m.Dispatch(data); err != nil {
+				return 0, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		n = copy(p, data)
+		sc.pending = data[n:]
+		return n, nil
 	}
-	copy(p, data)
-	return len(data), nil
 }
 
 func (sc *secConn) Write(p []byte) (n int, err error) {
-	header := append(misc.Magic(), sc.hpk[:]...)
-	out := sign.Sign(header, p, sc.k)
-	if err = util.WriteFrame(sc.conn, out); err != nil {
+	data := p
+	if m := sc.muxer(); m != nil {
+		data = m.Wrap(p)
+	}
+	if err = sc.writeFrame(data); err != nil {
 		return 0, err
 	}
 	return len(p), nil
 }
 
+// writeFrame signs and sends single frame to server.
+func (sc *secConn) writeFrame(data []byte) (err error) {
+	if codec, threshold := sc.compression(); codec != "" {
+		if data, err = util.Compress(codec, threshold, data); err != nil {
+			return err
+		}
+	}
+	header := append(misc.Magic(), sc.hpk[:]...)
+	out := sign.Sign(header, data, sc.k)
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return util.WriteFrame(sc.conn, out)
+}
+
 func (sc *secConn) Close() error {
+	if m := sc.muxer(); m != nil {
+		m.Close()
+	}
 	return sc.conn.Close()
 }
 
+// hello negotiates connection features. Servers which do not know about negotiation are used as is.
+// Origin is only sent by relay and lists key hashes of previous hops.
+func hello(rc *rpc.Client, sc *secConn, reqID string, origin []string) error {
+	var resp server.HelloResponse
+	err := rc.Call("Session.Hello", server.HelloRequest{Protocol: misc.Magic(), Version: misc.Version(), Compression: compressCodecs, Mux: true, RequestID: reqID, Origin: origin}, &resp)
+	if isUnknownMethod(err) {
+		if len(origin) > 0 {
+			requestLogger(util.SubsysRPC, reqID).Warnf("Server does not support protocol negotiation, relay origin is not recorded: %v", err)
+			return nil
+		}
+		requestLogger(util.SubsysRPC, reqID).Debugf("Server does not support protocol negotiation: %v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	requestLogger(util.SubsysRPC, reqID).Debugf("Server protocol [%x] compression %s threshold %d mux %t", resp.Protocol, resp.Compression, resp.CompressThreshold, resp.Mux)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if resp.Compression != "" && resp.Compression != util.CodecNone {
+		sc.codec, sc.threshold = resp.Compression, resp.CompressThreshold
+	}
+	if resp.Mux {
+		sc.mux = util.NewMux(sc.writeFrame, sc.conn.LocalAddr(), sc.conn.RemoteAddr())
+		// server drops connection which stays quiet while channels are open
+		go sc.mux.Keepalive(util.MuxKeepaliveInterval)
+	}
+	return nil
+}
+
 // doRPC reads keys, connects to the server, and executes the given RPC operation.
 func doRPC(home string, op func(*rpc.Client) error) error {
+	return doSession(home, func(rc *rpc.Client, _ *secConn) error {
+		return op(rc)
+	})
+}
+
+// doSession is doRPC for operations which also use connection channels.
+func doSession(home string, op func(*rpc.Client, *secConn) error) error {
 
 	pk, k, err := util.ReadKeys(home)
 	if err != nil {
@@ -234,27 +493,97 @@ func doRPC(home string, op func(*rpc.Client) error) error {
 	}
 	defer util.ZeroBytes(k[:])
 
-	hpk := sha256.Sum256(pk[:])
-
-	var conn net.Conn
-	conn, err = net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", aPort), aConnectTimeout)
+	rc, sc, err := dialServer(aPort, pk, k, requestID, nil)
 	if err != nil {
 		return err
 	}
-
-	rc := rpc.NewClient(&secConn{conn: conn, br: bufio.NewReader(conn), hpk: hpk, k: k})
 	defer rc.Close()
 
-	if err = op(rc); err != nil {
+	if err = op(rc, sc); err != nil {
 		return err
 	}
 	return nil
 }
 
+// dialServer connects to server on port and negotiates connection features, requests are signed with k.
+func dialServer(port int, pk *[32]byte, k *[64]byte, reqID string, origin []string) (*rpc.Client, *secConn, error) {
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), aConnectTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc := &secConn{conn: conn, br: bufio.NewReader(conn), hpk: sha256.Sum256(pk[:]), k: k}
+	rc := rpc.NewClient(sc)
+	if err = hello(rc, sc, reqID, origin); err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	return rc, sc, nil
+}
+
+// setRequestID makes id part of every log message and of requests sent to server.
+func setRequestID(id string) {
+	requestID = id
+}
+
+// logger returns logger of subsystem which marks messages with request id of current operation.
+func logger(subsys string) util.Logger {
+	return requestLogger(subsys, requestID)
+}
+
+// requestLogger returns logger of subsystem which marks messages with request id.
+func requestLogger(subsys, id string) util.Logger {
+	l := util.NewLogger(subsys)
+	if id != "" {
+		l = l.With("req", id)
+	}
+	return l
+}
+
+// setupLogging sends log to -log-file or stderr, -debug lowers default level to debug.
+func setupLogging() (io.Closer, error) {
+	opts := util.LogOptions{
+		Levels:       aLogLevel,
+		DefaultLevel: util.DefaultLogLevel,
+		JSON:         aLogJSON,
+		File:         aLogFile,
+		MaxSize:      aLogMaxSize << 20,
+		Backups:      aLogBackups,
+		Output:       os.Stderr,
+	}
+	if aDebug {
+		opts.DefaultLevel = slog.LevelDebug
+	}
+	if err := detachedLogging(&opts); err != nil {
+		return nil, err
+	}
+	return util.SetupLogging(opts)
+}
+
+// logArgs returns logging options of this process to be passed to processes it starts.
+func logArgs() []string {
+	var args []string
+	if aDebug {
+		args = append(args, "--debug")
+	}
+	if aLogLevel != "" {
+		args = append(args, "--log-level", aLogLevel)
+	}
+	if aLogJSON {
+		args = append(args, "--log-json")
+	}
+	if aLogFile != "" {
+		args = append(args, "--log-file", aLogFile, "--log-max-size", strconv.FormatInt(aLogMaxSize, 10), "--log-backups", strconv.Itoa(aLogBackups))
+	}
+	return args
+}
+
 // run executes the CLI application and returns an exit code.
 func run() int {
 
-	cmd, err := processCommandLine(os.Args)
+	// command line is modified while parsed, detached server needs original one
+	cmd, err := processCommandLine(slices.Clone(os.Args))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\n\n*** ERROR: %s\n", err.Error())
 		return exitFlagParseError
@@ -265,10 +594,17 @@ func run() int {
 		return exitHelp
 	}
 
-	log.SetPrefix("[gclpr] ")
-	log.SetFlags(0)
-	if !aDebug {
-		log.SetOutput(io.Discard)
+	logFile, err := setupLogging()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\n\n*** ERROR: %s\n", err.Error())
+		return exitFlagParseError
+	}
+	defer logFile.Close()
+	// every command which talks to server gets request id, watch and sync keep one for the whole session
+	switch cmd {
+	case cmdOpen, cmdCopy, cmdPaste, cmdStatus, cmdTunnelList, cmdTunnelKill, cmdPause, cmdResume,
+		cmdHistory, cmdHistoryClear, cmdWatch, cmdSync:
+		setRequestID(util.NewRequestID())
 	}
 
 	home, err := os.UserHomeDir()
@@ -277,7 +613,8 @@ func run() int {
 		return exitNoKeys
 	}
 
-	log.Printf("Received command \"%s\" [%s]\n", cmd, aData)
+	// argument may be text to copy, expiring copies among them, so only its size is logged
+	logger("").Debugf("Received command \"%s\" with %d bytes argument", cmd, len(aData))
 
 	switch cmd {
 	case cmdOpen:
@@ -289,7 +626,7 @@ func run() int {
 			if targets, _, err = buildTunnelTargetsFromURL(aData); err != nil {
 				break
 			}
-			log.Printf("tunnel mode selected targets=%v", targets)
+			logger(util.SubsysTunnel).Debugf("tunnel mode selected targets=%v", targets)
 			if macKey, err = generateTunnelMACKey(); err != nil {
 				break
 			}
@@ -299,13 +636,14 @@ func run() int {
 				MACKey:        macKey,
 				AttachTimeout: aConnectTimeout,
 				IdleTimeout:   aIOTimeout,
+				Compression:   compressCodecs,
 			}
-			err = doRPC(home, func(rc *rpc.Client) error {
-				return rc.Call("Tunnel.Open", req, &resp)
+			err = doSession(home, func(rc *rpc.Client, sc *secConn) error {
+				if err := rc.Call("Tunnel.Open", req, &resp); err != nil {
+					return err
+				}
+				return attachTunnel(rc, sc, resp, macKey, aConnectTimeout, nil)
 			})
-			if err == nil {
-				err = startTunnelClient(resp, macKey, aConnectTimeout, nil)
-			}
 			break
 		}
 		if aOAuth {
@@ -313,15 +651,15 @@ func run() int {
 			var resp server.TunnelOpenResponse
 			var targets []server.TunnelTarget
 			var macKey []byte
-			log.Printf("oauth mode parsing redirect_uri timeout=%s", aIOTimeout)
+			logger(util.SubsysOAuth).Debugf("oauth mode parsing redirect_uri timeout=%s", aIOTimeout)
 			targets, err = buildTunnelTargetsFromOAuthURL(aData)
 			if err != nil {
-				log.Printf("oauth setup unavailable: %v; continuing with normal open", err)
+				logger(util.SubsysOAuth).Infof("oauth setup unavailable: %v; continuing with normal open", err)
 				err = nil
 			} else {
-				log.Printf("oauth mode selected targets=%v", targets)
+				logger(util.SubsysOAuth).Debugf("oauth mode selected targets=%v", targets)
 				if macKey, err = generateTunnelMACKey(); err != nil {
-					log.Printf("oauth setup failed: %v; continuing with normal open", err)
+					logger(util.SubsysOAuth).Warnf("oauth setup failed: %v; continuing with normal open", err)
 					err = nil
 				} else {
 					req = server.TunnelOpenRequest{
@@ -330,20 +668,21 @@ func run() int {
 						MACKey:        macKey,
 						AttachTimeout: aConnectTimeout,
 						IdleTimeout:   aIOTimeout,
+						Compression:   compressCodecs,
 					}
 					err = doRPC(home, func(rc *rpc.Client) error {
 						return rc.Call("Tunnel.Open", req, &resp)
 					})
 					if err != nil {
-						log.Printf("oauth setup failed: %v; continuing with normal open", err)
+						logger(util.SubsysOAuth).Warnf("oauth setup failed: %v; continuing with normal open", err)
 						err = nil
 					} else {
 						err = launchOAuthWorker(resp, macKey)
 						if err != nil {
-							log.Printf("oauth worker launch failed: %v; continuing with normal open", err)
+							logger(util.SubsysOAuth).Warnf("oauth worker launch failed: %v; continuing with normal open", err)
 							err = nil
 						} else {
-							log.Printf("oauth worker launched session=%s", resp.SessionID)
+							logger(util.SubsysOAuth).Debugf("oauth worker launched session=%s", resp.SessionID)
 							return exitSuccess
 						}
 					}
@@ -358,14 +697,114 @@ func run() int {
 		})
 	case cmdCopy:
 		err = doRPC(home, func(rc *rpc.Client) error {
-			return rc.Call("Clipboard.Copy", aData, &struct{}{})
+			if aTTL > 0 {
+				return copyExpiring(rc, cmp.Or(aType, server.MIMEText), aSelection, aData, aTTL)
+			}
+			if typed(aType) || otherSelection(aSelection) {
+				return copyType(rc, cmp.Or(aType, server.MIMEText), aSelection, aData)
+			}
+			return copyText(rc, aData)
 		})
 	case cmdPaste:
+		if aListTypes {
+			var types []string
+			if err = doRPC(home, func(rc *rpc.Client) (err error) {
+				types, err = clipboardTypes(rc, aSelection)
+				return err
+			}); err == nil {
+				for _, t := range types {
+					fmt.Println(t)
+				}
+			}
+			break
+		}
 		var resp string
-		err = doRPC(home, func(rc *rpc.Client) error {
-			return rc.Call("Clipboard.Paste", struct{}{}, &resp)
+		err = doRPC(home, func(rc *rpc.Client) (err error) {
+			if aEntry > 0 {
+				resp, err = pasteHistory(rc, aEntry, cmp.Or(aType, server.MIMEText))
+				return err
+			}
+			if typed(aType) || otherSelection(aSelection) {
+				resp, err = pasteType(rc, cmp.Or(aType, server.MIMEText), aSelection)
+				return err
+			}
+			resp, err = pasteText(rc)
+			return err
 		})
+		if typed(aType) {
+			os.Stdout.WriteString(resp)
+			break
+		}
 		os.Stdout.Write([]byte(server.ConvertLE(resp, aLE)))
+	case cmdStatus:
+		var resp server.StatusResponse
+		err = doRPC(home, func(rc *rpc.Client) error {
+			return rc.Call("Server.Status", struct{}{}, &resp)
+		})
+		if err == nil {
+			err = printStatus(os.Stdout, resp, aJSON)
+		}
+	case cmdTunnelList:
+		var resp []server.TunnelStatus
+		err = doRPC(home, func(rc *rpc.Client) error {
+			return rc.Call("Server.Tunnels", struct{}{}, &resp)
+		})
+		if err == nil {
+			err = printTunnels(os.Stdout, resp, aJSON)
+		}
+	case cmdHistory:
+		var entries []server.HistoryEntry
+		err = doRPC(home, func(rc *rpc.Client) (err error) {
+			entries, err = clipboardHistory(rc)
+			return err
+		})
+		if err == nil {
+			err = printHistory(os.Stdout, entries, aJSON)
+		}
+	case cmdWatch:
+		err = doSession(home, func(rc *rpc.Client, sc *secConn) error {
+			return watchClipboard(rc, sc, aContent, func(ev server.ClipboardEvent) error {
+				return printClipboardEvent(os.Stdout, ev, aJSON, aContent)
+			})
+		})
+	case cmdSync:
+		var local server.ClipboardBackend
+		if local, err = server.NewClipboardBackend(aClipBackend, cmp.Or(aClipFile, filepath.Join(home, ".gclpr", "clipboard"))); err != nil {
+			break
+		}
+		if local.Name() == "memory" {
+			err = errors.New("no local clipboard to sync, use -clipboard-backend to choose backend")
+			break
+		}
+		var s *clipboardSync
+		if s, err = newClipboardSync(local, aDirection, aDebounce, aMaxSize, aLE); err == nil {
+			err = runSync(home, s)
+		}
+	case cmdHistoryClear:
+		var n int
+		err = doRPC(home, func(rc *rpc.Client) error {
+			return rc.Call("Clipboard.HistoryClear", struct{}{}, &n)
+		})
+		if err == nil {
+			fmt.Printf("%d clipboard history entries forgotten\n", n)
+		}
+	case cmdTunnelKill:
+		err = doRPC(home, func(rc *rpc.Client) error {
+			return rc.Call("Server.KillTunnel", aData, &struct{}{})
+		})
+	case cmdPause, cmdResume:
+		method := "Server.Pause"
+		if cmd == cmdResume {
+			method = "Server.Resume"
+		}
+		err = doRPC(home, func(rc *rpc.Client) error {
+			return rc.Call(method, struct{}{}, &struct{}{})
+		})
+	case cmdInstallUnit:
+		var name, hint string
+		if name, hint, err = installUnit(home); err == nil {
+			fmt.Printf("Service definition written to %s\nTo start server now and on login run:\n\t%s\n", name, hint)
+		}
 	case cmdGenKey:
 		pk, _, er := util.ReadKeys(home)
 		if er != nil {
@@ -378,14 +817,85 @@ func run() int {
 		}
 	case cmdServer:
 		var pkeys map[[32]byte][32]byte
-		pkeys, err = util.ReadTrustedKeys(home)
+		var info map[[32]byte]util.KeyInfo
+		pkeys, info, err = util.ReadTrustedKeysInfo(home)
 		if err == nil {
-			log.Printf("Starting server with %d trusted public key(s)\n", len(pkeys))
+			logger("").Infof("Starting server with %d trusted public key(s)", len(pkeys))
 			for k, v := range pkeys {
-				log.Printf("\t%s [%s]\n", hex.EncodeToString(v[:]), hex.EncodeToString(k[:]))
+				logger("").Debugf("Trusted key %s [%s] %q %v", hex.EncodeToString(v[:]), hex.EncodeToString(k[:]), info[k].Label, info[k].Permissions)
+			}
+			var relay *server.RelayOptions
+			if aRelay {
+				if aUpstreamPort <= 0 || aUpstreamPort == aPort {
+					err = errors.New("relay needs -upstream-port different from -port")
+					break
+				}
+				logger("").Infof("Relaying requests to upstream server on port %d", aUpstreamPort)
+				relay = &server.RelayOptions{Dial: dialUpstream(home, aUpstreamPort)}
+			}
+			var ready, release func()
+			if ready, release, err = prepareServer(); err != nil {
+				if errors.Is(err, errDaemonized) {
+					err = nil
+				}
+				break
 			}
-			// we never break this
-			err = server.Serve(context.Background(), aPort, aLE, pkeys, misc.Magic(), nil, aIOTimeout)
+			var audit *util.RotatingFile
+			if audit, err = serverCfg.openAudit(home); err != nil {
+				release()
+				break
+			}
+			var dashboardToken string
+			if aDashboardPort != 0 {
+				if dashboardToken, ready, err = dashboard(ready); err != nil {
+					release()
+					break
+				}
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			var locked int32
+			if !aUnlocked && relay == nil {
+				// relay does not touch clipboard of its own session
+				go watchSessionLock(ctx, &locked)
+			}
+			opts := server.Options{
+				Port:              aPort,
+				LineEnding:        aLE,
+				TrustedKeys:       pkeys,
+				Magic:             misc.Magic(),
+				IOTimeout:         aIOTimeout,
+				MaxClipboardSize:  aMaxSize,
+				Compression:       compressCodecs,
+				CompressThreshold: aCompressMin,
+				LemonadePort:      aLemonadePort,
+				LemonadeCopyOnly:  aLemonadeCopyOnly,
+				MetricsPort:       aMetricsPort,
+				DashboardPort:     aDashboardPort,
+				Locked:            &locked,
+				Relay:             relay,
+				KeyInfo:           info,
+				Version:           misc.Version(),
+				ShutdownTimeout:   aShutdownTimeout,
+				Ready:             ready,
+				DashboardToken:    dashboardToken,
+				ClipboardBackend:  aClipBackend,
+				ClipboardFile:     cmp.Or(aClipFile, filepath.Join(home, ".gclpr", "clipboard")),
+				History:           server.HistoryOptions{Size: aHistory, MaxSize: aHistoryMaxSize},
+			}
+			serverCfg.options(&opts, home)
+			if term.IsTerminal(int(os.Stdin.Fd())) {
+				// requests of keys with approve attribute are confirmed here
+				opts.Approval.Input, opts.Approval.Output = os.Stdin, os.Stderr
+			}
+			if audit != nil {
+				opts.Audit = audit
+			}
+			err = server.Serve(ctx, opts)
+			stop()
+			if audit != nil {
+				audit.Close()
+			}
+			release()
 		}
 	default:
 		if cmd == cmdOAuthWorker {
@@ -396,7 +906,11 @@ func run() int {
 	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\n\n*** ERROR: %s\n", err.Error())
+		if requestID != "" {
+			fmt.Fprintf(os.Stderr, "\n\n*** ERROR: %s (request %s)\n", err.Error(), requestID)
+		} else {
+			fmt.Fprintf(os.Stderr, "\n\n*** ERROR: %s\n", err.Error())
+		}
 		return exitRPCError
 	}
 	return exitSuccess
@@ -409,10 +923,41 @@ func main() {
 	cli.StringVar(&aLE, "line-ending", "", "Convert Line Endings (LF/CRLF)")
 	cli.DurationVar(&aConnectTimeout, "connect-timeout", server.DefaultConnectTimeout, "TCP connection timeout")
 	cli.DurationVar(&aIOTimeout, "timeout", time.Minute, "Read/write I/O timeout")
+	cli.Int64Var(&aMaxSize, "max-size", server.DefaultMaxClipboardSize, "Maximum clipboard payload size in bytes (server, sync, paste)")
+	cli.StringVar(&aCompress, "compress", util.DefaultCodecs, "Compression codecs to negotiate in order of preference (zstd,gzip or none)")
+	cli.IntVar(&aCompressMin, "compress-threshold", util.DefaultCompressThreshold, "Smallest payload size in bytes to compress (server)")
+	cli.IntVar(&aLemonadePort, "lemonade-port", 0, fmt.Sprintf("Enable lemonade compatible listener on this TCP port, lemonade uses %d (server)", server.DefaultLemonadePort))
+	cli.BoolVar(&aLemonadeCopyOnly, "lemonade-copy-only", false, "Only accept copy requests on lemonade listener (server)")
+	cli.IntVar(&aMetricsPort, "metrics-port", 0, "Serve Prometheus metrics on this loopback TCP port (server)")
+	cli.IntVar(&aDashboardPort, "dashboard-port", 0, "Serve web dashboard on this loopback TCP port (server)")
+	cli.StringVar(&aClipBackend, "clipboard-backend", "auto", "Where server or sync keeps clipboard: "+strings.Join(server.ClipboardBackends, ", ")+" (server, sync)")
+	cli.StringVar(&aClipFile, "clipboard-file", "", "File for -clipboard-backend file, ~/.gclpr/clipboard by default (server, sync)")
+	cli.StringVar(&aDirection, "direction", syncBoth, "Which way clipboard is synced: both, to-server or from-server (sync)")
+	cli.DurationVar(&aDebounce, "debounce", 500*time.Millisecond, "Time local clipboard has to stay unchanged before it is sent to server (sync)")
+	cli.DurationVar(&aShutdownTimeout, "shutdown-timeout", server.DefaultShutdownTimeout, "Time in-flight requests have to finish on SIGINT or SIGTERM (server)")
+	cli.StringVar(&aConfig, "config", "", "Server configuration file, ~/.gclpr/server.toml is used when it exists (server)")
+	cli.BoolVar(&aDaemon, "daemon", false, "Detach from terminal and log to file in runtime directory (server, not on Windows)")
+	cli.BoolVar(&aUnlocked, "ignore-session-lock", false, "Continue to access clipboard inside locked session (server, Linux only)")
+	cli.BoolVar(&aRelay, "relay", false, "Forward requests to upstream server instead of serving them locally (server)")
+	cli.IntVar(&aUpstreamPort, "upstream-port", 0, "TCP port number of upstream server for -relay (server)")
+	cli.BoolVar(&aJSON, "json", false, "Print status, tunnel list, clipboard history and changes as JSON")
+	cli.StringVar(&aType, "type", "", "MIME type of copied or pasted data, i.e. image/png or text/html (copy, paste)")
+	cli.BoolVar(&aListTypes, "list-types", false, "List MIME types server clipboard content could be pasted as (paste)")
+	cli.BoolVar(&aContent, "content", false, "Print text of clipboard changes, each followed by NUL unless -json is given (watch)")
+	cli.IntVar(&aEntry, "n", 0, "Paste entry of server clipboard history, 1 is the latest copy (paste)")
+	cli.IntVar(&aHistory, "history", 0, "Number of copies server keeps in clipboard history, 0 disables history (server)")
+	cli.Int64Var(&aHistoryMaxSize, "history-max-size", server.DefaultHistoryMaxSize, "Maximum total size of clipboard history in bytes (server)")
+	cli.StringVar(&aSelection, "selection", server.SelectionClipboard, "X11 selection to use: clipboard, primary or both, other platforms have only clipboard (copy, paste)")
+	cli.DurationVar(&aTTL, "ttl", 0, "Take copied data back from server clipboard after this time, i.e. 30s for passwords (copy)")
 	cli.BoolVar(&aTunnel, "tunnel", false, "Tunnel loopback http(s) targets for open")
 	cli.BoolVar(&aOAuth, "oauth", false, "Tunnel OAuth redirect_uri callback listener for open")
 	cli.StringVar(&aWorkerStatusAddr, "worker-status-addr", "", "Internal: oauth worker status address")
-	cli.BoolVar(&aDebug, "debug", false, "Print debugging information")
+	cli.BoolVar(&aDebug, "debug", false, "Print debugging information, same as -log-level debug")
+	cli.StringVar(&aLogLevel, "log-level", "", "Log levels: default level and subsystem=level pairs, e.g. info,tunnel=trace (error, warn, info, debug, trace; subsystems rpc, clipboard, tunnel, oauth)")
+	cli.BoolVar(&aLogJSON, "log-json", false, "Write log records as JSON")
+	cli.StringVar(&aLogFile, "log-file", "", "Write log to this file instead of stderr")
+	cli.Int64Var(&aLogMaxSize, "log-max-size", util.DefaultLogMaxSize>>20, "Rotate log file once it grows over this many MiB")
+	cli.IntVar(&aLogBackups, "log-backups", util.DefaultLogBackups, "Number of rotated log files to keep")
 
 	cli.Usage = func() {
 		var buf strings.Builder
@@ -434,11 +979,25 @@ Commands:
     paste        - (client) %s
     open 'url'   - (client) %s
     genkey       - (client) %s
+    status       - (client) %s
+    history      - (client) %s
+    history clear
+                 - (client) %s
+    watch        - (client) %s
+    sync         - (client) %s
+    tunnel ls    - (client) %s
+    tunnel kill 'id'
+                 - (client) %s
+    server pause - (client) %s
+    server resume
+                 - (client) %s
+    server install-unit
+                 - %s
     server       - %s
 
 Options:
 
-`, cmdCopy, cmdPaste, cmdOpen, cmdGenKey, cmdServer)
+`, cmdCopy, cmdPaste, cmdOpen, cmdGenKey, cmdStatus, cmdHistory, cmdHistoryClear, cmdWatch, cmdSync, cmdTunnelList, cmdTunnelKill, cmdPause, cmdResume, cmdInstallUnit, cmdServer)
 
 		cli.VisitAll(func(f *flag.Flag) {
 			if strings.HasPrefix(f.Name, "worker-") {
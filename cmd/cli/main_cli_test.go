@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"errors"
+	"bytes"
+	"encoding/json"
 	"io"
 	"net"
 	"os"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/rupor-github/gclpr/server"
 )
 
 func TestGetCommandAliased(t *testing.T) {
@@ -52,6 +54,8 @@ func TestGetCommandExplicit(t *testing.T) {
 		{"paste", []string{"gclpr", "paste"}, cmdPaste},
 		{"server", []string{"gclpr", "server"}, cmdServer},
 		{"genkey", []string{"gclpr", "genkey"}, cmdGenKey},
+		{"status", []string{"gclpr", "status"}, cmdStatus},
+		{"watch", []string{"gclpr", "watch"}, cmdWatch},
 	}
 
 	for _, tc := range tests {
@@ -109,6 +113,7 @@ func TestCommandString(t *testing.T) {
 		{cmdPaste, "output server clipboard locally"},
 		{cmdServer, "start server"},
 		{cmdGenKey, "generate key pair for signing"},
+		{cmdStatus, "show server status"},
 	}
 
 	for _, tc := range tests {
@@ -234,77 +239,151 @@ func TestGetCommandInternalOAuthWorker(t *testing.T) {
 	}
 }
 
-func TestTunnelClientRemoteEOFCloseWrite(t *testing.T) {
-	const macKey = "0123456789abcdef0123456789abcdef"
-
-	serverConn, clientConn := net.Pipe()
-	defer serverConn.Close()
-	defer clientConn.Close()
+func TestOAuthWatchConnDetectsCallbackResponse(t *testing.T) {
+	localConn, serviceConn := net.Pipe()
+	defer serviceConn.Close()
 
-	endpoint := newTunnelEndpoint(serverConn, []byte(macKey))
-	client := newTunnelClient(endpoint)
-	defer client.closeAll()
+	done := make(chan struct{})
+	conn := &oauthWatchConn{Conn: localConn, id: 7, onDone: func() { close(done) }}
 
-	localConn, remoteConn := net.Pipe()
-	defer remoteConn.Close()
-	stream := newTunnelLocalStream(7, localConn)
-	client.streams[stream.id] = stream
-
-	errCh := make(chan error, 1)
 	go func() {
-		errCh <- client.readFrames()
+		buf := make([]byte, 1024)
+		serviceConn.Read(buf)
+		serviceConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\ndone"))
+		serviceConn.Close()
 	}()
-
-	peer := &tunnelEndpoint{conn: clientConn, br: bufio.NewReader(clientConn), macKey: []byte(macKey)}
-	if err := peer.writeFrame(tunnelFrame{Type: tunnelFrameEOF, StreamID: stream.id}); err != nil {
-		t.Fatalf("writeFrame EOF: %v", err)
+	if _, err := conn.Write([]byte("GET /callback?code=abc&state=xyz HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("ReadAll: %v", err)
 	}
-
-	readDone := make(chan struct{})
-	go func() {
-		var buf [1]byte
-		_, err := remoteConn.Read(buf[:])
-		if err != io.EOF {
-			t.Errorf("remote read err = %v, want EOF", err)
-		}
-		close(readDone)
-	}()
-
 	select {
-	case <-readDone:
+	case <-done:
 	case <-time.After(time.Second):
-		t.Fatal("timed out waiting for local CloseWrite propagation")
+		t.Fatal("expected callback response to finish tunnel")
 	}
+}
 
-	_ = endpoint.close()
-	if err := <-errCh; err != nil && err != io.EOF && err != net.ErrClosed && !errors.Is(err, io.ErrClosedPipe) && !strings.Contains(err.Error(), "closed pipe") {
-		t.Fatalf("readFrames err = %v", err)
+func TestOAuthWatchConnIgnoresOtherRequests(t *testing.T) {
+	localConn, serviceConn := net.Pipe()
+	defer serviceConn.Close()
+
+	conn := &oauthWatchConn{Conn: localConn, id: 7, onDone: func() { t.Error("unexpected finish") }}
+	go func() {
+		buf := make([]byte, 1024)
+		serviceConn.Read(buf)
+		serviceConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		serviceConn.Close()
+	}()
+	if _, err := conn.Write([]byte("GET /favicon.ico HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("ReadAll: %v", err)
 	}
 }
 
-func TestTunnelClientFinishTreatsIntentionalCloseAsSuccess(t *testing.T) {
-	const macKey = "0123456789abcdef0123456789abcdef"
+func TestPrintStatus(t *testing.T) {
+	st := server.StatusResponse{
+		Version:          "1.2.3",
+		Uptime:           90 * time.Second,
+		Listeners:        []server.ListenerStatus{{Kind: "rpc", Addr: "127.0.0.1:2850"}},
+		ClipboardBackend: "xclip",
+		TrustedKeys:      2,
+		Caller:           server.CallerStatus{Key: "abcd", Label: "laptop", Permissions: []string{"admin"}},
+		Tunnels:          []server.TunnelStatus{{ID: "s1", Listeners: []string{"127.0.0.1:8080"}, Attached: true, BytesIn: 10}},
+	}
 
-	serverConn, clientConn := net.Pipe()
-	defer serverConn.Close()
-	defer clientConn.Close()
+	var text strings.Builder
+	if err := printStatus(&text, st, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1m30s", "rpc 127.0.0.1:2850", "abcd (laptop)", "Permissions:       admin", "Locked:            no", "s1 attached", "bytes_in=10", "Paused:            no"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("status output misses %q:\n%s", want, text.String())
+		}
+	}
 
-	endpoint := newTunnelEndpoint(serverConn, []byte(macKey))
-	client := newTunnelClient(endpoint)
+	var out bytes.Buffer
+	if err := printStatus(&out, st, true); err != nil {
+		t.Fatal(err)
+	}
+	var decoded server.StatusResponse
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("json output: %v", err)
+	}
+	if decoded.Caller.Label != "laptop" || len(decoded.Tunnels) != 1 || decoded.Tunnels[0].BytesIn != 10 {
+		t.Fatalf("decoded status = %+v", decoded)
+	}
+}
 
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- client.readFrames()
-	}()
+func TestPrintClipboardEvent(t *testing.T) {
+	ev := server.ClipboardEvent{Time: time.Now(), Type: "text/plain", Size: 5, Hash: strings.Repeat("ab", 32), Key: strings.Repeat("cd", 32), Text: "hello"}
+	var out strings.Builder
+	if err := printClipboardEvent(&out, ev, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(out.String(), "        5  abababababababab  text/plain  cdcdcdcd\n") {
+		t.Fatalf("event line = %q", out.String())
+	}
+	out.Reset()
+	printClipboardEvent(&out, server.ClipboardEvent{Time: ev.Time, Type: "text/plain", Size: 6, Concealed: true}, false, false)
+	if !strings.HasSuffix(out.String(), "        6  concealed         text/plain\n") {
+		t.Fatalf("concealed event line = %q", out.String())
+	}
+	out.Reset()
+	printClipboardEvent(&out, ev, false, true)
+	printClipboardEvent(&out, server.ClipboardEvent{Type: "image/png", Size: 3}, false, true)
+	if out.String() != "hello\x00" {
+		t.Fatalf("content = %q", out.String())
+	}
+}
 
-	client.finish()
+func TestProcessCommandLineAdminCommands(t *testing.T) {
+	origData := aData
+	t.Cleanup(func() { aData = origData })
+	// server reads configuration file from home directory, it must not be the one of whoever runs tests
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
 
-	select {
-	case err := <-errCh:
-		if err != nil {
-			t.Fatalf("readFrames err = %v, want nil", err)
-		}
-	case <-time.After(time.Second):
-		t.Fatal("timed out waiting for intentional close to finish")
+	tests := []struct {
+		args    []string
+		wantCmd command
+		wantErr bool
+	}{
+		{[]string{"gclpr", "server"}, cmdServer, false},
+		{[]string{"gclpr", "server", "pause"}, cmdPause, false},
+		{[]string{"gclpr", "server", "resume"}, cmdResume, false},
+		{[]string{"gclpr", "server", "install-unit"}, cmdInstallUnit, false},
+		{[]string{"gclpr", "server", "stop"}, 0, true},
+		{[]string{"gclpr", "tunnel", "ls"}, cmdTunnelList, false},
+		{[]string{"gclpr", "tunnel", "kill", "abc"}, cmdTunnelKill, false},
+		{[]string{"gclpr", "tunnel"}, 0, true},
+		{[]string{"gclpr", "tunnel", "kill"}, 0, true},
+		{[]string{"gclpr", "history"}, cmdHistory, false},
+		{[]string{"gclpr", "history", "clear"}, cmdHistoryClear, false},
+		{[]string{"gclpr", "history", "drop"}, 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(strings.Join(tc.args[1:], " "), func(t *testing.T) {
+			cmd, err := processCommandLine(append([]string(nil), tc.args...))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got cmd=%v", cmd)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cmd != tc.wantCmd {
+				t.Errorf("got cmd=%v, want %v", cmd, tc.wantCmd)
+			}
+		})
+	}
+	if aData != "abc" {
+		t.Errorf("tunnel kill id = %q", aData)
 	}
 }
@@ -2,12 +2,12 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"net/url"
 	"strconv"
 
 	"github.com/rupor-github/gclpr/server"
+	"github.com/rupor-github/gclpr/util"
 )
 
 func buildTunnelTargetsFromOAuthURL(raw string) ([]server.TunnelTarget, error) {
@@ -28,7 +28,7 @@ func buildTunnelTargetsFromOAuthURL(raw string) ([]server.TunnelTarget, error) {
 		return nil, err
 	}
 	host := redirectURL.Hostname()
-	log.Printf("oauth redirect_uri parsed raw=%q host=%q port=%d", redirectValue, host, port)
+	logger(util.SubsysOAuth).Debugf("oauth redirect_uri parsed raw=%q host=%q port=%d", redirectValue, host, port)
 	if host == "localhost" {
 		return []server.TunnelTarget{{ListenHost: "localhost", ListenPort: port, DialAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}}, nil
 	}
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"os/exec"
@@ -15,14 +14,18 @@ import (
 	"time"
 
 	"github.com/rupor-github/gclpr/server"
+	"github.com/rupor-github/gclpr/util"
 )
 
 var applyWorkerDetach = func(cmd *exec.Cmd) {}
-var oauthWorkerStartTunnelClient = startTunnelClient
+var oauthWorkerStartTunnelClient = connectTunnel
 
 type oauthWorkerHandshake struct {
-	SessionID string `json:"session_id"`
-	MACKey    string `json:"mac_key"`
+	SessionID         string `json:"session_id"`
+	MACKey            string `json:"mac_key"`
+	Compression       string `json:"compression,omitempty"`
+	CompressThreshold int    `json:"compress_threshold,omitempty"`
+	RequestID         string `json:"request_id,omitempty"`
 }
 
 func launchOAuthWorker(resp server.TunnelOpenResponse, macKey []byte) error {
@@ -38,12 +41,12 @@ func launchOAuthWorker(resp server.TunnelOpenResponse, macKey []byte) error {
 
 	statusAddr := statusLn.Addr().String()
 	var logFile *os.File
-	if aDebug {
+	if aLogFile == "" && (aDebug || aLogLevel != "") {
 		logFile, err = os.CreateTemp("", "gclpr-worker-*.log")
 		if err != nil {
 			return err
 		}
-		log.Printf("oauth worker log file: %s", logFile.Name())
+		logger(util.SubsysOAuth).Infof("oauth worker log file: %s", logFile.Name())
 	}
 
 	cmd := exec.Command(executable, "internal-oauth-worker",
@@ -52,9 +55,7 @@ func launchOAuthWorker(resp server.TunnelOpenResponse, macKey []byte) error {
 		"--timeout", aIOTimeout.String(),
 		"--worker-status-addr", statusAddr,
 	)
-	if aDebug {
-		cmd.Args = append(cmd.Args, "--debug")
-	}
+	cmd.Args = append(cmd.Args, logArgs()...)
 	cmd.Stdin = nil
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
@@ -77,7 +78,13 @@ func launchOAuthWorker(resp server.TunnelOpenResponse, macKey []byte) error {
 			return
 		}
 		defer conn.Close()
-		if err := json.NewEncoder(conn).Encode(oauthWorkerHandshake{SessionID: resp.SessionID, MACKey: hex.EncodeToString(macKey)}); err != nil {
+		if err := json.NewEncoder(conn).Encode(oauthWorkerHandshake{
+			SessionID:         resp.SessionID,
+			MACKey:            hex.EncodeToString(macKey),
+			Compression:       resp.Compression,
+			CompressThreshold: resp.CompressThreshold,
+			RequestID:         requestID,
+		}); err != nil {
 			resultCh <- err
 			return
 		}
@@ -127,6 +134,9 @@ func runOAuthWorker() error {
 			}
 		}
 	}
+	if util.ValidRequestID(handshake.RequestID) {
+		setRequestID(handshake.RequestID)
+	}
 	if handshake.SessionID == "" {
 		err := fmt.Errorf("oauth worker session id is required")
 		report("ERR " + err.Error())
@@ -144,11 +154,13 @@ func runOAuthWorker() error {
 		return err
 	}
 	resp := server.TunnelOpenResponse{
-		SessionID:     handshake.SessionID,
-		AttachTimeout: aConnectTimeout,
-		IdleTimeout:   aIOTimeout,
+		SessionID:         handshake.SessionID,
+		AttachTimeout:     aConnectTimeout,
+		IdleTimeout:       aIOTimeout,
+		Compression:       handshake.Compression,
+		CompressThreshold: handshake.CompressThreshold,
 	}
-	log.Printf("oauth worker started pid=%d session=%s", os.Getpid(), handshake.SessionID)
+	logger(util.SubsysOAuth).Infof("oauth worker started pid=%d session=%s", os.Getpid(), handshake.SessionID)
 	if resp.IdleTimeout <= 0 {
 		resp.IdleTimeout = time.Minute
 	}
@@ -157,9 +169,9 @@ func runOAuthWorker() error {
 		return nil
 	})
 	if err != nil {
-		log.Printf("oauth worker finished with error: %v", err)
+		logger(util.SubsysOAuth).Errorf("oauth worker finished with error: %v", err)
 		return err
 	}
-	log.Printf("oauth worker finished successfully")
+	logger(util.SubsysOAuth).Infof("oauth worker finished successfully")
 	return nil
 }
@@ -17,11 +17,13 @@ func TestRunOAuthWorkerReadsHandshakeAndReportsOK(t *testing.T) {
 	origTimeout := aConnectTimeout
 	origIOTimeout := aIOTimeout
 	origStart := oauthWorkerStartTunnelClient
+	origRequestID := requestID
 	t.Cleanup(func() {
 		aWorkerStatusAddr = origStatusAddr
 		aConnectTimeout = origTimeout
 		aIOTimeout = origIOTimeout
 		oauthWorkerStartTunnelClient = origStart
+		requestID = origRequestID
 	})
 
 	aConnectTimeout = time.Second
@@ -55,7 +57,7 @@ func TestRunOAuthWorkerReadsHandshakeAndReportsOK(t *testing.T) {
 	}
 	defer conn.Close()
 
-	if err := json.NewEncoder(conn).Encode(oauthWorkerHandshake{SessionID: "session-123", MACKey: "3031323334353637383961626364656630313233343536373839616263646566"}); err != nil {
+	if err := json.NewEncoder(conn).Encode(oauthWorkerHandshake{SessionID: "session-123", MACKey: "3031323334353637383961626364656630313233343536373839616263646566", RequestID: "0123abcd"}); err != nil {
 		t.Fatalf("encode handshake: %v", err)
 	}
 
@@ -82,6 +84,9 @@ func TestRunOAuthWorkerReadsHandshakeAndReportsOK(t *testing.T) {
 	if err := <-workerErrCh; err != nil {
 		t.Fatalf("runOAuthWorker err = %v", err)
 	}
+	if requestID != "0123abcd" {
+		t.Fatalf("worker request id = %q, want one from handshake", requestID)
+	}
 }
 
 func TestRunOAuthWorkerRejectsInvalidHandshake(t *testing.T) {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+
+	"github.com/rupor-github/gclpr/server"
+	"github.com/rupor-github/gclpr/util"
+)
+
+// upstream is relay connection to the next server, requests are signed with relay's own key.
+type upstream struct {
+	rc *rpc.Client
+	sc *secConn
+	k  *[64]byte
+}
+
+func (u *upstream) Call(method string, args any, reply any) error {
+	return u.rc.Call(method, args, reply)
+}
+
+func (u *upstream) OpenChannel() (net.Conn, uint32, error) {
+	m := u.sc.muxer()
+	if m == nil {
+		return nil, 0, errors.New("upstream server does not support channels")
+	}
+	id := m.NextID()
+	ch, err := m.Open(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ch, id, nil
+}
+
+func (u *upstream) Close() error {
+	err := u.rc.Close()
+	util.ZeroBytes(u.k[:])
+	return err
+}
+
+// dialUpstream returns relay dialer connecting to upstream server on port.
+func dialUpstream(home string, port int) func(origin []string, requestID string) (server.Upstream, error) {
+	return func(origin []string, requestID string) (server.Upstream, error) {
+		pk, k, err := util.ReadKeys(home)
+		if err != nil {
+			return nil, err
+		}
+		rc, sc, err := dialServer(port, pk, k, requestID, origin)
+		if err != nil {
+			util.ZeroBytes(k[:])
+			return nil, err
+		}
+		return &upstream{rc: rc, sc: sc, k: k}, nil
+	}
+}
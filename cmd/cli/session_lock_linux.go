@@ -0,0 +1,48 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/rupor-github/gclpr/logind"
+)
+
+// sessionLockRetry is how long to wait before reconnecting to message bus.
+const sessionLockRetry = 30 * time.Second
+
+// watchSessionLock keeps locked in sync with logind session lock state until ctx is cancelled. State is kept
+// while message bus is not available, nothing is locked if it never was.
+func watchSessionLock(ctx context.Context, locked *int32) {
+	log := logger("")
+	for failures := 0; ; failures++ {
+		err := logind.Watch(ctx, logind.SystemBusAddress(), func(l bool) {
+			var v int32
+			if l {
+				v = 1
+			}
+			if atomic.SwapInt32(locked, v) != v {
+				if l {
+					log.Infof("Session locked")
+				} else {
+					log.Infof("Session unlocked")
+				}
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if failures == 0 {
+			log.Warnf("Unable to follow session lock state, retrying every %s: %v", sessionLockRetry, err)
+		} else {
+			log.Debugf("Unable to follow session lock state: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sessionLockRetry):
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "context"
+
+// watchSessionLock does nothing, session lock is only followed on Linux.
+func watchSessionLock(context.Context, *int32) {}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rupor-github/gclpr/server"
+)
+
+// printStatus writes server status either as JSON for scripts or in human readable form.
+func printStatus(w io.Writer, st server.StatusResponse, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+
+	listeners := make([]string, 0, len(st.Listeners))
+	for _, l := range st.Listeners {
+		listeners = append(listeners, l.Kind+" "+l.Addr)
+	}
+	caller := st.Caller.Key
+	if st.Caller.Label != "" {
+		caller += " (" + st.Caller.Label + ")"
+	}
+	perms := "none"
+	if len(st.Caller.Permissions) > 0 {
+		perms = strings.Join(st.Caller.Permissions, ",")
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "Version:           %s\n", st.Version)
+	fmt.Fprintf(&buf, "Uptime:            %s\n", st.Uptime.Round(time.Second))
+	fmt.Fprintf(&buf, "Listening on:      %s\n", strings.Join(listeners, ", "))
+	fmt.Fprintf(&buf, "Clipboard backend: %s\n", st.ClipboardBackend)
+	fmt.Fprintf(&buf, "Trusted keys:      %d\n", st.TrustedKeys)
+	fmt.Fprintf(&buf, "Caller key:        %s\n", caller)
+	fmt.Fprintf(&buf, "Permissions:       %s\n", perms)
+	if len(st.Caller.Origin) > 0 {
+		fmt.Fprintf(&buf, "Relayed for:       %s\n", strings.Join(st.Caller.Origin, " -> "))
+	}
+	fmt.Fprintf(&buf, "Locked:            %s\n", yesNo(st.Locked))
+	fmt.Fprintf(&buf, "Paused:            %s\n", yesNo(st.Paused))
+	fmt.Fprintf(&buf, "Tunnel sessions:   %d\n", len(st.Tunnels))
+	for _, ts := range st.Tunnels {
+		buf.WriteString("  " + formatTunnel(ts) + "\n")
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// printHistory writes clipboard history either as JSON or one entry per line, the latest first.
+func printHistory(w io.Writer, entries []server.HistoryEntry, asJSON bool) error {
+	if asJSON {
+		if entries == nil {
+			entries = []server.HistoryEntry{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	var buf strings.Builder
+	for _, e := range entries {
+		from := "-"
+		if e.Label != "" {
+			from = e.Label
+		} else if len(e.Key) >= 8 {
+			from = e.Key[:8]
+		}
+		fmt.Fprintf(&buf, "%3d  %s  %-12s %9d  %s", e.N, e.Time.Local().Format(time.DateTime), from, e.Size, e.Type)
+		if e.Preview != "" {
+			buf.WriteString("  " + e.Preview)
+		}
+		buf.WriteString("\n")
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// printClipboardEvent writes clipboard change either as JSON line or in human readable form, with content
+// it writes text of change followed by NUL instead.
+func printClipboardEvent(w io.Writer, ev server.ClipboardEvent, asJSON, content bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(ev)
+	}
+	if content {
+		if ev.Text == "" && ev.Size > 0 {
+			// content which is not text has nothing to print
+			return nil
+		}
+		_, err := io.WriteString(w, ev.Text+"\x00")
+		return err
+	}
+	from := ""
+	if ev.Label != "" {
+		from = "  " + ev.Label
+	} else if len(ev.Key) >= 8 {
+		from = "  " + ev.Key[:8]
+	}
+	hash := ev.Hash
+	if ev.Concealed {
+		hash = "concealed"
+	}
+	_, err := fmt.Fprintf(w, "%s  %9d  %-16.16s  %s%s\n", ev.Time.Local().Format(time.DateTime), ev.Size, hash, ev.Type, from)
+	return err
+}
+
+// printTunnels writes list of tunnel sessions either as JSON or one session per line.
+func printTunnels(w io.Writer, tunnels []server.TunnelStatus, asJSON bool) error {
+	if asJSON {
+		if tunnels == nil {
+			tunnels = []server.TunnelStatus{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tunnels)
+	}
+	var buf strings.Builder
+	for _, ts := range tunnels {
+		buf.WriteString(formatTunnel(ts) + " owner=" + ts.Owner + " req=" + ts.RequestID + " url=" + ts.URL + "\n")
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+func formatTunnel(ts server.TunnelStatus) string {
+	state := "pending"
+	if ts.Attached {
+		state = "attached"
+	}
+	return fmt.Sprintf("%s %s age=%s listeners=%s streams=%d opened=%d bytes_in=%d bytes_out=%d",
+		ts.ID, state, time.Since(ts.Created).Round(time.Second), strings.Join(ts.Listeners, ","), ts.Streams, ts.Opened, ts.BytesIn, ts.BytesOut)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rupor-github/gclpr/server"
+	"github.com/rupor-github/gclpr/util"
+)
+
+// Sync directions.
+const (
+	syncBoth       = "both"
+	syncToServer   = "to-server"
+	syncFromServer = "from-server"
+)
+
+const (
+	// syncPollInterval is how often local clipboard is checked for changes.
+	syncPollInterval = 250 * time.Millisecond
+	// syncRetryInterval is how long sync waits before connecting to server again.
+	syncRetryInterval = 5 * time.Second
+)
+
+// clipboardSync mirrors text between local clipboard and server clipboard. Content hashes on both sides
+// are remembered, so change which came from the other side is not sent back.
+type clipboardSync struct {
+	local      server.ClipboardBackend
+	toServer   bool
+	fromServer bool
+	debounce   time.Duration
+	maxSize    int64
+	le         string
+
+	mu         sync.Mutex
+	localHash  [32]byte // content local clipboard is known to have
+	serverHash string   // hash of content server clipboard is known to have
+}
+
+func newClipboardSync(local server.ClipboardBackend, direction string, debounce time.Duration, maxSize int64, le string) (*clipboardSync, error) {
+	s := &clipboardSync{local: local, debounce: debounce, maxSize: maxSize, le: le}
+	switch direction {
+	case syncBoth:
+		s.toServer, s.fromServer = true, true
+	case syncToServer:
+		s.toServer = true
+	case syncFromServer:
+		s.fromServer = true
+	default:
+		return nil, fmt.Errorf("invalid -direction %q, expected %s, %s or %s", direction, syncBoth, syncToServer, syncFromServer)
+	}
+	// content clipboard has before sync starts is not a change
+	if text, err := local.Read(); err == nil {
+		s.localHash = sha256.Sum256([]byte(text))
+	}
+	return s, nil
+}
+
+// run syncs clipboards over single server connection until it fails or ctx is cancelled.
+func (s *clipboardSync) run(ctx context.Context, rc *rpc.Client, sc *secConn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	if s.fromServer {
+		go func() {
+			errs <- watchClipboard(rc, sc, true, func(ev server.ClipboardEvent) error {
+				s.pull(ev)
+				return ctx.Err()
+			})
+		}()
+	}
+	if s.toServer {
+		go func() {
+			errs <- s.pushChanges(ctx, rc)
+		}()
+	}
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// pull writes server clipboard change to local clipboard.
+func (s *clipboardSync) pull(ev server.ClipboardEvent) {
+	log := logger(util.SubsysClipboard)
+	if ev.Concealed {
+		log.Debugf("Server clipboard has expiring copy, it is not synced")
+		return
+	}
+	if ev.Text == "" && ev.Size > 0 {
+		log.Debugf("Server clipboard has %s, only text is synced", ev.Type)
+		return
+	}
+	if int64(ev.Size) > s.maxSize {
+		log.Warnf("Server clipboard change of %d bytes is larger than %d, not synced", ev.Size, s.maxSize)
+		return
+	}
+	text := server.ConvertLE(ev.Text, s.le)
+	sum := sha256.Sum256([]byte(text))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ev.Hash == s.serverHash || sum == s.localHash {
+		// change came from here
+		s.serverHash = ev.Hash
+		return
+	}
+	if err := s.local.Write(text); err != nil {
+		log.Warnf("Unable to write local clipboard: %v", err)
+		return
+	}
+	s.serverHash, s.localHash = ev.Hash, sum
+	log.Debugf("Server clipboard change of %d bytes synced to local clipboard", len(text))
+}
+
+// pushChanges sends local clipboard to server once it does not change for debounce interval.
+func (s *clipboardSync) pushChanges(ctx context.Context, rc *rpc.Client) error {
+	log := logger(util.SubsysClipboard)
+	t := time.NewTicker(syncPollInterval)
+	defer t.Stop()
+
+	var pending [32]byte
+	var since time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+		text, err := s.local.Read()
+		if err != nil {
+			log.Debugf("Unable to read local clipboard: %v", err)
+			continue
+		}
+		sum := sha256.Sum256([]byte(text))
+		s.mu.Lock()
+		changed := sum != s.localHash
+		s.mu.Unlock()
+		if !changed {
+			pending = [32]byte{}
+			continue
+		}
+		if sum != pending {
+			pending, since = sum, time.Now()
+		}
+		if time.Since(since) < s.debounce {
+			continue
+		}
+		s.mu.Lock()
+		s.localHash, s.serverHash = sum, hex.EncodeToString(sum[:])
+		s.mu.Unlock()
+		if int64(len(text)) > s.maxSize {
+			log.Warnf("Local clipboard change of %d bytes is larger than %d, not synced", len(text), s.maxSize)
+			continue
+		}
+		if err := copyText(rc, text); err != nil {
+			return fmt.Errorf("unable to sync local clipboard to server: %w", err)
+		}
+		log.Debugf("Local clipboard change of %d bytes synced to server", len(text))
+	}
+}
+
+// runSync keeps clipboards in sync until interrupted, connection to server is retried when it fails.
+func runSync(home string, s *clipboardSync) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log := logger(util.SubsysClipboard)
+	log.Infof("Syncing %s clipboard with server on port %d, to server: %t, from server: %t", s.local.Name(), aPort, s.toServer, s.fromServer)
+	for {
+		err := doSession(home, func(rc *rpc.Client, sc *secConn) error {
+			return s.run(ctx, rc, sc)
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errNoWatch) {
+			return err
+		}
+		log.Warnf("Clipboard sync interrupted, retrying in %s: %v", syncRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(syncRetryInterval):
+		}
+	}
+}
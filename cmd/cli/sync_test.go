@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/server"
+)
+
+func syncEvent(text string) server.ClipboardEvent {
+	sum := sha256.Sum256([]byte(text))
+	return server.ClipboardEvent{Type: server.MIMEText, Size: len(text), Hash: hex.EncodeToString(sum[:]), Text: text}
+}
+
+func TestClipboardSync(t *testing.T) {
+	local, err := server.NewClipboardBackend("file", filepath.Join(t.TempDir(), "clipboard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Write("before"); err != nil {
+		t.Fatal(err)
+	}
+	rc := startClipboardRPC(t, "Clipboard", server.NewClipboard("", 0))
+	remote := func() string {
+		var text string
+		if err := rc.Call("Clipboard.Paste", struct{}{}, &text); err != nil {
+			t.Fatal(err)
+		}
+		return text
+	}
+	if _, err := newClipboardSync(local, "sideways", 0, 100, ""); err == nil {
+		t.Fatal("unknown direction is accepted")
+	}
+	s, err := newClipboardSync(local, syncBoth, 0, 100, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.pushChanges(ctx, rc) }()
+
+	// content local clipboard had before sync started is not a change
+	time.Sleep(3 * syncPollInterval)
+	if got := remote(); got != "" {
+		t.Fatalf("server got %q", got)
+	}
+	if err := local.Write("local change"); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); remote() != "local change"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("local change is not synced to server")
+		}
+	}
+
+	// server change is written locally and is not sent back, echo of local change is ignored
+	s.pull(syncEvent("local change"))
+	s.pull(syncEvent("from server"))
+	s.pull(syncEvent(strings.Repeat("x", 101)))
+	s.pull(server.ClipboardEvent{Type: "image/png", Size: 3, Hash: "ff"})
+	s.pull(server.ClipboardEvent{Type: server.MIMEText, Size: 6, Concealed: true})
+	if text, err := local.Read(); err != nil || text != "from server" {
+		t.Fatalf("local = %q, %v", text, err)
+	}
+	time.Sleep(3 * syncPollInterval)
+	if got := remote(); got != "local change" {
+		t.Fatalf("server change came back as %q", got)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	systemdUnitName = "gclpr.service"
+	launchdLabel    = "com.github.rupor-github.gclpr"
+)
+
+// unitArgs returns server command line made of flags explicitly set on fs.
+func unitArgs(fs *flag.FlagSet) []string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "daemon", "help":
+			// service manager keeps server in foreground
+			return
+		}
+		if strings.HasPrefix(f.Name, "worker-") {
+			return
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	return append(args, "server")
+}
+
+// systemdQuote quotes word for ExecStart when needed, percent and dollar signs are special there and always escaped.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer("%", "%%", "$", "$$").Replace(s)
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// systemdUnit returns systemd user unit running server in foreground, server notifies systemd when it is ready.
+func systemdUnit(exe string, args []string) string {
+	words := []string{systemdQuote(exe)}
+	for _, a := range args {
+		words = append(words, systemdQuote(a))
+	}
+	return fmt.Sprintf(`[Unit]
+Description=gclpr clipboard and browser server
+After=graphical-session.target
+
+[Service]
+Type=notify
+ExecStart=%s
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`, strings.Join(words, " "))
+}
+
+// launchdPlist returns launchd agent definition running server in foreground.
+func launchdPlist(exe string, args []string) string {
+	var buf strings.Builder
+	for _, a := range append([]string{exe}, args...) {
+		buf.WriteString("\t\t<string>")
+		xml.EscapeText(&buf, []byte(a))
+		buf.WriteString("</string>\n")
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+</dict>
+</plist>
+`, launchdLabel, buf.String())
+}
+
+// installUnit writes service definition for current platform and returns its name along with commands to enable it.
+func installUnit(home string) (string, string, error) {
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", "", err
+	}
+	args := unitArgs(cli)
+
+	var name, content, hint string
+	switch runtime.GOOS {
+	case "linux":
+		dir := os.Getenv("XDG_CONFIG_HOME")
+		if dir == "" {
+			dir = filepath.Join(home, ".config")
+		}
+		name = filepath.Join(dir, "systemd", "user", systemdUnitName)
+		content = systemdUnit(exe, args)
+		hint = "systemctl --user daemon-reload && systemctl --user enable --now " + systemdUnitName
+	case "darwin":
+		name = filepath.Join(home, "Library", "LaunchAgents", launchdLabel+".plist")
+		content = launchdPlist(exe, args)
+		hint = "launchctl bootstrap gui/$(id -u) " + name
+	default:
+		return "", "", errors.New("service installation is only supported on Linux (systemd) and macOS (launchd)")
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		return "", "", err
+	}
+	return name, hint, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnitArgs(t *testing.T) {
+	fs := flag.NewFlagSet("gclpr", flag.ContinueOnError)
+	fs.Int("port", 2850, "")
+	fs.Bool("daemon", false, "")
+	fs.Bool("debug", false, "")
+	fs.Duration("timeout", time.Minute, "")
+	fs.String("worker-status-addr", "", "")
+	if err := fs.Parse([]string{"-port", "3000", "-daemon", "-timeout", "2m", "-worker-status-addr", "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := unitArgs(fs)
+	want := []string{"-port=3000", "-timeout=2m0s", "server"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unitArgs = %q, want %q", got, want)
+	}
+}
+
+func TestSystemdUnit(t *testing.T) {
+	unit := systemdUnit("/opt/my tools/gclpr", []string{"-line-ending=100%", "server"})
+	if !strings.Contains(unit, "\nType=notify\n") {
+		t.Fatalf("unit does not use readiness notification:\n%s", unit)
+	}
+	if !strings.Contains(unit, "\nExecStart=\"/opt/my tools/gclpr\" -line-ending=100%% server\n") {
+		t.Fatalf("unexpected ExecStart:\n%s", unit)
+	}
+}
+
+func TestSystemdQuote(t *testing.T) {
+	tests := map[string]string{
+		"plain":      "plain",
+		"":           `""`,
+		"a b":        `"a b"`,
+		`say "hi"`:   `"say \"hi\""`,
+		"$HOME":      "$$HOME",
+		`back\slash`: `"back\\slash"`,
+	}
+	for in, want := range tests {
+		if got := systemdQuote(in); got != want {
+			t.Errorf("systemdQuote(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestLaunchdPlist(t *testing.T) {
+	plist := launchdPlist("/usr/local/bin/gclpr", []string{"-line-ending=<LF>", "server"})
+	for _, want := range []string{
+		"<string>" + launchdLabel + "</string>",
+		"\t\t<string>/usr/local/bin/gclpr</string>\n\t\t<string>-line-ending=&lt;LF&gt;</string>\n\t\t<string>server</string>\n",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Fatalf("plist does not contain %q:\n%s", want, plist)
+		}
+	}
+}
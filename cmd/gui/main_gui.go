@@ -29,10 +29,18 @@ var (
 	aUnlocked   bool
 	aDebug      bool
 	aIOTimeout  time.Duration
+	aMaxSize    int64
+	aCompress   string
+	aCompressAt int
+	codecs      []string
+	aLemonade   int
+	aLemonadeCO bool
+	aMetrics    int
 	usageString string
 	lock        int32
 	clipCancel  context.CancelFunc
 	clipCtx     context.Context
+	clipDone    chan struct{}
 	title       = "gclpr-gui"
 	tooltip     = "Notification tray wrapper for gclpr"
 	cli         = flag.NewFlagSet(title, flag.ContinueOnError)
@@ -80,8 +88,9 @@ func onSession(e systray.SessionEvent) {
 
 // onExit is called when the systray is shutting down; it cancels the clipboard server.
 func onExit() {
-	// stop servicing clipboard and uri requests
+	// stop servicing clipboard and uri requests, let in-flight ones finish
 	clipCancel()
+	<-clipDone
 	log.Print("Exiting systray")
 }
 
@@ -93,7 +102,7 @@ func clipStart() error {
 		return fmt.Errorf("unable to get user directory: %w", err)
 	}
 
-	pkeys, err := util.ReadTrustedKeys(home)
+	pkeys, info, err := util.ReadTrustedKeysInfo(home)
 	if err != nil {
 		return err
 	}
@@ -104,12 +113,30 @@ func clipStart() error {
 	}
 
 	clipCtx, clipCancel = context.WithCancel(context.Background())
+	clipDone = make(chan struct{})
 	go func() {
+		defer close(clipDone)
 		locked := &lock
 		if aUnlocked {
 			locked = nil // ignore session messages
 		}
-		if err := server.Serve(clipCtx, aPort, aLE, pkeys, misc.Magic(), locked, aIOTimeout); err != nil {
+		opts := server.Options{
+			Port:              aPort,
+			LineEnding:        aLE,
+			TrustedKeys:       pkeys,
+			Magic:             misc.Magic(),
+			Locked:            locked,
+			IOTimeout:         aIOTimeout,
+			MaxClipboardSize:  aMaxSize,
+			Compression:       codecs,
+			CompressThreshold: aCompressAt,
+			LemonadePort:      aLemonade,
+			LemonadeCopyOnly:  aLemonadeCO,
+			MetricsPort:       aMetrics,
+			KeyInfo:           info,
+			Version:           misc.Version(),
+		}
+		if err := server.Serve(clipCtx, opts); err != nil {
 			log.Printf("gclpr serve() returned error: %s", err.Error())
 		}
 	}()
@@ -140,13 +167,19 @@ Options:
 
 func main() {
 
-	util.NewLogWriter(title, 0, false)
+	util.NewLogWriter(title, false)
 
 	cli.BoolVar(&aHelp, "h", false, "Show help")
 	cli.BoolVar(&aHelp, "help", false, "Show help")
 	cli.IntVar(&aPort, "port", server.DefaultPort, "TCP port number")
 	cli.StringVar(&aLE, "line-ending", "", "Convert Line Endings (LF/CRLF)")
 	cli.DurationVar(&aIOTimeout, "timeout", server.DefaultIOTimeout, "Read/write I/O timeout")
+	cli.Int64Var(&aMaxSize, "max-size", server.DefaultMaxClipboardSize, "Maximum clipboard payload size in bytes")
+	cli.StringVar(&aCompress, "compress", util.DefaultCodecs, "Compression codecs server agrees to use (zstd,gzip or none)")
+	cli.IntVar(&aCompressAt, "compress-threshold", util.DefaultCompressThreshold, "Smallest payload size in bytes to compress")
+	cli.IntVar(&aLemonade, "lemonade-port", 0, fmt.Sprintf("Enable lemonade compatible listener on this TCP port, lemonade uses %d", server.DefaultLemonadePort))
+	cli.BoolVar(&aLemonadeCO, "lemonade-copy-only", false, "Only accept copy requests on lemonade listener")
+	cli.IntVar(&aMetrics, "metrics-port", 0, "Serve Prometheus metrics on this loopback TCP port")
 	cli.BoolVar(&aUnlocked, "ignore-session-lock", false, "Continue to access clipboard inside locked session")
 	cli.BoolVar(&aDebug, "debug", false, "Print debugging information")
 
@@ -162,7 +195,13 @@ func main() {
 		os.Exit(0)
 	}
 
-	util.NewLogWriter(title, 0, aDebug)
+	util.NewLogWriter(title, aDebug)
+
+	var err error
+	if codecs, err = util.ParseCodecs(aCompress); err != nil {
+		util.ShowOKMessage(util.MsgError, title, err.Error())
+		os.Exit(1)
+	}
 
 	if !aUnlocked {
 		locked, err := currentSessionLocked()
@@ -0,0 +1,166 @@
+// Package logind follows lock state of login session over D-Bus.
+package logind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	loginService     = "org.freedesktop.login1"
+	loginPath        = dbus.ObjectPath("/org/freedesktop/login1")
+	managerInterface = "org.freedesktop.login1.Manager"
+	sessionInterface = "org.freedesktop.login1.Session"
+	userInterface    = "org.freedesktop.login1.User"
+	propsInterface   = "org.freedesktop.DBus.Properties"
+	lockedHint       = "LockedHint"
+)
+
+// SystemBusAddress returns address of system message bus.
+func SystemBusAddress() string {
+	if addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); addr != "" {
+		return addr
+	}
+	return "unix:path=/var/run/dbus/system_bus_socket"
+}
+
+// Watch reports lock state of login session this process belongs to until ctx is cancelled or connection
+// to message bus at address is lost. Current state is reported first, onChange is called from the same
+// goroutine every time state may have changed. Processes started outside of session (i.e. by systemd user
+// manager) follow graphical session of the user.
+func Watch(ctx context.Context, address string, onChange func(locked bool)) error {
+	// connection is closed when ctx is cancelled
+	c, err := dbus.Dial(address, dbus.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("unable to connect to message bus: %w", err)
+	}
+	defer c.Close()
+	if err := c.Auth(nil); err != nil {
+		return fmt.Errorf("unable to connect to message bus: %w", err)
+	}
+	if err := c.Hello(); err != nil {
+		return fmt.Errorf("unable to connect to message bus: %w", err)
+	}
+
+	session, err := findSession(ctx, c)
+	if err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 16)
+	c.Signal(signals)
+	if err := c.AddMatchSignalContext(ctx, dbus.WithMatchSender(loginService), dbus.WithMatchObjectPath(session)); err != nil {
+		return fmt.Errorf("unable to subscribe to session signals: %w", err)
+	}
+	locked, err := lockedHintOf(ctx, c, session)
+	if err != nil {
+		return err
+	}
+	onChange(locked)
+
+	for {
+		var m *dbus.Signal
+		select {
+		case <-ctx.Done():
+			return nil
+		case m = <-signals:
+		}
+		if m == nil {
+			// signal channel is closed along with connection
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.New("message bus connection is lost")
+		}
+		if m.Path != session {
+			continue
+		}
+		switch m.Name {
+		case sessionInterface + ".Lock":
+			onChange(true)
+		case sessionInterface + ".Unlock":
+			onChange(false)
+		case propsInterface + ".PropertiesChanged":
+			var (
+				iface       string
+				changed     map[string]dbus.Variant
+				invalidated []string
+			)
+			if dbus.Store(m.Body, &iface, &changed, &invalidated) != nil || iface != sessionInterface {
+				continue
+			}
+			if v, ok := changed[lockedHint]; ok {
+				if locked, ok := v.Value().(bool); ok {
+					onChange(locked)
+				}
+				continue
+			}
+			if slices.Contains(invalidated, lockedHint) {
+				if locked, err = lockedHintOf(ctx, c, session); err != nil {
+					return err
+				}
+				onChange(locked)
+			}
+		}
+	}
+}
+
+// findSession returns object path of session to follow.
+func findSession(ctx context.Context, c *dbus.Conn) (dbus.ObjectPath, error) {
+	manager := c.Object(loginService, loginPath)
+	var session dbus.ObjectPath
+	if id := os.Getenv("XDG_SESSION_ID"); id != "" {
+		if err := manager.CallWithContext(ctx, managerInterface+".GetSession", 0, id).Store(&session); err == nil {
+			return session, nil
+		}
+	}
+	err := manager.CallWithContext(ctx, managerInterface+".GetSessionByPID", 0, uint32(os.Getpid())).Store(&session)
+	if err == nil {
+		return session, nil
+	}
+	var derr dbus.Error
+	if !errors.As(err, &derr) {
+		return "", err
+	}
+
+	// not in session, use graphical session of the user
+	var user dbus.ObjectPath
+	if err := manager.CallWithContext(ctx, managerInterface+".GetUser", 0, uint32(os.Getuid())).Store(&user); err != nil {
+		return "", fmt.Errorf("unable to find login session: %w", err)
+	}
+	v, err := property(ctx, c, user, userInterface, "Display")
+	if err != nil {
+		return "", err
+	}
+	// Display is (so): session id and path, path is "/" when there is no graphical session
+	if display, ok := v.([]any); ok && len(display) == 2 {
+		if path, ok := display[1].(dbus.ObjectPath); ok && path != "/" {
+			return path, nil
+		}
+	}
+	return "", errors.New("unable to find login session: user has no graphical session")
+}
+
+func property(ctx context.Context, c *dbus.Conn, path dbus.ObjectPath, iface, name string) (any, error) {
+	var v dbus.Variant
+	if err := c.Object(loginService, path).CallWithContext(ctx, propsInterface+".Get", 0, iface, name).Store(&v); err != nil {
+		return nil, fmt.Errorf("unable to get %s of %s: %w", name, path, err)
+	}
+	return v.Value(), nil
+}
+
+func lockedHintOf(ctx context.Context, c *dbus.Conn, session dbus.ObjectPath) (bool, error) {
+	v, err := property(ctx, c, session, sessionInterface, lockedHint)
+	if err != nil {
+		return false, err
+	}
+	locked, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected %s value %v", lockedHint, v)
+	}
+	return locked, nil
+}
@@ -0,0 +1,250 @@
+package logind
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeBus is private bus stand-in playing both message bus daemon and logind.
+type fakeBus struct {
+	t       *testing.T
+	addr    string
+	session dbus.ObjectPath
+	// inSession when false makes GetSessionByPID fail, so user Display is used
+	inSession bool
+
+	mu     sync.Mutex
+	locked bool
+	conn   net.Conn
+	calls  []string
+}
+
+func startFakeBus(t *testing.T, locked, inSession bool) *fakeBus {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "bus")
+	l, err := net.Listen("unix", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b := &fakeBus{t: t, addr: "unix:path=" + name, session: "/org/freedesktop/login1/session/_31", inSession: inSession, locked: locked}
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { c.Close() })
+		b.serve(c)
+	}()
+	return b
+}
+
+func (b *fakeBus) serve(c net.Conn) {
+	br := bufio.NewReader(c)
+	if nul, err := br.ReadByte(); err != nil || nul != 0 {
+		return
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.TrimSpace(line); {
+		case cmd == "AUTH EXTERNAL" || strings.HasPrefix(cmd, "AUTH EXTERNAL "):
+			c.Write([]byte("OK 0123456789abcdef0123456789abcdef\r\n"))
+		case cmd == "NEGOTIATE_UNIX_FD":
+			c.Write([]byte("ERROR\r\n"))
+		case cmd == "BEGIN":
+			b.mu.Lock()
+			b.conn = c
+			b.mu.Unlock()
+			b.reply(br)
+			return
+		default:
+			c.Write([]byte("REJECTED EXTERNAL\r\n"))
+		}
+	}
+}
+
+// reply answers method calls once client is authenticated.
+func (b *fakeBus) reply(br *bufio.Reader) {
+	for {
+		m, err := dbus.DecodeMessage(br)
+		if err != nil {
+			return
+		}
+		member, _ := m.Headers[dbus.FieldMember].Value().(string)
+		b.mu.Lock()
+		b.calls = append(b.calls, member)
+		locked := b.locked
+		b.mu.Unlock()
+
+		var body []any
+		errName := ""
+		switch member {
+		case "Hello":
+			body = []any{":1.42"}
+		case "AddMatch":
+		case "GetSession":
+			body = []any{b.session}
+		case "GetSessionByPID":
+			if !b.inSession {
+				errName = "org.freedesktop.login1.NoSessionForPID"
+				body = []any{"PID does not belong to any known session"}
+				break
+			}
+			body = []any{b.session}
+		case "GetUser":
+			body = []any{dbus.ObjectPath("/org/freedesktop/login1/user/_1000")}
+		case "Get":
+			switch m.Body[1] {
+			case lockedHint:
+				body = []any{dbus.MakeVariant(locked)}
+			case "Display":
+				// struct makes it (so), slice would be av
+				body = []any{dbus.MakeVariant(struct {
+					ID   string
+					Path dbus.ObjectPath
+				}{"31", b.session})}
+			}
+		default:
+			errName = "org.freedesktop.DBus.Error.UnknownMethod"
+		}
+		reply := &dbus.Message{Type: dbus.TypeMethodReply, Headers: map[dbus.HeaderField]dbus.Variant{
+			dbus.FieldReplySerial: dbus.MakeVariant(m.Serial()),
+		}, Body: body}
+		if errName != "" {
+			reply.Type, reply.Headers[dbus.FieldErrorName] = dbus.TypeError, dbus.MakeVariant(errName)
+		}
+		b.send(reply)
+	}
+}
+
+func (b *fakeBus) send(m *dbus.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m.Headers[dbus.FieldSender] = dbus.MakeVariant(":1.1")
+	if len(m.Body) > 0 {
+		m.Headers[dbus.FieldSignature] = dbus.MakeVariant(dbus.SignatureOf(m.Body...))
+	}
+	if err := m.EncodeTo(b.conn, binary.LittleEndian); err != nil {
+		b.t.Errorf("encode: %v", err)
+	}
+}
+
+// signal sends signal of session object.
+func (b *fakeBus) signal(iface, member string, body ...any) {
+	b.send(&dbus.Message{Type: dbus.TypeSignal, Headers: map[dbus.HeaderField]dbus.Variant{
+		dbus.FieldPath:      dbus.MakeVariant(b.session),
+		dbus.FieldInterface: dbus.MakeVariant(iface),
+		dbus.FieldMember:    dbus.MakeVariant(member),
+	}, Body: body})
+}
+
+func (b *fakeBus) setLocked(locked bool) {
+	b.mu.Lock()
+	b.locked = locked
+	b.mu.Unlock()
+}
+
+func watchBus(t *testing.T, b *fakeBus) (<-chan bool, context.CancelFunc, <-chan error) {
+	t.Helper()
+	states := make(chan bool, 8)
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		errs <- Watch(ctx, b.addr, func(locked bool) { states <- locked })
+	}()
+	t.Cleanup(cancel)
+	return states, cancel, errs
+}
+
+func expectState(t *testing.T, states <-chan bool, want bool) {
+	t.Helper()
+	select {
+	case got := <-states:
+		if got != want {
+			t.Fatalf("locked = %v, want %v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for locked = %v", want)
+	}
+}
+
+func TestWatchSession(t *testing.T) {
+	t.Setenv("XDG_SESSION_ID", "31")
+	b := startFakeBus(t, true, true)
+	states, cancel, errs := watchBus(t, b)
+
+	expectState(t, states, true)
+	b.signal(propsInterface, "PropertiesChanged", sessionInterface, map[string]dbus.Variant{lockedHint: dbus.MakeVariant(false)}, []string{})
+	expectState(t, states, false)
+	b.signal(sessionInterface, "Lock")
+	expectState(t, states, true)
+	b.signal(sessionInterface, "Unlock")
+	expectState(t, states, false)
+
+	// invalidated property is queried again
+	b.setLocked(true)
+	b.signal(propsInterface, "PropertiesChanged", sessionInterface, map[string]dbus.Variant{}, []string{lockedHint})
+	expectState(t, states, true)
+
+	// unrelated properties are ignored
+	b.signal(propsInterface, "PropertiesChanged", sessionInterface, map[string]dbus.Variant{"IdleHint": dbus.MakeVariant(true)}, []string{})
+	b.signal(sessionInterface, "Unlock")
+	expectState(t, states, false)
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+}
+
+func TestWatchUserDisplay(t *testing.T) {
+	t.Setenv("XDG_SESSION_ID", "")
+	b := startFakeBus(t, false, false)
+	states, _, _ := watchBus(t, b)
+
+	expectState(t, states, false)
+	b.mu.Lock()
+	calls := strings.Join(b.calls, ",")
+	b.mu.Unlock()
+	if calls != "Hello,GetSessionByPID,GetUser,Get,AddMatch,Get" {
+		t.Fatalf("calls = %s", calls)
+	}
+}
+
+func TestWatchBusLost(t *testing.T) {
+	t.Setenv("XDG_SESSION_ID", "31")
+	b := startFakeBus(t, false, true)
+	states, _, errs := watchBus(t, b)
+
+	expectState(t, states, false)
+	b.mu.Lock()
+	b.conn.Close()
+	b.mu.Unlock()
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "connection is lost") {
+			t.Fatalf("Watch err = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watch did not notice lost connection")
+	}
+}
+
+func TestWatchNoBus(t *testing.T) {
+	err := Watch(context.Background(), "unix:path="+filepath.Join(t.TempDir(), "missing"), func(bool) {})
+	if err == nil {
+		t.Fatal("expected error without message bus")
+	}
+}
@@ -0,0 +1,336 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/idna"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+const (
+	// DefaultApprovalTimeout is how long request waits for answer before it is denied.
+	DefaultApprovalTimeout = 30 * time.Second
+	// DefaultApprovalRemember is how long remembered answer lets key repeat operation without asking.
+	DefaultApprovalRemember = 5 * time.Minute
+)
+
+// ApprovalOptions configures confirmation of operations keys have approve attribute for.
+type ApprovalOptions struct {
+	// Timeout is how long request waits for answer, DefaultApprovalTimeout is used when not set.
+	Timeout time.Duration
+	// Remember is how long remembered answer is valid, DefaultApprovalRemember is used when not set.
+	Remember time.Duration
+	// Input and Output when set are terminal server asks on, answers are read line by line. Dashboard
+	// asks as well when it is enabled.
+	Input  io.Reader
+	Output io.Writer
+}
+
+// approvalAnswer is decision on pending request.
+type approvalAnswer int
+
+const (
+	approvalDeny approvalAnswer = iota
+	approvalAllow
+	approvalRemember
+)
+
+// approvalRequest is operation waiting for answer.
+type approvalRequest struct {
+	ID       string
+	Op       string
+	Key      string
+	Label    string
+	Origin   []string // previous hops when request came through relay, original client first
+	Detail   string   // what operation does, safe to show on terminal
+	Created  time.Time
+	Deadline time.Time
+
+	key    [32]byte
+	answer chan approvalAnswer
+}
+
+// who names key which asks for approval along with original client of relayed request.
+func (r *approvalRequest) who() string {
+	who := "[" + r.Key[:8] + "]"
+	if r.Label != "" {
+		who = fmt.Sprintf("%q [%s]", r.Label, r.Key[:8])
+	}
+	if len(r.Origin) > 0 {
+		who += " on behalf of [" + r.Origin[0][:8] + "]"
+	}
+	return who
+}
+
+// approvalVerbs describe operations in prompts.
+var approvalVerbs = map[string]string{
+	util.ApprovePaste:  "read clipboard",
+	util.ApproveOpen:   "open",
+	util.ApproveTunnel: "open tunnel for",
+}
+
+type rememberKey struct {
+	key    [32]byte
+	origin string // original client of relayed request
+	op     string
+}
+
+// approver holds operations which need confirmation until they are answered on terminal or dashboard.
+// Nil approver approves everything.
+type approver struct {
+	info     map[[32]byte]util.KeyInfo
+	timeout  time.Duration
+	remember time.Duration
+	now      func() time.Time
+	events   *events
+
+	notifier
+	mu         sync.Mutex
+	pending    []*approvalRequest // oldest first
+	remembered map[rememberKey]time.Time
+}
+
+// newApprover returns nil when no key needs approval for anything.
+func newApprover(info map[[32]byte]util.KeyInfo, opts ApprovalOptions) *approver {
+	needed := false
+	for _, ki := range info {
+		needed = needed || len(ki.Approve) > 0
+	}
+	if !needed {
+		return nil
+	}
+	return &approver{
+		info:       info,
+		timeout:    cmp.Or(opts.Timeout, DefaultApprovalTimeout),
+		remember:   cmp.Or(opts.Remember, DefaultApprovalRemember),
+		now:        time.Now,
+		remembered: make(map[rememberKey]time.Time),
+	}
+}
+
+// check returns once operation is approved or with error when it is denied. Detail describes operation
+// to whoever answers.
+func (a *approver) check(op string, caller callerInfo, detail string) error {
+	if a == nil || !caller.known || !a.info[caller.key].NeedsApproval(op) {
+		return nil
+	}
+	rk := rememberKey{key: caller.key, origin: strings.Join(caller.origin, ","), op: op}
+	now := a.now()
+	a.mu.Lock()
+	if until, ok := a.remembered[rk]; ok {
+		if now.Before(until) {
+			a.mu.Unlock()
+			return nil
+		}
+		delete(a.remembered, rk)
+	}
+	id, err := randomID()
+	if err != nil {
+		a.mu.Unlock()
+		return fmt.Errorf("unable to create approval request id: %w", err)
+	}
+	req := &approvalRequest{
+		ID: id, Op: op, Key: hex.EncodeToString(caller.key[:]), Label: a.info[caller.key].Label, Origin: caller.origin, Detail: sanitize(detail),
+		Created: now, Deadline: now.Add(a.timeout), key: caller.key, answer: make(chan approvalAnswer, 1),
+	}
+	a.pending = append(a.pending, req)
+	a.mu.Unlock()
+	a.notify()
+
+	log := requestLogger(util.SubsysRPC, caller.req)
+	log.Infof("Waiting for approval of %s by key %s: %s", op, req.who(), req.Detail)
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+
+	var (
+		ans     approvalAnswer
+		timeout bool
+	)
+	select {
+	case ans = <-req.answer:
+	case <-timer.C:
+		// answer may arrive at the same time
+		if timeout = a.drop(req.ID) != nil; !timeout {
+			ans = <-req.answer
+		}
+	}
+	outcome := [...]string{approvalDeny: "denied", approvalAllow: "allowed", approvalRemember: "remembered"}[ans]
+	if timeout {
+		outcome = "timeout"
+	}
+	a.events.record(auditRecord{Event: "approval", Method: op, Outcome: outcome}, caller)
+	log.Infof("Approval of %s by key %s: %s", op, req.who(), outcome)
+	switch {
+	case timeout:
+		return fmt.Errorf("%s was not approved in %s", op, a.timeout)
+	case ans == approvalDeny:
+		return fmt.Errorf("%s was denied on server", op)
+	}
+	return nil
+}
+
+// answer decides pending request, it returns false when request is not pending anymore.
+func (a *approver) answer(id string, ans approvalAnswer) bool {
+	req := a.drop(id)
+	if req == nil {
+		return false
+	}
+	if ans == approvalRemember {
+		a.mu.Lock()
+		a.remembered[rememberKey{key: req.key, origin: strings.Join(req.Origin, ","), op: req.Op}] = a.now().Add(a.remember)
+		a.mu.Unlock()
+	}
+	req.answer <- ans
+	return true
+}
+
+// drop removes request from pending ones and returns it.
+func (a *approver) drop(id string) *approvalRequest {
+	a.mu.Lock()
+	i := slices.IndexFunc(a.pending, func(r *approvalRequest) bool { return r.ID == id })
+	if i < 0 {
+		a.mu.Unlock()
+		return nil
+	}
+	req := a.pending[i]
+	a.pending = slices.Delete(a.pending, i, i+1)
+	a.mu.Unlock()
+	a.notify()
+	return req
+}
+
+// list returns pending requests, oldest first.
+func (a *approver) list() []approvalRequest {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := make([]approvalRequest, 0, len(a.pending))
+	for _, r := range a.pending {
+		res = append(res, *r)
+	}
+	return res
+}
+
+// serveTerminal asks about pending requests one at a time on terminal until ctx is done or input ends.
+func (a *approver) serveTerminal(ctx context.Context, in io.Reader, out io.Writer) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(in)
+		for sc.Scan() {
+			select {
+			case lines <- strings.TrimSpace(sc.Text()):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	changed, stop := a.watch()
+	defer stop()
+
+	shown := "" // request prompt is shown for
+	for {
+		if pending := a.list(); len(pending) == 0 {
+			shown = ""
+		} else if r := pending[0]; r.ID != shown {
+			shown = r.ID
+			fmt.Fprintf(out, "\ngclpr: key %s asks to %s\n", r.who(), approvalVerbs[r.Op])
+			if r.Detail != "" {
+				fmt.Fprintf(out, "  %s\n", r.Detail)
+			}
+			fmt.Fprintf(out, "Allow? [y]es, [n]o, [r]emember for %s (denied in %s): ", a.remember, time.Until(r.Deadline).Round(time.Second))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			if shown == "" {
+				continue
+			}
+			var ans approvalAnswer
+			switch strings.ToLower(line) {
+			case "y", "yes":
+				ans = approvalAllow
+			case "r", "remember":
+				ans = approvalRemember
+			case "n", "no":
+				ans = approvalDeny
+			default:
+				fmt.Fprint(out, "Please answer y, n or r: ")
+				continue
+			}
+			if !a.answer(shown, ans) {
+				fmt.Fprintln(out, "Request is not pending anymore")
+			}
+			shown = ""
+		}
+	}
+}
+
+// describeURL shows URL the way person answering has to see it: decoded, with international host names
+// shown both in Unicode and in punycode, so look-alike hosts stand out.
+func describeURL(u *url.URL) string {
+	host := u.Hostname()
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		ascii = host
+	}
+	unicodeHost, err := idna.Display.ToUnicode(ascii)
+	if err != nil {
+		unicodeHost = host
+	}
+	s := u.Scheme + ":"
+	if u.Opaque != "" {
+		s += u.Opaque
+	} else {
+		if u.Host != "" {
+			s += "//" + unicodeHost
+			if strings.Contains(unicodeHost, ":") {
+				s = u.Scheme + "://[" + unicodeHost + "]"
+			}
+			if port := u.Port(); port != "" {
+				s += ":" + port
+			}
+		}
+		s += u.Path
+	}
+	if u.RawQuery != "" {
+		q, err := url.QueryUnescape(u.RawQuery)
+		if err != nil {
+			q = u.RawQuery
+		}
+		s += "?" + q
+	}
+	if ascii != unicodeHost {
+		s += " (host " + ascii + ")"
+	}
+	return s
+}
+
+// sanitize replaces characters which are not printable, i.e. terminal escapes and direction overrides.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return '?'
+	}, s)
+}
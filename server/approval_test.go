@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// syncBuffer collects terminal output written by prompter goroutine.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) waitFor(t *testing.T, s string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		b.mu.Lock()
+		found := strings.Count(b.b.String(), s) >= n
+		b.mu.Unlock()
+		if found {
+			return
+		}
+	}
+	t.Fatalf("terminal did not show %q %d times:\n%s", s, n, b.b.String())
+}
+
+func TestApprovalTerminal(t *testing.T) {
+	key, plain := [32]byte{1}, [32]byte{2}
+	a := newApprover(map[[32]byte]util.KeyInfo{key: {Label: "vm", Approve: []string{util.ApprovePaste, util.ApproveOpen}}, plain: {}}, ApprovalOptions{})
+	in, answers := io.Pipe()
+	var out syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.serveTerminal(ctx, in, &out)
+
+	caller := callerInfo{key: key, known: true}
+	if err := a.check(util.ApprovePaste, callerInfo{key: plain, known: true}, ""); err != nil {
+		t.Fatalf("key without approve attribute: %v", err)
+	}
+	if err := a.check(util.ApproveTunnel, caller, "https://example.com"); err != nil {
+		t.Fatalf("operation key does not need approval for: %v", err)
+	}
+
+	prompts := 0
+	ask := func(op, detail, answer string) error {
+		t.Helper()
+		res := make(chan error, 1)
+		go func() { res <- a.check(op, caller, detail) }()
+		prompts++
+		out.waitFor(t, "Allow?", prompts)
+		io.WriteString(answers, answer+"\n")
+		return <-res
+	}
+	if err := ask(util.ApproveOpen, "https://example.com", "y"); err != nil {
+		t.Fatalf("allowed: %v", err)
+	}
+	if err := ask(util.ApproveOpen, "https://example.com", "n"); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("denied: %v", err)
+	}
+	if err := ask(util.ApprovePaste, "", "r"); err != nil {
+		t.Fatalf("remembered: %v", err)
+	}
+	// remembered answer is not asked again, other operations still are
+	if err := a.check(util.ApprovePaste, caller, ""); err != nil {
+		t.Fatalf("remembered paste: %v", err)
+	}
+	if err := ask(util.ApproveOpen, "https://example.com", "yes"); err != nil {
+		t.Fatalf("open after remembered paste: %v", err)
+	}
+	if !strings.Contains(out.b.String(), `key "vm" [01000000] asks to open`) {
+		t.Fatalf("prompt does not name key:\n%s", out.b.String())
+	}
+}
+
+func TestApprovalTimeout(t *testing.T) {
+	key := [32]byte{1}
+	a := newApprover(map[[32]byte]util.KeyInfo{key: {Approve: []string{util.ApproveOpen}}}, ApprovalOptions{Timeout: 50 * time.Millisecond})
+	err := a.check(util.ApproveOpen, callerInfo{key: key, known: true}, "https://example.com")
+	if err == nil || !strings.Contains(err.Error(), "not approved in 50ms") {
+		t.Fatalf("err = %v", err)
+	}
+	if pending := a.list(); len(pending) != 0 {
+		t.Fatalf("timed out request is still pending: %+v", pending)
+	}
+	if newApprover(map[[32]byte]util.KeyInfo{key: {Label: "x"}}, ApprovalOptions{}) != nil {
+		t.Fatal("approver is not needed when no key asks for it")
+	}
+}
+
+func TestDescribeURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://example.com/path":                      "https://example.com/path",
+		"https://xn--bcher-kva.example/a%20b?q=%41":     "https://bücher.example/a b?q=A (host xn--bcher-kva.example)",
+		"https://bücher.example:8443/":                  "https://bücher.example:8443/ (host xn--bcher-kva.example)",
+		"https://xn--80ak6aa92e.com/login":              "https://аррӏе.com/login (host xn--80ak6aa92e.com)",
+		"http://[::1]:8080/cb":                          "http://[::1]:8080/cb",
+		"mailto:someone@example.com":                    "mailto:someone@example.com",
+		"https://user@evil.example/?next=%0d%0a%1b[31m": "https://evil.example/?next=\r\n\x1b[31m",
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := describeURL(u); got != want {
+			t.Errorf("describeURL(%q) = %q, want %q", raw, got, want)
+		}
+	}
+	if got := sanitize("a\r\n\x1b[31m‮b"); got != "a???[31m?b" {
+		t.Errorf("sanitize = %q", got)
+	}
+}
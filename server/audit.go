@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// auditRecord is single line of audit log.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Listener string    `json:"listener,omitempty"`
+	Method   string    `json:"method,omitempty"`
+	Outcome  string    `json:"outcome,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // seconds
+	Reason   string    `json:"reason,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	Request  string    `json:"req,omitempty"`
+	Origin   []string  `json:"origin,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	URL      string    `json:"url,omitempty"`
+}
+
+// auditLog writes JSON line for every request, authentication failure and tunnel session. Nil auditLog
+// ignores everything.
+type auditLog struct {
+	info map[[32]byte]util.KeyInfo
+	now  func() time.Time
+
+	mu     sync.Mutex
+	w      io.Writer
+	failed bool // write error was reported already
+}
+
+func newAuditLog(w io.Writer, info map[[32]byte]util.KeyInfo) *auditLog {
+	if w == nil {
+		return nil
+	}
+	return &auditLog{info: info, now: time.Now, w: w}
+}
+
+func (a *auditLog) write(r auditRecord, caller callerInfo) {
+	if a == nil {
+		return
+	}
+	r.Time = a.now()
+	r.identify(caller, a.info)
+	data, err := json.Marshal(r)
+	if err != nil {
+		serverLog.Errorf("Unable to encode audit record: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(data, '\n')); err != nil && !a.failed {
+		a.failed = true
+		serverLog.Errorf("Unable to write audit log: %v", err)
+	}
+}
+
+// identify fills caller fields of record.
+func (r *auditRecord) identify(caller callerInfo, info map[[32]byte]util.KeyInfo) {
+	if caller.known {
+		r.Key = hex.EncodeToString(caller.key[:])
+		r.Label = info[caller.key].Label
+	}
+	r.Request, r.Origin = caller.req, caller.origin
+}
+
+// redactURL drops query and fragment which may carry secrets, i.e. OAuth state.
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	r := *u
+	r.RawQuery, r.Fragment, r.RawFragment, r.User = "", "", "", nil
+	return r.String()
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atotto/clipboard"
+)
+
+// ClipboardBackend is where Clipboard keeps text.
+type ClipboardBackend interface {
+	// Name is reported by server status.
+	Name() string
+	Read() (string, error)
+	Write(text string) error
+}
+
+// TypedClipboardBackend is backend which keeps content of other MIME types than plain text.
+type TypedClipboardBackend interface {
+	ClipboardBackend
+	// Types lists MIME types clipboard content is offered as.
+	Types() ([]string, error)
+	ReadType(mime string) ([]byte, error)
+	WriteType(mime string, data []byte) error
+}
+
+// SelectionBackend is backend which has X PRIMARY selection besides clipboard.
+type SelectionBackend interface {
+	ClipboardBackend
+	// Primary returns backend of PRIMARY selection, nil when there is none.
+	Primary() ClipboardBackend
+}
+
+// Selections copy and paste work with, empty selection is clipboard. Backends without PRIMARY selection
+// use clipboard for it.
+const (
+	SelectionClipboard = "clipboard"
+	SelectionPrimary   = "primary"
+	SelectionBoth      = "both"
+)
+
+// MIMEText is type of plain text, every backend keeps it.
+const MIMEText = "text/plain"
+
+// ClipboardBackends lists names NewClipboardBackend accepts.
+var ClipboardBackends = []string{"auto", "windows", "pbcopy", "plan9", "wl-clipboard", "xclip", "xsel", "termux", "wsl", "tmux", "file", "memory"}
+
+// clipboardCommand describes backend which runs clipboard tool for every operation.
+type clipboardCommand struct {
+	read, write []string
+	env         string // environment variable tool needs to reach clipboard
+	trim        string // suffix read command adds to text
+	// types lists offered types, readType and writeType have typeArg in place of MIME type; tools without
+	// them keep only text
+	types, readType, writeType []string
+	// writeConcealed is writeType which tells clipboard managers to skip content, tools without it cannot
+	writeConcealed []string
+	// primary is the same tool working with PRIMARY selection
+	primary *clipboardCommand
+}
+
+// typeArg stands for MIME type in arguments of clipboard tool.
+const typeArg = "{type}"
+
+// clipboardToolTimeout limits single run of clipboard tool, so tool which hangs does not hold clipboard.
+var clipboardToolTimeout = 10 * time.Second
+
+var clipboardCommands = map[string]clipboardCommand{
+	"wl-clipboard": withPrimary(wlClipboard),
+	"xclip":        withPrimary(xclip),
+	"xsel":         withPrimary(xsel),
+	"termux":       {read: []string{"termux-clipboard-get"}, write: []string{"termux-clipboard-set"}},
+	"wsl":          {read: []string{"powershell.exe", "-NoProfile", "-Command", "Get-Clipboard"}, write: []string{"clip.exe"}, trim: "\r\n"},
+	"tmux":         {read: []string{"tmux", "save-buffer", "-"}, write: []string{"tmux", "load-buffer", "-"}},
+}
+
+// withPrimary makes clipboard command of tool which knows about PRIMARY selection.
+func withPrimary(tool func(primary bool) clipboardCommand) clipboardCommand {
+	c, p := tool(false), tool(true)
+	c.primary = &p
+	return c
+}
+
+func wlClipboard(primary bool) clipboardCommand {
+	var sel []string
+	if primary {
+		sel = []string{"--primary"}
+	}
+	paste := func(args ...string) []string { return slices.Concat([]string{"wl-paste"}, sel, args) }
+	set := func(args ...string) []string { return slices.Concat([]string{"wl-copy"}, sel, args) }
+	return clipboardCommand{read: paste("--no-newline"), write: set(), env: "WAYLAND_DISPLAY",
+		types: paste("--list-types"), readType: paste("--no-newline", "--type", typeArg), writeType: set("--type", typeArg),
+		writeConcealed: set("--sensitive", "--type", typeArg)}
+}
+
+func xclip(primary bool) clipboardCommand {
+	sel := SelectionClipboard
+	if primary {
+		sel = SelectionPrimary
+	}
+	run := func(args ...string) []string {
+		return slices.Concat([]string{"xclip", args[0], "-selection", sel}, args[1:])
+	}
+	return clipboardCommand{read: run("-out"), write: run("-in"), env: "DISPLAY",
+		types: run("-out", "-target", "TARGETS"), readType: run("-out", "-target", typeArg), writeType: run("-in", "-target", typeArg)}
+}
+
+func xsel(primary bool) clipboardCommand {
+	sel := "--clipboard"
+	if primary {
+		sel = "--primary"
+	}
+	return clipboardCommand{read: []string{"xsel", "--output", sel}, write: []string{"xsel", "--input", sel}, env: "DISPLAY"}
+}
+
+// systemClipboards are backends of clipboard package by operating system they are available on.
+var systemClipboards = map[string]string{"windows": "windows", "pbcopy": "darwin", "plan9": "plan9"}
+
+// NewClipboardBackend returns backend by name, "auto" or empty name picks the first available of system
+// clipboard, wl-clipboard, xclip, xsel, termux, wsl and tmux (when server runs inside tmux), it is an error
+// when none is. File is where file backend keeps text.
+func NewClipboardBackend(name, file string) (ClipboardBackend, error) {
+	switch name {
+	case "", "auto":
+		return detectClipboardBackend()
+	case "memory":
+		return &memoryBackend{}, nil
+	case "file":
+		if file == "" {
+			return nil, errors.New("file clipboard backend needs file name")
+		}
+		return &fileBackend{path: file}, nil
+	}
+	if goos, ok := systemClipboards[name]; ok {
+		if goos != runtime.GOOS {
+			return nil, fmt.Errorf("clipboard backend %q is only available on %s", name, goos)
+		}
+		return systemBackend(name), nil
+	}
+	spec, ok := clipboardCommands[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown clipboard backend %q, expected one of %s", name, strings.Join(ClipboardBackends, ", "))
+	}
+	for _, tool := range []string{spec.read[0], spec.write[0]} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, fmt.Errorf("clipboard backend %q needs %s which is not found in PATH", name, tool)
+		}
+	}
+	if spec.env != "" && os.Getenv(spec.env) == "" {
+		return nil, fmt.Errorf("clipboard backend %q needs %s to be set, server is not running in graphical session", name, spec.env)
+	}
+	return newCommandBackend(name, spec), nil
+}
+
+func newCommandBackend(name string, spec clipboardCommand) ClipboardBackend {
+	b := &commandBackend{name: name, clipboardCommand: spec}
+	switch {
+	case spec.writeConcealed != nil:
+		return &concealedCommandBackend{&typedCommandBackend{b}}
+	case spec.types != nil:
+		return &typedCommandBackend{b}
+	}
+	return b
+}
+
+// detectClipboardBackend follows clipboard package selection, but does not pick X tools without display.
+// When nothing is available error lists why every tool it tried cannot be used.
+func detectClipboardBackend() (ClipboardBackend, error) {
+	for name, goos := range systemClipboards {
+		if goos == runtime.GOOS {
+			return systemBackend(name), nil
+		}
+	}
+	names := []string{"wl-clipboard", "xclip", "xsel", "termux", "wsl"}
+	if os.Getenv("TMUX") != "" {
+		names = append(names, "tmux")
+	}
+	var tried []string
+	for _, name := range names {
+		b, err := NewClipboardBackend(name, "")
+		if err == nil {
+			return b, nil
+		}
+		tried = append(tried, err.Error())
+	}
+	return nil, fmt.Errorf("no clipboard tool is available, use -clipboard-backend to choose backend (memory keeps clipboard in server memory): %s", strings.Join(tried, "; "))
+}
+
+// systemBackend is clipboard package access to clipboard of operating system.
+type systemBackend string
+
+func (b systemBackend) Name() string            { return string(b) }
+func (b systemBackend) Read() (string, error)   { return clipboard.ReadAll() }
+func (b systemBackend) Write(text string) error { return clipboard.WriteAll(text) }
+
+// commandBackend runs clipboard tool for every operation.
+type commandBackend struct {
+	name string
+	clipboardCommand
+}
+
+func (b *commandBackend) Name() string { return b.name }
+
+func (b *commandBackend) Primary() ClipboardBackend {
+	if b.primary == nil {
+		return nil
+	}
+	return newCommandBackend(b.name, *b.primary)
+}
+
+func (b *commandBackend) Read() (string, error) {
+	out, err := b.output(b.read)
+	return strings.TrimSuffix(string(out), b.trim), err
+}
+
+func (b *commandBackend) Write(text string) error {
+	return b.input(b.write, []byte(text))
+}
+
+// output runs tool and returns what it printed.
+func (b *commandBackend) output(args []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clipboardToolTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// children of killed tool may keep its output open
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, b.timedOut(args[0])
+		}
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			return nil, b.fail(args[0], err, string(ee.Stderr))
+		}
+		return nil, b.fail(args[0], err, "")
+	}
+	return out, nil
+}
+
+// input runs tool with data on its stdin.
+func (b *commandBackend) input(args []string, data []byte) error {
+	// tools which keep running to own X selection inherit stderr, pipe would keep Write waiting for them
+	stderr, err := os.CreateTemp("", "gclpr-clipboard-*")
+	if err != nil {
+		return fmt.Errorf("unable to create clipboard tool output file: %w", err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), clipboardToolTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin, cmd.Stderr, cmd.WaitDelay = bytes.NewReader(data), stderr, time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return b.timedOut(args[0])
+		}
+		msg := make([]byte, maxHookOutput)
+		n, _ := stderr.ReadAt(msg, 0)
+		return b.fail(args[0], err, string(msg[:n]))
+	}
+	return nil
+}
+
+// fail names tool and adds the first line it printed on stderr to err.
+func (b *commandBackend) fail(tool string, err error, stderr string) error {
+	if msg, _, _ := strings.Cut(strings.TrimSpace(stderr), "\n"); msg != "" {
+		return fmt.Errorf("%s: %w: %s", tool, err, msg)
+	}
+	return fmt.Errorf("%s: %w", tool, err)
+}
+
+func (b *commandBackend) timedOut(tool string) error {
+	return fmt.Errorf("%s: did not finish in %s and was killed", tool, clipboardToolTimeout)
+}
+
+// typedCommandBackend is commandBackend of tool which knows about MIME types.
+type typedCommandBackend struct {
+	*commandBackend
+}
+
+// Types lists MIME types, X atoms for text are reported as plain text.
+func (b *typedCommandBackend) Types() ([]string, error) {
+	out, err := b.output(b.types)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	text := false
+	for line := range strings.Lines(string(out)) {
+		switch t := strings.TrimSpace(line); {
+		case strings.Contains(t, "/"):
+			if !slices.Contains(res, t) {
+				res = append(res, t)
+			}
+			text = text || sameType(t, MIMEText)
+		case t == "UTF8_STRING" || t == "STRING" || t == "TEXT":
+			if !text {
+				res, text = append(res, MIMEText), true
+			}
+		}
+	}
+	return res, nil
+}
+
+func (b *typedCommandBackend) ReadType(mime string) ([]byte, error) {
+	return b.output(withType(b.readType, mime))
+}
+
+func (b *typedCommandBackend) WriteType(mime string, data []byte) error {
+	return b.input(withType(b.writeType, mime), data)
+}
+
+// concealedCommandBackend is typedCommandBackend of tool which can mark content as secret.
+type concealedCommandBackend struct {
+	*typedCommandBackend
+}
+
+// WriteConcealed marks content as secret, tool which does not know how (wl-copy before 2.2 has no --sensitive)
+// gets it as usual.
+func (b *concealedCommandBackend) WriteConcealed(mime string, data []byte) error {
+	if err := b.input(withType(b.writeConcealed, mime), data); err == nil {
+		return nil
+	}
+	return b.WriteType(mime, data)
+}
+
+// withType puts MIME type into tool arguments.
+func withType(args []string, mime string) []string {
+	res := slices.Clone(args)
+	res[slices.Index(res, typeArg)] = mime
+	return res
+}
+
+// fileBackend keeps text in file readable by owner only, so other processes could share it.
+type fileBackend struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (b *fileBackend) Name() string { return "file" }
+
+func (b *fileBackend) Read() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// Write replaces file at once, readers never see partial text.
+func (b *fileBackend) Write(text string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := os.CreateTemp(filepath.Dir(b.path), "."+filepath.Base(b.path)+".*")
+	if err != nil {
+		return fmt.Errorf("unable to write clipboard file: %w", err)
+	}
+	_, err = f.WriteString(text)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), b.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("unable to write clipboard file: %w", err)
+	}
+	return nil
+}
+
+// memoryBackend keeps content of any type in server process.
+type memoryBackend struct {
+	mu        sync.Mutex
+	mime      string // empty until something is written
+	data      []byte
+	concealed bool
+	primary   *memoryBackend
+}
+
+func (b *memoryBackend) Name() string { return "memory" }
+
+func (b *memoryBackend) Primary() ClipboardBackend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.primary == nil {
+		b.primary = &memoryBackend{}
+	}
+	return b.primary
+}
+
+func (b *memoryBackend) Read() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mime != "" && !sameType(b.mime, MIMEText) {
+		return "", fmt.Errorf("clipboard has %s, not text", b.mime)
+	}
+	return string(b.data), nil
+}
+
+func (b *memoryBackend) Write(text string) error {
+	return b.WriteType(MIMEText, []byte(text))
+}
+
+func (b *memoryBackend) Types() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mime == "" {
+		return nil, nil
+	}
+	if b.concealed {
+		return []string{b.mime, MIMEConcealed}, nil
+	}
+	return []string{b.mime}, nil
+}
+
+func (b *memoryBackend) ReadType(mime string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.concealed && sameType(mime, MIMEConcealed) {
+		return []byte("secret"), nil
+	}
+	if !sameType(b.mime, mime) {
+		return nil, notOffered(mime, []string{b.mime})
+	}
+	return slices.Clone(b.data), nil
+}
+
+func (b *memoryBackend) WriteType(mime string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mime, b.data, b.concealed = mime, slices.Clone(data), false
+	return nil
+}
+
+// WriteConcealed is WriteType of content which also offers MIMEConcealed.
+func (b *memoryBackend) WriteConcealed(mime string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mime, b.data, b.concealed = mime, slices.Clone(data), true
+	return nil
+}
+
+// sameType compares MIME types ignoring their parameters.
+func sameType(a, b string) bool {
+	return mediaType(a) == mediaType(b)
+}
+
+func mediaType(m string) string {
+	if mt, _, err := mime.ParseMediaType(m); err == nil {
+		return mt
+	}
+	return strings.ToLower(strings.TrimSpace(m))
+}
+
+// notOffered is error for type clipboard content is not available as.
+func notOffered(mime string, offered []string) error {
+	offered = slices.DeleteFunc(slices.Clone(offered), func(t string) bool { return t == "" })
+	if len(offered) == 0 {
+		return fmt.Errorf("clipboard has no %s, it is empty", mime)
+	}
+	return fmt.Errorf("clipboard has no %s, it has %s", mime, strings.Join(offered, ", "))
+}
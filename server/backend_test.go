@@ -0,0 +1,221 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTool puts shell script named name on PATH, scripts are the only programs there.
+func fakeTool(t *testing.T, dir, name, script string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake clipboard tools are shell scripts")
+	}
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\nPATH=/usr/bin:/bin\n"+script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+}
+
+func TestCommandBackend(t *testing.T) {
+	dir := t.TempDir()
+	store := filepath.Join(dir, "store")
+	t.Setenv("STORE", store)
+	// arguments are -in|-out -selection clipboard|primary
+	fakeTool(t, dir, "xclip", `
+case "$1" in
+-in) exec cat > "$STORE.$3" ;;
+-out) [ -f "$STORE.$3" ] || { echo "Error: target STRING not available" >&2; exit 1; }; exec cat "$STORE.$3" ;;
+esac
+`)
+	t.Setenv("DISPLAY", "")
+	if _, err := NewClipboardBackend("xclip", ""); err == nil || !strings.Contains(err.Error(), "needs DISPLAY to be set") {
+		t.Fatalf("xclip without display: %v", err)
+	}
+	if _, err := NewClipboardBackend("xsel", ""); err == nil || !strings.Contains(err.Error(), "needs xsel which is not found in PATH") {
+		t.Fatalf("xsel without tool: %v", err)
+	}
+	t.Setenv("DISPLAY", ":0")
+	b, err := NewClipboardBackend("xclip", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(); err == nil || err.Error() != "xclip: exit status 1: Error: target STRING not available" {
+		t.Fatalf("Read empty: %v", err)
+	}
+	if err := b.Write("hello\nworld\n"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if text, err := b.Read(); err != nil || text != "hello\nworld\n" {
+		t.Fatalf("Read = %q, %v", text, err)
+	}
+	if b.Name() != "xclip" {
+		t.Fatalf("name = %q", b.Name())
+	}
+	primary := b.(SelectionBackend).Primary()
+	if err := primary.Write("selected"); err != nil {
+		t.Fatalf("Write primary: %v", err)
+	}
+	if text, err := primary.Read(); err != nil || text != "selected" {
+		t.Fatalf("Read primary = %q, %v", text, err)
+	}
+	if text, _ := b.Read(); text != "hello\nworld\n" {
+		t.Fatalf("primary overwrote clipboard with %q", text)
+	}
+	if tmux, _ := newCommandBackend("tmux", clipboardCommands["tmux"]).(SelectionBackend); tmux.Primary() != nil {
+		t.Fatal("tmux has PRIMARY selection")
+	}
+
+	// tool which hangs is killed
+	fakeTool(t, dir, "xclip", "sleep 10")
+	defer func(d time.Duration) { clipboardToolTimeout = d }(clipboardToolTimeout)
+	clipboardToolTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if _, err := b.Read(); err == nil || !strings.Contains(err.Error(), "xclip: did not finish in 100ms") {
+		t.Fatalf("Read of hanging tool: %v", err)
+	}
+	if err := b.Write("text"); err == nil || !strings.Contains(err.Error(), "xclip: did not finish in 100ms") {
+		t.Fatalf("Write of hanging tool: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("hanging tool took %s", d)
+	}
+}
+
+func TestDetectClipboardBackend(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("detection of clipboard tools")
+	}
+	dir := t.TempDir()
+	fakeTool(t, dir, "tmux", "")
+	t.Setenv("WAYLAND_DISPLAY", "")
+	t.Setenv("DISPLAY", "")
+	t.Setenv("TMUX", "")
+	if b, err := detectClipboardBackend(); err == nil || !strings.Contains(err.Error(), `clipboard backend "xclip" needs xclip which is not found in PATH`) || strings.Contains(err.Error(), "tmux") {
+		t.Fatalf("headless = %v, %v", b, err)
+	}
+	t.Setenv("TMUX", "/tmp/tmux-1000/default,1,0")
+	if b, err := detectClipboardBackend(); err != nil || b.Name() != "tmux" {
+		t.Fatalf("inside tmux = %v, %v", b, err)
+	}
+	fakeTool(t, dir, "xsel", "")
+	t.Setenv("DISPLAY", ":1")
+	if b, err := detectClipboardBackend(); err != nil || b.Name() != "xsel" {
+		t.Fatalf("X session = %v, %v", b, err)
+	}
+	if _, err := NewClipboardBackend("pasteboard", ""); err == nil || !strings.Contains(err.Error(), `unknown clipboard backend "pasteboard"`) {
+		t.Fatalf("unknown backend: %v", err)
+	}
+	if _, err := NewClipboardBackend("pbcopy", ""); err == nil || err.Error() != `clipboard backend "pbcopy" is only available on darwin` {
+		t.Fatalf("pbcopy: %v", err)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	if _, err := NewClipboardBackend("file", ""); err == nil {
+		t.Fatal("file backend without file name")
+	}
+	path := filepath.Join(t.TempDir(), "clipboard")
+	b, err := NewClipboardBackend("file", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := b.Read(); err != nil || text != "" {
+		t.Fatalf("Read missing file = %q, %v", text, err)
+	}
+	for _, text := range []string{"first", "second"} {
+		if err := b.Write(text); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	// another server could share the same file
+	other, _ := NewClipboardBackend("file", path)
+	if text, err := other.Read(); err != nil || text != "second" {
+		t.Fatalf("Read = %q, %v", text, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o600 {
+		t.Fatalf("mode = %v", fi.Mode())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("temporary files are left: %v", entries)
+	}
+}
+
+func TestCommandBackendTypes(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORE", dir)
+	// arguments are -in|-out -selection clipboard [-target type]
+	fakeTool(t, dir, "xclip", `
+case "$1 $5" in
+"-out TARGETS") printf 'TARGETS\nTIMESTAMP\nimage/png\nUTF8_STRING\nSTRING\n' ;;
+"-out "*) cat "$STORE/type" ;;
+"-in "*) printf '%s' "$5" > "$STORE/type" ;;
+esac
+`)
+	t.Setenv("DISPLAY", ":0")
+	b, err := NewClipboardBackend("xclip", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, ok := b.(TypedClipboardBackend)
+	if !ok {
+		t.Fatalf("%T does not keep types", b)
+	}
+	if types, err := tb.Types(); err != nil || strings.Join(types, ",") != "image/png,text/plain" {
+		t.Fatalf("Types = %v, %v", types, err)
+	}
+	if err := tb.WriteType("image/png", []byte("png")); err != nil {
+		t.Fatalf("WriteType: %v", err)
+	}
+	if data, err := tb.ReadType("image/png"); err != nil || string(data) != "image/png" {
+		t.Fatalf("ReadType = %q, %v", data, err)
+	}
+}
+
+func TestCommandBackendConcealed(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORE", dir)
+	// wl-copy remembers its arguments, REFUSE makes it behave like version which does not know --sensitive
+	fakeTool(t, dir, "wl-copy", `
+[ "$1" = --sensitive ] && [ -n "$REFUSE" ] && { echo "wl-copy: unrecognized option '--sensitive'" >&2; exit 1; }
+echo "$@" > "$STORE/args"; cat > "$STORE/data"
+`)
+	fakeTool(t, dir, "wl-paste", `cat "$STORE/data"`)
+	t.Setenv("WAYLAND_DISPLAY", "wayland-0")
+	b, err := NewClipboardBackend("wl-clipboard", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, ok := b.(ConcealedClipboardBackend)
+	if !ok {
+		t.Fatalf("%T cannot mark content as secret", b)
+	}
+	args := func() string {
+		data, _ := os.ReadFile(filepath.Join(dir, "args"))
+		return strings.TrimSpace(string(data))
+	}
+	if err := cb.WriteConcealed(MIMEText, []byte("secret")); err != nil || args() != "--sensitive --type "+MIMEText {
+		t.Fatalf("WriteConcealed = %v, args %q", err, args())
+	}
+	t.Setenv("REFUSE", "1")
+	if err := cb.WriteConcealed(MIMEText, []byte("secret")); err != nil || args() != "--type "+MIMEText {
+		t.Fatalf("WriteConcealed with old wl-copy = %v, args %q", err, args())
+	}
+	if text, err := b.Read(); err != nil || text != "secret" {
+		t.Fatalf("Read = %q, %v", text, err)
+	}
+	if _, ok := b.(SelectionBackend).Primary().(ConcealedClipboardBackend); !ok {
+		t.Fatal("primary selection cannot mark content as secret")
+	}
+}
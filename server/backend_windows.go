@@ -0,0 +1,107 @@
+//go:build windows
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modUser32                    = windows.NewLazySystemDLL("user32")
+	pOpenClipboard               = modUser32.NewProc("OpenClipboard")
+	pCloseClipboard              = modUser32.NewProc("CloseClipboard")
+	pEmptyClipboard              = modUser32.NewProc("EmptyClipboard")
+	pSetClipboardData            = modUser32.NewProc("SetClipboardData")
+	pRegisterClipboardFormat     = modUser32.NewProc("RegisterClipboardFormatW")
+	modKernel32                  = windows.NewLazySystemDLL("kernel32")
+	pGlobalAlloc                 = modKernel32.NewProc("GlobalAlloc")
+	pGlobalFree                  = modKernel32.NewProc("GlobalFree")
+	pGlobalLock                  = modKernel32.NewProc("GlobalLock")
+	pGlobalUnlock                = modKernel32.NewProc("GlobalUnlock")
+	pRtlMoveMemory               = modKernel32.NewProc("RtlMoveMemory")
+	concealedClipboardFormats    = []string{"ExcludeClipboardContentFromMonitorProcessing", "CanIncludeInClipboardHistory", "CanUploadToCloudClipboard"}
+	concealedClipboardFormatData = binary.LittleEndian.AppendUint32(nil, 0)
+)
+
+const (
+	cfUnicodeText = 13
+	gmemMoveable  = 0x0002
+)
+
+// WriteConcealed puts text into clipboard along with formats which keep it out of clipboard history and
+// cloud clipboard of Windows and tell clipboard monitors to skip it.
+func (b systemBackend) WriteConcealed(mime string, data []byte) error {
+	if !strings.HasPrefix(mediaType(mime), "text/") {
+		return fmt.Errorf("clipboard backend %s keeps only text, not %s", b.Name(), mime)
+	}
+	text := utf16.Encode([]rune(string(data) + "\x00"))
+	unicode := unsafe.Slice((*byte)(unsafe.Pointer(&text[0])), len(text)*2)
+
+	// clipboard has to be opened and closed on the same thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := openClipboard(); err != nil {
+		return fmt.Errorf("unable to open clipboard: %w", err)
+	}
+	defer pCloseClipboard.Call()
+	if r, _, err := pEmptyClipboard.Call(); r == 0 {
+		return fmt.Errorf("unable to empty clipboard: %w", err)
+	}
+	if err := setClipboardData(cfUnicodeText, unicode); err != nil {
+		return err
+	}
+	for _, name := range concealedClipboardFormats {
+		p, err := windows.UTF16PtrFromString(name)
+		if err != nil {
+			return err
+		}
+		format, _, err := pRegisterClipboardFormat.Call(uintptr(unsafe.Pointer(p)))
+		if format == 0 {
+			return fmt.Errorf("unable to register clipboard format %s: %w", name, err)
+		}
+		if err := setClipboardData(format, concealedClipboardFormatData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openClipboard waits up to a second for other application to close clipboard.
+func openClipboard() (err error) {
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		var r uintptr
+		if r, _, err = pOpenClipboard.Call(0); r != 0 {
+			return nil
+		}
+	}
+	return err
+}
+
+// setClipboardData puts copy of data into opened clipboard as format, clipboard owns the memory after that.
+func setClipboardData(format uintptr, data []byte) error {
+	h, _, err := pGlobalAlloc.Call(gmemMoveable, uintptr(len(data)))
+	if h == 0 {
+		return fmt.Errorf("unable to allocate clipboard memory: %w", err)
+	}
+	p, _, err := pGlobalLock.Call(h)
+	if p == 0 {
+		pGlobalFree.Call(h)
+		return fmt.Errorf("unable to lock clipboard memory: %w", err)
+	}
+	pRtlMoveMemory.Call(p, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)))
+	pGlobalUnlock.Call(h)
+	if r, _, err := pSetClipboardData.Call(format, h); r == 0 {
+		pGlobalFree.Call(h)
+		return fmt.Errorf("unable to set clipboard data: %w", err)
+	}
+	return nil
+}
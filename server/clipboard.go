@@ -1,38 +1,599 @@
 package server
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
-	"log"
+	"mime"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/atotto/clipboard"
+	"github.com/rupor-github/gclpr/util"
 )
 
-// MaxClipboardSize is the maximum allowed clipboard payload size (1 MiB).
-const MaxClipboardSize = 1 << 20
+const (
+	// MaxClipboardSize is the largest clipboard payload moved by a single Copy or Paste call (1 MiB).
+	// Larger payloads are streamed in chunks.
+	MaxClipboardSize = 1 << 20
+	// DefaultMaxClipboardSize is the default server-side limit for clipboard payloads (64 MiB).
+	DefaultMaxClipboardSize = 64 << 20
+	// ClipboardChunkSize is the size of a single chunk used by streaming copy and paste.
+	ClipboardChunkSize = 256 << 10
+)
+
+const (
+	clipboardTransferTimeout = DefaultIOTimeout
+	maxClipboardTransfers    = 8
+	// maxKeyClipboardTransfers leaves room for other clients when one of them does not finish its transfers.
+	maxKeyClipboardTransfers = 2
+)
+
+// newDefaultBackend makes backend NewClipboard starts with, Serve replaces it with configured one. It can be
+// overridden in tests.
+var newDefaultBackend = func() ClipboardBackend { return &memoryBackend{} }
+
+// CopyBeginRequest starts streaming copy of Size bytes.
+type CopyBeginRequest struct {
+	Size int64
+}
+
+// CopyTypeRequest starts streaming copy of Size bytes of MIME Type into Selection.
+type CopyTypeRequest struct {
+	Type      string
+	Size      int64
+	Selection string
+}
+
+// PasteTypeRequest asks for content of MIME Type from Selection.
+type PasteTypeRequest struct {
+	Type      string
+	Selection string
+}
+
+// HistoryPasteRequest asks for clipboard history Entry of MIME Type, 1 being the latest copy.
+type HistoryPasteRequest struct {
+	Entry int
+	Type  string
+}
+
+// TypesRequest asks which MIME types content of Selection could be pasted as.
+type TypesRequest struct {
+	Selection string
+}
+
+// TransferResponse describes started clipboard transfer.
+type TransferResponse struct {
+	TransferID string
+	Size       int64
+	ChunkSize  int
+	// Data holds the first chunk of a paste transfer, so small payloads need a single round trip.
+	Data []byte
+}
+
+// ChunkRequest carries one chunk of streaming copy.
+type ChunkRequest struct {
+	TransferID string
+	Offset     int64
+	Data       []byte
+}
+
+// PasteChunkRequest asks for one chunk of streaming paste.
+type PasteChunkRequest struct {
+	TransferID string
+	Offset     int64
+}
+
+type clipTransfer struct {
+	id    string
+	paste bool
+	mime  string // type of copied data, empty for text
+	sel   string
+	ttl   time.Duration // copy is taken back after it, zero keeps it
+	owner [32]byte      // key of client which started transfer
+	data  []byte        // copied data grows as chunks arrive, declared size is not trusted
+	size  int64
+	timer *time.Timer
+}
+
+// clipTransfers is the table of streaming transfers shared by all connections.
+type clipTransfers struct {
+	mu        sync.Mutex
+	transfers map[string]*clipTransfer
+}
 
 // Clipboard is used to rpc clipboard content.
 type Clipboard struct {
-	leOP string
+	leOP    string
+	limit   int64
+	backend ClipboardBackend
+	log     logSource
+	// caller identifies client for hooks
+	caller func() callerInfo
+	// info describes trusted keys, clearing shared history needs admin key
+	info map[[32]byte]util.KeyInfo
+	// events, approve, history, watch and expiry are shared with connection copies made by withConn
+	events  *events
+	approve *approver
+	history *history
+	watch   *watcher
+	expiry  *expiry
+	// openChannel opens channel of connection, it is not set for connections without channels
+	openChannel func(id uint32) (net.Conn, error)
+	*clipTransfers
+}
+
+// NewClipboard initializes Clipboard structure. Payloads larger than limit bytes are rejected.
+func NewClipboard(le string, limit int64) *Clipboard {
+	if limit <= 0 {
+		limit = DefaultMaxClipboardSize
+	}
+	c := &Clipboard{leOP: le, limit: limit, backend: newDefaultBackend(), log: fixedLog(util.NewLogger(util.SubsysClipboard)), caller: noCaller, clipTransfers: &clipTransfers{transfers: make(map[string]*clipTransfer)}}
+	c.watch, c.expiry = newWatcher(c), &expiry{}
+	return c
 }
 
-// NewClipboard initializes Clipboard structure.
-func NewClipboard(le string) *Clipboard {
-	return &Clipboard{leOP: le}
+// withConn returns Clipboard sharing state with c which logs with log and reports caller to hooks.
+func (c *Clipboard) withConn(log logSource, caller func() callerInfo) *Clipboard {
+	cc := *c
+	cc.log, cc.caller = log, caller
+	return &cc
 }
 
 // Copy is implementation of rpc "copy" command.
 func (c *Clipboard) Copy(text string, _ *struct{}) error {
-	log.Printf("Copy request received len: %d\n", len(text))
-	if len(text) > MaxClipboardSize {
-		return fmt.Errorf("clipboard payload size %d exceeds maximum %d", len(text), MaxClipboardSize)
+	c.log().Infof("Copy request received len: %d", len(text))
+	if err := c.checkSize(int64(len(text))); err != nil {
+		return err
 	}
-	return clipboard.WriteAll(ConvertLE(text, c.leOP))
+	copied := ConvertLE(text, c.leOP)
+	if err := c.backend.Write(copied); err != nil {
+		return err
+	}
+	c.history.add(MIMEText, []byte(copied), c.caller())
+	c.watch.changed(MIMEText, []byte(copied), c.caller())
+	c.events.copied(text, MIMEText, c.caller())
+	return nil
 }
 
 // Paste is implementation of rpc "paste" command.
 func (c *Clipboard) Paste(_ struct{}, resp *string) error {
-	t, err := clipboard.ReadAll()
-	log.Printf("Paste request received len: %d, error: '%+v'\n", len(t), err)
+	if err := c.approve.check(util.ApprovePaste, c.caller(), ""); err != nil {
+		return err
+	}
+	t, err := c.backend.Read()
+	c.log().Infof("Paste request received len: %d, error: '%+v'", len(t), err)
+	if err != nil {
+		return err
+	}
+	if err := c.checkSize(int64(len(t))); err != nil {
+		return err
+	}
+	c.events.payload("paste", len(t))
 	*resp = t
-	return err
+	return nil
+}
+
+// CopyBegin starts streaming copy. Data is sent with CopyChunk and committed to clipboard by CopyEnd.
+func (c *Clipboard) CopyBegin(req CopyBeginRequest, resp *TransferResponse) error {
+	c.log().Infof("Streaming copy request received len: %d", req.Size)
+	return c.beginCopy(&clipTransfer{size: req.Size}, resp)
+}
+
+// CopyTypeBegin starts streaming copy of data of MIME type, it continues the same way as CopyBegin.
+func (c *Clipboard) CopyTypeBegin(req CopyTypeRequest, resp *TransferResponse) error {
+	c.log().Infof("Streaming copy of %s to %s request received len: %d", req.Type, cmp.Or(req.Selection, SelectionClipboard), req.Size)
+	if _, _, err := mime.ParseMediaType(req.Type); err != nil {
+		return fmt.Errorf("invalid MIME type %q: %w", req.Type, err)
+	}
+	if _, err := c.selected(req.Selection); err != nil {
+		return err
+	}
+	return c.beginCopy(&clipTransfer{mime: req.Type, sel: req.Selection, size: req.Size}, resp)
+}
+
+// CopyExpiringBegin is CopyTypeBegin of content which is taken back from clipboard after TTL. It is not
+// remembered in history, watchers and hooks do not get it and backends which support it mark it as secret.
+func (c *Clipboard) CopyExpiringBegin(req ExpiringCopyRequest, resp *TransferResponse) error {
+	c.log().Infof("Streaming copy of %s to %s expiring in %s request received len: %d", req.Type, cmp.Or(req.Selection, SelectionClipboard), req.TTL, req.Size)
+	if req.TTL <= 0 {
+		return fmt.Errorf("invalid copy TTL %s", req.TTL)
+	}
+	if _, _, err := mime.ParseMediaType(req.Type); err != nil {
+		return fmt.Errorf("invalid MIME type %q: %w", req.Type, err)
+	}
+	if _, err := c.selected(req.Selection); err != nil {
+		return err
+	}
+	return c.beginCopy(&clipTransfer{mime: req.Type, sel: req.Selection, ttl: req.TTL, size: req.Size}, resp)
+}
+
+func (c *Clipboard) beginCopy(tr *clipTransfer, resp *TransferResponse) error {
+	if tr.size < 0 {
+		return fmt.Errorf("invalid clipboard payload size %d", tr.size)
+	}
+	if err := c.checkSize(tr.size); err != nil {
+		return err
+	}
+	tr, err := c.newTransfer(tr)
+	if err != nil {
+		return err
+	}
+	resp.TransferID = tr.id
+	resp.Size = tr.size
+	resp.ChunkSize = ClipboardChunkSize
+	return nil
+}
+
+// CopyChunk appends next chunk of data to streaming copy.
+func (c *Clipboard) CopyChunk(req ChunkRequest, _ *struct{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tr, err := c.lookupTransfer(req.TransferID, false)
+	if err != nil {
+		return err
+	}
+	if req.Offset != int64(len(tr.data)) {
+		c.removeTransfer(tr.id)
+		return fmt.Errorf("unexpected chunk offset %d, want %d", req.Offset, len(tr.data))
+	}
+	if len(req.Data) > ClipboardChunkSize || int64(len(tr.data)+len(req.Data)) > tr.size {
+		c.removeTransfer(tr.id)
+		return fmt.Errorf("clipboard chunk of %d bytes at offset %d exceeds declared size %d", len(req.Data), req.Offset, tr.size)
+	}
+	tr.data = append(tr.data, req.Data...)
+	return nil
+}
+
+// CopyEnd completes streaming copy and places collected text into clipboard.
+func (c *Clipboard) CopyEnd(id string, _ *struct{}) error {
+	c.mu.Lock()
+	tr, err := c.lookupTransfer(id, false)
+	if err == nil {
+		c.removeTransfer(tr.id)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if int64(len(tr.data)) != tr.size {
+		return fmt.Errorf("clipboard transfer is incomplete: received %d of %d bytes", len(tr.data), tr.size)
+	}
+	c.log().Debugf("Streaming copy completed len: %d", tr.size)
+	if tr.ttl > 0 {
+		written, err := c.copyExpiring(tr.sel, tr.mime, tr.data, tr.ttl)
+		if err != nil {
+			return err
+		}
+		if tr.sel != SelectionPrimary {
+			// watcher compares what it polls with content as backend holds it
+			c.watch.concealed(tr.mime, written, c.caller())
+		}
+		c.events.payload("copy", len(tr.data))
+		return nil
+	}
+	text, copied := string(tr.data), tr.data
+	if tr.mime == "" || sameType(tr.mime, MIMEText) {
+		copied = []byte(ConvertLE(text, c.leOP))
+	}
+	if tr.mime == "" {
+		err = c.backend.Write(string(copied))
+	} else {
+		backends, _ := c.selected(tr.sel)
+		for _, b := range backends {
+			if err = c.writeType(b, tr.mime, tr.data); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.history.add(cmp.Or(tr.mime, MIMEText), copied, c.caller())
+	if tr.sel != SelectionPrimary {
+		c.watch.changed(cmp.Or(tr.mime, MIMEText), copied, c.caller())
+	}
+	c.events.copied(text, cmp.Or(tr.mime, MIMEText), c.caller())
+	return nil
+}
+
+// PasteBegin snapshots clipboard content and returns its size along with the first chunk.
+func (c *Clipboard) PasteBegin(_ struct{}, resp *TransferResponse) error {
+	if err := c.approve.check(util.ApprovePaste, c.caller(), ""); err != nil {
+		return err
+	}
+	t, err := c.backend.Read()
+	c.log().Infof("Streaming paste request received len: %d, error: '%+v'", len(t), err)
+	if err != nil {
+		return err
+	}
+	return c.beginPaste([]byte(t), resp)
+}
+
+// PasteTypeBegin is PasteBegin for clipboard content of MIME type.
+func (c *Clipboard) PasteTypeBegin(req PasteTypeRequest, resp *TransferResponse) error {
+	if err := c.approve.check(util.ApprovePaste, c.caller(), req.Type); err != nil {
+		return err
+	}
+	backends, err := c.selected(req.Selection)
+	if err != nil {
+		return err
+	}
+	// both selections are pasted from clipboard, or from PRIMARY when clipboard has nothing
+	var data []byte
+	for _, b := range backends {
+		if data, err = c.readType(b, req.Type); err == nil && len(data) > 0 {
+			break
+		}
+	}
+	c.log().Infof("Streaming paste of %s from %s request received len: %d, error: '%+v'", req.Type, cmp.Or(req.Selection, SelectionClipboard), len(data), err)
+	if err != nil {
+		return err
+	}
+	return c.beginPaste(data, resp)
+}
+
+// HistoryPasteBegin is PasteBegin for clipboard history entry, text entries of any type could be pasted
+// as plain text.
+func (c *Clipboard) HistoryPasteBegin(req HistoryPasteRequest, resp *TransferResponse) error {
+	if err := c.approve.check(util.ApprovePaste, c.caller(), fmt.Sprintf("history entry %d", req.Entry)); err != nil {
+		return err
+	}
+	e, err := c.history.get(req.Entry)
+	c.log().Infof("Streaming paste of %s from history entry %d request received len: %d, error: '%+v'", req.Type, req.Entry, len(e.data), err)
+	if err != nil {
+		return err
+	}
+	if !sameType(req.Type, e.mime) && (!sameType(req.Type, MIMEText) || !strings.HasPrefix(mediaType(e.mime), "text/")) {
+		return fmt.Errorf("clipboard history entry %d has %s, not %s", req.Entry, e.mime, req.Type)
+	}
+	return c.beginPaste(e.data, resp)
+}
+
+// History lists remembered copies, the latest first.
+func (c *Clipboard) History(_ struct{}, resp *[]HistoryEntry) error {
+	if err := c.approve.check(util.ApprovePaste, c.caller(), "history"); err != nil {
+		return err
+	}
+	if c.history == nil {
+		return errNoHistory
+	}
+	*resp = c.history.list()
+	c.log().Infof("Clipboard history request received: %d entries", len(*resp))
+	return nil
+}
+
+// HistoryClear forgets remembered copies and returns how many there were. Admin only.
+func (c *Clipboard) HistoryClear(_ struct{}, resp *int) error {
+	if caller := c.caller(); !caller.known || !c.info[caller.key].Has(util.PermAdmin) {
+		c.log().Warnf("Clipboard history clear refused: key [%x] is not admin", caller.key)
+		return errors.New("clipboard history clear requires admin key")
+	}
+	if c.history == nil {
+		return errNoHistory
+	}
+	*resp = c.history.clear()
+	c.log().Infof("Clipboard history cleared, %d entries forgotten", *resp)
+	return nil
+}
+
+// Watch sends clipboard changes to channel of connection until client closes it, see ClipboardEvent.
+// Hashes of changes let client confirm guessed content, so watch needs approval with or without content.
+func (c *Clipboard) Watch(req WatchRequest, _ *struct{}) error {
+	if err := c.approve.check(util.ApprovePaste, c.caller(), "watch"); err != nil {
+		return err
+	}
+	if c.openChannel == nil {
+		return errors.New("connection does not support channels")
+	}
+	ch, err := c.openChannel(req.Channel)
+	if err != nil {
+		return err
+	}
+	c.log().Infof("Clipboard watch request received on channel %d, content: %t", req.Channel, req.Content)
+	c.watch.subscribe(ch, req.Content, c.log)
+	return nil
+}
+
+// Types lists MIME types content of selection could be pasted as. It tells what clipboard holds, so it
+// needs approval like paste does.
+func (c *Clipboard) Types(req TypesRequest, resp *[]string) error {
+	if err := c.approve.check(util.ApprovePaste, c.caller(), "types"); err != nil {
+		return err
+	}
+	backends, err := c.selected(req.Selection)
+	if err != nil {
+		return err
+	}
+	var types []string
+	for _, b := range backends {
+		bt, err := c.types(b)
+		c.log().Infof("Clipboard types request received: %v, error: '%+v'", bt, err)
+		if err != nil {
+			return err
+		}
+		for _, t := range bt {
+			if !slices.Contains(types, t) {
+				types = append(types, t)
+			}
+		}
+	}
+	*resp = types
+	return nil
+}
+
+// selected returns backends of selection, both selections are clipboard followed by PRIMARY. Backends
+// without PRIMARY selection use clipboard for it.
+func (c *Clipboard) selected(sel string) ([]ClipboardBackend, error) {
+	primary := c.backend
+	if sb, ok := c.backend.(SelectionBackend); ok {
+		primary = cmp.Or(sb.Primary(), c.backend)
+	}
+	switch sel {
+	case "", SelectionClipboard:
+		return []ClipboardBackend{c.backend}, nil
+	case SelectionPrimary:
+		return []ClipboardBackend{primary}, nil
+	case SelectionBoth:
+		if primary == c.backend {
+			return []ClipboardBackend{c.backend}, nil
+		}
+		return []ClipboardBackend{c.backend, primary}, nil
+	}
+	return nil, fmt.Errorf("unknown selection %q, expected %s, %s or %s", sel, SelectionClipboard, SelectionPrimary, SelectionBoth)
+}
+
+func (c *Clipboard) beginPaste(data []byte, resp *TransferResponse) error {
+	if err := c.checkSize(int64(len(data))); err != nil {
+		return err
+	}
+	c.events.payload("paste", len(data))
+	resp.Size = int64(len(data))
+	resp.ChunkSize = ClipboardChunkSize
+	if len(data) <= ClipboardChunkSize {
+		resp.Data = data
+		return nil
+	}
+	tr, err := c.newTransfer(&clipTransfer{paste: true, data: data, size: int64(len(data))})
+	if err != nil {
+		return err
+	}
+	resp.TransferID = tr.id
+	resp.Data = tr.data[:ClipboardChunkSize]
+	return nil
+}
+
+// types lists MIME types of content of backend, backends which keep only text offer it as plain text.
+func (c *Clipboard) types(b ClipboardBackend) ([]string, error) {
+	if tb, ok := b.(TypedClipboardBackend); ok {
+		return tb.Types()
+	}
+	text, err := b.Read()
+	if err != nil || text == "" {
+		return nil, err
+	}
+	return []string{MIMEText}, nil
+}
+
+// readType returns content of backend of MIME type, plain text is read the same way Paste does.
+func (c *Clipboard) readType(b ClipboardBackend, mime string) ([]byte, error) {
+	if sameType(mime, MIMEText) {
+		text, err := b.Read()
+		return []byte(text), err
+	}
+	if tb, ok := b.(TypedClipboardBackend); ok {
+		return tb.ReadType(mime)
+	}
+	return nil, fmt.Errorf("clipboard backend %s keeps only text, not %s", b.Name(), mime)
+}
+
+// writeType puts data of MIME type into clipboard, backends which keep only text get other text types
+// as plain text.
+func (c *Clipboard) writeType(b ClipboardBackend, mime string, data []byte) error {
+	if sameType(mime, MIMEText) {
+		return b.Write(ConvertLE(string(data), c.leOP))
+	}
+	if tb, ok := b.(TypedClipboardBackend); ok {
+		return tb.WriteType(mime, data)
+	}
+	if !strings.HasPrefix(mediaType(mime), "text/") {
+		return fmt.Errorf("clipboard backend %s keeps only text, not %s", b.Name(), mime)
+	}
+	c.log().Infof("Clipboard backend %s keeps only text, %s is stored as plain text", b.Name(), mime)
+	return b.Write(string(data))
+}
+
+// PasteChunk returns next chunk of streaming paste. Transfer is released after the last chunk is sent.
+func (c *Clipboard) PasteChunk(req PasteChunkRequest, resp *[]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tr, err := c.lookupTransfer(req.TransferID, true)
+	if err != nil {
+		return err
+	}
+	if req.Offset < 0 || req.Offset >= tr.size {
+		c.removeTransfer(tr.id)
+		return fmt.Errorf("invalid chunk offset %d for transfer of %d bytes", req.Offset, tr.size)
+	}
+	end := min(req.Offset+ClipboardChunkSize, tr.size)
+	*resp = tr.data[req.Offset:end]
+	if end == tr.size {
+		c.removeTransfer(tr.id)
+	}
+	return nil
+}
+
+func (c *Clipboard) checkSize(size int64) error {
+	if size > c.limit {
+		return fmt.Errorf("clipboard payload size %d exceeds maximum %d", size, c.limit)
+	}
+	return nil
+}
+
+// newTransfer registers transfer tr describes under new id, it belongs to the key of the caller.
+func (c *Clipboard) newTransfer(tr *clipTransfer) (*clipTransfer, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create clipboard transfer id: %w", err)
+	}
+	tr.id, tr.owner = id, c.caller().key
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.transfers) >= maxClipboardTransfers {
+		return nil, errors.New("too many clipboard transfers in progress")
+	}
+	owned := 0
+	for _, other := range c.transfers {
+		if other.owner == tr.owner {
+			owned++
+		}
+	}
+	if owned >= maxKeyClipboardTransfers {
+		return nil, fmt.Errorf("too many clipboard transfers in progress for this key, server allows %d", maxKeyClipboardTransfers)
+	}
+	tr.timer = time.AfterFunc(clipboardTransferTimeout, func() {
+		c.log().Warnf("Clipboard transfer %s expired", id)
+		c.dropTransfer(id)
+	})
+	c.transfers[id] = tr
+	return tr, nil
+}
+
+// lookupTransfer finds active transfer started by the key of the caller and extends its lifetime. Transfers
+// of other keys are unknown. Must be called with c.mu held.
+func (c *Clipboard) lookupTransfer(id string, paste bool) (*clipTransfer, error) {
+	tr, ok := c.transfers[id]
+	if !ok || tr.paste != paste || tr.owner != c.caller().key {
+		return nil, fmt.Errorf("unknown clipboard transfer %q", id)
+	}
+	tr.timer.Reset(clipboardTransferTimeout)
+	return tr, nil
+}
+
+// removeTransfer forgets transfer. Must be called with c.mu held.
+func (c *Clipboard) removeTransfer(id string) {
+	if tr, ok := c.transfers[id]; ok {
+		tr.timer.Stop()
+		delete(c.transfers, id)
+	}
+}
+
+// shutdown takes expiring copy back and forgets all transfers in progress.
+func (c *Clipboard) shutdown() {
+	c.expire()
+	c.watch.close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.transfers {
+		c.removeTransfer(id)
+	}
+}
+
+func (c *Clipboard) dropTransfer(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeTransfer(id)
 }
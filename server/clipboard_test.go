@@ -0,0 +1,369 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// fakeClipboard makes clipboards created during the test share in-memory backend with initial text.
+func fakeClipboard(t *testing.T, initial string) *memoryBackend {
+	t.Helper()
+	b := &memoryBackend{}
+	if initial != "" {
+		b.Write(initial)
+	}
+	orig := newDefaultBackend
+	newDefaultBackend = func() ClipboardBackend { return b }
+	t.Cleanup(func() { newDefaultBackend = orig })
+	return b
+}
+
+// content returns text in backend.
+func (b *memoryBackend) content() string {
+	text, _ := b.Read()
+	return text
+}
+
+func TestClipboardCopyLimit(t *testing.T) {
+	content := fakeClipboard(t, "")
+	c := NewClipboard("", 10)
+
+	if err := c.Copy("0123456789", nil); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if content.content() != "0123456789" {
+		t.Fatalf("clipboard = %q", content.content())
+	}
+	err := c.Copy("0123456789A", nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum 10") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClipboardPasteLimit(t *testing.T) {
+	fakeClipboard(t, strings.Repeat("x", 11))
+	c := NewClipboard("", 10)
+
+	var resp string
+	if err := c.Paste(struct{}{}, &resp); err == nil {
+		t.Fatal("expected error for oversized paste")
+	}
+	var tr TransferResponse
+	if err := c.PasteBegin(struct{}{}, &tr); err == nil {
+		t.Fatal("expected error for oversized streaming paste")
+	}
+}
+
+func TestClipboardStreamingCopy(t *testing.T) {
+	content := fakeClipboard(t, "")
+	c := NewClipboard("lf", 0)
+
+	text := strings.Repeat("line\r\n", (3*ClipboardChunkSize)/6+1)
+	var tr TransferResponse
+	if err := c.CopyBegin(CopyBeginRequest{Size: int64(len(text))}, &tr); err != nil {
+		t.Fatalf("CopyBegin: %v", err)
+	}
+	for off := 0; off < len(text); off += tr.ChunkSize {
+		end := min(off+tr.ChunkSize, len(text))
+		if err := c.CopyChunk(ChunkRequest{TransferID: tr.TransferID, Offset: int64(off), Data: []byte(text[off:end])}, nil); err != nil {
+			t.Fatalf("CopyChunk at %d: %v", off, err)
+		}
+	}
+	if err := c.CopyEnd(tr.TransferID, nil); err != nil {
+		t.Fatalf("CopyEnd: %v", err)
+	}
+	if want := ConvertLE(text, "lf"); content.content() != want {
+		t.Fatalf("clipboard length = %d, want %d", len(content.content()), len(want))
+	}
+	if len(c.transfers) != 0 {
+		t.Fatalf("transfers left: %d", len(c.transfers))
+	}
+}
+
+func TestClipboardStreamingCopyRejectsBadChunks(t *testing.T) {
+	fakeClipboard(t, "")
+	c := NewClipboard("", 0)
+
+	var tr TransferResponse
+	if err := c.CopyBegin(CopyBeginRequest{Size: 4}, &tr); err != nil {
+		t.Fatalf("CopyBegin: %v", err)
+	}
+	if err := c.CopyChunk(ChunkRequest{TransferID: tr.TransferID, Offset: 2, Data: []byte("ab")}, nil); err == nil {
+		t.Fatal("expected error for out of order chunk")
+	}
+	if err := c.CopyEnd(tr.TransferID, nil); err == nil {
+		t.Fatal("expected transfer to be dropped after bad chunk")
+	}
+
+	if err := c.CopyBegin(CopyBeginRequest{Size: 4}, &tr); err != nil {
+		t.Fatalf("CopyBegin: %v", err)
+	}
+	if err := c.CopyChunk(ChunkRequest{TransferID: tr.TransferID, Data: []byte("abcde")}, nil); err == nil {
+		t.Fatal("expected error for chunk exceeding declared size")
+	}
+
+	if err := c.CopyBegin(CopyBeginRequest{Size: 4}, &tr); err != nil {
+		t.Fatalf("CopyBegin: %v", err)
+	}
+	if err := c.CopyChunk(ChunkRequest{TransferID: tr.TransferID, Data: []byte("ab")}, nil); err != nil {
+		t.Fatalf("CopyChunk: %v", err)
+	}
+	if err := c.CopyEnd(tr.TransferID, nil); err == nil || !strings.Contains(err.Error(), "incomplete") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClipboardStreamingPaste(t *testing.T) {
+	text := strings.Repeat("0123456789", ClipboardChunkSize/4)
+	fakeClipboard(t, text)
+	c := NewClipboard("", 0)
+
+	var tr TransferResponse
+	if err := c.PasteBegin(struct{}{}, &tr); err != nil {
+		t.Fatalf("PasteBegin: %v", err)
+	}
+	if tr.Size != int64(len(text)) || tr.TransferID == "" {
+		t.Fatalf("unexpected transfer: id=%q size=%d", tr.TransferID, tr.Size)
+	}
+	got := append([]byte(nil), tr.Data...)
+	for int64(len(got)) < tr.Size {
+		var chunk []byte
+		if err := c.PasteChunk(PasteChunkRequest{TransferID: tr.TransferID, Offset: int64(len(got))}, &chunk); err != nil {
+			t.Fatalf("PasteChunk at %d: %v", len(got), err)
+		}
+		got = append(got, chunk...)
+	}
+	if string(got) != text {
+		t.Fatal("pasted content mismatch")
+	}
+	if len(c.transfers) != 0 {
+		t.Fatalf("transfers left: %d", len(c.transfers))
+	}
+}
+
+func TestClipboardSmallPasteIsInline(t *testing.T) {
+	fakeClipboard(t, "hello")
+	c := NewClipboard("", 0)
+
+	var tr TransferResponse
+	if err := c.PasteBegin(struct{}{}, &tr); err != nil {
+		t.Fatalf("PasteBegin: %v", err)
+	}
+	if tr.TransferID != "" || string(tr.Data) != "hello" {
+		t.Fatalf("unexpected transfer: id=%q data=%q", tr.TransferID, tr.Data)
+	}
+}
+
+// copyTyped runs streaming copy of data of MIME type into selection.
+func copyTyped(c *Clipboard, sel, mime string, data []byte) error {
+	var tr TransferResponse
+	if err := c.CopyTypeBegin(CopyTypeRequest{Type: mime, Size: int64(len(data)), Selection: sel}, &tr); err != nil {
+		return err
+	}
+	if err := c.CopyChunk(ChunkRequest{TransferID: tr.TransferID, Data: data}, nil); err != nil {
+		return err
+	}
+	return c.CopyEnd(tr.TransferID, nil)
+}
+
+func TestClipboardTypes(t *testing.T) {
+	fakeClipboard(t, "")
+	c := NewClipboard("", 0)
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\xff")
+	if err := copyTyped(c, "", "image/png", png); err != nil {
+		t.Fatalf("copy image: %v", err)
+	}
+	var types []string
+	if err := c.Types(TypesRequest{}, &types); err != nil || len(types) != 1 || types[0] != "image/png" {
+		t.Fatalf("Types = %v, %v", types, err)
+	}
+	var tr TransferResponse
+	if err := c.PasteTypeBegin(PasteTypeRequest{Type: "image/png"}, &tr); err != nil || string(tr.Data) != string(png) {
+		t.Fatalf("paste image = %q, %v", tr.Data, err)
+	}
+	if err := c.PasteTypeBegin(PasteTypeRequest{Type: "text/html"}, &tr); err == nil || err.Error() != "clipboard has no text/html, it has image/png" {
+		t.Fatalf("paste html: %v", err)
+	}
+	var text string
+	if err := c.Paste(struct{}{}, &text); err == nil {
+		t.Fatalf("paste image as text = %q", text)
+	}
+	if err := c.CopyTypeBegin(CopyTypeRequest{Type: "image png", Size: 1}, &tr); err == nil {
+		t.Fatal("invalid MIME type is accepted")
+	}
+
+	// plain text is the same as Copy
+	if err := copyTyped(c, "", "text/plain; charset=utf-8", []byte("hello")); err != nil {
+		t.Fatalf("copy text: %v", err)
+	}
+	if err := c.Paste(struct{}{}, &text); err != nil || text != "hello" {
+		t.Fatalf("Paste = %q, %v", text, err)
+	}
+}
+
+func TestClipboardTypesNeedApproval(t *testing.T) {
+	fakeClipboard(t, "secret")
+	key := [32]byte{1}
+	c := NewClipboard("", 0)
+	c.approve = newApprover(map[[32]byte]util.KeyInfo{key: {Approve: []string{util.ApprovePaste}}}, ApprovalOptions{Timeout: 50 * time.Millisecond})
+	kc := c.withConn(c.log, func() callerInfo { return callerInfo{key: key, known: true} })
+
+	var types []string
+	if err := kc.Types(TypesRequest{}, &types); err == nil || !strings.Contains(err.Error(), "not approved") {
+		t.Fatalf("Types without approval = %v, %v", types, err)
+	}
+}
+
+func TestClipboardTypesTextBackend(t *testing.T) {
+	c := NewClipboard("", 0)
+	c.backend = &fileBackend{path: filepath.Join(t.TempDir(), "clipboard")}
+
+	var types []string
+	if err := c.Types(TypesRequest{}, &types); err != nil || len(types) != 0 {
+		t.Fatalf("Types of empty clipboard = %v, %v", types, err)
+	}
+	if err := copyTyped(c, "", "text/html", []byte("<b>bold</b>")); err != nil {
+		t.Fatalf("copy html: %v", err)
+	}
+	if err := c.Types(TypesRequest{}, &types); err != nil || len(types) != 1 || types[0] != MIMEText {
+		t.Fatalf("Types = %v, %v", types, err)
+	}
+	var tr TransferResponse
+	if err := c.PasteTypeBegin(PasteTypeRequest{Type: "text/plain"}, &tr); err != nil || string(tr.Data) != "<b>bold</b>" {
+		t.Fatalf("paste text = %q, %v", tr.Data, err)
+	}
+	if err := copyTyped(c, "", "image/png", []byte("png")); err == nil || !strings.Contains(err.Error(), "keeps only text, not image/png") {
+		t.Fatalf("copy image: %v", err)
+	}
+	if err := c.PasteTypeBegin(PasteTypeRequest{Type: "text/html"}, &tr); err == nil {
+		t.Fatal("text backend offers html")
+	}
+}
+
+// pasteSelection returns text of selection.
+func pasteSelection(t *testing.T, c *Clipboard, sel string) string {
+	t.Helper()
+	var tr TransferResponse
+	if err := c.PasteTypeBegin(PasteTypeRequest{Type: MIMEText, Selection: sel}, &tr); err != nil {
+		t.Fatalf("paste %s: %v", sel, err)
+	}
+	return string(tr.Data)
+}
+
+func TestClipboardSelections(t *testing.T) {
+	clip := fakeClipboard(t, "clip")
+	c := NewClipboard("", 0)
+
+	if err := copyTyped(c, SelectionPrimary, MIMEText, []byte("primary")); err != nil {
+		t.Fatalf("copy primary: %v", err)
+	}
+	if got := clip.content(); got != "clip" {
+		t.Fatalf("copy to primary changed clipboard to %q", got)
+	}
+	if got := pasteSelection(t, c, SelectionPrimary); got != "primary" {
+		t.Fatalf("primary = %q", got)
+	}
+	if got := pasteSelection(t, c, SelectionBoth); got != "clip" {
+		t.Fatalf("both = %q, clipboard goes first", got)
+	}
+	if err := copyTyped(c, SelectionBoth, MIMEText, []byte("both")); err != nil {
+		t.Fatalf("copy both: %v", err)
+	}
+	if clip.content() != "both" || pasteSelection(t, c, SelectionPrimary) != "both" {
+		t.Fatal("copy to both selections")
+	}
+	if err := clip.Write(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := pasteSelection(t, c, SelectionBoth); got != "both" {
+		t.Fatalf("both with empty clipboard = %q", got)
+	}
+	var tr TransferResponse
+	if err := c.CopyTypeBegin(CopyTypeRequest{Type: MIMEText, Selection: "secondary"}, &tr); err == nil || !strings.Contains(err.Error(), `unknown selection "secondary"`) {
+		t.Fatalf("unknown selection: %v", err)
+	}
+
+	// backends without PRIMARY selection use clipboard for it
+	c.backend = &fileBackend{path: filepath.Join(t.TempDir(), "clipboard")}
+	if err := copyTyped(c, SelectionPrimary, MIMEText, []byte("mirrored")); err != nil {
+		t.Fatalf("copy primary: %v", err)
+	}
+	if got := pasteSelection(t, c, SelectionClipboard); got != "mirrored" {
+		t.Fatalf("clipboard = %q", got)
+	}
+}
+
+func TestClipboardTransfersPerKey(t *testing.T) {
+	fakeClipboard(t, "")
+	base := NewClipboard("", 0)
+	client := func(b byte) *Clipboard {
+		return base.withConn(base.log, func() callerInfo { return callerInfo{key: [32]byte{b}, known: true} })
+	}
+
+	var tr TransferResponse
+	// declared size is not allocated up front
+	if err := client(1).CopyBegin(CopyBeginRequest{Size: DefaultMaxClipboardSize}, &tr); err != nil {
+		t.Fatal(err)
+	}
+	if n := cap(base.transfers[tr.TransferID].data); n != 0 {
+		t.Fatalf("transfer buffer of %d bytes is allocated before data arrived", n)
+	}
+	if err := client(1).CopyBegin(CopyBeginRequest{Size: 4}, &tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := client(1).CopyBegin(CopyBeginRequest{Size: 4}, &tr); err == nil || !strings.Contains(err.Error(), "for this key") {
+		t.Fatalf("third transfer of the same key: %v", err)
+	}
+	for b := byte(2); len(base.transfers) < maxClipboardTransfers; b++ {
+		if err := client(b).CopyBegin(CopyBeginRequest{Size: 4}, &tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client(100).CopyBegin(CopyBeginRequest{Size: 4}, &tr); err == nil || err.Error() != "too many clipboard transfers in progress" {
+		t.Fatalf("transfer over the limit: %v", err)
+	}
+	base.shutdown()
+}
+
+func TestClipboardTransferOwner(t *testing.T) {
+	clip := fakeClipboard(t, "")
+	base := NewClipboard("", 0)
+	owner := base.withConn(base.log, func() callerInfo { return callerInfo{key: [32]byte{1}, known: true} })
+	other := base.withConn(base.log, func() callerInfo { return callerInfo{key: [32]byte{2}, known: true} })
+
+	var tr TransferResponse
+	if err := owner.CopyBegin(CopyBeginRequest{Size: 4}, &tr); err != nil {
+		t.Fatal(err)
+	}
+	unknown := fmt.Sprintf("unknown clipboard transfer %q", tr.TransferID)
+	if err := other.CopyChunk(ChunkRequest{TransferID: tr.TransferID, Data: []byte("evil")}, nil); err == nil || err.Error() != unknown {
+		t.Fatalf("chunk from other key: %v", err)
+	}
+	if err := other.CopyEnd(tr.TransferID, nil); err == nil || err.Error() != unknown {
+		t.Fatalf("end from other key: %v", err)
+	}
+	if err := owner.CopyChunk(ChunkRequest{TransferID: tr.TransferID, Data: []byte("mine")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.CopyEnd(tr.TransferID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	clip.Write(strings.Repeat("x", ClipboardChunkSize+1))
+	if err := owner.PasteBegin(struct{}{}, &tr); err != nil || tr.TransferID == "" {
+		t.Fatalf("PasteBegin = %+v, %v", tr, err)
+	}
+	var chunk []byte
+	if err := other.PasteChunk(PasteChunkRequest{TransferID: tr.TransferID, Offset: ClipboardChunkSize}, &chunk); err == nil || !strings.Contains(err.Error(), "unknown clipboard transfer") {
+		t.Fatalf("paste chunk for other key: %v", err)
+	}
+	if err := owner.PasteChunk(PasteChunkRequest{TransferID: tr.TransferID, Offset: ClipboardChunkSize}, &chunk); err != nil || len(chunk) != 1 {
+		t.Fatalf("PasteChunk = %d bytes, %v", len(chunk), err)
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// gate decides whether requests are served, they are refused while session is locked or server is paused.
+type gate struct {
+	locked *int32
+	paused atomic.Bool
+}
+
+// closed returns reason requests are refused for, it is empty when requests are served.
+func (g *gate) closed() string {
+	if g == nil {
+		return ""
+	}
+	if g.locked != nil && atomic.LoadInt32(g.locked) == 1 {
+		return "session is locked"
+	}
+	if g.paused.Load() {
+		return "server is paused"
+	}
+	return ""
+}
+
+// gateExempt reports whether method is served when gate is closed. Such methods do not touch clipboard or
+// browser, Server methods have to be available to resume paused server.
+func gateExempt(method string) bool {
+	return method == "Session.Hello" || strings.HasPrefix(method, "Server.")
+}
+
+// serverCodec is gob rpc codec which refuses requests while gate is closed. Once draining it stops reading
+// requests and closes connection as soon as requests already read are answered.
+type serverCodec struct {
+	conn   io.ReadWriteCloser
+	log    logSource
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	gate   *gate
+
+	events   *events
+	listener string // labels requests in metrics and audit log
+
+	mu       sync.Mutex
+	inflight int
+	started  map[uint64]time.Time // by sequence number of requests being served
+	draining bool
+	closed   bool
+}
+
+func newServerCodec(conn io.ReadWriteCloser, log logSource, g *gate, ev *events, listener string) *serverCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{conn: conn, log: log, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf, gate: g,
+		events: ev, listener: listener, started: make(map[uint64]time.Time)}
+}
+
+// caller identifies client in audit log, lemonade clients are not authenticated.
+func (c *serverCodec) caller() callerInfo {
+	sc, ok := c.conn.(*secConn)
+	if !ok {
+		return callerInfo{}
+	}
+	return sc.callerInfo()
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	if why := c.gate.closed(); why != "" && !gateExempt(r.ServiceMethod) {
+		c.log().Infof("Refusing %s: %s", r.ServiceMethod, why)
+		c.events.request(requestEvent{listener: c.listener, method: r.ServiceMethod, outcome: "refused", err: why, caller: c.caller()})
+		return io.ErrUnexpectedEOF
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		c.log().Debugf("Dropping %s: server is shutting down", r.ServiceMethod)
+		return io.EOF
+	}
+	c.inflight++
+	c.started[r.Seq] = time.Now()
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body any) (err error) {
+	defer c.answered(r)
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// gob couldn't encode the header, should not happen, so shut down the connection
+			c.log().Errorf("rpc: gob error encoding response: %v", err)
+			c.Close()
+		}
+		return err
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// was a gob problem encoding the body but the header has been written
+			c.log().Errorf("rpc: gob error encoding body: %v", err)
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+// answered accounts for request which got its response.
+func (c *serverCodec) answered(r *rpc.Response) {
+	outcome := "ok"
+	if r.Error != "" {
+		outcome = "error"
+	}
+	c.mu.Lock()
+	if started, ok := c.started[r.Seq]; ok {
+		delete(c.started, r.Seq)
+		c.events.request(requestEvent{listener: c.listener, method: r.ServiceMethod, outcome: outcome, err: r.Error, duration: time.Since(started), caller: c.caller()})
+	}
+	c.inflight--
+	idle := c.draining && c.inflight == 0
+	c.mu.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+// drain makes codec stop reading requests, connection is closed once requests already read are answered.
+func (c *serverCodec) drain() {
+	c.mu.Lock()
+	c.draining = true
+	idle := c.inflight == 0
+	c.mu.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+func (c *serverCodec) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		// only call Close once
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+// connections tracks connections accepted by server, so they can be drained on shutdown. Connection
+// is tracked from accept, its codec is known once rpc is served on it.
+type connections struct {
+	mu       sync.Mutex
+	conns    map[net.Conn]*serverCodec
+	draining bool
+	wg       sync.WaitGroup
+}
+
+func newConnections() *connections {
+	return &connections{conns: make(map[net.Conn]*serverCodec)}
+}
+
+// add starts tracking accepted connection, it returns false once draining began.
+func (cs *connections) add(conn net.Conn) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.draining {
+		return false
+	}
+	cs.conns[conn] = nil
+	cs.wg.Add(1)
+	return true
+}
+
+// done stops tracking connection, connection goroutine must call it when it exits.
+func (cs *connections) done(conn net.Conn) {
+	cs.mu.Lock()
+	delete(cs.conns, conn)
+	cs.mu.Unlock()
+	cs.wg.Done()
+}
+
+// serve runs rpc server on codec of tracked connection until connection is closed.
+func (cs *connections) serve(conn net.Conn, srv *rpc.Server, c *serverCodec) {
+	cs.mu.Lock()
+	if cs.draining {
+		cs.mu.Unlock()
+		c.Close()
+		return
+	}
+	cs.conns[conn] = c
+	cs.mu.Unlock()
+	srv.ServeCodec(c)
+}
+
+// drain lets connections answer requests they already read and waits for them to close. Connections still
+// busy after timeout are closed, drain returns when all connection goroutines are finished.
+func (cs *connections) drain(timeout time.Duration) {
+	cs.mu.Lock()
+	cs.draining = true
+	codecs := make([]*serverCodec, 0, len(cs.conns))
+	for conn, c := range cs.conns {
+		if c == nil {
+			// rpc is not served yet, nothing to finish
+			conn.Close()
+			continue
+		}
+		codecs = append(codecs, c)
+	}
+	cs.mu.Unlock()
+	for _, c := range codecs {
+		c.drain()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	cs.mu.Lock()
+	serverLog.Warnf("gclpr server closes %d busy connection(s) after %s", len(cs.conns), timeout)
+	for conn, c := range cs.conns {
+		if c != nil {
+			c.Close()
+		}
+		conn.Close()
+	}
+	cs.mu.Unlock()
+	<-done
+}
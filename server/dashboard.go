@@ -0,0 +1,350 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+const (
+	// dashboardCookie carries dashboard token once browser presented it in URL, cookies are not
+	// separated by port, so name gets port appended.
+	dashboardCookie = "gclpr_dashboard"
+	// dashboardRefresh is how often dashboard gets fresh state when nothing happens, tunnel byte counts
+	// change without events.
+	dashboardRefresh = 2 * time.Second
+	// maxRecentActivity limits number of operations dashboard shows.
+	maxRecentActivity = 100
+)
+
+// activity remembers recent operations and when keys were last seen for dashboard. Nil activity
+// ignores everything.
+type activity struct {
+	info map[[32]byte]util.KeyInfo
+	now  func() time.Time
+
+	notifier
+	mu       sync.Mutex
+	lastSeen map[[32]byte]time.Time
+	recent   []auditRecord // oldest first
+}
+
+func newActivity(info map[[32]byte]util.KeyInfo) *activity {
+	return &activity{info: info, now: time.Now, lastSeen: make(map[[32]byte]time.Time)}
+}
+
+func (a *activity) record(r auditRecord, caller callerInfo) {
+	if a == nil {
+		return
+	}
+	r.Time = a.now()
+	r.identify(caller, a.info)
+
+	defer a.notify()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if r.Event == "request" && caller.known {
+		a.lastSeen[caller.key] = r.Time
+	}
+	// every connection starts with handshake, it is noise on dashboard
+	if strings.HasPrefix(r.Method, "Session.") {
+		return
+	}
+	a.recent = append(a.recent, r)
+	if len(a.recent) > maxRecentActivity {
+		a.recent = slices.Delete(a.recent, 0, len(a.recent)-maxRecentActivity)
+	}
+}
+
+// snapshot returns copies of last seen times and recent operations, newest first.
+func (a *activity) snapshot() (map[[32]byte]time.Time, []auditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	recent := slices.Clone(a.recent)
+	slices.Reverse(recent)
+	return maps.Clone(a.lastSeen), recent
+}
+
+// dashboardState is what dashboard shows.
+type dashboardState struct {
+	Version          string
+	Started          time.Time
+	Uptime           time.Duration
+	Listeners        []ListenerStatus
+	ClipboardBackend string
+	Keys             []dashboardKey
+	// Approvals are requests waiting for answer, oldest first.
+	Approvals []approvalRequest
+	// Remember is how long remembered approval is valid.
+	Remember time.Duration
+	// Tunnels is nil in relay mode.
+	Tunnels []TunnelStatus
+	Recent  []auditRecord
+	Locked  bool
+	Paused  bool
+}
+
+// dashboardKey describes trusted key, LastSeen is zero until key makes request.
+type dashboardKey struct {
+	Key         string
+	Label       string
+	Permissions []string
+	Approve     []string
+	LastSeen    time.Time
+}
+
+// dashboard serves local web page showing server state. Every request has to carry token server was
+// started with, browser presents it once in URL and keeps it in cookie afterwards.
+type dashboard struct {
+	s        *serverState
+	activity *activity
+	approve  *approver
+	token    string
+}
+
+func (d *dashboard) state() dashboardState {
+	s := d.s
+	lastSeen, recent := d.activity.snapshot()
+	st := dashboardState{
+		Version:          s.version,
+		Started:          s.started,
+		Uptime:           time.Since(s.started),
+		ClipboardBackend: s.backend,
+		Recent:           recent,
+		Approvals:        d.approve.list(),
+	}
+	if d.approve != nil {
+		st.Remember = d.approve.remember
+	}
+	s.mu.Lock()
+	st.Listeners = slices.Clone(s.listeners)
+	s.mu.Unlock()
+	for hk := range s.keys {
+		ki := s.info[hk]
+		st.Keys = append(st.Keys, dashboardKey{Key: hex.EncodeToString(hk[:]), Label: ki.Label, Permissions: slices.Clone(ki.Permissions), Approve: slices.Clone(ki.Approve), LastSeen: lastSeen[hk]})
+	}
+	slices.SortFunc(st.Keys, func(a, b dashboardKey) int {
+		// labelled keys go first
+		if (a.Label == "") != (b.Label == "") {
+			if a.Label == "" {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(strings.Compare(a.Label, b.Label), strings.Compare(a.Key, b.Key))
+	})
+	if s.tunnel != nil {
+		st.Tunnels = s.tunnel.status([32]byte{}, true)
+	}
+	st.Locked, st.Paused = s.gateState()
+	return st
+}
+
+func (d *dashboard) handler() http.Handler {
+	static, _ := fs.Sub(dashboardAssets, "dashboard")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", d.index)
+	mux.Handle("GET /static/", d.authorized(http.StripPrefix("/static/", http.FileServerFS(static))))
+	mux.Handle("GET /api/state", d.authorized(http.HandlerFunc(d.serveState)))
+	mux.Handle("GET /api/events", d.authorized(http.HandlerFunc(d.serveEvents)))
+	mux.Handle("POST /api/tunnels/{id}/kill", d.authorized(http.HandlerFunc(d.killTunnel)))
+	mux.Handle("POST /api/pause", d.authorized(http.HandlerFunc(d.pause)))
+	mux.Handle("POST /api/resume", d.authorized(http.HandlerFunc(d.pause)))
+	mux.Handle("POST /api/approvals/{id}/{answer}", d.authorized(http.HandlerFunc(d.answer)))
+	return d.guard(mux)
+}
+
+// guard refuses requests addressed to anything but loopback names, so pages of other sites cannot reach
+// dashboard through DNS rebinding, and sets headers which keep page to itself.
+func (d *dashboard) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if host != "localhost" {
+			if ip := net.ParseIP(strings.Trim(host, "[]")); ip == nil || !ip.IsLoopback() {
+				http.Error(w, "dashboard is only available on loopback address", http.StatusForbidden)
+				return
+			}
+		}
+		if r.Method != http.MethodGet {
+			// browser sends Origin with every cross-site POST
+			if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+				http.Error(w, "cross-origin request refused", http.StatusForbidden)
+				return
+			}
+		}
+		h := w.Header()
+		h.Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// valid checks token in constant time.
+func (d *dashboard) valid(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) == 1
+}
+
+func (d *dashboard) authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			if c, err := r.Cookie(cookieName(r)); err == nil {
+				token = c.Value
+			}
+		}
+		if !d.valid(token) {
+			http.Error(w, "dashboard token is required, open URL server printed on start", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// index exchanges token in URL for cookie, so it does not stay in address bar and history, and serves page.
+func (d *dashboard) index(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		if !d.valid(token) {
+			http.Error(w, "invalid dashboard token", http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: cookieName(r), Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	d.authorized(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, dashboardAssets, "dashboard/index.html")
+	})).ServeHTTP(w, r)
+}
+
+func cookieName(r *http.Request) string {
+	_, port, _ := net.SplitHostPort(r.Host)
+	return dashboardCookie + "_" + port
+}
+
+func (d *dashboard) serveState(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.state())
+}
+
+// serveEvents streams state as server-sent events whenever something happens and every dashboardRefresh.
+func (d *dashboard) serveEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	changed, stop := d.activity.watch()
+	defer stop()
+	var asked <-chan struct{}
+	if d.approve != nil {
+		var stopAsked func()
+		asked, stopAsked = d.approve.watch()
+		defer stopAsked()
+	}
+	tick := time.NewTicker(dashboardRefresh)
+	defer tick.Stop()
+	for {
+		data, err := json.Marshal(d.state())
+		if err != nil {
+			serverLog.Errorf("Unable to encode dashboard state: %v", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-asked:
+		case <-tick.C:
+		}
+	}
+}
+
+func (d *dashboard) killTunnel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if d.s.tunnel == nil || !d.s.tunnel.killSession(id) {
+		http.Error(w, fmt.Sprintf("unknown tunnel session %q", id), http.StatusNotFound)
+		return
+	}
+	serverLog.Infof("Tunnel session %s killed from dashboard", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// answer decides pending approval request.
+func (d *dashboard) answer(w http.ResponseWriter, r *http.Request) {
+	answers := map[string]approvalAnswer{"allow": approvalAllow, "remember": approvalRemember, "deny": approvalDeny}
+	ans, ok := answers[r.PathValue("answer")]
+	if !ok {
+		http.Error(w, "answer is one of allow, remember or deny", http.StatusBadRequest)
+		return
+	}
+	if d.approve == nil || !d.approve.answer(r.PathValue("id"), ans) {
+		http.Error(w, "request is not pending anymore", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pause serves both pause and resume.
+func (d *dashboard) pause(w http.ResponseWriter, r *http.Request) {
+	paused := r.URL.Path == "/api/pause"
+	if d.s.gate.paused.CompareAndSwap(!paused, paused) {
+		if paused {
+			serverLog.Infof("gclpr server is paused from dashboard")
+		} else {
+			serverLog.Infof("gclpr server is resumed from dashboard")
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listenDashboard starts dashboard listener on loopback.
+func listenDashboard(port int) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve dashboard address: %w", err)
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on '%s': %w", addr, err)
+	}
+	return l, nil
+}
+
+func serveDashboard(ctx context.Context, l net.Listener, d *dashboard) {
+	srv := &http.Server{Handler: d.handler(), ReadHeaderTimeout: DefaultIOTimeout}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	serverLog.Infof("gclpr dashboard is served on 'http://%s/'", l.Addr())
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		serverLog.Errorf("gclpr dashboard listener is unable to accept requests: %v", err)
+	}
+}
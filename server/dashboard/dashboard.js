@@ -0,0 +1,218 @@
+"use strict";
+
+// Dashboard renders state server streams as server-sent events. Everything coming from server is
+// inserted as text, labels and URLs are never interpreted as markup.
+
+const $ = (id) => document.getElementById(id);
+
+function el(tag, text, cls) {
+  const e = document.createElement(tag);
+  if (text !== undefined && text !== null) {
+    e.textContent = String(text);
+  }
+  if (cls) {
+    e.className = cls;
+  }
+  return e;
+}
+
+function row(cells) {
+  const tr = el("tr");
+  for (const c of cells) {
+    tr.append(c instanceof Node ? c : el("td", c));
+  }
+  return tr;
+}
+
+function isZero(t) {
+  return !t || t.startsWith("0001-01-01");
+}
+
+function ago(t) {
+  if (isZero(t)) {
+    return "never";
+  }
+  const s = Math.max(0, Math.round((Date.now() - Date.parse(t)) / 1000));
+  if (s < 60) {
+    return s + "s ago";
+  }
+  if (s < 3600) {
+    return Math.floor(s / 60) + "m ago";
+  }
+  if (s < 86400) {
+    return Math.floor(s / 3600) + "h ago";
+  }
+  return Math.floor(s / 86400) + "d ago";
+}
+
+function duration(ns) {
+  const s = Math.floor(ns / 1e9);
+  const d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+  return (d ? d + "d " : "") + (d || h ? h + "h " : "") + m + "m " + (s % 60) + "s";
+}
+
+function bytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function short(key) {
+  return key ? key.slice(0, 12) + "…" : "";
+}
+
+function num(v) {
+  return el("td", v, "num");
+}
+
+async function post(path) {
+  const resp = await fetch(path, { method: "POST" });
+  if (!resp.ok) {
+    alert(await resp.text());
+  }
+}
+
+function renderServer(st) {
+  $("version").textContent = st.Version;
+  const state = $("state");
+  state.textContent = st.Locked ? "locked" : st.Paused ? "paused" : "serving";
+  state.className = "badge" + (st.Locked ? " locked" : st.Paused ? " paused" : "");
+
+  const pause = $("pause");
+  pause.hidden = false;
+  pause.textContent = st.Paused ? "Resume" : "Pause";
+  pause.onclick = () => post(st.Paused ? "/api/resume" : "/api/pause");
+
+  const dl = $("server");
+  dl.replaceChildren();
+  const items = [["Uptime", duration(st.Uptime)], ["Clipboard", st.ClipboardBackend]];
+  for (const l of st.Listeners || []) {
+    items.push([l.Kind, l.Addr]);
+  }
+  for (const [k, v] of items) {
+    dl.append(el("dt", k), el("dd", v));
+  }
+}
+
+function renderKeys(st) {
+  const body = $("keys");
+  body.replaceChildren();
+  for (const k of st.Keys || []) {
+    const key = el("td", short(k.Key), "key");
+    key.title = k.Key;
+    const seen = el("td", ago(k.LastSeen));
+    if (!isZero(k.LastSeen)) {
+      seen.title = new Date(k.LastSeen).toLocaleString();
+    }
+    body.append(row([k.Label || "", key, (k.Permissions || []).join(", "), (k.Approve || []).join(", "), seen]));
+  }
+}
+
+const verbs = { paste: "read clipboard", open: "open", tunnel: "open tunnel for" };
+
+function renderApprovals(st) {
+  const approvals = st.Approvals || [];
+  $("approvals-section").hidden = approvals.length === 0;
+  const body = $("approvals");
+  body.replaceChildren();
+  for (const a of approvals) {
+    const action = el("td");
+    for (const [answer, text] of [["allow", "Allow"], ["remember", "Remember for " + duration(st.Remember).replace(/^0m /, "")], ["deny", "Deny"]]) {
+      const b = el("button", text);
+      b.type = "button";
+      b.onclick = () => post("/api/approvals/" + encodeURIComponent(a.ID) + "/" + answer);
+      action.append(b, " ");
+    }
+    const key = el("td", a.Label || short(a.Key), a.Label ? "" : "key");
+    key.title = a.Key + (a.Origin ? " on behalf of " + a.Origin[0] : "");
+    const left = Math.max(0, Math.round((Date.parse(a.Deadline) - Date.now()) / 1000));
+    body.append(row([key, verbs[a.Op] || a.Op, el("td", a.Detail, "url"), num(left + "s"), action]));
+  }
+}
+
+function renderTunnels(st) {
+  $("tunnels-section").hidden = st.Tunnels === null;
+  const body = $("tunnels");
+  body.replaceChildren();
+  const labels = new Map((st.Keys || []).map((k) => [k.Key, k.Label]));
+  for (const t of st.Tunnels || []) {
+    const kill = el("button", "Kill");
+    kill.type = "button";
+    kill.onclick = () => {
+      if (confirm("Kill tunnel session " + t.ID + "?")) {
+        post("/api/tunnels/" + encodeURIComponent(t.ID) + "/kill");
+      }
+    };
+    const action = el("td");
+    action.append(kill);
+    const owner = el("td", labels.get(t.Owner) || short(t.Owner), "key");
+    owner.title = t.Owner;
+    body.append(row([
+      el("td", t.ID.slice(0, 8), "key"),
+      el("td", t.URL, "url"),
+      owner,
+      (t.Listeners || []).join(" "),
+      num(t.Attached ? t.Streams + " / " + t.Opened : "waiting"),
+      num(bytes(t.BytesIn)),
+      num(bytes(t.BytesOut)),
+      ago(t.Created).replace(" ago", ""),
+      action,
+    ]));
+  }
+}
+
+function details(r) {
+  switch (r.event) {
+    case "request":
+      return r.method + (r.listener !== "rpc" ? " (" + r.listener + ")" : "");
+    case "tunnel_open":
+      return (r.session || "").slice(0, 8) + " " + r.url;
+    case "tunnel_close":
+      return (r.session || "").slice(0, 8);
+    case "approval":
+      return verbs[r.method] || r.method;
+    default:
+      return "";
+  }
+}
+
+function renderRecent(st) {
+  const body = $("recent");
+  body.replaceChildren();
+  for (const r of st.Recent || []) {
+    const outcome = el("td", r.outcome || r.reason || "", r.outcome || (r.event === "auth_failure" ? "error" : ""));
+    if (r.error) {
+      outcome.title = r.error;
+    }
+    const caller = el("td", r.label || short(r.key), r.label ? "" : "key");
+    caller.title = r.key || "";
+    body.append(row([new Date(r.time).toLocaleTimeString(), r.event, el("td", details(r), "url"), caller, outcome]));
+  }
+}
+
+function render(st) {
+  renderServer(st);
+  renderApprovals(st);
+  renderKeys(st);
+  renderTunnels(st);
+  renderRecent(st);
+}
+
+function connect() {
+  const status = $("connection");
+  const es = new EventSource("/api/events");
+  es.addEventListener("state", (e) => {
+    status.textContent = "";
+    render(JSON.parse(e.data));
+  });
+  es.onerror = () => {
+    // browser reconnects on its own, unless server refused the request
+    status.textContent = es.readyState === EventSource.CLOSED ? "disconnected, reload page" : "reconnecting…";
+  };
+}
+
+connect();
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+func newTestDashboard() (*dashboard, [32]byte) {
+	key := [32]byte{7}
+	info := map[[32]byte]util.KeyInfo{key: {Label: "laptop", Permissions: []string{util.PermAdmin}}}
+	s := &serverState{version: "test", started: time.Now(), backend: "xclip", keys: map[[32]byte][32]byte{key: {}, {9}: {}}, info: info, gate: &gate{}, tunnel: NewTunnel()}
+	return &dashboard{s: s, activity: newActivity(info), token: "secret"}, key
+}
+
+func TestDashboardAuth(t *testing.T) {
+	d, _ := newTestDashboard()
+	h := d.handler()
+	do := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Host = "localhost:9000"
+		for k, v := range header {
+			if k == "Host" {
+				r.Host = v
+				continue
+			}
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("GET", "/", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token: %d", w.Code)
+	}
+	if w := do("GET", "/?token=guess", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("bad token: %d", w.Code)
+	}
+	w := do("GET", "/?token=secret", nil)
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" || len(cookies) != 1 || cookies[0].Name != "gclpr_dashboard_9000" || !cookies[0].HttpOnly {
+		t.Fatalf("token exchange: %d %q %v", w.Code, w.Header().Get("Location"), cookies)
+	}
+	cookie := map[string]string{"Cookie": cookies[0].Name + "=" + cookies[0].Value}
+	if w := do("GET", "/", cookie); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/static/dashboard.js") {
+		t.Fatalf("index: %d", w.Code)
+	}
+	if w := do("GET", "/static/dashboard.js", cookie); w.Code != http.StatusOK || w.Header().Get("Content-Security-Policy") == "" {
+		t.Fatalf("asset: %d %v", w.Code, w.Header())
+	}
+	if w := do("GET", "/static/dashboard.js", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("asset without token: %d", w.Code)
+	}
+	// DNS rebinding
+	if w := do("GET", "/api/state", map[string]string{"Host": "evil.example.com:9000", "Authorization": "Bearer secret"}); w.Code != http.StatusForbidden {
+		t.Fatalf("foreign host: %d", w.Code)
+	}
+	if w := do("GET", "/api/state", map[string]string{"Host": "127.0.0.1:9000", "Authorization": "Bearer secret"}); w.Code != http.StatusOK {
+		t.Fatalf("loopback address: %d", w.Code)
+	}
+	if w := do("POST", "/api/pause", map[string]string{"Authorization": "Bearer secret", "Origin": "http://evil.example.com"}); w.Code != http.StatusForbidden || d.s.gate.paused.Load() {
+		t.Fatalf("cross-origin pause: %d", w.Code)
+	}
+	if w := do("POST", "/api/pause", map[string]string{"Authorization": "Bearer secret", "Origin": "http://localhost:9000"}); w.Code != http.StatusNoContent || !d.s.gate.paused.Load() {
+		t.Fatalf("pause: %d", w.Code)
+	}
+	if w := do("POST", "/api/resume", map[string]string{"Authorization": "Bearer secret"}); w.Code != http.StatusNoContent || d.s.gate.paused.Load() {
+		t.Fatalf("resume: %d", w.Code)
+	}
+	if w := do("POST", "/api/tunnels/nope/kill", map[string]string{"Authorization": "Bearer secret"}); w.Code != http.StatusNotFound {
+		t.Fatalf("kill unknown session: %d", w.Code)
+	}
+}
+
+func TestDashboardEvents(t *testing.T) {
+	d, key := newTestDashboard()
+	srv := httptest.NewServer(d.handler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/events", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+	next := func() dashboardState {
+		t.Helper()
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("event stream: %v", err)
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				var st dashboardState
+				if err := json.Unmarshal([]byte(data), &st); err != nil {
+					t.Fatal(err)
+				}
+				return st
+			}
+		}
+	}
+
+	st := next()
+	if len(st.Keys) != 2 || st.Keys[0].Label != "laptop" || !st.Keys[0].LastSeen.IsZero() || st.Tunnels == nil || len(st.Recent) != 0 {
+		t.Fatalf("initial state: %+v", st)
+	}
+
+	ev := &events{activity: d.activity}
+	caller := callerInfo{key: key, known: true, req: "r1"}
+	ev.request(requestEvent{listener: "rpc", method: "Session.Hello", outcome: "ok", caller: caller})
+	ev.request(requestEvent{listener: "rpc", method: "Clipboard.Copy", outcome: "ok", caller: caller})
+	for st = next(); len(st.Recent) == 0; st = next() {
+	}
+	if st.Keys[0].LastSeen.IsZero() || len(st.Recent) != 1 || st.Recent[0].Method != "Clipboard.Copy" || st.Recent[0].Label != "laptop" || st.Recent[0].Key != hex.EncodeToString(key[:]) {
+		t.Fatalf("state after copy: %+v", st)
+	}
+}
+
+func TestActivityRecent(t *testing.T) {
+	a := newActivity(nil)
+	for range maxRecentActivity + 10 {
+		a.record(auditRecord{Event: "auth_failure"}, callerInfo{})
+	}
+	a.record(auditRecord{Event: "tunnel_open", Session: "last"}, callerInfo{})
+	_, recent := a.snapshot()
+	if len(recent) != maxRecentActivity || recent[0].Session != "last" {
+		t.Fatalf("recent = %d, newest %+v", len(recent), recent[0])
+	}
+}
+
+func TestDashboardApproval(t *testing.T) {
+	d, key := newTestDashboard()
+	d.approve = newApprover(map[[32]byte]util.KeyInfo{key: {Label: "laptop", Approve: []string{util.ApproveOpen}}}, ApprovalOptions{})
+	h := d.handler()
+	post := func(target string) int {
+		r := httptest.NewRequest("POST", target, nil)
+		r.Host = "localhost:9000"
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		res <- d.approve.check(util.ApproveOpen, callerInfo{key: key, known: true}, "https://example.com")
+	}()
+	var pending []approvalRequest
+	for deadline := time.Now().Add(5 * time.Second); len(pending) == 0 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		pending = d.state().Approvals
+	}
+	if len(pending) != 1 || pending[0].Label != "laptop" || pending[0].Detail != "https://example.com" {
+		t.Fatalf("pending approvals: %+v", pending)
+	}
+	if code := post("/api/approvals/" + pending[0].ID + "/maybe"); code != http.StatusBadRequest {
+		t.Fatalf("unknown answer: %d", code)
+	}
+	if code := post("/api/approvals/" + pending[0].ID + "/deny"); code != http.StatusNoContent {
+		t.Fatalf("deny: %d", code)
+	}
+	if err := <-res; err == nil {
+		t.Fatal("denied open was allowed")
+	}
+	if code := post("/api/approvals/" + pending[0].ID + "/allow"); code != http.StatusNotFound {
+		t.Fatalf("answered request: %d", code)
+	}
+}
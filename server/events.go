@@ -0,0 +1,104 @@
+package server
+
+import (
+	"time"
+)
+
+// events passes what server does to metrics, audit log, dashboard and hooks. Nil events ignores
+// everything, so objects created outside of Serve do not need any.
+type events struct {
+	metrics  *metrics
+	audit    *auditLog
+	activity *activity
+	hooks    *hookRunner
+}
+
+// callerInfo identifies client in audit records and hooks, key is not known for lemonade requests. Origin
+// lists key hashes of previous hops, original client first, when key belongs to relay.
+type callerInfo struct {
+	key    [32]byte
+	known  bool
+	req    string
+	origin []string
+}
+
+func noCaller() callerInfo { return callerInfo{} }
+
+// requestEvent describes rpc request answered with outcome, duration is not known for refused requests.
+type requestEvent struct {
+	listener string
+	method   string
+	outcome  string
+	err      string
+	duration time.Duration
+	caller   callerInfo
+}
+
+func (e *events) request(r requestEvent) {
+	if e == nil {
+		return
+	}
+	e.metrics.request(r.listener, r.method, r.outcome, r.duration)
+	e.record(auditRecord{Event: "request", Listener: r.listener, Method: r.method, Outcome: r.outcome, Error: r.err, Duration: r.duration.Seconds()}, r.caller)
+}
+
+// record passes record to audit log and dashboard.
+func (e *events) record(r auditRecord, caller callerInfo) {
+	if e == nil {
+		return
+	}
+	e.audit.write(r, caller)
+	e.activity.record(r, caller)
+}
+
+func (e *events) authFailure(reason string, caller callerInfo) {
+	if e == nil {
+		return
+	}
+	e.metrics.authFailure(reason)
+	e.record(auditRecord{Event: "auth_failure", Reason: reason}, caller)
+	e.hooks.authFailure(reason, caller)
+}
+
+func (e *events) payload(op string, size int) {
+	if e == nil {
+		return
+	}
+	e.metrics.payload(op, size)
+}
+
+// copied is called once text is in clipboard.
+func (e *events) copied(text, mime string, caller callerInfo) {
+	if e == nil {
+		return
+	}
+	e.metrics.payload("copy", len(text))
+	e.hooks.afterCopy(text, mime, caller)
+}
+
+// beforeOpen returns URL to open or error when open is refused, caller has to validate returned URL.
+func (e *events) beforeOpen(url string, caller callerInfo) (string, error) {
+	if e == nil {
+		return url, nil
+	}
+	return e.hooks.beforeOpen(url, caller)
+}
+
+func (e *events) tunnelOpened(s *tunnelSession) {
+	if e == nil {
+		return
+	}
+	e.metrics.tunnelOpened()
+	e.record(auditRecord{Event: "tunnel_open", Session: s.id, URL: redactURL(s.url)}, s.caller())
+	e.hooks.tunnelOpened(s)
+}
+
+func (e *events) tunnelClosed(s *tunnelSession) {
+	if e == nil {
+		return
+	}
+	reason := s.reason()
+	e.metrics.tunnelClosed(reason)
+	e.record(auditRecord{Event: "tunnel_close", Session: s.id, Reason: closeReasonLabel(reason)}, s.caller())
+	e.hooks.tunnelClosed(s)
+}
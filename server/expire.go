@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MIMEConcealed is type clipboard managers look for to skip content, KDE Klipper and others follow it.
+// Content marked with it offers this type along with its own one, its data is "secret".
+const MIMEConcealed = "x-kde-passwordManagerHint"
+
+// ConcealedClipboardBackend is backend which can mark content as secret, so clipboard managers and
+// clipboard history of operating system skip it.
+type ConcealedClipboardBackend interface {
+	ClipboardBackend
+	WriteConcealed(mime string, data []byte) error
+}
+
+// ExpiringCopyRequest starts streaming copy which is taken back from clipboard after TTL. It continues
+// the same way as CopyTypeBegin.
+type ExpiringCopyRequest struct {
+	CopyTypeRequest
+	TTL time.Duration
+}
+
+// clipContent is content of single backend, empty type means there was nothing to read.
+type clipContent struct {
+	mime string
+	data []byte
+}
+
+// expiringCopy is copy waiting for its TTL to pass.
+type expiringCopy struct {
+	sel      string
+	backends []ClipboardBackend
+	previous []clipContent // what backends had before copy
+	copied   []byte
+	// written is copy as backends read it back, tools may change it, i.e. wsl drops trailing line end
+	written [][]byte
+	timer   *time.Timer
+}
+
+// expiry keeps the only expiring copy, new one takes the previous one back first, so its content is never
+// restored over.
+type expiry struct {
+	mu      sync.Mutex
+	pending *expiringCopy
+}
+
+// copyExpiring puts data of MIME type into backends of selection marked as concealed where backend
+// supports it, after ttl backends which still hold it get their previous content back or are cleared.
+// It returns copy as the first backend reads it back.
+func (c *Clipboard) copyExpiring(sel, mime string, data []byte, ttl time.Duration) ([]byte, error) {
+	backends, err := c.selected(sel)
+	if err != nil {
+		return nil, err
+	}
+	c.expiry.mu.Lock()
+	defer c.expiry.mu.Unlock()
+	c.expireLocked()
+
+	copied := data
+	if sameType(mime, MIMEText) {
+		copied = []byte(ConvertLE(string(data), c.leOP))
+	}
+	e := &expiringCopy{sel: sel, backends: backends, previous: make([]clipContent, len(backends)), copied: copied, written: make([][]byte, len(backends))}
+	for i, b := range backends {
+		pt, prev, err := c.current(b)
+		if err != nil {
+			c.log().Debugf("Unable to read clipboard before expiring copy, it will be cleared: %v", err)
+			continue
+		}
+		e.previous[i] = clipContent{mime: pt, data: prev}
+	}
+	// copy which fails half way is taken back too
+	e.timer = time.AfterFunc(ttl, func() {
+		c.expiry.mu.Lock()
+		defer c.expiry.mu.Unlock()
+		if c.expiry.pending == e {
+			c.expireLocked()
+		}
+	})
+	c.expiry.pending = e
+	for i, b := range backends {
+		e.written[i] = copied
+		if err := c.writeConcealed(b, mime, data); err != nil {
+			return nil, err
+		}
+		if _, back, err := c.current(b); err == nil {
+			e.written[i] = back
+		}
+	}
+	return e.written[0], nil
+}
+
+// expiring reports whether data is pending expiring copy, as it was sent or as any backend read it back.
+func (c *Clipboard) expiring(data []byte) bool {
+	c.expiry.mu.Lock()
+	defer c.expiry.mu.Unlock()
+	e := c.expiry.pending
+	if e == nil {
+		return false
+	}
+	if bytes.Equal(data, e.copied) {
+		return true
+	}
+	for _, written := range e.written {
+		if written != nil && bytes.Equal(data, written) {
+			return true
+		}
+	}
+	return false
+}
+
+// expire takes pending expiring copy back right away.
+func (c *Clipboard) expire() {
+	c.expiry.mu.Lock()
+	defer c.expiry.mu.Unlock()
+	c.expireLocked()
+}
+
+// expireLocked restores content backends had before pending copy, must be called with c.expiry.mu held.
+// Backends content of which was replaced since are left alone.
+func (c *Clipboard) expireLocked() {
+	e := c.expiry.pending
+	if e == nil {
+		return
+	}
+	c.expiry.pending = nil
+	e.timer.Stop()
+
+	for i, b := range e.backends {
+		_, data, err := c.current(b)
+		if err != nil || e.written[i] == nil || !bytes.Equal(data, e.written[i]) {
+			c.log().Debugf("Clipboard content was replaced before expiring copy ended, not restored")
+			continue
+		}
+		prev := e.previous[i]
+		if err := c.restore(b, prev); err != nil {
+			c.log().Warnf("Unable to take expired copy back from clipboard: %v", err)
+			continue
+		}
+		c.log().Infof("Expiring copy of %d bytes is taken back from clipboard, %d bytes restored", len(e.copied), len(prev.data))
+		if i == 0 && e.sel != SelectionPrimary {
+			c.watch.changed(prev.mime, prev.data, callerInfo{})
+		}
+	}
+}
+
+// current returns content of backend, content which is not text is read as the first type it is offered as.
+func (c *Clipboard) current(b ClipboardBackend) (string, []byte, error) {
+	text, err := b.Read()
+	if err == nil {
+		return MIMEText, []byte(text), nil
+	}
+	tb, ok := b.(TypedClipboardBackend)
+	if !ok {
+		return "", nil, err
+	}
+	types, err := tb.Types()
+	if err != nil || len(types) == 0 {
+		return "", nil, err
+	}
+	data, err := tb.ReadType(types[0])
+	return types[0], data, err
+}
+
+// restore puts content current returned back, backend is cleared when there was none.
+func (c *Clipboard) restore(b ClipboardBackend, content clipContent) error {
+	if content.mime == "" || sameType(content.mime, MIMEText) {
+		return b.Write(string(content.data))
+	}
+	return c.writeType(b, content.mime, content.data)
+}
+
+// writeConcealed is writeType which marks content as secret on backends which support it.
+func (c *Clipboard) writeConcealed(b ClipboardBackend, mime string, data []byte) error {
+	cb, ok := b.(ConcealedClipboardBackend)
+	if !ok {
+		c.log().Debugf("Clipboard backend %s cannot mark content as secret", b.Name())
+		return c.writeType(b, mime, data)
+	}
+	if sameType(mime, MIMEText) {
+		data = []byte(ConvertLE(string(data), c.leOP))
+	} else if _, typed := b.(TypedClipboardBackend); !typed && !strings.HasPrefix(mediaType(mime), "text/") {
+		return c.writeType(b, mime, data)
+	}
+	return cb.WriteConcealed(mime, data)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func copyExpiring(c *Clipboard, sel, text string, ttl time.Duration) error {
+	var tr TransferResponse
+	req := ExpiringCopyRequest{CopyTypeRequest: CopyTypeRequest{Type: MIMEText, Size: int64(len(text)), Selection: sel}, TTL: ttl}
+	if err := c.CopyExpiringBegin(req, &tr); err != nil {
+		return err
+	}
+	if err := c.CopyChunk(ChunkRequest{TransferID: tr.TransferID, Data: []byte(text)}, nil); err != nil {
+		return err
+	}
+	return c.CopyEnd(tr.TransferID, nil)
+}
+
+func TestClipboardExpiringCopy(t *testing.T) {
+	clip := fakeClipboard(t, "before")
+	c := NewClipboard("", 0)
+	c.history = newHistory(HistoryOptions{Size: 10}, nil)
+
+	if err := copyExpiring(c, "", "secret", 0); err == nil {
+		t.Fatal("copy without TTL is accepted")
+	}
+	if err := copyExpiring(c, "", "secret", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if types, _ := clip.Types(); clip.content() != "secret" || !slices.Contains(types, MIMEConcealed) {
+		t.Fatalf("clipboard = %q, types %v", clip.content(), types)
+	}
+	if list := c.history.list(); len(list) != 0 {
+		t.Fatalf("expiring copy is in history: %+v", list)
+	}
+	for deadline := time.Now().Add(5 * time.Second); clip.content() != "before"; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("clipboard = %q after TTL", clip.content())
+		}
+	}
+	if types, _ := clip.Types(); slices.Contains(types, MIMEConcealed) {
+		t.Fatalf("restored content is concealed: %v", types)
+	}
+
+	// content replaced before TTL passes is left alone
+	if err := copyExpiring(c, "", "secret", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Copy("replaced", nil); err != nil {
+		t.Fatal(err)
+	}
+	c.expire()
+	if clip.content() != "replaced" {
+		t.Fatalf("replaced clipboard = %q", clip.content())
+	}
+
+	// the second expiring copy takes the first one back, so the first one is never restored
+	if err := copyExpiring(c, "", "first", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyExpiring(c, "", "second", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	c.shutdown()
+	if clip.content() != "replaced" {
+		t.Fatalf("clipboard after shutdown = %q", clip.content())
+	}
+}
+
+func TestClipboardExpiringCopyClears(t *testing.T) {
+	clip := fakeClipboard(t, "")
+	c := NewClipboard("", 0)
+	if err := copyTyped(c, "", "image/png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyExpiring(c, SelectionBoth, "secret", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	primary := clip.Primary().(*memoryBackend)
+	if primary.content() != "secret" {
+		t.Fatalf("primary = %q", primary.content())
+	}
+	c.expire()
+	if data, err := clip.ReadType("image/png"); err != nil || string(data) != "png" {
+		t.Fatalf("clipboard = %q, %v", data, err)
+	}
+	// selection which was empty is cleared
+	if primary.content() != "" {
+		t.Fatalf("primary = %q", primary.content())
+	}
+}
+
+func TestClipboardExpiringCopyNormalisedByBackend(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("STORE", filepath.Join(dir, "store"))
+	// like Get-Clipboard of wsl backend, reading ends every line with CRLF, backend trims the last one
+	fakeTool(t, dir, "paste", `awk '{ printf "%s\r\n", $0 }' "$STORE"`)
+	fakeTool(t, dir, "copy", `cat > "$STORE"`)
+	b := newCommandBackend("wsl", clipboardCommand{read: []string{"paste"}, write: []string{"copy"}, trim: "\r\n"})
+	if err := b.Write("before"); err != nil {
+		t.Fatal(err)
+	}
+	c := NewClipboard("", 0)
+	c.backend = b
+
+	if err := copyExpiring(c, "", "user\nsecret", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	c.expire()
+	if text, err := b.Read(); err != nil || text != "before" {
+		t.Fatalf("clipboard = %q, %v", text, err)
+	}
+}
@@ -1,7 +1,12 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"strings"
+	"sync"
+
+	"github.com/rupor-github/gclpr/util"
 )
 
 // ConvertLE is used to normalize line endings when exchanging clipboard content.
@@ -19,3 +24,66 @@ func ConvertLE(text, op string) string {
 		return text
 	}
 }
+
+// randomID returns random 128 bit identifier encoded as hex string.
+func randomID() (string, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw[:]), nil
+}
+
+// logSource returns logger for the next message, loggers of connection pick up request id once client sends it.
+type logSource func() util.Logger
+
+// fixedLog is logSource for messages which are not related to any connection.
+func fixedLog(l util.Logger) logSource {
+	return func() util.Logger { return l }
+}
+
+// requestLogger returns logger of subsystem which marks messages with request id client attached to its connection.
+func requestLogger(subsys, id string) util.Logger {
+	l := util.NewLogger(subsys)
+	if id != "" {
+		l = l.With("req", id)
+	}
+	return l
+}
+
+// notifier tells watchers something changed, changes coalesce while watcher is busy. Nil notifier
+// never notifies.
+type notifier struct {
+	mu       sync.Mutex
+	watchers map[chan struct{}]struct{}
+}
+
+// watch returns channel which receives on change and function to stop watching.
+func (n *notifier) watch() (<-chan struct{}, func()) {
+	if n == nil {
+		return nil, func() {}
+	}
+	ch := make(chan struct{}, 1)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.watchers == nil {
+		n.watchers = make(map[chan struct{}]struct{})
+	}
+	n.watchers[ch] = struct{}{}
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.watchers, ch)
+	}
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// DefaultHistoryMaxSize limits total size of clipboard history entries when HistoryOptions do not.
+const DefaultHistoryMaxSize = 16 << 20
+
+// historyPreview is how many characters of text entry history listing shows.
+const historyPreview = 40
+
+// HistoryOptions configure clipboard history, server does not keep it unless Size is set.
+type HistoryOptions struct {
+	// Size is how many copied entries server remembers.
+	Size int
+	// MaxSize limits total size of remembered entries in bytes, oldest entries are forgotten first.
+	MaxSize int64
+}
+
+// HistoryEntry describes remembered copy, N is its position starting with 1 for the latest one.
+type HistoryEntry struct {
+	N       int
+	Time    time.Time
+	Key     string `json:",omitempty"`
+	Label   string `json:",omitempty"`
+	Type    string
+	Size    int
+	Preview string `json:",omitempty"`
+}
+
+// historyEntry is remembered copy along with the client which made it.
+type historyEntry struct {
+	time   time.Time
+	caller callerInfo
+	mime   string
+	data   []byte
+}
+
+// history is bounded in memory ring of copied clipboard content. Nil history remembers nothing.
+type history struct {
+	mu      sync.Mutex
+	size    int
+	maxSize int64
+	used    int64
+	entries []historyEntry // the latest entry goes last
+	info    map[[32]byte]util.KeyInfo
+}
+
+func newHistory(opts HistoryOptions, info map[[32]byte]util.KeyInfo) *history {
+	if opts.Size <= 0 {
+		return nil
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultHistoryMaxSize
+	}
+	return &history{size: opts.Size, maxSize: opts.MaxSize, info: info}
+}
+
+// add remembers data of MIME type copied by caller. Entries larger than the whole history and repeated
+// copies of the latest entry are not remembered.
+func (h *history) add(mime string, data []byte, caller callerInfo) {
+	if h == nil || int64(len(data)) > h.maxSize {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.entries); n > 0 && h.entries[n-1].mime == mime && bytes.Equal(h.entries[n-1].data, data) {
+		h.entries[n-1].time, h.entries[n-1].caller = time.Now(), caller
+		return
+	}
+	h.entries = append(h.entries, historyEntry{time: time.Now(), caller: caller, mime: mime, data: bytes.Clone(data)})
+	h.used += int64(len(data))
+	for len(h.entries) > h.size || h.used > h.maxSize {
+		h.used -= int64(len(h.entries[0].data))
+		h.entries[0] = historyEntry{}
+		h.entries = h.entries[1:]
+	}
+}
+
+// get returns entry n counting from 1 for the latest one.
+func (h *history) get(n int) (historyEntry, error) {
+	if h == nil {
+		return historyEntry{}, errNoHistory
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n < 1 || n > len(h.entries) {
+		return historyEntry{}, fmt.Errorf("clipboard history has %d entries, there is no entry %d", len(h.entries), n)
+	}
+	return h.entries[len(h.entries)-n], nil
+}
+
+// list describes remembered entries, the latest first.
+func (h *history) list() []HistoryEntry {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]HistoryEntry, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		he := HistoryEntry{N: len(list) + 1, Time: e.time, Type: e.mime, Size: len(e.data), Preview: preview(e.mime, e.data)}
+		if e.caller.known {
+			he.Key = hex.EncodeToString(e.caller.key[:])
+			he.Label = h.info[e.caller.key].Label
+		}
+		list = append(list, he)
+	}
+	return list
+}
+
+// clear forgets every entry and returns how many there were.
+func (h *history) clear() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := len(h.entries)
+	h.entries, h.used = nil, 0
+	return n
+}
+
+var errNoHistory = errors.New("server does not keep clipboard history, start it with -history")
+
+// preview returns beginning of the first line of text entry safe to print on terminal.
+func preview(mime string, data []byte) string {
+	if !strings.HasPrefix(mediaType(mime), "text/") || !utf8.Valid(data) {
+		return ""
+	}
+	text, rest, _ := strings.Cut(strings.TrimLeft(string(data), " \t\r\n"), "\n")
+	text, more := strings.TrimRight(text, "\r"), strings.TrimSpace(rest) != ""
+	if r := []rune(text); len(r) > historyPreview {
+		text, more = string(r[:historyPreview]), true
+	}
+	if more {
+		text += "…"
+	}
+	return sanitize(text)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+func TestHistory(t *testing.T) {
+	if newHistory(HistoryOptions{}, nil) != nil {
+		t.Fatal("history is kept without size")
+	}
+	key := [32]byte{0xab}
+	h := newHistory(HistoryOptions{Size: 3, MaxSize: 12}, map[[32]byte]util.KeyInfo{key: {Label: "vm"}})
+	for _, s := range []string{"one", "two", "two", "three", "four"} {
+		h.add(MIMEText, []byte(s), callerInfo{key: key, known: true})
+	}
+	list := h.list()
+	if len(list) != 3 || list[0].Preview != "four" || list[2].Preview != "two" || list[0].N != 1 || list[0].Label != "vm" || !strings.HasPrefix(list[0].Key, "ab00") {
+		t.Fatalf("list = %+v", list)
+	}
+	// entries are forgotten when they do not fit
+	h.add("image/png", []byte("0123456789ab"), noCaller())
+	if list := h.list(); len(list) != 1 || list[0].Type != "image/png" || list[0].Preview != "" || list[0].Key != "" {
+		t.Fatalf("list = %+v", list)
+	}
+	h.add(MIMEText, []byte("too long to remember"), noCaller())
+	if e, err := h.get(1); err != nil || e.mime != "image/png" {
+		t.Fatalf("get = %+v, %v", e, err)
+	}
+	if _, err := h.get(2); err == nil || err.Error() != "clipboard history has 1 entries, there is no entry 2" {
+		t.Fatalf("get 2: %v", err)
+	}
+	if n := h.clear(); n != 1 || len(h.list()) != 0 {
+		t.Fatalf("clear = %d", n)
+	}
+
+	for text, want := range map[string]string{
+		"\n  first line\r\nsecond": "first line…",
+		"line\n":                   "line",
+		strings.Repeat("é", 50):    strings.Repeat("é", 40) + "…",
+		"bell\x07":                 "bell?",
+	} {
+		if got := preview("text/plain; charset=utf-8", []byte(text)); got != want {
+			t.Errorf("preview(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestClipboardHistory(t *testing.T) {
+	fakeClipboard(t, "")
+	admin := [32]byte{0xad}
+	c := NewClipboard("CRLF", 0)
+	c.info = map[[32]byte]util.KeyInfo{admin: {Permissions: []string{util.PermAdmin}}}
+	as := func(key [32]byte) *Clipboard {
+		return c.withConn(c.log, func() callerInfo { return callerInfo{key: key, known: true} })
+	}
+	var n int
+	if err := as(admin).HistoryClear(struct{}{}, &n); err != errNoHistory {
+		t.Fatalf("HistoryClear without history: %v", err)
+	}
+	c.history = newHistory(HistoryOptions{Size: 10}, nil)
+
+	if err := c.Copy("first\n", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTyped(c, "", "text/html", []byte("<b>second</b>")); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTyped(c, SelectionPrimary, "image/png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	var list []HistoryEntry
+	if err := c.History(struct{}{}, &list); err != nil || len(list) != 3 || list[2].Type != MIMEText || list[2].Size != len("first\r\n") {
+		t.Fatalf("History = %+v, %v", list, err)
+	}
+	var tr TransferResponse
+	if err := c.HistoryPasteBegin(HistoryPasteRequest{Entry: 3, Type: MIMEText}, &tr); err != nil || string(tr.Data) != "first\r\n" {
+		t.Fatalf("paste entry 3 = %q, %v", tr.Data, err)
+	}
+	// text of any type could be pasted as plain text
+	if err := c.HistoryPasteBegin(HistoryPasteRequest{Entry: 2, Type: MIMEText}, &tr); err != nil || string(tr.Data) != "<b>second</b>" {
+		t.Fatalf("paste entry 2 = %q, %v", tr.Data, err)
+	}
+	if err := c.HistoryPasteBegin(HistoryPasteRequest{Entry: 1, Type: MIMEText}, &tr); err == nil || err.Error() != "clipboard history entry 1 has image/png, not text/plain" {
+		t.Fatalf("paste image as text: %v", err)
+	}
+	if err := c.HistoryPasteBegin(HistoryPasteRequest{Entry: 1, Type: "image/png"}, &tr); err != nil || string(tr.Data) != "png" {
+		t.Fatalf("paste entry 1 = %q, %v", tr.Data, err)
+	}
+	// history is shared, key which is not admin cannot wipe it
+	if err := as([32]byte{0xcd}).HistoryClear(struct{}{}, &n); err == nil || err.Error() != "clipboard history clear requires admin key" {
+		t.Fatalf("HistoryClear by key which is not admin: %v", err)
+	}
+	if err := c.HistoryClear(struct{}{}, &n); err == nil {
+		t.Fatal("HistoryClear by unknown caller is accepted")
+	}
+	if list := c.history.list(); len(list) != 3 {
+		t.Fatalf("refused clear changed history: %+v", list)
+	}
+	if err := as(admin).HistoryClear(struct{}{}, &n); err != nil || n != 3 {
+		t.Fatalf("HistoryClear = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+const (
+	// DefaultHookTimeout limits run time of hooks which do not set their own.
+	DefaultHookTimeout = 5 * time.Second
+	// maxHookOutput limits output of hook kept by server.
+	maxHookOutput = 64 << 10
+)
+
+// Values of Hook.Stdin.
+const (
+	HookStdinJSON = "json"
+	HookStdinText = "text"
+)
+
+// Hook is command server runs when event happens. Hook gets event data in GCLPR_* environment variables
+// and, unless Stdin says otherwise, as JSON object on stdin.
+type Hook struct {
+	// Command is program to run followed by its arguments, it is not passed to shell.
+	Command []string
+	// Stdin selects what hook reads: HookStdinJSON (default) is event data, HookStdinText is copied
+	// text and is only valid for AfterCopy hooks.
+	Stdin string
+	// Timeout limits hook run time, DefaultHookTimeout is used when not set.
+	Timeout time.Duration
+}
+
+// Hooks lists commands run on server events, hooks of the same event run one after another.
+type Hooks struct {
+	// AfterCopy hooks run in background once copied text is in clipboard.
+	AfterCopy []Hook
+	// BeforeOpen hooks run before URI or tunnel URL is opened. Hook refuses open by exiting with non-zero
+	// code or running out of time, text it prints replaces URL, new URL is validated again.
+	BeforeOpen []Hook
+	// TunnelOpen and TunnelClose hooks run in background when tunnel session is reserved and closed.
+	TunnelOpen  []Hook
+	TunnelClose []Hook
+	// AuthFailure hooks run in background when request or tunnel attach fails authentication.
+	AuthFailure []Hook
+}
+
+// hookEvent is data hooks receive.
+type hookEvent struct {
+	Event   string   `json:"event"`
+	Key     string   `json:"key,omitempty"`
+	Label   string   `json:"label,omitempty"`
+	Request string   `json:"req,omitempty"`
+	Origin  []string `json:"origin,omitempty"`
+	Size    int      `json:"size,omitempty"`
+	Type    string   `json:"type,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Session string   `json:"session,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// env returns event data as environment variables, empty values are not set.
+func (ev hookEvent) env() []string {
+	env := []string{"GCLPR_EVENT=" + ev.Event}
+	for _, v := range []struct{ name, value string }{
+		{"GCLPR_KEY", ev.Key},
+		{"GCLPR_LABEL", ev.Label},
+		{"GCLPR_REQUEST", ev.Request},
+		{"GCLPR_ORIGIN", strings.Join(ev.Origin, ",")},
+		{"GCLPR_TYPE", ev.Type},
+		{"GCLPR_URL", ev.URL},
+		{"GCLPR_SESSION", ev.Session},
+		{"GCLPR_REASON", ev.Reason},
+	} {
+		if v.value != "" {
+			env = append(env, v.name+"="+v.value)
+		}
+	}
+	if ev.Event == "after_copy" {
+		env = append(env, "GCLPR_SIZE="+strconv.Itoa(ev.Size))
+	}
+	return env
+}
+
+// hookRunner runs hooks. Nil hookRunner runs nothing and lets every URL open.
+type hookRunner struct {
+	hooks Hooks
+	info  map[[32]byte]util.KeyInfo
+	log   util.Logger
+	wg    sync.WaitGroup // hooks running in background
+}
+
+func newHookRunner(hooks Hooks, info map[[32]byte]util.KeyInfo) *hookRunner {
+	if len(hooks.AfterCopy)+len(hooks.BeforeOpen)+len(hooks.TunnelOpen)+len(hooks.TunnelClose)+len(hooks.AuthFailure) == 0 {
+		return nil
+	}
+	return &hookRunner{hooks: hooks, info: info, log: util.NewLogger(util.SubsysHooks)}
+}
+
+func (r *hookRunner) event(name string, c callerInfo) hookEvent {
+	ev := hookEvent{Event: name, Request: c.req, Origin: c.origin}
+	if c.known {
+		ev.Key = hex.EncodeToString(c.key[:])
+		ev.Label = r.info[c.key].Label
+	}
+	return ev
+}
+
+func (r *hookRunner) afterCopy(text, mime string, c callerInfo) {
+	if r == nil {
+		return
+	}
+	ev := r.event("after_copy", c)
+	ev.Size, ev.Type = len(text), mime
+	r.background(r.hooks.AfterCopy, ev, text)
+}
+
+// beforeOpen returns URL to open, possibly replaced by hooks, or error when hook refuses open.
+func (r *hookRunner) beforeOpen(url string, c callerInfo) (string, error) {
+	if r == nil {
+		return url, nil
+	}
+	for _, h := range r.hooks.BeforeOpen {
+		ev := r.event("before_open", c)
+		ev.URL = url
+		out, err := r.run(h, ev, "")
+		if err != nil {
+			r.log.Infof("Hook %q refused to open '%s': %v", h.Command[0], url, err)
+			return "", fmt.Errorf("open is refused by hook: %w", err)
+		}
+		if replaced := strings.TrimSpace(out); replaced != "" && replaced != url {
+			r.log.Infof("Hook %q replaced '%s' with '%s'", h.Command[0], url, replaced)
+			url = replaced
+		}
+	}
+	return url, nil
+}
+
+func (r *hookRunner) tunnelOpened(s *tunnelSession) {
+	if r == nil {
+		return
+	}
+	ev := r.event("tunnel_open", s.caller())
+	ev.Session, ev.URL = s.id, s.url.String()
+	r.background(r.hooks.TunnelOpen, ev, "")
+}
+
+func (r *hookRunner) tunnelClosed(s *tunnelSession) {
+	if r == nil {
+		return
+	}
+	ev := r.event("tunnel_close", s.caller())
+	ev.Session, ev.URL, ev.Reason = s.id, s.url.String(), closeReasonLabel(s.reason())
+	r.background(r.hooks.TunnelClose, ev, "")
+}
+
+func (r *hookRunner) authFailure(reason string, c callerInfo) {
+	if r == nil {
+		return
+	}
+	ev := r.event("auth_failure", c)
+	ev.Reason = reason
+	r.background(r.hooks.AuthFailure, ev, "")
+}
+
+// background runs hooks without making event wait for them.
+func (r *hookRunner) background(hooks []Hook, ev hookEvent, text string) {
+	if len(hooks) == 0 {
+		return
+	}
+	r.wg.Go(func() {
+		for _, h := range hooks {
+			if _, err := r.run(h, ev, text); err != nil {
+				r.log.Warnf("Hook %q for %s failed: %v", h.Command[0], ev.Event, err)
+			}
+		}
+	})
+}
+
+// wait returns once hooks running in background are finished, they are limited by timeouts.
+func (r *hookRunner) wait() {
+	if r == nil {
+		return
+	}
+	r.wg.Wait()
+}
+
+// run runs hook and returns its standard output.
+func (r *hookRunner) run(h Hook, ev hookEvent, text string) (string, error) {
+	timeout := cmp.Or(h.Timeout, DefaultHookTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), ev.env()...)
+	if h.Stdin == HookStdinText {
+		cmd.Stdin = strings.NewReader(text)
+	} else {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return "", err
+		}
+		cmd.Stdin = bytes.NewReader(append(data, '\n'))
+	}
+	var stdout, stderr limitedBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// grandchildren holding output open do not keep hook running
+	cmd.WaitDelay = time.Second
+
+	r.log.Debugf("Running hook %q for %s", h.Command[0], ev.Event)
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("hook timed out after %s", timeout)
+	}
+	if err != nil {
+		if msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// limitedBuffer keeps the first maxHookOutput bytes written to it and discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxHookOutput - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+func shellHook(t *testing.T, script string) Hook {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests use sh")
+	}
+	return Hook{Command: []string{"sh", "-c", script}}
+}
+
+func TestHookBeforeOpen(t *testing.T) {
+	opened := fakeOpener(t)
+	veto := shellHook(t, `case "$GCLPR_URL" in *deny*) echo "denied by policy" >&2; exit 3;; esac`)
+	rewrite := shellHook(t, `read -r ev; case "$ev" in *'"event":"before_open"'*) ;; *) exit 1;; esac
+case "$GCLPR_URL" in *evil*) echo "file:///etc/passwd";; *) echo "$GCLPR_URL?via=hook";; esac`)
+
+	key := [32]byte{1}
+	uri := NewURI()
+	uri.events = &events{hooks: newHookRunner(Hooks{BeforeOpen: []Hook{veto, rewrite}}, map[[32]byte]util.KeyInfo{key: {Label: "laptop"}})}
+	uri = uri.withConn(uri.log, func() callerInfo { return callerInfo{key: key, known: true} })
+
+	if err := uri.Open("https://example.com/x", &struct{}{}); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if len(*opened) != 1 || (*opened)[0] != "https://example.com/x?via=hook" {
+		t.Fatalf("opened = %q", *opened)
+	}
+	err := uri.Open("https://deny.example.com", &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "denied by policy") {
+		t.Fatalf("vetoed open: err = %v", err)
+	}
+	// replacement is validated as if client asked for it
+	err = uri.Open("https://evil.example.com", &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), `scheme "file" is not allowed`) {
+		t.Fatalf("rewritten open: err = %v", err)
+	}
+	if len(*opened) != 1 {
+		t.Fatalf("refused URIs were opened: %q", *opened)
+	}
+}
+
+func TestHookAfterCopy(t *testing.T) {
+	fakeClipboard(t, "")
+	out := filepath.Join(t.TempDir(), "copied")
+	h := shellHook(t, `{ printf '%s %s %s %s ' "$GCLPR_EVENT" "$GCLPR_LABEL" "$GCLPR_ORIGIN" "$GCLPR_SIZE"; cat; } > "$OUT"`)
+	h.Stdin = HookStdinText
+	t.Setenv("OUT", out)
+
+	key := [32]byte{2}
+	runner := newHookRunner(Hooks{AfterCopy: []Hook{h}}, map[[32]byte]util.KeyInfo{key: {Label: "desktop"}})
+	clip := NewClipboard("", 0)
+	clip.events = &events{hooks: runner}
+	clip = clip.withConn(clip.log, func() callerInfo { return callerInfo{key: key, known: true, origin: []string{"aa", "bb"}} })
+	if err := clip.Copy("hello", &struct{}{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	runner.wait()
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "after_copy desktop aa,bb 5 hello" {
+		t.Fatalf("hook got %q", data)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	h := shellHook(t, "sleep 10")
+	h.Timeout = 100 * time.Millisecond
+	runner := newHookRunner(Hooks{BeforeOpen: []Hook{h}}, nil)
+
+	start := time.Now()
+	_, err := runner.beforeOpen("https://example.com", callerInfo{})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("err = %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("hook was not stopped in time: %s", d)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// DefaultLemonadePort is the port lemonade clients use by default.
+const DefaultLemonadePort = 2489
+
+// lemonadeLog is used for requests coming to lemonade listener, they carry no request id.
+var lemonadeLog = util.NewLogger(util.SubsysRPC).With("listener", "lemonade")
+
+var errLemonadeCopyOnly = errors.New("lemonade listener is restricted to copy")
+
+// LemonadeOpenParam mirrors lemonade's open request, gob matches it by field names.
+type LemonadeOpenParam struct {
+	URI           string
+	TransLoopback bool
+}
+
+// lemonadeURI exposes URI service under lemonade rpc signatures.
+type lemonadeURI struct {
+	uri      *URI
+	copyOnly bool
+	gate     *gate
+}
+
+// Open is implementation of lemonade rpc "open" command.
+func (l *lemonadeURI) Open(param *LemonadeOpenParam, _ *struct{}) error {
+	if err := checkLemonade(l.gate); err != nil {
+		return err
+	}
+	if l.copyOnly {
+		lemonadeLog.Warnf("Lemonade open of '%s' refused: copy-only", param.URI)
+		return errLemonadeCopyOnly
+	}
+	return l.uri.Open(param.URI, &struct{}{})
+}
+
+// lemonadeClipboard exposes Clipboard service under lemonade rpc signatures.
+type lemonadeClipboard struct {
+	clip     *Clipboard
+	copyOnly bool
+	gate     *gate
+}
+
+// Copy is implementation of lemonade rpc "copy" command.
+func (l *lemonadeClipboard) Copy(text string, _ *struct{}) error {
+	if err := checkLemonade(l.gate); err != nil {
+		return err
+	}
+	return l.clip.Copy(text, &struct{}{})
+}
+
+// Paste is implementation of lemonade rpc "paste" command.
+func (l *lemonadeClipboard) Paste(_ struct{}, resp *string) error {
+	if err := checkLemonade(l.gate); err != nil {
+		return err
+	}
+	if l.copyOnly {
+		lemonadeLog.Warnf("Lemonade paste refused: copy-only")
+		return errLemonadeCopyOnly
+	}
+	return l.clip.Paste(struct{}{}, resp)
+}
+
+func checkLemonade(g *gate) error {
+	if why := g.closed(); why != "" {
+		lemonadeLog.Infof("Refusing lemonade request: %s", why)
+		return errors.New(why)
+	}
+	return nil
+}
+
+func newLemonadeServer(uri *URI, clip *Clipboard, copyOnly bool, g *gate) (*rpc.Server, error) {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("URI", &lemonadeURI{uri: uri, copyOnly: copyOnly, gate: g}); err != nil {
+		return nil, fmt.Errorf("unable to register lemonade URI rpc object: %w", err)
+	}
+	if err := srv.RegisterName("Clipboard", &lemonadeClipboard{clip: clip, copyOnly: copyOnly, gate: g}); err != nil {
+		return nil, fmt.Errorf("unable to register lemonade Clipboard rpc object: %w", err)
+	}
+	return srv, nil
+}
+
+// deadlineConn refreshes read and write deadlines on every operation.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// listenLemonade starts lemonade compatible listener on loopback. Lemonade protocol has no
+// authentication, so it is only enabled explicitly and could be limited to copy.
+func listenLemonade(port int) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve lemonade address: %w", err)
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on '%s': %w", addr, err)
+	}
+	return l, nil
+}
+
+func serveLemonade(ctx context.Context, l net.Listener, srv *rpc.Server, conns *connections, ioTimeout time.Duration, ev *events) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	serverLog.Infof("gclpr lemonade listener is ready on '%s'", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				serverLog.Errorf("gclpr lemonade listener is unable to accept requests: %v", err)
+			}
+			return
+		}
+		if !conns.add(conn) {
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer conns.done(conn)
+			lemonadeLog.Debugf("gclpr lemonade listener accepted request from '%s'", conn.RemoteAddr())
+			conns.serve(conn, srv, newServerCodec(&deadlineConn{Conn: conn, timeout: ioTimeout}, fixedLog(lemonadeLog), nil, ev, "lemonade"))
+		}(conn)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net/rpc"
+	"sync/atomic"
+	"testing"
+)
+
+// openParam has the same shape as lemonade's param.OpenParam.
+type openParam struct {
+	URI           string
+	TransLoopback bool
+}
+
+func startLemonade(t *testing.T, copyOnly bool, g *gate) *rpc.Client {
+	t.Helper()
+
+	srv, err := newLemonadeServer(NewURI(), NewClipboard("CRLF", 0), copyOnly, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenLemonade(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go serveLemonade(ctx, l, srv, newConnections(), 0, nil)
+
+	rc, err := rpc.Dial("tcp", l.Addr().String())
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rc.Close()
+		cancel()
+	})
+	return rc
+}
+
+func fakeOpener(t *testing.T) *[]string {
+	t.Helper()
+	var opened []string
+	origOpener := opener
+	opener = func(uri string) error {
+		opened = append(opened, uri)
+		return nil
+	}
+	t.Cleanup(func() { opener = origOpener })
+	return &opened
+}
+
+func TestLemonadeRequests(t *testing.T) {
+	content := fakeClipboard(t, "")
+	opened := fakeOpener(t)
+	rc := startLemonade(t, false, nil)
+
+	if err := rc.Call("Clipboard.Copy", "a\nb", &struct{}{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if content.content() != "a\r\nb" {
+		t.Fatalf("clipboard = %q, want line endings converted", content.content())
+	}
+
+	var text string
+	if err := rc.Call("Clipboard.Paste", struct{}{}, &text); err != nil {
+		t.Fatalf("Paste: %v", err)
+	}
+	if text != "a\r\nb" {
+		t.Fatalf("Paste = %q", text)
+	}
+
+	if err := rc.Call("URI.Open", &openParam{URI: "https://example.com", TransLoopback: true}, &struct{}{}); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := rc.Call("URI.Open", &openParam{URI: "file:///etc/passwd"}, &struct{}{}); err == nil {
+		t.Fatal("expected blocked scheme to be rejected")
+	}
+	if len(*opened) != 1 || (*opened)[0] != "https://example.com" {
+		t.Fatalf("opened = %v", *opened)
+	}
+}
+
+func TestLemonadeCopyOnly(t *testing.T) {
+	content := fakeClipboard(t, "secret")
+	opened := fakeOpener(t)
+	rc := startLemonade(t, true, nil)
+
+	var text string
+	if err := rc.Call("Clipboard.Paste", struct{}{}, &text); err == nil || text != "" {
+		t.Fatalf("Paste = %q, %v; want refusal", text, err)
+	}
+	if err := rc.Call("URI.Open", &openParam{URI: "https://example.com"}, &struct{}{}); err == nil {
+		t.Fatal("expected open to be refused")
+	}
+	if len(*opened) != 0 {
+		t.Fatalf("opened = %v", *opened)
+	}
+	if err := rc.Call("Clipboard.Copy", "text", &struct{}{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if content.content() != "text" {
+		t.Fatalf("clipboard = %q", content.content())
+	}
+}
+
+func TestLemonadeLockedSession(t *testing.T) {
+	content := fakeClipboard(t, "")
+	var locked int32 = 1
+	g := &gate{locked: &locked}
+	rc := startLemonade(t, false, g)
+
+	if err := rc.Call("Clipboard.Copy", "text", &struct{}{}); err == nil {
+		t.Fatal("expected copy to be refused while session is locked")
+	}
+	atomic.StoreInt32(&locked, 0)
+	g.paused.Store(true)
+	if err := rc.Call("Clipboard.Copy", "text", &struct{}{}); err == nil {
+		t.Fatal("expected copy to be refused while server is paused")
+	}
+	g.paused.Store(false)
+	if err := rc.Call("Clipboard.Copy", "text", &struct{}{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if content.content() != "text" {
+		t.Fatalf("clipboard = %q", content.content())
+	}
+}
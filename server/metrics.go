@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/gclpr/tunnel"
+)
+
+// metricsPath is where metrics endpoint serves Prometheus text exposition format.
+const metricsPath = "/metrics"
+
+var (
+	// latencyBuckets are upper bounds of rpc duration histogram in seconds.
+	latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+	// payloadBuckets are upper bounds of clipboard payload histogram in bytes.
+	payloadBuckets = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+)
+
+// metricVec is family of counters or histograms with the same name distinguished by label values.
+type metricVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // histogram only
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	count  uint64 // counter value or number of histogram observations
+	sum    float64
+	counts []uint64 // observations in every bucket, not cumulative
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	v := &metricVec{name: name, help: help, labels: labels, series: make(map[string]*series)}
+	if len(labels) == 0 {
+		// single counter is reported before it is incremented
+		v.get(nil)
+	}
+	return v
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*series)}
+}
+
+// get returns series for label values creating it when needed. Must be called with v.mu held.
+func (v *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		if v.buckets != nil {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) inc(values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).count++
+}
+
+func (v *metricVec) observe(x float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.get(values)
+	s.count++
+	s.sum += x
+	if i, _ := slices.BinarySearch(v.buckets, x); i < len(v.buckets) {
+		s.counts[i]++
+	}
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	kind := "counter"
+	if v.buckets != nil {
+		kind = "histogram"
+	}
+	writeHeader(w, v.name, v.help, kind)
+	for _, key := range slices.Sorted(maps.Keys(v.series)) {
+		s := v.series[key]
+		if v.buckets == nil {
+			writeSample(w, v.name, v.labels, s.values, float64(s.count))
+			continue
+		}
+		labels, values := append(slices.Clip(v.labels), "le"), append(slices.Clip(s.values), "")
+		var cumulative uint64
+		for i, le := range v.buckets {
+			cumulative += s.counts[i]
+			values[len(values)-1] = formatValue(le)
+			writeSample(w, v.name+"_bucket", labels, values, float64(cumulative))
+		}
+		values[len(values)-1] = "+Inf"
+		writeSample(w, v.name+"_bucket", labels, values, float64(s.count))
+		writeSample(w, v.name+"_sum", v.labels, s.values, s.sum)
+		writeSample(w, v.name+"_count", v.labels, s.values, float64(s.count))
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w io.Writer, name string, labels, values []string, v float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, l := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, l, labelEscaper.Replace(values[i]))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", formatValue(v))
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metrics collects server usage statistics. Nil metrics ignores everything, so objects created
+// outside of Serve do not need any.
+type metrics struct {
+	requests       *metricVec
+	latency        *metricVec
+	authFailures   *metricVec
+	payloads       *metricVec
+	tunnelSessions *metricVec
+	tunnelClosures *metricVec
+
+	// tunnel is asked about active sessions and streams, it is nil in relay mode
+	tunnel *Tunnel
+}
+
+func newMetrics(t *Tunnel) *metrics {
+	return &metrics{
+		requests:       newCounterVec("gclpr_requests_total", "RPC requests by listener, method and outcome.", "listener", "method", "outcome"),
+		latency:        newHistogramVec("gclpr_request_duration_seconds", "Time to serve RPC request.", latencyBuckets, "listener", "method"),
+		authFailures:   newCounterVec("gclpr_auth_failures_total", "Requests refused because of failed authentication by reason.", "reason"),
+		payloads:       newHistogramVec("gclpr_clipboard_payload_bytes", "Size of clipboard payloads by operation.", payloadBuckets, "op"),
+		tunnelSessions: newCounterVec("gclpr_tunnel_sessions_total", "Tunnel sessions opened."),
+		tunnelClosures: newCounterVec("gclpr_tunnel_closures_total", "Tunnel sessions closed by reason.", "reason"),
+		tunnel:         t,
+	}
+}
+
+// request accounts for rpc request answered with outcome, duration is not known for refused requests.
+func (m *metrics) request(listener, method, outcome string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.inc(listener, method, outcome)
+	if outcome != "refused" {
+		m.latency.observe(d.Seconds(), listener, method)
+	}
+}
+
+func (m *metrics) authFailure(reason string) {
+	if m == nil {
+		return
+	}
+	m.authFailures.inc(reason)
+}
+
+func (m *metrics) payload(op string, size int) {
+	if m == nil {
+		return
+	}
+	m.payloads.observe(float64(size), op)
+}
+
+func (m *metrics) tunnelOpened() {
+	if m == nil {
+		return
+	}
+	m.tunnelSessions.inc()
+}
+
+func (m *metrics) tunnelClosed(reason string) {
+	if m == nil {
+		return
+	}
+	m.tunnelClosures.inc(closeReasonLabel(reason))
+}
+
+// closeReasonLabels maps beginnings of tunnel session close reasons to metric labels.
+var closeReasonLabels = []struct{ prefix, label string }{
+	{"attach timeout", "attach_timeout"},
+	{"idle timeout", "idle_timeout"},
+	{"attach validation failed", "attach_failed"},
+	{"peer read failed", "peer_failed"},
+	{"peer closed", "peer_closed"},
+	{"browser open failed", "open_failed"},
+	{"server shutdown", "shutdown"},
+	{"killed by admin", "killed"},
+}
+
+func closeReasonLabel(reason string) string {
+	if reason == "" {
+		return "explicit"
+	}
+	for _, l := range closeReasonLabels {
+		if strings.HasPrefix(reason, l.prefix) {
+			return l.label
+		}
+	}
+	return "other"
+}
+
+// writeTo writes all metrics in Prometheus text exposition format.
+func (m *metrics) writeTo(w io.Writer) {
+	for _, v := range []*metricVec{m.requests, m.latency, m.authFailures, m.payloads, m.tunnelSessions, m.tunnelClosures} {
+		v.write(w)
+	}
+	if m.tunnel == nil {
+		return
+	}
+	active, st := m.tunnel.metricsStats()
+	writeHeader(w, "gclpr_tunnel_sessions_active", "Tunnel sessions currently open.", "gauge")
+	writeSample(w, "gclpr_tunnel_sessions_active", nil, nil, float64(active))
+	writeHeader(w, "gclpr_tunnel_streams_active", "Tunnel streams currently open.", "gauge")
+	writeSample(w, "gclpr_tunnel_streams_active", nil, nil, float64(st.Streams))
+	writeHeader(w, "gclpr_tunnel_streams_total", "Tunnel streams opened.", "counter")
+	writeSample(w, "gclpr_tunnel_streams_total", nil, nil, float64(st.Opened))
+	writeHeader(w, "gclpr_tunnel_bytes_total", "Tunnel stream data by direction, in is received from tunnel client.", "counter")
+	writeSample(w, "gclpr_tunnel_bytes_total", []string{"direction"}, []string{"in"}, float64(st.BytesIn))
+	writeSample(w, "gclpr_tunnel_bytes_total", []string{"direction"}, []string{"out"}, float64(st.BytesOut))
+}
+
+// metricsStats returns number of active sessions along with traffic of both active and closed ones.
+func (t *Tunnel) metricsStats() (int, tunnel.Stats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.closedStats
+	st.Streams = 0
+	for _, session := range t.sessions {
+		peer := session.getPeer()
+		if peer == nil {
+			continue
+		}
+		ps := peer.Stats()
+		st.Streams += ps.Streams
+		st.Opened += ps.Opened
+		st.BytesIn += ps.BytesIn
+		st.BytesOut += ps.BytesOut
+	}
+	return len(t.sessions), st
+}
+
+// listenMetrics starts metrics listener on loopback, metrics are not authenticated.
+func listenMetrics(port int) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve metrics address: %w", err)
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on '%s': %w", addr, err)
+	}
+	return l, nil
+}
+
+func serveMetrics(ctx context.Context, l net.Listener, m *metrics) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+metricsPath, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		m.writeTo(bw)
+		bw.Flush()
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: DefaultIOTimeout}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	serverLog.Infof("gclpr metrics are served on 'http://%s%s'", l.Addr(), metricsPath)
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		serverLog.Errorf("gclpr metrics listener is unable to accept requests: %v", err)
+	}
+}
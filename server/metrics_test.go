@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "op")
+	c.inc("b")
+	c.inc("a")
+	c.inc("b")
+	h := newHistogramVec("test_bytes", "Test histogram.", []float64{10, 100}, "op")
+	h.observe(5, "copy")
+	h.observe(10, "copy")
+	h.observe(500, "copy")
+
+	var buf strings.Builder
+	c.write(&buf)
+	h.write(&buf)
+	newCounterVec("test_single_total", "Counter without labels.").write(&buf)
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{op="a"} 1
+test_total{op="b"} 2
+# HELP test_bytes Test histogram.
+# TYPE test_bytes histogram
+test_bytes_bucket{op="copy",le="10"} 2
+test_bytes_bucket{op="copy",le="100"} 2
+test_bytes_bucket{op="copy",le="+Inf"} 3
+test_bytes_sum{op="copy"} 515
+test_bytes_count{op="copy"} 3
+# HELP test_single_total Counter without labels.
+# TYPE test_single_total counter
+test_single_total 0
+`
+	if buf.String() != want {
+		t.Fatalf("exposition =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestCloseReasonLabel(t *testing.T) {
+	for reason, want := range map[string]string{
+		"":                         "explicit",
+		"attach timeout after 1s":  "attach_timeout",
+		"idle timeout after 1m0s":  "idle_timeout",
+		"peer read failed: EOF":    "peer_failed",
+		"killed by admin":          "killed",
+		"something nobody expects": "other",
+	} {
+		if got := closeReasonLabel(reason); got != want {
+			t.Errorf("closeReasonLabel(%q) = %q, want %q", reason, got, want)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	clip := fakeClipboard(t, "")
+	pk, sk, pkeys := generateTestKeys(t)
+
+	ports := make([]int, 2)
+	for i := range ports {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served, ready := make(chan error, 1), make(chan struct{})
+	go func() {
+		served <- Serve(ctx, Options{Port: ports[0], MetricsPort: ports[1], TrustedKeys: pkeys, Magic: []byte{'g', 'c', 'l', 'p', 'r', 0, 0, 0}, Clipboard: clip, Ready: func() { close(ready) }})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+	select {
+	case <-ready:
+	case err := <-served:
+		t.Fatalf("Serve: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("server did not start")
+	}
+
+	addr := fmt.Sprintf("localhost:%d", ports[0])
+	rc := dialClient(t, addr, pk, sk)
+	if err := rc.Call("Clipboard.Copy", "hello", &struct{}{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	rc.Close()
+	otherPK, otherSK, _ := generateTestKeys(t)
+	other := dialClient(t, addr, otherPK, otherSK)
+	if err := other.Call("Clipboard.Copy", "hello", &struct{}{}); err == nil {
+		t.Fatal("expected call with untrusted key to fail")
+	}
+	other.Close()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", ports[1], metricsPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("metrics status %d: %v", resp.StatusCode, err)
+	}
+	for _, line := range []string{
+		`gclpr_requests_total{listener="rpc",method="Clipboard.Copy",outcome="ok"} 1`,
+		`gclpr_request_duration_seconds_count{listener="rpc",method="Clipboard.Copy"} 1`,
+		`gclpr_auth_failures_total{reason="unknown_key"} 1`,
+		`gclpr_clipboard_payload_bytes_bucket{op="copy",le="64"} 1`,
+		`gclpr_tunnel_sessions_total 0`,
+		`gclpr_tunnel_sessions_active 0`,
+		`gclpr_tunnel_bytes_total{direction="in"} 0`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// Upstream is a connection to the next gclpr server in relay chain. It is signed with relay's own key.
+type Upstream interface {
+	// Call invokes rpc method on upstream server.
+	Call(method string, args any, reply any) error
+	// OpenChannel opens new channel of upstream connection, it fails when upstream does not support channels.
+	OpenChannel() (net.Conn, uint32, error)
+	Close() error
+}
+
+// RelayOptions turns server into relay which forwards requests upstream instead of serving them locally.
+type RelayOptions struct {
+	// Dial connects to upstream server on behalf of client operation. Origin lists key hashes of all
+	// hops request passed through, original client first.
+	Dial func(origin []string, requestID string) (Upstream, error)
+}
+
+// relay holds state shared by all relayed connections.
+type relay struct {
+	dial   func(origin []string, requestID string) (Upstream, error)
+	limit  int64
+	policy *uriPolicy
+	// approve holds requests of keys relay marks with approve attribute, upstream asks on its own too
+	approve *approver
+
+	mu     sync.Mutex
+	owners map[string][32]byte // tunnel sessions waiting for attach and their downstream owners
+}
+
+func newRelay(opts *RelayOptions, limit int64) *relay {
+	if limit <= 0 {
+		limit = DefaultMaxClipboardSize
+	}
+	return &relay{dial: opts.Dial, limit: limit, owners: make(map[string][32]byte)}
+}
+
+// relayConn forwards requests received on a single connection upstream.
+type relayConn struct {
+	r    *relay
+	sc   *secConn
+	info map[[32]byte]util.KeyInfo
+
+	mu sync.Mutex
+	up Upstream
+}
+
+func (rc *relayConn) upstream() (Upstream, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.up != nil {
+		return rc.up, nil
+	}
+	up, err := rc.r.dial(rc.sc.chain(), rc.sc.getRequestID())
+	if err != nil {
+		rc.sc.log().Errorf("Unable to connect upstream: %v", err)
+		return nil, fmt.Errorf("relay is unable to connect upstream: %w", err)
+	}
+	rc.up = up
+	return up, nil
+}
+
+func (rc *relayConn) call(method string, args any, reply any) error {
+	up, err := rc.upstream()
+	if err != nil {
+		return err
+	}
+	rc.sc.log().Debugf("Relaying %s upstream", method)
+	return up.Call(method, args, reply)
+}
+
+// check holds operation for approval on relay before it goes upstream.
+func (rc *relayConn) check(op, detail string) error {
+	return rc.r.approve.check(op, rc.sc.callerInfo(), detail)
+}
+
+func (rc *relayConn) close() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.up != nil {
+		rc.up.Close()
+		rc.up = nil
+	}
+}
+
+func newRelayRPCServer(sc *secConn, state *serverState, r *relay, comp *compression) (*rpc.Server, *relayConn, error) {
+	rc := &relayConn{r: r, sc: sc, info: state.info}
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("URI", &relayURI{rc: rc}); err != nil {
+		return nil, nil, fmt.Errorf("unable to register URI rpc object: %w", err)
+	}
+	if err := srv.RegisterName("Clipboard", &relayClipboard{rc: rc}); err != nil {
+		return nil, nil, fmt.Errorf("unable to register Clipboard rpc object: %w", err)
+	}
+	if err := srv.RegisterName("Tunnel", &relayTunnel{rc: rc}); err != nil {
+		return nil, nil, fmt.Errorf("unable to register Tunnel rpc object: %w", err)
+	}
+	if err := srv.Register(&Session{conn: sc, magic: sc.magic, comp: comp, info: state.info}); err != nil {
+		return nil, nil, fmt.Errorf("unable to register Session rpc object: %w", err)
+	}
+	if err := srv.RegisterName("Server", &relayServer{rc: rc, local: &serverConn{s: state, sc: sc}}); err != nil {
+		return nil, nil, fmt.Errorf("unable to register Server rpc object: %w", err)
+	}
+	return srv, rc, nil
+}
+
+// relayServer forwards status upstream. Upstream sees relay key as caller of everything relayed, so admin
+// commands are never forwarded rather than run with relay key permissions on behalf of every key relay trusts.
+// Pause and resume act on relay itself.
+type relayServer struct {
+	rc    *relayConn
+	local *serverConn
+}
+
+// Status is relayed implementation of rpc "status" command. Upstream lists tunnel sessions relay key
+// opened for all its clients, they are only passed to admin keys of relay.
+func (s *relayServer) Status(_ struct{}, resp *StatusResponse) error {
+	if err := s.rc.call("Server.Status", struct{}{}, resp); err != nil {
+		return err
+	}
+	if hk, _ := s.rc.sc.caller(); !s.rc.info[hk].Has(util.PermAdmin) {
+		resp.Tunnels = nil
+	}
+	// requests stop at relay as well when it is locked or paused
+	locked, paused := s.local.s.gateState()
+	resp.Locked, resp.Paused = resp.Locked || locked, resp.Paused || paused
+	return nil
+}
+
+func (s *relayServer) refuse(op string) error {
+	hk, _ := s.rc.sc.caller()
+	s.rc.sc.log().Warnf("%s refused: key [%x] asked relay, admin commands are not relayed", op, hk)
+	return fmt.Errorf("%s is not available through relay, run it against upstream server", op)
+}
+
+// Tunnels is refused by relay.
+func (s *relayServer) Tunnels(_ struct{}, _ *[]TunnelStatus) error {
+	return s.refuse("tunnel list")
+}
+
+// KillTunnel is refused by relay.
+func (s *relayServer) KillTunnel(_ string, _ *struct{}) error {
+	return s.refuse("tunnel kill")
+}
+
+// Pause makes relay refuse requests, upstream is not paused. Admin only.
+func (s *relayServer) Pause(req struct{}, resp *struct{}) error {
+	return s.local.Pause(req, resp)
+}
+
+// Resume makes paused relay serve requests again. Admin only.
+func (s *relayServer) Resume(req struct{}, resp *struct{}) error {
+	return s.local.Resume(req, resp)
+}
+
+// relayURI forwards URI service. URIs are validated at every hop.
+type relayURI struct {
+	rc *relayConn
+}
+
+// Open is relayed implementation of rpc "open" command.
+func (u *relayURI) Open(uri string, _ *struct{}) error {
+	parsed, err := u.rc.r.policy.parse(uri)
+	if err != nil {
+		return err
+	}
+	if err := u.rc.check(util.ApproveOpen, describeURL(parsed)); err != nil {
+		return err
+	}
+	return u.rc.call("URI.Open", uri, &struct{}{})
+}
+
+// relayClipboard forwards Clipboard service enforcing relay's own size limit.
+type relayClipboard struct {
+	rc *relayConn
+}
+
+func (c *relayClipboard) checkSize(size int64) error {
+	if size > c.rc.r.limit {
+		return fmt.Errorf("clipboard payload size %d exceeds maximum %d", size, c.rc.r.limit)
+	}
+	return nil
+}
+
+// Copy is relayed implementation of rpc "copy" command.
+func (c *relayClipboard) Copy(text string, _ *struct{}) error {
+	if err := c.checkSize(int64(len(text))); err != nil {
+		return err
+	}
+	return c.rc.call("Clipboard.Copy", text, &struct{}{})
+}
+
+// Paste is relayed implementation of rpc "paste" command.
+func (c *relayClipboard) Paste(_ struct{}, resp *string) error {
+	if err := c.rc.check(util.ApprovePaste, ""); err != nil {
+		return err
+	}
+	if err := c.rc.call("Clipboard.Paste", struct{}{}, resp); err != nil {
+		return err
+	}
+	return c.checkSize(int64(len(*resp)))
+}
+
+// CopyBegin is relayed implementation of streaming copy.
+func (c *relayClipboard) CopyBegin(req CopyBeginRequest, resp *TransferResponse) error {
+	if err := c.checkSize(req.Size); err != nil {
+		return err
+	}
+	return c.rc.call("Clipboard.CopyBegin", req, resp)
+}
+
+// CopyTypeBegin is relayed implementation of streaming copy of typed data.
+func (c *relayClipboard) CopyTypeBegin(req CopyTypeRequest, resp *TransferResponse) error {
+	if err := c.checkSize(req.Size); err != nil {
+		return err
+	}
+	return c.rc.call("Clipboard.CopyTypeBegin", req, resp)
+}
+
+// CopyExpiringBegin is relayed implementation of streaming copy which expires.
+func (c *relayClipboard) CopyExpiringBegin(req ExpiringCopyRequest, resp *TransferResponse) error {
+	if err := c.checkSize(req.Size); err != nil {
+		return err
+	}
+	return c.rc.call("Clipboard.CopyExpiringBegin", req, resp)
+}
+
+// CopyChunk is relayed implementation of streaming copy.
+func (c *relayClipboard) CopyChunk(req ChunkRequest, _ *struct{}) error {
+	return c.rc.call("Clipboard.CopyChunk", req, &struct{}{})
+}
+
+// CopyEnd is relayed implementation of streaming copy.
+func (c *relayClipboard) CopyEnd(id string, _ *struct{}) error {
+	return c.rc.call("Clipboard.CopyEnd", id, &struct{}{})
+}
+
+// PasteBegin is relayed implementation of streaming paste.
+func (c *relayClipboard) PasteBegin(_ struct{}, resp *TransferResponse) error {
+	if err := c.rc.check(util.ApprovePaste, ""); err != nil {
+		return err
+	}
+	if err := c.rc.call("Clipboard.PasteBegin", struct{}{}, resp); err != nil {
+		return err
+	}
+	return c.checkSize(resp.Size)
+}
+
+// PasteTypeBegin is relayed implementation of streaming paste of typed data.
+func (c *relayClipboard) PasteTypeBegin(req PasteTypeRequest, resp *TransferResponse) error {
+	if err := c.rc.check(util.ApprovePaste, req.Type); err != nil {
+		return err
+	}
+	if err := c.rc.call("Clipboard.PasteTypeBegin", req, resp); err != nil {
+		return err
+	}
+	return c.checkSize(resp.Size)
+}
+
+// HistoryPasteBegin is relayed implementation of streaming paste of clipboard history entry.
+func (c *relayClipboard) HistoryPasteBegin(req HistoryPasteRequest, resp *TransferResponse) error {
+	if err := c.rc.check(util.ApprovePaste, fmt.Sprintf("history entry %d", req.Entry)); err != nil {
+		return err
+	}
+	if err := c.rc.call("Clipboard.HistoryPasteBegin", req, resp); err != nil {
+		return err
+	}
+	return c.checkSize(resp.Size)
+}
+
+// History is relayed implementation of clipboard history listing.
+func (c *relayClipboard) History(_ struct{}, resp *[]HistoryEntry) error {
+	if err := c.rc.check(util.ApprovePaste, "history"); err != nil {
+		return err
+	}
+	return c.rc.call("Clipboard.History", struct{}{}, resp)
+}
+
+// HistoryClear is relayed implementation of clipboard history clearing.
+// Upstream sees relay key as caller, so relay checks downstream key is admin before forwarding.
+func (c *relayClipboard) HistoryClear(_ struct{}, resp *int) error {
+	if hk, identified := c.rc.sc.caller(); !identified || !c.rc.info[hk].Has(util.PermAdmin) {
+		c.rc.sc.log().Warnf("Clipboard history clear refused: key [%x] is not admin", hk)
+		return errors.New("clipboard history clear requires admin key")
+	}
+	return c.rc.call("Clipboard.HistoryClear", struct{}{}, resp)
+}
+
+// Watch is relayed implementation of clipboard watch, changes come from upstream channel.
+func (c *relayClipboard) Watch(req WatchRequest, _ *struct{}) error {
+	if err := c.rc.check(util.ApprovePaste, "watch"); err != nil {
+		return err
+	}
+	m := c.rc.sc.muxer()
+	if m == nil {
+		return errors.New("connection does not support channels")
+	}
+	up, err := c.rc.upstream()
+	if err != nil {
+		return err
+	}
+	upCh, upID, err := up.OpenChannel()
+	if err != nil {
+		return fmt.Errorf("relay is unable to carry clipboard watch upstream: %w", err)
+	}
+	if err := up.Call("Clipboard.Watch", WatchRequest{Channel: upID, Content: req.Content}, &struct{}{}); err != nil {
+		upCh.Close()
+		return err
+	}
+	downCh, err := m.Open(req.Channel)
+	if err != nil {
+		upCh.Close()
+		return err
+	}
+	go pipeChannels(downCh, upCh)
+	return nil
+}
+
+// Types is relayed implementation of clipboard types listing.
+func (c *relayClipboard) Types(req TypesRequest, resp *[]string) error {
+	if err := c.rc.check(util.ApprovePaste, "types"); err != nil {
+		return err
+	}
+	return c.rc.call("Clipboard.Types", req, resp)
+}
+
+// PasteChunk is relayed implementation of streaming paste.
+func (c *relayClipboard) PasteChunk(req PasteChunkRequest, resp *[]byte) error {
+	return c.rc.call("Clipboard.PasteChunk", req, resp)
+}
+
+// relayTunnel forwards Tunnel service. Tunnel data is piped between channels of downstream
+// and upstream connections without looking into it.
+type relayTunnel struct {
+	rc *relayConn
+}
+
+// Open is relayed implementation of tunnel reservation.
+func (t *relayTunnel) Open(req TunnelOpenRequest, resp *TunnelOpenResponse) error {
+	parsed, err := t.rc.r.policy.parse(req.URL)
+	if err != nil {
+		return err
+	}
+	if err := t.rc.check(util.ApproveTunnel, describeURL(parsed)); err != nil {
+		return err
+	}
+	owner, _ := t.rc.sc.caller()
+	if err := t.rc.call("Tunnel.Open", req, resp); err != nil {
+		return err
+	}
+	r := t.rc.r
+	r.mu.Lock()
+	r.owners[resp.SessionID] = owner
+	r.mu.Unlock()
+	attachTimeout := resp.AttachTimeout
+	if attachTimeout <= 0 {
+		attachTimeout = DefaultTunnelAttachTimeout
+	}
+	id := resp.SessionID
+	time.AfterFunc(attachTimeout, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.owners, id)
+	})
+	return nil
+}
+
+// Attach binds downstream channel to the upstream tunnel session.
+func (t *relayTunnel) Attach(req TunnelAttachRequest, _ *struct{}) error {
+	m := t.rc.sc.muxer()
+	if m == nil {
+		return errors.New("connection does not support channels")
+	}
+	r := t.rc.r
+	r.mu.Lock()
+	owner, ok := r.owners[req.SessionID]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown tunnel session %q", req.SessionID)
+	}
+	if caller, identified := t.rc.sc.caller(); !identified || caller != owner {
+		t.rc.sc.logger(util.SubsysTunnel).Warnf("Relayed tunnel session %s attach refused: caller key [%x] is not session owner", req.SessionID, caller)
+		return fmt.Errorf("tunnel session %q was opened with a different key", req.SessionID)
+	}
+
+	up, err := t.rc.upstream()
+	if err != nil {
+		return err
+	}
+	upCh, upID, err := up.OpenChannel()
+	if err != nil {
+		return fmt.Errorf("relay is unable to carry tunnel upstream: %w", err)
+	}
+	if err := up.Call("Tunnel.Attach", TunnelAttachRequest{SessionID: req.SessionID, Channel: upID, Proof: req.Proof}, &struct{}{}); err != nil {
+		upCh.Close()
+		return err
+	}
+	downCh, err := m.Open(req.Channel)
+	if err != nil {
+		upCh.Close()
+		return err
+	}
+	r.mu.Lock()
+	delete(r.owners, req.SessionID)
+	r.mu.Unlock()
+
+	t.rc.sc.logger(util.SubsysTunnel).Debugf("Relaying tunnel session %s channel %d -> upstream channel %d", req.SessionID, req.Channel, upID)
+	go pipeChannels(downCh, upCh)
+	return nil
+}
+
+// pipeChannels copies data both ways until either side is closed.
+func pipeChannels(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
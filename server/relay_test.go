@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"net/rpc"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/tunnel"
+	"github.com/rupor-github/gclpr/util"
+)
+
+// testUpstream is relay connection to in-process upstream server.
+type testUpstream struct {
+	client *clientSecConn
+	rc     *rpc.Client
+}
+
+func (u *testUpstream) Call(method string, args any, reply any) error {
+	return u.rc.Call(method, args, reply)
+}
+
+func (u *testUpstream) OpenChannel() (net.Conn, uint32, error) {
+	m := u.client.mux.Load()
+	if m == nil {
+		return nil, 0, errors.New("no channels")
+	}
+	id := m.NextID()
+	ch, err := m.Open(id)
+	return ch, id, err
+}
+
+func (u *testUpstream) Close() error {
+	return u.rc.Close()
+}
+
+type relayDial struct {
+	origin    []string
+	requestID string
+}
+
+// newTestRelay creates relay forwarding to in-process upstream server which trusts relay key only.
+func newTestRelay(t *testing.T, tn *Tunnel) (*relay, chan relayDial) {
+	t.Helper()
+
+	rpk, rsk, upKeys := generateTestKeys(t)
+	info := make(map[[32]byte]util.KeyInfo)
+	for hk := range upKeys {
+		info[hk] = util.KeyInfo{Permissions: []string{util.PermRelay}}
+	}
+	dials := make(chan relayDial, 4)
+	dial := func(origin []string, requestID string) (Upstream, error) {
+		dials <- relayDial{origin: origin, requestID: requestID}
+		state := &serverState{started: time.Now(), keys: upKeys, info: info, gate: &gate{}, tunnel: tn}
+		client, rc := newSessionClient(t, startStateConn(t, state, nil), rpk, rsk)
+		var resp HelloResponse
+		if err := rc.Call("Session.Hello", HelloRequest{Mux: true, RequestID: requestID, Origin: origin}, &resp); err != nil {
+			return nil, err
+		}
+		client.mux.Store(util.NewMux(client.writeFrame, nil, nil))
+		return &testUpstream{client: client, rc: rc}, nil
+	}
+	return newRelay(&RelayOptions{Dial: dial}, 0), dials
+}
+
+// startRelayConn serves relay rpc on one end of a pipe and returns the other end.
+func startRelayConn(t *testing.T, pkeys map[[32]byte][32]byte, r *relay) net.Conn {
+	t.Helper()
+	return startRelayStateConn(t, &serverState{started: time.Now(), keys: pkeys, backend: "relay", gate: &gate{}}, r)
+}
+
+// startRelayStateConn is startRelayConn for relay with given state.
+func startRelayStateConn(t *testing.T, state *serverState, r *relay) net.Conn {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	magic := []byte{'g', 'c', 'l', 'p', 'r', 0, 0, 0}
+	sc := &secConn{conn: serverConn, br: bufio.NewReader(serverConn), pkeys: state.keys, magic: magic}
+	srv, rc, err := newRelayRPCServer(sc, state, r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer rc.close()
+		srv.ServeCodec(newServerCodec(sc, sc.log, nil, nil, ""))
+	}()
+	return clientConn
+}
+
+func TestHelloOriginNeedsRelayPermission(t *testing.T) {
+	pk, sk, pkeys := generateTestKeys(t)
+	_, rc := newSessionClient(t, startSessionConn(t, pkeys, NewTunnel(), nil), pk, sk)
+	origin := []string{strings.Repeat("ab", 32)}
+	var resp HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{Origin: origin}, &resp); err == nil || !strings.Contains(err.Error(), "not allowed to relay") {
+		t.Fatalf("Hello with origin from key which is not relay: %v", err)
+	}
+}
+
+func TestRelayForwardsClipboard(t *testing.T) {
+	content := fakeClipboard(t, "")
+
+	pk, sk, pkeys := generateTestKeys(t)
+	r, dials := newTestRelay(t, NewTunnel())
+	_, rc := newSessionClient(t, startRelayConn(t, pkeys, r), pk, sk)
+
+	var resp HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{RequestID: "relayed1"}, &resp); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if err := rc.Call("Clipboard.Copy", "relayed text", &struct{}{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if content.content() != "relayed text" {
+		t.Fatalf("clipboard = %q", content.content())
+	}
+	var pasted string
+	if err := rc.Call("Clipboard.Paste", struct{}{}, &pasted); err != nil || pasted != "relayed text" {
+		t.Fatalf("Paste = %q, %v", pasted, err)
+	}
+
+	d := <-dials
+	hpk := sha256.Sum256(pk[:])
+	if !slices.Equal(d.origin, []string{hex.EncodeToString(hpk[:])}) || d.requestID != "relayed1" {
+		t.Fatalf("dial = %+v", d)
+	}
+	select {
+	case d := <-dials:
+		t.Fatalf("unexpected second dial %+v", d)
+	default:
+	}
+
+	// URI is validated by relay before going upstream
+	if err := rc.Call("URI.Open", "file:///etc/passwd", &struct{}{}); err == nil {
+		t.Fatal("expected relay to refuse file uri")
+	}
+}
+
+func TestRelayNeedsApproval(t *testing.T) {
+	content := fakeClipboard(t, "secret")
+
+	pk, sk, pkeys := generateTestKeys(t)
+	var hk [32]byte
+	for k := range pkeys {
+		hk = k
+	}
+	r, _ := newTestRelay(t, NewTunnel())
+	r.approve = newApprover(map[[32]byte]util.KeyInfo{hk: {Approve: []string{util.ApprovePaste, util.ApproveOpen}}}, ApprovalOptions{Timeout: 50 * time.Millisecond})
+	_, rc := newSessionClient(t, startRelayConn(t, pkeys, r), pk, sk)
+
+	var resp HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{}, &resp); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	var pasted string
+	if err := rc.Call("Clipboard.Paste", struct{}{}, &pasted); err == nil || !strings.Contains(err.Error(), "not approved") {
+		t.Fatalf("Paste without approval = %q, %v", pasted, err)
+	}
+	var types []string
+	if err := rc.Call("Clipboard.Types", TypesRequest{}, &types); err == nil || !strings.Contains(err.Error(), "not approved") {
+		t.Fatalf("Types without approval = %v, %v", types, err)
+	}
+	if err := rc.Call("URI.Open", "https://example.com", &struct{}{}); err == nil || !strings.Contains(err.Error(), "not approved") {
+		t.Fatalf("Open without approval: %v", err)
+	}
+	// copy is never held
+	if err := rc.Call("Clipboard.Copy", "relayed text", &struct{}{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if content.content() != "relayed text" {
+		t.Fatalf("clipboard = %q", content.content())
+	}
+}
+
+func TestRelayServerCommands(t *testing.T) {
+	pk, sk, pkeys := generateTestKeys(t)
+	info := make(map[[32]byte]util.KeyInfo)
+	for hk := range pkeys {
+		info[hk] = util.KeyInfo{Label: "downstream", Permissions: []string{util.PermAdmin}}
+	}
+	r, _ := newTestRelay(t, NewTunnel())
+	state := &serverState{started: time.Now(), keys: pkeys, info: info, backend: "relay", gate: &gate{}}
+	_, rc := newSessionClient(t, startRelayStateConn(t, state, r), pk, sk)
+
+	var hello HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{}, &hello); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	// status comes from upstream, which sees relay key with downstream key as origin
+	var status StatusResponse
+	if err := rc.Call("Server.Status", struct{}{}, &status); err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.ClipboardBackend == "relay" || !slices.Contains(status.Caller.Permissions, util.PermRelay) || len(status.Caller.Origin) != 1 {
+		t.Fatalf("status = %+v", status)
+	}
+	// admin key of relay is not admin upstream and relay does not act on its own
+	for _, call := range []struct {
+		method string
+		args   any
+		reply  any
+	}{
+		{"Server.Tunnels", struct{}{}, &[]TunnelStatus{}},
+		{"Server.KillTunnel", "session", &struct{}{}},
+	} {
+		if err := rc.Call(call.method, call.args, call.reply); err == nil || !strings.Contains(err.Error(), "not available through relay") {
+			t.Fatalf("%s through relay: %v", call.method, err)
+		}
+	}
+	// pause and resume act on relay for its admin keys
+	if err := rc.Call("Server.Pause", struct{}{}, &struct{}{}); err != nil || !state.gate.paused.Load() {
+		t.Fatalf("Pause = %v, paused %v", err, state.gate.paused.Load())
+	}
+	if err := rc.Call("Server.Status", struct{}{}, &status); err != nil || !status.Paused {
+		t.Fatalf("Status of paused relay = %+v, %v", status, err)
+	}
+	if err := rc.Call("Server.Resume", struct{}{}, &struct{}{}); err != nil || state.gate.paused.Load() {
+		t.Fatalf("Resume = %v, paused %v", err, state.gate.paused.Load())
+	}
+}
+
+func TestRelayPauseNeedsAdmin(t *testing.T) {
+	pk, sk, pkeys := generateTestKeys(t)
+	info := make(map[[32]byte]util.KeyInfo)
+	for hk := range pkeys {
+		info[hk] = util.KeyInfo{Label: "downstream"}
+	}
+	r, _ := newTestRelay(t, NewTunnel())
+	state := &serverState{started: time.Now(), keys: pkeys, info: info, backend: "relay", gate: &gate{}}
+	_, rc := newSessionClient(t, startRelayStateConn(t, state, r), pk, sk)
+
+	var hello HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{}, &hello); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if err := rc.Call("Server.Pause", struct{}{}, &struct{}{}); err == nil || !strings.Contains(err.Error(), "requires admin key") || state.gate.paused.Load() {
+		t.Fatalf("Pause by key which is not admin: %v", err)
+	}
+}
+
+func TestRelayHistoryClearNeedsAdmin(t *testing.T) {
+	pk, sk, pkeys := generateTestKeys(t)
+	info := make(map[[32]byte]util.KeyInfo)
+	for hk := range pkeys {
+		info[hk] = util.KeyInfo{Label: "downstream"}
+	}
+	r, dials := newTestRelay(t, NewTunnel())
+	state := &serverState{started: time.Now(), keys: pkeys, info: info, backend: "relay", gate: &gate{}}
+	_, rc := newSessionClient(t, startRelayStateConn(t, state, r), pk, sk)
+
+	var hello HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{}, &hello); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	var cleared int
+	if err := rc.Call("Clipboard.HistoryClear", struct{}{}, &cleared); err == nil || !strings.Contains(err.Error(), "requires admin key") {
+		t.Fatalf("HistoryClear by key which is not admin: %v", err)
+	}
+	// refused by relay itself, upstream where relay key acts is never asked
+	select {
+	case d := <-dials:
+		t.Fatalf("unexpected dial %+v", d)
+	default:
+	}
+}
+
+func TestRelayTunnelAttach(t *testing.T) {
+	origOpener := opener
+	opener = func(string) error { return nil }
+	t.Cleanup(func() { opener = origOpener })
+
+	pk1, sk1, pkeys := generateTestKeys(t)
+	pk2, sk2, pkeys2 := generateTestKeys(t)
+	maps.Copy(pkeys, pkeys2)
+
+	tn := NewTunnel()
+	tn.listenTCP = func(network string, _ *net.TCPAddr) (*net.TCPListener, error) {
+		return net.ListenTCP(network, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	}
+	r, _ := newTestRelay(t, tn)
+	client, rc := newSessionClient(t, startRelayConn(t, pkeys, r), pk1, sk1)
+	m := helloMux(t, client, rc)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	var resp TunnelOpenResponse
+	req := TunnelOpenRequest{
+		URL:     "http://127.0.0.1:1",
+		Targets: []TunnelTarget{{ListenHost: "127.0.0.1", ListenPort: 1, DialAddr: "127.0.0.1:1"}},
+		MACKey:  key,
+	}
+	if err := rc.Call("Tunnel.Open", req, &resp); err != nil {
+		t.Fatalf("Tunnel.Open: %v", err)
+	}
+	defer tn.closeSession(resp.SessionID)
+
+	// session belongs to the key which opened it on relay
+	otherClient, other := newSessionClient(t, startRelayConn(t, pkeys, r), pk2, sk2)
+	om := helloMux(t, otherClient, other)
+	attach := TunnelAttachRequest{SessionID: resp.SessionID, Channel: om.NextID(), Proof: TunnelAttachProof(key, resp.SessionID)}
+	if err := other.Call("Tunnel.Attach", attach, &struct{}{}); err == nil || !strings.Contains(err.Error(), "different key") {
+		t.Fatalf("Tunnel.Attach with other key err = %v", err)
+	}
+
+	ch, err := m.Open(m.NextID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attach = TunnelAttachRequest{SessionID: resp.SessionID, Channel: ch.ID(), Proof: TunnelAttachProof(key, resp.SessionID)}
+	if err := rc.Call("Tunnel.Attach", attach, &struct{}{}); err != nil {
+		t.Fatalf("Tunnel.Attach: %v", err)
+	}
+	peer := tunnel.NewEndpoint(ch, key)
+
+	browserConn, err := net.Dial("tcp", resp.ListenAddrs[0])
+	if err != nil {
+		t.Fatalf("Dial browser listener: %v", err)
+	}
+	defer browserConn.Close()
+
+	frame, err := peer.ReadFrame()
+	if err != nil {
+		t.Fatalf("read open frame: %v", err)
+	}
+	if frame.Type != tunnel.FrameOpen || frame.StreamID == 0 {
+		t.Fatalf("unexpected frame: %#v", frame)
+	}
+	if err := peer.WriteFrame(tunnel.Frame{Type: tunnel.FrameData, StreamID: frame.StreamID, Payload: []byte("hello")}); err != nil {
+		t.Fatalf("write data frame: %v", err)
+	}
+	buf := make([]byte, 5)
+	browserConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(browserConn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("browser read = %q, %v", buf, err)
+	}
+
+	// closing upstream session closes relayed channel
+	tn.closeSession(resp.SessionID)
+	expectTunnelClose(t, peer)
+}
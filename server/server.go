@@ -8,14 +8,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/rpc"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/nacl/sign"
 
+	"github.com/rupor-github/gclpr/tunnel"
 	"github.com/rupor-github/gclpr/util"
 )
 
@@ -23,103 +23,500 @@ const (
 	DefaultPort           = 2850
 	DefaultConnectTimeout = 10 * time.Second
 	DefaultIOTimeout      = 30 * time.Second
+	// DefaultShutdownTimeout is how long server waits for in-flight requests when shutting down.
+	DefaultShutdownTimeout = 5 * time.Second
 )
 
+// serverLog is used for server life cycle messages which are not related to any subsystem.
+var serverLog = util.NewLogger("")
+
+// channelIdleTimeout is how long connection with open channels may stay quiet, clients send keepalive
+// messages while channels are open, so only abandoned connection runs out of it.
+var channelIdleTimeout = 3 * util.MuxKeepaliveInterval
+
+// Options controls server behavior.
+type Options struct {
+	// Port is TCP port server listens on (localhost only).
+	Port int
+	// LineEnding is line ending conversion applied to copied text (LF/CRLF).
+	LineEnding string
+	// TrustedKeys maps hashes of trusted public keys to keys themselves.
+	TrustedKeys map[[32]byte][32]byte
+	// Magic is protocol signature and version, only signature and major version must match.
+	Magic []byte
+	// Locked when not nil and set to 1 makes server refuse requests (session is locked).
+	Locked *int32
+	// IOTimeout is read/write timeout for client connections.
+	IOTimeout time.Duration
+	// MaxClipboardSize limits clipboard payload size, DefaultMaxClipboardSize is used when not set.
+	MaxClipboardSize int64
+	// Compression lists codecs server agrees to use, empty list disables compression.
+	Compression []string
+	// CompressThreshold is the size of the smallest payload which gets compressed.
+	CompressThreshold int
+	// LemonadePort when not 0 enables lemonade compatible listener on this loopback port.
+	LemonadePort int
+	// LemonadeCopyOnly restricts lemonade listener to copy requests.
+	LemonadeCopyOnly bool
+	// Relay when set makes server forward requests upstream instead of serving them locally.
+	Relay *RelayOptions
+	// KeyInfo holds optional attributes of trusted keys.
+	KeyInfo map[[32]byte]util.KeyInfo
+	// Version is reported to clients asking for server status.
+	Version string
+	// ShutdownTimeout limits time in-flight requests have to finish once ctx is cancelled,
+	// DefaultShutdownTimeout is used when not set.
+	ShutdownTimeout time.Duration
+	// Ready when set is called once server listens and accepts requests.
+	Ready func()
+	// MetricsPort when not 0 enables Prometheus metrics endpoint on this loopback port.
+	MetricsPort int
+	// BlockedSchemes lists URI schemes which are never opened, DefaultBlockedSchemes is used when nil.
+	BlockedSchemes []string
+	// AllowedSchemes when not empty lists the only URI schemes which are opened.
+	AllowedSchemes []string
+	// Tunnel restricts tunnel sessions.
+	Tunnel TunnelLimits
+	// ClipboardBackend names backend server keeps clipboard in, one of ClipboardBackends; it is detected when
+	// empty or "auto". ClipboardFile is where "file" backend keeps text.
+	ClipboardBackend string
+	ClipboardFile    string
+	// Clipboard when set is used instead of ClipboardBackend.
+	Clipboard ClipboardBackend
+	// Audit when set receives JSON line for every request, authentication failure and tunnel session.
+	Audit io.Writer
+	// DashboardPort when not 0 enables web dashboard on this loopback port, every request to dashboard
+	// has to carry DashboardToken.
+	DashboardPort  int
+	DashboardToken string
+	// Approval configures confirmation of operations keys have approve attribute for.
+	Approval ApprovalOptions
+	// History configures clipboard history, it is not kept by default.
+	History HistoryOptions
+	// Hooks are commands run on server events. In relay mode only AuthFailure hooks run, the rest belong
+	// to server relay forwards requests to.
+	Hooks Hooks
+}
+
 type secConn struct {
 	conn      net.Conn
 	br        *bufio.Reader
 	pkeys     map[[32]byte][32]byte
 	magic     []byte
-	locked    *int32
 	ioTimeout time.Duration
+	events    *events
+	pending   []byte
+	wmu       sync.Mutex // serializes frames written by rpc and channels
+
+	mu         sync.Mutex
+	codec      string // active compression codec, empty until negotiated
+	threshold  int
+	mux        *util.Mux // active session layer, nil until negotiated
+	negotiated *features // agreed on by Hello, activated by the next received frame
+	identity   [32]byte  // hash of the key which signed the first frame
+	identified bool
+	requestID  string   // client operation this connection serves
+	origin     []string // key hashes of previous hops when connection comes from relay
+}
+
+// features describes what connection peers agreed to use.
+type features struct {
+	codec     string
+	threshold int
+	mux       bool
+}
+
+// negotiate arranges for features to be used from the first frame received after Hello reply.
+func (sc *secConn) negotiate(f features) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.negotiated = &f
+}
+
+func (sc *secConn) compression() (string, int) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.codec, sc.threshold
+}
+
+// openChannel opens channel id of connection, peer has to open it as well.
+func (sc *secConn) openChannel(id uint32) (net.Conn, error) {
+	m := sc.muxer()
+	if m == nil {
+		return nil, errors.New("connection does not support channels")
+	}
+	return m.Open(id)
+}
+
+func (sc *secConn) muxer() *util.Mux {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.mux
+}
+
+// caller returns hash of the key connection is authenticated with.
+func (sc *secConn) caller() ([32]byte, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.identity, sc.identified
+}
+
+// callerInfo identifies client of connection in audit records and hooks.
+func (sc *secConn) callerInfo() callerInfo {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return callerInfo{key: sc.identity, known: sc.identified, req: sc.requestID, origin: sc.origin}
+}
+
+func (sc *secConn) setRequestID(id string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.requestID = id
+}
+
+func (sc *secConn) getRequestID() string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.requestID
+}
+
+// maxRelayHops limits length of relay chain.
+const maxRelayHops = 16
+
+func (sc *secConn) setOrigin(origin []string) error {
+	if len(origin) > maxRelayHops {
+		return fmt.Errorf("relay chain is longer than %d hops", maxRelayHops)
+	}
+	for _, o := range origin {
+		if h, err := hex.DecodeString(o); err != nil || len(h) != 32 {
+			return fmt.Errorf("invalid relay origin %q", o)
+		}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.origin = append([]string(nil), origin...)
+	return nil
+}
+
+// chain returns key hashes of all hops which signed requests on this connection, original client first.
+func (sc *secConn) chain() []string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	res := append([]string(nil), sc.origin...)
+	if sc.identified {
+		res = append(res, hex.EncodeToString(sc.identity[:]))
+	}
+	return res
+}
+
+// logger returns logger of subsystem which marks messages with request id of this connection.
+func (sc *secConn) logger(subsys string) util.Logger {
+	return requestLogger(subsys, sc.getRequestID())
+}
+
+// log returns logger for rpc messages of this connection.
+func (sc *secConn) log() util.Logger {
+	return sc.logger(util.SubsysRPC)
+}
+
+// activate switches to negotiated features if there are any.
+func (sc *secConn) activate() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.negotiated == nil {
+		return
+	}
+	f := sc.negotiated
+	sc.negotiated = nil
+	if f.codec != "" && f.codec != util.CodecNone {
+		sc.codec, sc.threshold = f.codec, f.threshold
+	}
+	if f.mux && sc.mux == nil {
+		sc.mux = util.NewMux(sc.writeFrame, sc.conn.LocalAddr(), sc.conn.RemoteAddr())
+	}
 }
 
 func (sc *secConn) Read(p []byte) (n int, err error) {
 
+	// previously verified frame may not fit into caller's buffer
+	if len(sc.pending) > 0 {
+		n = copy(p, sc.pending)
+		sc.pending = sc.pending[n:]
+		return n, nil
+	}
+
+	for {
+		out, err := sc.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		if m := sc.muxer(); m != nil {
+			var ok bool
+			if out, ok, err = m.Dispatch(out); err != nil {
+				sc.log().Warnf("Bad session frame: %v", err)
+				return 0, rpc.ErrShutdown
+			}
+			if !ok {
+				continue
+			}
+		}
+		n = copy(p, out)
+		sc.pending = out[n:]
+		return n, nil
+	}
+}
+
+// readFrame reads and verifies single frame sent by client.
+func (sc *secConn) readFrame() ([]byte, error) {
+
 	var hpk, pk [32]byte
 
 	if sc.ioTimeout > 0 {
-		sc.conn.SetReadDeadline(time.Now().Add(sc.ioTimeout))
+		// channels may be quiet for long, client keeps connection with open channels alive
+		timeout := sc.ioTimeout
+		if m := sc.muxer(); m != nil && m.Channels() > 0 {
+			timeout = max(timeout, channelIdleTimeout)
+		}
+		sc.conn.SetReadDeadline(time.Now().Add(timeout))
 	}
 
 	in, err := util.ReadFrame(sc.br)
 	if err != nil {
-		return 0, err
-	}
-
-	if sc.locked != nil && atomic.LoadInt32(sc.locked) == 1 {
-		log.Print("Session is locked - exiting from Read")
-		return 0, io.ErrUnexpectedEOF
+		return nil, err
 	}
 
 	if len(in) <= len(sc.magic)+len(hpk)+sign.Overhead {
-		log.Printf("Message is too short: %d", len(in))
-		return 0, io.ErrUnexpectedEOF
+		sc.events.authFailure("short_message", callerInfo{req: sc.getRequestID()})
+		sc.log().Warnf("Message is too short: %d", len(in))
+		return nil, io.ErrUnexpectedEOF
 	}
 
 	// check first 6 bytes of magic - signature and major version number
 	if !bytes.Equal(in[0:6], sc.magic[0:6]) {
-		log.Printf("Bad signature or incompatible versions: server [%x], client [%x]", sc.magic, in[0:len(sc.magic)])
-		return 0, rpc.ErrShutdown
+		sc.events.authFailure("bad_magic", callerInfo{req: sc.getRequestID()})
+		sc.log().Warnf("Bad signature or incompatible versions: server [%x], client [%x]", sc.magic, in[0:len(sc.magic)])
+		return nil, rpc.ErrShutdown
 	}
 
 	copy(hpk[:], in[len(sc.magic):len(sc.magic)+len(hpk)])
 
 	var ok bool
 	if pk, ok = sc.pkeys[hpk]; !ok {
-		log.Printf("Call with unauthorized key: %s", hex.EncodeToString(hpk[:]))
-		return 0, rpc.ErrShutdown
+		sc.events.authFailure("unknown_key", callerInfo{key: hpk, known: true, req: sc.getRequestID()})
+		sc.log().Warnf("Call with unauthorized key: %s", hex.EncodeToString(hpk[:]))
+		return nil, rpc.ErrShutdown
 	}
 
 	out, ok := sign.Open([]byte{}, in[len(sc.magic)+len(hpk):], &pk)
 	if !ok {
-		log.Printf("Call fails verification with key: %s", hex.EncodeToString(pk[:]))
-		return 0, rpc.ErrShutdown
+		sc.events.authFailure("bad_signature", callerInfo{key: hpk, known: true, req: sc.getRequestID()})
+		sc.log().Warnf("Call fails verification with key: %s", hex.EncodeToString(pk[:]))
+		return nil, rpc.ErrShutdown
 	}
-	copy(p, out)
-	return len(out), nil
+
+	// connection is bound to the key it was opened with
+	sc.mu.Lock()
+	if sc.identified && sc.identity != hpk {
+		sc.mu.Unlock()
+		sc.events.authFailure("key_changed", callerInfo{key: hpk, known: true, req: sc.getRequestID()})
+		sc.log().Warnf("Call with different key on the same connection: %s", hex.EncodeToString(hpk[:]))
+		return nil, rpc.ErrShutdown
+	}
+	sc.identity, sc.identified = hpk, true
+	sc.mu.Unlock()
+
+	sc.activate()
+	if codec, _ := sc.compression(); codec != "" {
+		if out, err = util.Decompress(out); err != nil {
+			sc.log().Warnf("Unable to decompress call: %v", err)
+			return nil, rpc.ErrShutdown
+		}
+	}
+	return out, nil
 }
 
 func (sc *secConn) Write(p []byte) (n int, err error) {
-	if sc.ioTimeout > 0 {
-		sc.conn.SetWriteDeadline(time.Now().Add(sc.ioTimeout))
+	data := p
+	if m := sc.muxer(); m != nil {
+		data = m.Wrap(p)
 	}
-	if err = util.WriteFrame(sc.conn, p); err != nil {
+	if err = sc.writeFrame(data); err != nil {
 		return 0, err
 	}
 	return len(p), nil
 }
 
+// writeFrame sends single frame to client.
+func (sc *secConn) writeFrame(data []byte) (err error) {
+	if codec, threshold := sc.compression(); codec != "" {
+		if data, err = util.Compress(codec, threshold, data); err != nil {
+			return err
+		}
+	}
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	if sc.ioTimeout > 0 {
+		sc.conn.SetWriteDeadline(time.Now().Add(sc.ioTimeout))
+	}
+	return util.WriteFrame(sc.conn, data)
+}
+
 func (sc *secConn) Close() error {
+	if m := sc.muxer(); m != nil {
+		m.Close()
+	}
 	return sc.conn.Close()
 }
 
-// Serve handles backend rpc calls.
-// It uses rpc.DefaultServer internally, so it can only be called once per process.
-func Serve(ctx context.Context, port int, le string, pkeys map[[32]byte][32]byte, magic []byte, locked *int32, ioTimeout time.Duration) error {
+// newRPCServer builds rpc server for a single connection. Shared objects are registered
+// along with per-connection Session, which needs access to connection itself.
+func newRPCServer(sc *secConn, state *serverState, uri *URI, clip *Clipboard, tunnel *Tunnel, comp *compression) (*rpc.Server, error) {
+	srv := rpc.NewServer()
+	if err := srv.Register(uri.withConn(sc.log, sc.callerInfo)); err != nil {
+		return nil, fmt.Errorf("unable to register URI rpc object: %w", err)
+	}
+	cc := clip.withConn(func() util.Logger { return sc.logger(util.SubsysClipboard) }, sc.callerInfo)
+	cc.openChannel = sc.openChannel
+	if err := srv.Register(cc); err != nil {
+		return nil, fmt.Errorf("unable to register Clipboard rpc object: %w", err)
+	}
+	if err := srv.RegisterName("Tunnel", &tunnelConn{t: tunnel, sc: sc}); err != nil {
+		return nil, fmt.Errorf("unable to register Tunnel rpc object: %w", err)
+	}
+	if err := srv.Register(&Session{conn: sc, magic: sc.magic, comp: comp, info: state.info}); err != nil {
+		return nil, fmt.Errorf("unable to register Session rpc object: %w", err)
+	}
+	if err := srv.RegisterName("Server", &serverConn{s: state, sc: sc}); err != nil {
+		return nil, fmt.Errorf("unable to register Server rpc object: %w", err)
+	}
+	return srv, nil
+}
+
+// Serve handles backend rpc calls until ctx is cancelled. On shutdown server stops accepting connections,
+// closes tunnel sessions and lets in-flight requests finish, it returns once all connections are released.
+func Serve(ctx context.Context, opts Options) error {
+	comp := &compression{codecs: opts.Compression, threshold: opts.CompressThreshold}
+	if comp.threshold <= 0 {
+		comp.threshold = util.DefaultCompressThreshold
+	}
+	shutdownTimeout := opts.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	backend := opts.Clipboard
+	if backend == nil && opts.Relay == nil {
+		var err error
+		if backend, err = NewClipboardBackend(opts.ClipboardBackend, opts.ClipboardFile); err != nil {
+			return err
+		}
+	}
+	blocked := opts.BlockedSchemes
+	if blocked == nil {
+		blocked = DefaultBlockedSchemes
+	}
+	policy := newURIPolicy(blocked, opts.AllowedSchemes)
+	uri := NewURI()
+	uri.policy = policy
+	clip := NewClipboard(opts.LineEnding, opts.MaxClipboardSize)
+	backendName := "relay"
+	if backend != nil {
+		clip.backend, backendName = backend, backend.Name()
+	}
 	tunnel := NewTunnel()
+	tunnel.comp, tunnel.policy, tunnel.limits = comp, policy, opts.Tunnel
+	m := newMetrics(tunnel)
+	ev := &events{metrics: m, audit: newAuditLog(opts.Audit, opts.KeyInfo), hooks: newHookRunner(opts.Hooks, opts.KeyInfo)}
+	if opts.DashboardPort != 0 {
+		if opts.DashboardToken == "" {
+			return errors.New("dashboard needs token")
+		}
+		ev.activity = newActivity(opts.KeyInfo)
+	}
+	approve := newApprover(opts.KeyInfo, opts.Approval)
+	if approve != nil {
+		approve.events = ev
+		uri.approve, clip.approve, tunnel.approve = approve, approve, approve
+	}
+	uri.events, tunnel.events, clip.events = ev, ev, ev
+	clip.history = newHistory(opts.History, opts.KeyInfo)
+	clip.info, clip.watch.info = opts.KeyInfo, opts.KeyInfo
+	state := &serverState{
+		version: opts.Version,
+		started: time.Now(),
+		backend: backendName,
+		keys:    opts.TrustedKeys,
+		info:    opts.KeyInfo,
+		gate:    &gate{locked: opts.Locked},
+		tunnel:  tunnel,
+	}
+	clip.watch.gate = state.gate
+	conns := newConnections()
 
-	if err := rpc.Register(NewURI()); err != nil {
-		return fmt.Errorf("unable to register URI rpc object: %w", err)
+	var rl *relay
+	if opts.Relay != nil {
+		if opts.LemonadePort != 0 {
+			return errors.New("lemonade listener cannot be used in relay mode")
+		}
+		rl = newRelay(opts.Relay, opts.MaxClipboardSize)
+		rl.policy, rl.approve = policy, approve
+		state.tunnel = nil
+		m.tunnel = nil
 	}
-	if err := rpc.Register(NewClipboard(le)); err != nil {
-		return fmt.Errorf("unable to register Clipboard rpc object: %w", err)
+
+	// listeners are closed when ctx is cancelled or server fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var listeners sync.WaitGroup
+	if opts.LemonadePort != 0 {
+		lsrv, err := newLemonadeServer(uri, clip, opts.LemonadeCopyOnly, state.gate)
+		if err != nil {
+			return err
+		}
+		ll, err := listenLemonade(opts.LemonadePort)
+		if err != nil {
+			return err
+		}
+		state.addListener("lemonade", ll.Addr().String())
+		listeners.Go(func() { serveLemonade(ctx, ll, lsrv, conns, opts.IOTimeout, ev) })
 	}
-	if err := rpc.Register(tunnel); err != nil {
-		return fmt.Errorf("unable to register Tunnel rpc object: %w", err)
+	if opts.MetricsPort != 0 {
+		ml, err := listenMetrics(opts.MetricsPort)
+		if err != nil {
+			return err
+		}
+		state.addListener("metrics", ml.Addr().String())
+		listeners.Go(func() { serveMetrics(ctx, ml, m) })
+	}
+	if opts.DashboardPort != 0 {
+		dl, err := listenDashboard(opts.DashboardPort)
+		if err != nil {
+			return err
+		}
+		state.addListener("dashboard", dl.Addr().String())
+		d := &dashboard{s: state, activity: ev.activity, approve: approve, token: opts.DashboardToken}
+		listeners.Go(func() { serveDashboard(ctx, dl, d) })
+	}
+	if approve != nil {
+		if opts.Approval.Input != nil {
+			listeners.Go(func() { approve.serveTerminal(ctx, opts.Approval.Input, opts.Approval.Output) })
+		} else if opts.DashboardPort == 0 {
+			serverLog.Warnf("Some keys need approval, but there is neither terminal nor dashboard to ask on, such requests will be denied")
+		}
 	}
 
-	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", opts.Port))
 	if err != nil {
 		return fmt.Errorf("unable to resolve address: %w", err)
 	}
 
-	log.Printf("gclpr server listens on '%s'\n", addr)
+	serverLog.Debugf("gclpr server listens on '%s'", addr)
 
 	l, err := net.ListenTCP("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("unable to listen on '%s': %w", addr, err)
 	}
+	state.addListener("rpc", l.Addr().String())
 
 	// This will break the loop
 	go func() {
@@ -127,17 +524,24 @@ func Serve(ctx context.Context, port int, le string, pkeys map[[32]byte][32]byte
 		l.Close()
 	}()
 
-	log.Print("gclpr server is ready\n")
+	serverLog.Infof("gclpr server is ready on '%s'", l.Addr())
+	if opts.Ready != nil {
+		opts.Ready()
+	}
 	for {
-		conn, err := l.Accept()
-		if err != nil {
-			if !errors.Is(err, net.ErrClosed) {
-				return fmt.Errorf("gclpr server is unable to accept requests: %w", err)
+		conn, aerr := l.Accept()
+		if aerr != nil {
+			if !errors.Is(aerr, net.ErrClosed) {
+				err = fmt.Errorf("gclpr server is unable to accept requests: %w", aerr)
 			}
-			log.Print("gclpr server is shutting down\n")
-			return nil
+			break
+		}
+		if !conns.add(conn) {
+			conn.Close()
+			continue
 		}
 		go func(conn net.Conn) {
+			defer conns.done(conn)
 			handled, rpcReader := tunnel.attach(conn)
 			if handled {
 				return
@@ -145,19 +549,49 @@ func Serve(ctx context.Context, port int, le string, pkeys map[[32]byte][32]byte
 			sc := &secConn{
 				conn:      conn,
 				br:        rpcReader,
-				pkeys:     pkeys,
-				magic:     magic,
-				locked:    locked,
-				ioTimeout: ioTimeout,
+				pkeys:     opts.TrustedKeys,
+				magic:     opts.Magic,
+				ioTimeout: opts.IOTimeout,
+				events:    ev,
 			}
 			defer sc.Close()
-			log.Printf("gclpr server accepted request from '%s'", sc.conn.RemoteAddr())
-			rpc.ServeConn(sc)
-			log.Printf("gclpr server handled request from '%s'", sc.conn.RemoteAddr())
+			var (
+				srv *rpc.Server
+				err error
+			)
+			if rl != nil {
+				var rc *relayConn
+				if srv, rc, err = newRelayRPCServer(sc, state, rl, comp); err == nil {
+					defer rc.close()
+				}
+			} else {
+				srv, err = newRPCServer(sc, state, uri, clip, tunnel, comp)
+			}
+			if err != nil {
+				sc.log().Errorf("gclpr server is unable to handle request from '%s': %v", sc.conn.RemoteAddr(), err)
+				return
+			}
+			sc.log().Debugf("gclpr server accepted request from '%s'", sc.conn.RemoteAddr())
+			conns.serve(conn, srv, newServerCodec(sc, sc.log, state.gate, ev, "rpc"))
+			sc.log().Debugf("gclpr server handled request from '%s'", sc.conn.RemoteAddr())
 		}(conn)
 	}
+
+	serverLog.Infof("gclpr server is shutting down")
+	cancel()
+	listeners.Wait()
+	// peers are told tunnels are closing while rpc connections carrying them are still up
+	tunnel.shutdown()
+	conns.drain(shutdownTimeout)
+	clip.shutdown()
+	ev.hooks.wait()
+	serverLog.Infof("gclpr server stopped")
+	return err
 }
 
+// attach handles tunnel peers which connect separately from rpc connection. Such peers are
+// authenticated by session MAC key only and supported for compatibility with older clients, sessions
+// opened over connection with channels refuse them.
 func (t *Tunnel) attach(conn net.Conn) (bool, *bufio.Reader) {
 	br := bufio.NewReader(conn)
 	prefix, err := br.Peek(4)
@@ -179,14 +613,13 @@ func (t *Tunnel) attach(conn net.Conn) (bool, *bufio.Reader) {
 		return true, nil
 	}
 	replay := bufio.NewReader(io.MultiReader(bytes.NewReader(appendFrame(raw)), br))
-	if len(raw) < 1+4+tunnelMACSize {
+	if len(raw) < tunnel.HeaderSize+tunnel.MACSize {
 		return false, replay
 	}
-	frameType := tunnelFrameType(raw[0])
-	if frameType != tunnelFrameAttach {
+	if tunnel.FrameType(raw[0]) != tunnel.FrameAttach {
 		return false, replay
 	}
-	sessionIDBytes := raw[5 : len(raw)-tunnelMACSize]
+	sessionIDBytes := raw[tunnel.HeaderSize : len(raw)-tunnel.MACSize]
 	if len(sessionIDBytes) == 0 {
 		conn.Close()
 		return true, nil
@@ -199,32 +632,26 @@ func (t *Tunnel) attach(conn net.Conn) (bool, *bufio.Reader) {
 		conn.Close()
 		return true, nil
 	}
-	endpoint := &tunnelEndpoint{conn: conn, br: replay, macKey: append([]byte(nil), session.macKey...)}
-	frame, err := endpoint.readFrame()
-	if err != nil || frame.Type != tunnelFrameAttach || string(frame.Payload) != sessionID {
-		endpoint.close()
-		session.closeReason = "attach validation failed"
-		t.closeSession(sessionID)
+	if session.channelOnly {
+		t.events.authFailure("tunnel_separate_attach", callerInfo{req: session.reqID})
+		session.log().Warnf("attach refused: session was opened over connection with channels, peer has to attach over channel")
+		conn.Close()
 		return true, nil
 	}
-	if session.attachTimer != nil {
-		session.attachTimer.Stop()
-	}
-	if session.peer != nil {
-		endpoint.close()
+	endpoint := tunnel.NewEndpoint(&replayConn{Conn: conn, r: replay}, session.macKey)
+	endpoint.SetCompression(session.codec, session.threshold)
+	frame, err := endpoint.ReadFrame()
+	if err != nil || frame.Type != tunnel.FrameAttach || string(frame.Payload) != sessionID {
+		t.events.authFailure("tunnel_mac", callerInfo{req: session.reqID})
+		endpoint.Close()
+		session.setCloseReason("attach validation failed")
+		t.closeSession(sessionID)
 		return true, nil
 	}
-	session.peer = endpoint
-	session.markPeerReady()
-	session.touch()
-	session.launchOnce.Do(func() {
-		if err := opener(session.openURL); err != nil {
-			log.Printf("unable to open tunneled URI %q: %v", session.openURL, err)
-			session.closeReason = fmt.Sprintf("browser open failed: %v", err)
-			t.closeSession(sessionID)
-		}
-	})
-	go t.readPeerFrames(session)
+	if err := t.bindPeer(session, endpoint); err != nil {
+		session.log().Warnf("%v", err)
+		endpoint.Close()
+	}
 	return true, nil
 }
 
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
@@ -9,7 +10,9 @@ import (
 	"net/rpc"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/nacl/sign"
 
@@ -40,31 +43,72 @@ func (e *Echo) Repeat(text string, resp *string) error {
 // clientSecConn mirrors the client-side secConn from cmd/cli/main_cli.go.
 // We duplicate it here to avoid importing main packages.
 type clientSecConn struct {
-	conn net.Conn
-	br   *bufio.Reader
-	hpk  [32]byte
-	k    *[64]byte
+	conn    net.Conn
+	br      *bufio.Reader
+	hpk     [32]byte
+	k       *[64]byte
+	pending []byte
+	codec   string
+	mux     atomic.Pointer[util.Mux]
+	wmu     sync.Mutex
 }
 
 func (sc *clientSecConn) Read(p []byte) (n int, err error) {
-	data, err := util.ReadFrame(sc.br)
-	if err != nil {
-		return 0, err
+	if len(sc.pending) > 0 {
+		n = copy(p, sc.pending)
+		sc.pending = sc.pending[n:]
+		return n, nil
+	}
+	for {
+		data, err := util.ReadFrame(sc.br)
+		if err != nil {
+			return 0, err
+		}
+		if sc.codec != "" {
+			if data, err = util.Decompress(data); err != nil {
+				return 0, err
+			}
+		}
+		if m := sc.mux.Load(); m != nil {
+			var ok bool
+			if data, ok, err = m.Dispatch(data); err != nil {
+				return 0, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		n = copy(p, data)
+		sc.pending = data[n:]
+		return n, nil
 	}
-	copy(p, data)
-	return len(data), nil
 }
 
 func (sc *clientSecConn) Write(p []byte) (n int, err error) {
-	magic := []byte{'g', 'c', 'l', 'p', 'r', 0, 0, 0}
-	header := append(magic, sc.hpk[:]...)
-	out := sign.Sign(header, p, sc.k)
-	if err = util.WriteFrame(sc.conn, out); err != nil {
+	data := p
+	if m := sc.mux.Load(); m != nil {
+		data = m.Wrap(p)
+	}
+	if err = sc.writeFrame(data); err != nil {
 		return 0, err
 	}
 	return len(p), nil
 }
 
+func (sc *clientSecConn) writeFrame(data []byte) (err error) {
+	magic := []byte{'g', 'c', 'l', 'p', 'r', 0, 0, 0}
+	header := append(magic, sc.hpk[:]...)
+	if sc.codec != "" {
+		if data, err = util.Compress(sc.codec, 0, data); err != nil {
+			return err
+		}
+	}
+	out := sign.Sign(header, data, sc.k)
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return util.WriteFrame(sc.conn, out)
+}
+
 func (sc *clientSecConn) Close() error {
 	return sc.conn.Close()
 }
@@ -100,7 +144,6 @@ func startTestServer(t *testing.T, pkeys map[[32]byte][32]byte) (string, func())
 					br:        bufio.NewReader(conn),
 					pkeys:     pkeys,
 					magic:     magic,
-					locked:    nil,
 					ioTimeout: 0, // no timeout in tests
 				}
 				defer sc.Close()
@@ -316,3 +359,120 @@ func TestRPCBadMagic(t *testing.T) {
 		t.Error("expected error reading from rejected connection, got nil")
 	}
 }
+
+func TestSecConnReadSmallBuffer(t *testing.T) {
+	pk, sk, pkeys := generateTestKeys(t)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	sc := &secConn{conn: serverConn, br: bufio.NewReader(serverConn), pkeys: pkeys, magic: []byte{'g', 'c', 'l', 'p', 'r', 0, 0, 0}}
+	client := &clientSecConn{conn: clientConn, br: bufio.NewReader(clientConn), hpk: sha256.Sum256(pk[:]), k: sk}
+
+	payload := []byte(strings.Repeat("0123456789", 10))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Write(payload)
+		errCh <- err
+	}()
+
+	var got []byte
+	buf := make([]byte, 7)
+	for len(got) < len(payload) {
+		n, err := sc.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if n > len(buf) {
+			t.Fatalf("Read returned n=%d larger than buffer %d", n, len(buf))
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != string(payload) {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// blockingBackend holds Write until release is closed.
+type blockingBackend struct {
+	memoryBackend
+	started, release chan struct{}
+}
+
+func (b *blockingBackend) Write(string) error {
+	close(b.started)
+	<-b.release
+	return nil
+}
+
+func TestServeShutdownDrainsConnections(t *testing.T) {
+	pk, sk, pkeys := generateTestKeys(t)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	clip := &blockingBackend{started: started, release: release}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served, ready := make(chan error, 1), make(chan struct{})
+	go func() {
+		served <- Serve(ctx, Options{Port: port, TrustedKeys: pkeys, Magic: []byte{'g', 'c', 'l', 'p', 'r', 0, 0, 0}, Clipboard: clip, Ready: func() { close(ready) }})
+	}()
+	select {
+	case <-ready:
+	case err := <-served:
+		t.Fatalf("Serve: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("server did not start")
+	}
+
+	addr := fmt.Sprintf("localhost:%d", port)
+	var busy *rpc.Client
+	busy = dialClient(t, addr, pk, sk)
+	defer busy.Close()
+	idle := dialClient(t, addr, pk, sk)
+	defer idle.Close()
+	var reply StatusResponse
+	if err := idle.Call("Server.Status", struct{}{}, &reply); err != nil {
+		t.Fatalf("Server.Status: %v", err)
+	}
+
+	copied := busy.Go("Clipboard.Copy", "text", &struct{}{}, nil)
+	<-started
+	cancel()
+
+	// idle connection is closed right away
+	if err := idle.Call("Server.Status", struct{}{}, &reply); err == nil {
+		t.Fatal("expected idle connection to be closed on shutdown")
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned while request is in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if call := <-copied.Done; call.Error != nil {
+		t.Fatalf("in-flight Copy: %v", call.Error)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after in-flight request finished")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("expected server to stop listening")
+	}
+}
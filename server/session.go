@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// HelloRequest is sent by client right after connecting to negotiate protocol features.
+// Servers which predate it reject the call and connection continues without any of them.
+type HelloRequest struct {
+	Protocol    []byte
+	Version     string
+	Compression []string
+	// Mux asks to carry tunnel channels over this connection.
+	Mux bool
+	// RequestID identifies client operation in server logs.
+	RequestID string
+	// Origin is set by relays: hex encoded hashes of keys which signed the request on
+	// previous hops, original client first.
+	Origin []string
+}
+
+// HelloResponse describes features server agreed to use for this connection.
+type HelloResponse struct {
+	Protocol          []byte
+	Compression       string
+	CompressThreshold int
+	Mux               bool
+}
+
+// compression holds server compression policy.
+type compression struct {
+	codecs    []string
+	threshold int
+}
+
+func (c *compression) negotiate(offered []string) string {
+	if c == nil {
+		return util.CodecNone
+	}
+	return util.NegotiateCodec(offered, c.codecs)
+}
+
+// Session is per-connection rpc object handling protocol negotiation.
+type Session struct {
+	conn  *secConn
+	magic []byte
+	comp  *compression
+	info  map[[32]byte]util.KeyInfo
+}
+
+// Hello negotiates connection features. They are used starting with the first request received after reply.
+func (s *Session) Hello(req HelloRequest, resp *HelloResponse) error {
+	if util.ValidRequestID(req.RequestID) {
+		s.conn.setRequestID(req.RequestID)
+	} else if req.RequestID != "" {
+		s.conn.log().Warnf("Hello from '%s' with invalid request id ignored", s.conn.conn.RemoteAddr())
+	}
+	if len(req.Origin) > 0 {
+		if key, ok := s.conn.caller(); !ok || !s.info[key].Has(util.PermRelay) {
+			s.conn.log().Warnf("Hello from '%s' rejected: origin sent by key which is not allowed to relay", s.conn.conn.RemoteAddr())
+			return errors.New("key is not allowed to relay requests, it needs perms=relay in trusted keys file")
+		}
+		if err := s.conn.setOrigin(req.Origin); err != nil {
+			s.conn.log().Warnf("Hello from '%s' rejected: %v", s.conn.conn.RemoteAddr(), err)
+			return err
+		}
+		s.conn.log().Debugf("Hello from '%s' relayed on behalf of %v", s.conn.conn.RemoteAddr(), req.Origin)
+	}
+	codec := s.comp.negotiate(req.Compression)
+	s.conn.log().Debugf("Hello from '%s' protocol [%x] version %q compression %v -> %s mux %t", s.conn.conn.RemoteAddr(), req.Protocol, req.Version, req.Compression, codec, req.Mux)
+
+	resp.Protocol = s.magic
+	resp.Compression = codec
+	resp.Mux = req.Mux
+	f := features{codec: codec, mux: req.Mux}
+	if codec != util.CodecNone {
+		resp.CompressThreshold = s.comp.threshold
+		f.threshold = s.comp.threshold
+	}
+	s.conn.negotiate(f)
+	return nil
+}
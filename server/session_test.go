@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"maps"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/tunnel"
+	"github.com/rupor-github/gclpr/util"
+)
+
+// startSessionConn serves per-connection rpc on one end of a pipe and returns the other end.
+func startSessionConn(t *testing.T, pkeys map[[32]byte][32]byte, tn *Tunnel, comp *compression) net.Conn {
+	t.Helper()
+	return startStateConn(t, &serverState{started: time.Now(), keys: pkeys, gate: &gate{}, tunnel: tn}, comp)
+}
+
+// startStateConn is startSessionConn for server described by state.
+func startStateConn(t *testing.T, state *serverState, comp *compression) net.Conn {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	magic := []byte{'g', 'c', 'l', 'p', 'r', 0, 0, 0}
+	sc := &secConn{conn: serverConn, br: bufio.NewReader(serverConn), pkeys: state.keys, magic: magic}
+	srv, err := newRPCServer(sc, state, NewURI(), NewClipboard("", 0), state.tunnel, comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register(&Echo{}); err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeCodec(newServerCodec(sc, sc.log, state.gate, nil, ""))
+	return clientConn
+}
+
+func newSessionClient(t *testing.T, conn net.Conn, pk *[32]byte, sk *[64]byte) (*clientSecConn, *rpc.Client) {
+	t.Helper()
+
+	client := &clientSecConn{conn: conn, br: bufio.NewReader(conn), hpk: sha256.Sum256(pk[:]), k: sk}
+	rc := rpc.NewClient(client)
+	t.Cleanup(func() { rc.Close() })
+	return client, rc
+}
+
+func startSessionRPC(t *testing.T, comp *compression) (*clientSecConn, *rpc.Client) {
+	t.Helper()
+
+	pk, sk, pkeys := generateTestKeys(t)
+	return newSessionClient(t, startSessionConn(t, pkeys, NewTunnel(), comp), pk, sk)
+}
+
+func TestSessionHelloNegotiatesCompression(t *testing.T) {
+	client, rc := startSessionRPC(t, &compression{codecs: []string{"gzip", "zstd"}, threshold: 64})
+
+	var resp HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{Compression: []string{"zstd", "gzip"}}, &resp); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if resp.Compression != "zstd" || resp.CompressThreshold != 64 {
+		t.Fatalf("Hello response = %+v", resp)
+	}
+	client.codec = resp.Compression
+
+	text := strings.Repeat("compressible text ", 10000)
+	var reply string
+	if err := rc.Call("Echo.Repeat", text, &reply); err != nil {
+		t.Fatalf("Echo.Repeat after compression: %v", err)
+	}
+	if reply != text+text {
+		t.Fatalf("reply length = %d, want %d", len(reply), 2*len(text))
+	}
+}
+
+func TestSessionHelloWithoutCommonCodec(t *testing.T) {
+	_, rc := startSessionRPC(t, &compression{threshold: 64})
+
+	var resp HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{Compression: []string{"zstd"}}, &resp); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if resp.Compression != "none" || resp.CompressThreshold != 0 {
+		t.Fatalf("Hello response = %+v", resp)
+	}
+
+	var reply string
+	if err := rc.Call("Echo.Reverse", "abc", &reply); err != nil {
+		t.Fatalf("Echo.Reverse: %v", err)
+	}
+	if reply != "cba" {
+		t.Fatalf("reply = %q", reply)
+	}
+}
+
+// helloMux negotiates session layer and starts using it on client side.
+func helloMux(t *testing.T, client *clientSecConn, rc *rpc.Client) *util.Mux {
+	t.Helper()
+
+	var resp HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{Mux: true}, &resp); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if !resp.Mux {
+		t.Fatal("server did not agree to mux")
+	}
+	m := util.NewMux(client.writeFrame, nil, nil)
+	client.mux.Store(m)
+	return m
+}
+
+func TestSessionTunnelAttachOverChannel(t *testing.T) {
+	opened := make(chan string, 1)
+	origOpener := opener
+	opener = func(uri string) error {
+		opened <- uri
+		return nil
+	}
+	t.Cleanup(func() { opener = origOpener })
+
+	pk, sk, pkeys := generateTestKeys(t)
+	tn := NewTunnel()
+	client, rc := newSessionClient(t, startSessionConn(t, pkeys, tn, nil), pk, sk)
+	m := helloMux(t, client, rc)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	var resp TunnelOpenResponse
+	req := TunnelOpenRequest{
+		URL:           "http://127.0.0.1:1",
+		Targets:       []TunnelTarget{{ListenHost: "127.0.0.1", ListenPort: 1, DialAddr: "127.0.0.1:1"}},
+		MACKey:        key,
+		AttachTimeout: time.Second,
+		IdleTimeout:   time.Second,
+	}
+	tn.listenTCP = func(network string, _ *net.TCPAddr) (*net.TCPListener, error) {
+		return net.ListenTCP(network, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	}
+	if err := rc.Call("Tunnel.Open", req, &resp); err != nil {
+		t.Fatalf("Tunnel.Open: %v", err)
+	}
+	defer tn.closeSession(resp.SessionID)
+
+	// session opened over connection with channels refuses peer knowing MAC key only
+	legacy, legacyServer := net.Pipe()
+	go tunnel.NewEndpoint(legacy, key).WriteFrame(tunnel.Frame{Type: tunnel.FrameAttach, Payload: []byte(resp.SessionID)})
+	if handled, _ := tn.attach(legacyServer); !handled {
+		t.Fatal("separate attach is not handled")
+	}
+	tn.mu.Lock()
+	_, open := tn.sessions[resp.SessionID]
+	tn.mu.Unlock()
+	if !open {
+		t.Fatal("refused separate attach closed session")
+	}
+
+	bad := TunnelAttachRequest{SessionID: resp.SessionID, Channel: 7, Proof: TunnelAttachProof([]byte("wrong key"), resp.SessionID)}
+	if err := rc.Call("Tunnel.Attach", bad, &struct{}{}); err == nil {
+		t.Fatal("expected attach with bad proof to fail")
+	}
+
+	ch, err := m.Open(m.NextID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attach := TunnelAttachRequest{SessionID: resp.SessionID, Channel: ch.ID(), Proof: TunnelAttachProof(key, resp.SessionID)}
+	if err := rc.Call("Tunnel.Attach", attach, &struct{}{}); err != nil {
+		t.Fatalf("Tunnel.Attach: %v", err)
+	}
+	peer := tunnel.NewEndpoint(ch, key)
+
+	browserConn, err := net.Dial("tcp", resp.ListenAddrs[0])
+	if err != nil {
+		t.Fatalf("Dial browser listener: %v", err)
+	}
+	defer browserConn.Close()
+
+	frame, err := peer.ReadFrame()
+	if err != nil {
+		t.Fatalf("read open frame: %v", err)
+	}
+	if frame.Type != tunnel.FrameOpen || frame.StreamID == 0 {
+		t.Fatalf("unexpected frame: %#v", frame)
+	}
+	if err := peer.WriteFrame(tunnel.Frame{Type: tunnel.FrameData, StreamID: frame.StreamID, Payload: []byte("hello")}); err != nil {
+		t.Fatalf("write data frame: %v", err)
+	}
+	buf := make([]byte, 5)
+	browserConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(browserConn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("browser read = %q, %v", buf, err)
+	}
+	select {
+	case got := <-opened:
+		if got != resp.OpenURL {
+			t.Fatalf("opened = %q, want %q", got, resp.OpenURL)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for opener")
+	}
+
+	// rpc keeps working while channel is open
+	var reply string
+	if err := rc.Call("Echo.Reverse", "abc", &reply); err != nil || reply != "cba" {
+		t.Fatalf("Echo.Reverse = %q, %v", reply, err)
+	}
+
+	// closing session closes the channel
+	tn.closeSession(resp.SessionID)
+	expectTunnelClose(t, peer)
+}
+
+func TestSessionTunnelAttachRequiresOwner(t *testing.T) {
+	origOpener := opener
+	opener = func(string) error { return nil }
+	t.Cleanup(func() { opener = origOpener })
+
+	pk1, sk1, pkeys := generateTestKeys(t)
+	pk2, sk2, pkeys2 := generateTestKeys(t)
+	maps.Copy(pkeys, pkeys2)
+
+	tn := NewTunnel()
+	tn.listenTCP = func(network string, _ *net.TCPAddr) (*net.TCPListener, error) {
+		return net.ListenTCP(network, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	}
+	_, owner := newSessionClient(t, startSessionConn(t, pkeys, tn, nil), pk1, sk1)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	var resp TunnelOpenResponse
+	req := TunnelOpenRequest{
+		URL:     "http://127.0.0.1:1",
+		Targets: []TunnelTarget{{ListenHost: "127.0.0.1", ListenPort: 1, DialAddr: "127.0.0.1:1"}},
+		MACKey:  key,
+	}
+	if err := owner.Call("Tunnel.Open", req, &resp); err != nil {
+		t.Fatalf("Tunnel.Open: %v", err)
+	}
+	defer tn.closeSession(resp.SessionID)
+
+	client, other := newSessionClient(t, startSessionConn(t, pkeys, tn, nil), pk2, sk2)
+	m := helloMux(t, client, other)
+	attach := TunnelAttachRequest{SessionID: resp.SessionID, Channel: m.NextID(), Proof: TunnelAttachProof(key, resp.SessionID)}
+	err := other.Call("Tunnel.Attach", attach, &struct{}{})
+	if err == nil || !strings.Contains(err.Error(), "different key") {
+		t.Fatalf("Tunnel.Attach with other key err = %v", err)
+	}
+
+	// connection without session layer could not attach either
+	_, plain := newSessionClient(t, startSessionConn(t, pkeys, tn, nil), pk1, sk1)
+	if err := plain.Call("Tunnel.Attach", attach, &struct{}{}); err == nil {
+		t.Fatal("expected attach without channels to fail")
+	}
+}
+
+func TestSessionHelloRequestID(t *testing.T) {
+	fakeClipboard(t, "")
+	var buf bytes.Buffer
+	if _, err := util.SetupLogging(util.LogOptions{Levels: "clipboard=info", Output: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { util.SetupLogging(util.LogOptions{DefaultLevel: util.DefaultLogLevel}) })
+
+	_, rc := startSessionRPC(t, nil)
+	var resp HelloResponse
+	if err := rc.Call("Session.Hello", HelloRequest{RequestID: "0123abcd"}, &resp); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if err := rc.Call("Clipboard.Copy", "text", &struct{}{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	rc.Close()
+
+	for line := range strings.Lines(buf.String()) {
+		if strings.Contains(line, "Copy request received") {
+			if !strings.Contains(line, " subsys=clipboard req=0123abcd") {
+				t.Fatalf("copy log line %q does not carry request id", line)
+			}
+			return
+		}
+	}
+	t.Fatalf("copy was not logged: %q", buf.String())
+}
+
+// expectTunnelClose reads frames until peer endpoint is closed, server must say it is closing the tunnel first.
+func expectTunnelClose(t *testing.T, peer *tunnel.Endpoint) {
+	t.Helper()
+
+	told := false
+	for {
+		frame, err := peer.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read after session close err = %v, want EOF", err)
+		}
+		if frame.Type == tunnel.FrameClose && frame.StreamID == 0 {
+			told = true
+		}
+	}
+	if !told {
+		t.Fatal("server closed tunnel without close frame")
+	}
+}
+
+func TestSessionQuietChannelsTimeOut(t *testing.T) {
+	orig := channelIdleTimeout
+	channelIdleTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { channelIdleTimeout = orig })
+
+	pk, sk, pkeys := generateTestKeys(t)
+	clientConn, serverConn := net.Pipe()
+	magic := []byte{'g', 'c', 'l', 'p', 'r', 0, 0, 0}
+	sc := &secConn{conn: serverConn, br: bufio.NewReader(serverConn), pkeys: pkeys, magic: magic, ioTimeout: 50 * time.Millisecond}
+	state := &serverState{started: time.Now(), keys: pkeys, gate: &gate{}, tunnel: NewTunnel()}
+	srv, err := newRPCServer(sc, state, NewURI(), NewClipboard("", 0), state.tunnel, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Register(&Echo{}); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		srv.ServeCodec(newServerCodec(sc, sc.log, state.gate, nil, ""))
+		close(served)
+	}()
+
+	client, rc := newSessionClient(t, clientConn, pk, sk)
+	m := helloMux(t, client, rc)
+	// server starts using channels with the first call after hello
+	var reply string
+	if err := rc.Call("Echo.Reverse", "abc", &reply); err != nil {
+		t.Fatalf("Echo.Reverse: %v", err)
+	}
+	id := m.NextID()
+	if _, err := m.Open(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.openChannel(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// keepalive holds connection with quiet channel open past both timeouts
+	go m.Keepalive(20 * time.Millisecond)
+	time.Sleep(400 * time.Millisecond)
+	if err := rc.Call("Echo.Reverse", "abc", &reply); err != nil || reply != "cba" {
+		t.Fatalf("Echo.Reverse = %q, %v", reply, err)
+	}
+
+	// abandoned connection is dropped even though channel is still open
+	m.Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("quiet connection with open channel was not dropped")
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// StatusResponse describes running server as seen by the caller.
+type StatusResponse struct {
+	Version          string
+	Started          time.Time
+	Uptime           time.Duration
+	Listeners        []ListenerStatus
+	ClipboardBackend string
+	TrustedKeys      int
+	Caller           CallerStatus
+	// Tunnels lists active tunnel sessions, only sessions opened by caller are listed for non-admin keys.
+	Tunnels []TunnelStatus
+	Locked  bool
+	Paused  bool
+}
+
+// ListenerStatus describes address server accepts connections on.
+type ListenerStatus struct {
+	Kind string
+	Addr string
+}
+
+// CallerStatus describes key request was signed with.
+type CallerStatus struct {
+	Key         string
+	Label       string
+	Permissions []string
+	// Origin lists key hashes of previous hops when request came through relay.
+	Origin []string
+}
+
+// TunnelStatus describes single tunnel session.
+type TunnelStatus struct {
+	ID        string
+	RequestID string
+	Owner     string
+	URL       string
+	Listeners []string
+	Created   time.Time
+	Attached  bool
+	Streams   int
+	Opened    int64
+	BytesIn   int64
+	BytesOut  int64
+}
+
+// serverState is what server knows about itself, it is shared by all connections.
+type serverState struct {
+	version string
+	started time.Time
+	backend string
+	keys    map[[32]byte][32]byte
+	info    map[[32]byte]util.KeyInfo
+	gate    *gate
+	tunnel  *Tunnel // nil in relay mode
+
+	mu        sync.Mutex
+	listeners []ListenerStatus
+}
+
+func (s *serverState) addListener(kind, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, ListenerStatus{Kind: kind, Addr: addr})
+}
+
+// gateState reports whether requests are refused because session is locked or server is paused.
+func (s *serverState) gateState() (locked, paused bool) {
+	return s.gate.locked != nil && atomic.LoadInt32(s.gate.locked) == 1, s.gate.paused.Load()
+}
+
+// serverConn exposes server state to a single rpc connection.
+type serverConn struct {
+	s  *serverState
+	sc *secConn
+}
+
+// Status reports server state.
+func (c *serverConn) Status(_ struct{}, resp *StatusResponse) error {
+	s := c.s
+	hk, _ := c.sc.caller()
+	ki := s.info[hk]
+	c.sc.log().Debugf("Status requested by [%x]", hk)
+
+	resp.Version = s.version
+	resp.Started = s.started
+	resp.Uptime = time.Since(s.started)
+	s.mu.Lock()
+	resp.Listeners = slices.Clone(s.listeners)
+	s.mu.Unlock()
+	resp.ClipboardBackend = s.backend
+	resp.TrustedKeys = len(s.keys)
+	resp.Caller = CallerStatus{
+		Key:         hex.EncodeToString(hk[:]),
+		Label:       ki.Label,
+		Permissions: slices.Clone(ki.Permissions),
+		Origin:      c.sc.chain(),
+	}
+	// chain ends with caller itself
+	resp.Caller.Origin = resp.Caller.Origin[:max(0, len(resp.Caller.Origin)-1)]
+	if s.tunnel != nil {
+		resp.Tunnels = s.tunnel.status(hk, ki.Has(util.PermAdmin))
+	}
+	resp.Locked, resp.Paused = s.gateState()
+	return nil
+}
+
+// admin checks that caller key has admin permission.
+func (c *serverConn) admin(op string) error {
+	hk, _ := c.sc.caller()
+	if !c.s.info[hk].Has(util.PermAdmin) {
+		c.sc.log().Warnf("%s refused: key [%x] is not admin", op, hk)
+		return fmt.Errorf("%s requires admin key", op)
+	}
+	c.sc.log().Infof("%s requested by admin key [%x] %q", op, hk, c.s.info[hk].Label)
+	return nil
+}
+
+// Tunnels lists all active tunnel sessions. Admin only.
+func (c *serverConn) Tunnels(_ struct{}, resp *[]TunnelStatus) error {
+	if err := c.admin("tunnel list"); err != nil {
+		return err
+	}
+	if c.s.tunnel != nil {
+		*resp = c.s.tunnel.status([32]byte{}, true)
+	}
+	return nil
+}
+
+// KillTunnel closes tunnel session along with its listeners and streams. Admin only.
+func (c *serverConn) KillTunnel(id string, _ *struct{}) error {
+	if err := c.admin("tunnel kill"); err != nil {
+		return err
+	}
+	if c.s.tunnel == nil || !c.s.tunnel.killSession(id) {
+		return fmt.Errorf("unknown tunnel session %q", id)
+	}
+	return nil
+}
+
+// Pause makes server refuse requests the same way it does while session is locked. Admin only.
+func (c *serverConn) Pause(_ struct{}, _ *struct{}) error {
+	if err := c.admin("pause"); err != nil {
+		return err
+	}
+	if c.s.gate.paused.CompareAndSwap(false, true) {
+		serverLog.Infof("gclpr server is paused")
+	}
+	return nil
+}
+
+// Resume makes paused server serve requests again. Admin only.
+func (c *serverConn) Resume(_ struct{}, _ *struct{}) error {
+	if err := c.admin("resume"); err != nil {
+		return err
+	}
+	if c.s.gate.paused.CompareAndSwap(true, false) {
+		serverLog.Infof("gclpr server is resumed")
+	}
+	return nil
+}
+
+// status describes active tunnel sessions, all of them or only the ones opened with owner key.
+func (t *Tunnel) status(owner [32]byte, all bool) []TunnelStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make([]TunnelStatus, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		if !all && s.owner != owner {
+			continue
+		}
+		ts := TunnelStatus{
+			ID:        s.id,
+			RequestID: s.reqID,
+			Owner:     hex.EncodeToString(s.owner[:]),
+			URL:       s.url.String(),
+			Listeners: slices.Clone(s.listenAddrs),
+			Created:   s.createdAt,
+		}
+		if peer := s.getPeer(); peer != nil {
+			ts.Attached = true
+			st := peer.Stats()
+			ts.Streams, ts.Opened, ts.BytesIn, ts.BytesOut = st.Streams, st.Opened, st.BytesIn, st.BytesOut
+		}
+		res = append(res, ts)
+	}
+	slices.SortFunc(res, func(a, b TunnelStatus) int { return a.Created.Compare(b.Created) })
+	return res
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/hex"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// openTestTunnel reserves tunnel session on a free loopback port.
+func openTestTunnel(t *testing.T, call func(string, any, any) error) TunnelOpenResponse {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+
+	var resp TunnelOpenResponse
+	req := TunnelOpenRequest{
+		URL:           "http://" + addr,
+		Targets:       []TunnelTarget{{ListenHost: "127.0.0.1", ListenPort: port, DialAddr: addr}},
+		MACKey:        testTunnelMACKey,
+		AttachTimeout: time.Minute,
+	}
+	if err := call("Tunnel.Open", req, &resp); err != nil {
+		t.Fatalf("Tunnel.Open: %v", err)
+	}
+	return resp
+}
+
+func TestServerStatus(t *testing.T) {
+	adminPK, adminSK, pkeys := generateTestKeys(t)
+	userPK, userSK, userKeys := generateTestKeys(t)
+	maps.Copy(pkeys, userKeys)
+
+	var adminHash [32]byte
+	for hk, pk := range pkeys {
+		if pk == *adminPK {
+			adminHash = hk
+		}
+	}
+	var locked int32
+	tn := NewTunnel()
+	state := &serverState{
+		version: "1.2.3",
+		started: time.Now().Add(-time.Minute),
+		backend: "memory",
+		keys:    pkeys,
+		info:    map[[32]byte]util.KeyInfo{adminHash: {Label: "laptop", Permissions: []string{util.PermAdmin}}},
+		gate:    &gate{locked: &locked},
+		tunnel:  tn,
+	}
+	state.addListener("rpc", "127.0.0.1:2850")
+	t.Cleanup(func() {
+		for _, ts := range tn.status([32]byte{}, true) {
+			tn.closeSession(ts.ID)
+		}
+	})
+
+	_, admin := newSessionClient(t, startStateConn(t, state, nil), adminPK, adminSK)
+	_, user := newSessionClient(t, startStateConn(t, state, nil), userPK, userSK)
+	opened := openTestTunnel(t, admin.Call)
+	openTestTunnel(t, user.Call)
+
+	var resp StatusResponse
+	if err := admin.Call("Server.Status", struct{}{}, &resp); err != nil {
+		t.Fatalf("Server.Status: %v", err)
+	}
+	if resp.Version != "1.2.3" || resp.Uptime < time.Minute || resp.ClipboardBackend != "memory" || resp.TrustedKeys != 2 || resp.Locked {
+		t.Fatalf("status = %+v", resp)
+	}
+	if len(resp.Listeners) != 1 || resp.Listeners[0] != (ListenerStatus{Kind: "rpc", Addr: "127.0.0.1:2850"}) {
+		t.Fatalf("listeners = %+v", resp.Listeners)
+	}
+	if resp.Caller.Key != hex.EncodeToString(adminHash[:]) || resp.Caller.Label != "laptop" || len(resp.Caller.Permissions) != 1 || len(resp.Caller.Origin) != 0 {
+		t.Fatalf("caller = %+v", resp.Caller)
+	}
+	// admin sees every session
+	if len(resp.Tunnels) != 2 {
+		t.Fatalf("admin tunnels = %+v", resp.Tunnels)
+	}
+	i := slices.IndexFunc(resp.Tunnels, func(ts TunnelStatus) bool { return ts.ID == opened.SessionID })
+	if i < 0 || resp.Tunnels[i].Attached || resp.Tunnels[i].Owner != resp.Caller.Key {
+		t.Fatalf("admin tunnels = %+v", resp.Tunnels)
+	}
+	if len(resp.Tunnels[i].Listeners) != 1 || resp.Tunnels[i].Listeners[0] != opened.ListenAddrs[0] {
+		t.Fatalf("tunnel listeners = %+v, want %v", resp.Tunnels[i].Listeners, opened.ListenAddrs)
+	}
+
+	// status is available while session is locked, clipboard is not
+	atomic.StoreInt32(&locked, 1)
+	resp = StatusResponse{}
+	if err := user.Call("Server.Status", struct{}{}, &resp); err != nil {
+		t.Fatalf("Server.Status: %v", err)
+	}
+	if resp.Caller.Label != "" || len(resp.Caller.Permissions) != 0 || !resp.Locked {
+		t.Fatalf("user status = %+v", resp)
+	}
+	if len(resp.Tunnels) != 1 || resp.Tunnels[0].ID == opened.SessionID {
+		t.Fatalf("user tunnels = %+v", resp.Tunnels)
+	}
+	var text string
+	if err := user.Call("Clipboard.Paste", struct{}{}, &text); err == nil {
+		t.Fatal("expected paste to be refused while session is locked")
+	}
+}
+
+func TestServerAdmin(t *testing.T) {
+	content := fakeClipboard(t, "")
+
+	adminPK, adminSK, pkeys := generateTestKeys(t)
+	userPK, userSK, userKeys := generateTestKeys(t)
+	maps.Copy(pkeys, userKeys)
+	info := map[[32]byte]util.KeyInfo{}
+	for hk, pk := range pkeys {
+		if pk == *adminPK {
+			info[hk] = util.KeyInfo{Permissions: []string{util.PermAdmin}}
+		}
+	}
+	tn := NewTunnel()
+	state := &serverState{started: time.Now(), keys: pkeys, info: info, gate: &gate{}, tunnel: tn}
+
+	_, admin := newSessionClient(t, startStateConn(t, state, nil), adminPK, adminSK)
+	_, user := newSessionClient(t, startStateConn(t, state, nil), userPK, userSK)
+	opened := openTestTunnel(t, user.Call)
+
+	var list []TunnelStatus
+	if err := user.Call("Server.Tunnels", struct{}{}, &list); err == nil {
+		t.Fatal("expected tunnel list to require admin key")
+	}
+	if err := user.Call("Server.KillTunnel", opened.SessionID, &struct{}{}); err == nil {
+		t.Fatal("expected tunnel kill to require admin key")
+	}
+	if err := user.Call("Server.Pause", struct{}{}, &struct{}{}); err == nil {
+		t.Fatal("expected pause to require admin key")
+	}
+
+	if err := admin.Call("Server.Tunnels", struct{}{}, &list); err != nil {
+		t.Fatalf("Server.Tunnels: %v", err)
+	}
+	if len(list) != 1 || list[0].ID != opened.SessionID {
+		t.Fatalf("tunnels = %+v", list)
+	}
+	if err := admin.Call("Server.KillTunnel", opened.SessionID, &struct{}{}); err != nil {
+		t.Fatalf("Server.KillTunnel: %v", err)
+	}
+	if err := admin.Call("Server.KillTunnel", opened.SessionID, &struct{}{}); err == nil {
+		t.Fatal("expected killing unknown session to fail")
+	}
+	if st := tn.status([32]byte{}, true); len(st) != 0 {
+		t.Fatalf("tunnels after kill = %+v", st)
+	}
+
+	if err := admin.Call("Server.Pause", struct{}{}, &struct{}{}); err != nil {
+		t.Fatalf("Server.Pause: %v", err)
+	}
+	var status StatusResponse
+	if err := user.Call("Server.Status", struct{}{}, &status); err != nil || !status.Paused {
+		t.Fatalf("status while paused = %+v, %v", status, err)
+	}
+	// paused server drops connection just like locked one does
+	if err := user.Call("Clipboard.Copy", "text", &struct{}{}); err == nil {
+		t.Fatal("expected copy to be refused while server is paused")
+	}
+	if err := admin.Call("Server.Resume", struct{}{}, &struct{}{}); err != nil {
+		t.Fatalf("Server.Resume: %v", err)
+	}
+	_, user = newSessionClient(t, startStateConn(t, state, nil), userPK, userSK)
+	if err := user.Call("Clipboard.Copy", "text", &struct{}{}); err != nil {
+		t.Fatalf("Copy after resume: %v", err)
+	}
+	if content.content() != "text" {
+		t.Fatalf("clipboard = %q", content.content())
+	}
+}
@@ -1,19 +1,21 @@
 package server
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/rupor-github/gclpr/tunnel"
+	"github.com/rupor-github/gclpr/util"
 )
 
 const (
@@ -28,6 +30,8 @@ type TunnelOpenRequest struct {
 	MACKey        []byte
 	AttachTimeout time.Duration
 	IdleTimeout   time.Duration
+	// Compression lists codecs client supports for data frames, in order of preference.
+	Compression []string
 }
 
 // TunnelTarget describes one server-side listener and its matching client-side dial target.
@@ -45,31 +49,52 @@ type TunnelOpenResponse struct {
 	ListenAddrs   []string
 	AttachTimeout time.Duration
 	IdleTimeout   time.Duration
+	// Compression is codec agreed on for data frames, CompressThreshold is the smallest payload to compress.
+	Compression       string
+	CompressThreshold int
+}
+
+// TunnelAttachRequest binds reserved tunnel session to a channel of the connection it was opened from.
+type TunnelAttachRequest struct {
+	SessionID string
+	Channel   uint32
+	// Proof is TunnelAttachProof computed with session MAC key.
+	Proof []byte
+}
+
+// TunnelAttachProof returns HMAC-SHA256 of session id keyed with session MAC key.
+func TunnelAttachProof(macKey []byte, sessionID string) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write([]byte(sessionID))
+	return mac.Sum(nil)
 }
 
 type tunnelSession struct {
-	id           string
-	url          *url.URL
-	openURL      string
-	listenAddrs  []string
-	listeners    []*tunnelListener
-	attachTimer  *time.Timer
-	idleTimer    *time.Timer
-	closeReason  string
-	attachTO     time.Duration
-	idleTO       time.Duration
-	createdAt    time.Time
-	macKey       []byte
-	peerReady    chan struct{}
-	peerOnce     sync.Once
-	launchOnce   sync.Once
-	timerMu      sync.Mutex
-	peer         *tunnelEndpoint
-	streamMu     sync.Mutex
-	streams      map[uint32]*tunnelStream
-	nextStreamID uint32
-	closeOnce    sync.Once
-	closed       chan struct{}
+	id          string
+	reqID       string   // client operation which opened the session
+	owner       [32]byte // hash of the key session was opened with
+	channelOnly bool     // opened over connection with channels, peer attaches over channel only
+	url         *url.URL
+	openURL     string
+	listenAddrs []string
+	listeners   []*tunnelListener
+	attachTimer *time.Timer
+	idleTimer   *time.Timer
+	attachTO    time.Duration
+	idleTO      time.Duration
+	createdAt   time.Time
+	macKey      []byte
+	codec       string
+	threshold   int
+	peerReady   chan struct{}
+	peerOnce    sync.Once
+	launchOnce  sync.Once
+	timerMu     sync.Mutex
+	stateMu     sync.Mutex // guards peer and closeReason
+	peer        *tunnel.Session
+	closeReason string
+	closeOnce   sync.Once
+	closed      chan struct{}
 }
 
 type tunnelListener struct {
@@ -92,18 +117,56 @@ func (s *tunnelSession) close() {
 		for _, listener := range s.listeners {
 			listener.listener.Close()
 		}
-		if s.peer != nil {
-			s.peer.close()
+		if peer := s.getPeer(); peer != nil {
+			// streams and browser connections are closed along with peer
+			peer.Close()
 		}
-		s.streamMu.Lock()
-		for _, stream := range s.streams {
-			stream.close()
-		}
-		s.streamMu.Unlock()
 		close(s.closed)
 	})
 }
 
+// getPeer returns tunnel session of attached peer or nil when peer is not attached yet.
+func (s *tunnelSession) getPeer() *tunnel.Session {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.peer
+}
+
+// setCloseReason records why session is closed, the first recorded reason wins.
+func (s *tunnelSession) setCloseReason(reason string) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+}
+
+// reason returns recorded close reason.
+func (s *tunnelSession) reason() string {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.closeReason
+}
+
+// logAttrs returns attributes which identify session in log messages of tunnel package.
+func (s *tunnelSession) logAttrs() []any {
+	var attrs []any
+	if s.reqID != "" {
+		attrs = append(attrs, "req", s.reqID)
+	}
+	return append(attrs, "session", s.id)
+}
+
+// caller identifies client which opened the session, sessions opened without connection have no owner.
+func (s *tunnelSession) caller() callerInfo {
+	return callerInfo{key: s.owner, known: s.owner != [32]byte{}, req: s.reqID}
+}
+
+// log returns logger which marks messages with request and session ids.
+func (s *tunnelSession) log() util.Logger {
+	return util.NewLogger(util.SubsysTunnel).With(s.logAttrs()...)
+}
+
 func (s *tunnelSession) markPeerReady() {
 	s.peerOnce.Do(func() {
 		close(s.peerReady)
@@ -140,6 +203,24 @@ type Tunnel struct {
 	listenTCP    func(network string, laddr *net.TCPAddr) (*net.TCPListener, error)
 	newSessionID func() (string, error)
 	now          func() time.Time
+	comp         *compression
+	events       *events
+	closedStats  tunnel.Stats // traffic of closed sessions
+	policy       *uriPolicy
+	approve      *approver
+	limits       TunnelLimits
+}
+
+// TunnelLimits restricts tunnel sessions, zero values select defaults.
+type TunnelLimits struct {
+	// AttachTimeout and IdleTimeout are used for sessions which do not ask for their own,
+	// DefaultTunnelAttachTimeout and DefaultTunnelIdleTimeout are used when not set.
+	AttachTimeout time.Duration
+	IdleTimeout   time.Duration
+	// MaxSessions when not 0 limits number of sessions open at the same time.
+	MaxSessions int
+	// BufferSize when not 0 limits payload of data frames sent to tunnel clients.
+	BufferSize int
 }
 
 // NewTunnel initializes Tunnel structure.
@@ -154,42 +235,57 @@ func NewTunnel() *Tunnel {
 
 // Open reserves server-side listener(s) for a future browser tunnel connection.
 func (t *Tunnel) Open(req TunnelOpenRequest, resp *TunnelOpenResponse) error {
-	parsed, err := ParseOpenURI(req.URL)
+	return t.open(req, resp, [32]byte{}, "", false)
+}
+
+func (t *Tunnel) open(req TunnelOpenRequest, resp *TunnelOpenResponse, owner [32]byte, reqID string, channelOnly bool) error {
+	log := requestLogger(util.SubsysTunnel, reqID)
+
+	if _, err := t.policy.parse(req.URL); err != nil {
+		return err
+	}
+	// hooks see validated URL and may replace it, replacement has to pass the same policy
+	caller := callerInfo{key: owner, known: owner != [32]byte{}, req: reqID}
+	raw, err := t.events.beforeOpen(req.URL, caller)
 	if err != nil {
 		return err
 	}
+	parsed, err := t.policy.parse(raw)
+	if err != nil {
+		return err
+	}
+	if err := t.approve.check(util.ApproveTunnel, caller, describeURL(parsed)); err != nil {
+		return err
+	}
 	if len(req.Targets) == 0 {
 		return fmt.Errorf("tunnel targets are required")
 	}
 
-	attachTimeout := req.AttachTimeout
-	if attachTimeout <= 0 {
-		attachTimeout = DefaultTunnelAttachTimeout
-	}
-	idleTimeout := req.IdleTimeout
-	if idleTimeout <= 0 {
-		idleTimeout = DefaultTunnelIdleTimeout
-	}
+	attachTimeout := cmp.Or(max(req.AttachTimeout, 0), t.limits.AttachTimeout, DefaultTunnelAttachTimeout)
+	idleTimeout := cmp.Or(max(req.IdleTimeout, 0), t.limits.IdleTimeout, DefaultTunnelIdleTimeout)
 
 	sessionID, err := t.newSessionID()
 	if err != nil {
 		return fmt.Errorf("unable to create tunnel session id: %w", err)
 	}
 
-	targets, listenAddrs, err := t.bindListeners(req.Targets)
+	targets, listenAddrs, err := t.bindListeners(req.Targets, log)
 	if err != nil {
 		return err
 	}
-	log.Printf("tunnel session request url=%q targets=%d attach_timeout=%s idle_timeout=%s", parsed.String(), len(req.Targets), attachTimeout, idleTimeout)
-	if len(req.MACKey) != tunnelMACKeySize {
+	log.Infof("tunnel session request url=%q targets=%d attach_timeout=%s idle_timeout=%s", parsed.String(), len(req.Targets), attachTimeout, idleTimeout)
+	if len(req.MACKey) != tunnel.MACKeySize {
 		for _, listener := range targets {
 			listener.listener.Close()
 		}
-		return fmt.Errorf("tunnel MAC key must be %d bytes", tunnelMACKeySize)
+		return fmt.Errorf("tunnel MAC key must be %d bytes", tunnel.MACKeySize)
 	}
 
 	session := &tunnelSession{
 		id:          sessionID,
+		owner:       owner,
+		channelOnly: channelOnly,
+		reqID:       reqID,
 		url:         parsed,
 		openURL:     rewriteTunnelOpenURL(parsed, targets),
 		listenAddrs: listenAddrs,
@@ -198,22 +294,29 @@ func (t *Tunnel) Open(req TunnelOpenRequest, resp *TunnelOpenResponse) error {
 		idleTO:      idleTimeout,
 		createdAt:   t.now(),
 		macKey:      append([]byte(nil), req.MACKey...),
+		codec:       t.comp.negotiate(req.Compression),
 		peerReady:   make(chan struct{}),
-		streams:     make(map[uint32]*tunnelStream),
 		closed:      make(chan struct{}),
 	}
 	session.attachTimer = time.AfterFunc(attachTimeout, func() {
-		session.closeReason = fmt.Sprintf("attach timeout after %s", attachTimeout)
+		session.setCloseReason(fmt.Sprintf("attach timeout after %s", attachTimeout))
 		t.closeSession(sessionID)
 	})
 	session.startIdleTimer(func() {
-		session.closeReason = fmt.Sprintf("idle timeout after %s", idleTimeout)
+		session.setCloseReason(fmt.Sprintf("idle timeout after %s", idleTimeout))
 		t.closeSession(sessionID)
 	})
 
 	t.mu.Lock()
+	if t.limits.MaxSessions > 0 && len(t.sessions) >= t.limits.MaxSessions {
+		t.mu.Unlock()
+		session.close()
+		log.Warnf("tunnel session refused: %d sessions are open already", len(t.sessions))
+		return fmt.Errorf("too many tunnel sessions, server allows %d", t.limits.MaxSessions)
+	}
 	t.sessions[sessionID] = session
 	t.mu.Unlock()
+	t.events.tunnelOpened(session)
 
 	resp.SessionID = sessionID
 	resp.OpenURL = session.openURL
@@ -223,7 +326,12 @@ func (t *Tunnel) Open(req TunnelOpenRequest, resp *TunnelOpenResponse) error {
 	resp.ListenAddrs = append([]string(nil), session.listenAddrs...)
 	resp.AttachTimeout = session.attachTO
 	resp.IdleTimeout = session.idleTO
-	log.Printf("tunnel session %s reserved listeners=%v", sessionID, session.listenAddrs)
+	resp.Compression = session.codec
+	if session.codec != util.CodecNone {
+		session.threshold = t.comp.threshold
+		resp.CompressThreshold = session.threshold
+	}
+	session.log().Debugf("reserved listeners=%v compression=%s", session.listenAddrs, session.codec)
 
 	for _, listener := range session.listeners {
 		go t.serveBrowserListener(session, listener)
@@ -232,23 +340,148 @@ func (t *Tunnel) Open(req TunnelOpenRequest, resp *TunnelOpenResponse) error {
 	return nil
 }
 
+// bindPeer makes endpoint the peer of reserved session and opens browser.
+func (t *Tunnel) bindPeer(session *tunnelSession, endpoint *tunnel.Endpoint) error {
+	session.timerMu.Lock()
+	if session.attachTimer != nil {
+		session.attachTimer.Stop()
+	}
+	session.timerMu.Unlock()
+	session.stateMu.Lock()
+	if session.peer != nil {
+		session.stateMu.Unlock()
+		return fmt.Errorf("tunnel session is already attached")
+	}
+	peer := tunnel.NewSession(endpoint, tunnel.Options{LogAttrs: session.logAttrs(), OnActivity: session.touch, ChunkSize: t.limits.BufferSize})
+	session.peer = peer
+	session.stateMu.Unlock()
+	go func() {
+		<-peer.Done()
+		if err := peer.Err(); err != nil {
+			session.setCloseReason(fmt.Sprintf("peer read failed: %v", err))
+		} else {
+			session.setCloseReason("peer closed")
+		}
+		t.closeSession(session.id)
+	}()
+	session.markPeerReady()
+	session.touch()
+	session.launchOnce.Do(func() {
+		if err := opener(session.openURL); err != nil {
+			session.log().Errorf("unable to open tunneled URI %q: %v", session.openURL, err)
+			session.setCloseReason(fmt.Sprintf("browser open failed: %v", err))
+			t.closeSession(session.id)
+		}
+	})
+	return nil
+}
+
+// tunnelConn exposes Tunnel to a single rpc connection, binding sessions to caller identity.
+type tunnelConn struct {
+	t  *Tunnel
+	sc *secConn
+}
+
+// Open reserves tunnel session owned by the key connection is authenticated with.
+func (tc *tunnelConn) Open(req TunnelOpenRequest, resp *TunnelOpenResponse) error {
+	owner, _ := tc.sc.caller()
+	// client which could attach over channel of authenticated connection has no need for separate one
+	return tc.t.open(req, resp, owner, tc.sc.getRequestID(), tc.sc.muxer() != nil)
+}
+
+// Attach makes channel of this connection the peer of tunnel session. Session must be opened
+// with the same key connection is authenticated with.
+func (tc *tunnelConn) Attach(req TunnelAttachRequest, _ *struct{}) error {
+	m := tc.sc.muxer()
+	if m == nil {
+		return fmt.Errorf("connection does not support channels")
+	}
+	tc.t.mu.Lock()
+	session, ok := tc.t.sessions[req.SessionID]
+	tc.t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown tunnel session %q", req.SessionID)
+	}
+	caller, identified := tc.sc.caller()
+	if !identified || caller != session.owner {
+		tc.t.events.authFailure("tunnel_owner", callerInfo{key: caller, known: identified, req: tc.sc.getRequestID()})
+		session.log().Warnf("attach refused: caller key [%x] is not session owner", caller)
+		return fmt.Errorf("tunnel session %q was opened with a different key", req.SessionID)
+	}
+	if !hmac.Equal(req.Proof, TunnelAttachProof(session.macKey, session.id)) {
+		tc.t.events.authFailure("tunnel_proof", callerInfo{key: caller, known: true, req: tc.sc.getRequestID()})
+		session.log().Warnf("attach refused: bad proof")
+		return fmt.Errorf("tunnel session %q attach validation failed", req.SessionID)
+	}
+	ch, err := m.Open(req.Channel)
+	if err != nil {
+		return err
+	}
+	// data is compressed by connection itself
+	endpoint := tunnel.NewEndpoint(ch, session.macKey)
+	if err := tc.t.bindPeer(session, endpoint); err != nil {
+		endpoint.Close()
+		return err
+	}
+	session.log().Debugf("attached to channel %d of '%s'", req.Channel, tc.sc.conn.RemoteAddr())
+	return nil
+}
+
 func (t *Tunnel) closeSession(id string) {
 	t.mu.Lock()
 	session, ok := t.sessions[id]
 	if ok {
 		delete(t.sessions, id)
+		if peer := session.getPeer(); peer != nil {
+			// counters keep growing when session leaves the table
+			st := peer.Stats()
+			t.closedStats.Opened += st.Opened
+			t.closedStats.BytesIn += st.BytesIn
+			t.closedStats.BytesOut += st.BytesOut
+		}
 	}
 	t.mu.Unlock()
 	if ok {
-		reason := session.closeReason
+		t.events.tunnelClosed(session)
+		reason := session.reason()
 		if reason == "" {
 			reason = "explicit close"
 		}
-		log.Printf("closing tunnel session %s listeners=%d streams=%d reason=%s", id, len(session.listeners), len(session.streams), reason)
+		session.log().Infof("closing listeners=%d %s reason=%s", len(session.listeners), session.stats(), reason)
 		session.close()
 	}
 }
 
+// shutdown closes all sessions and waits for their peers to stop.
+func (t *Tunnel) shutdown() {
+	t.mu.Lock()
+	sessions := make([]*tunnelSession, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		sessions = append(sessions, session)
+	}
+	t.mu.Unlock()
+	for _, session := range sessions {
+		session.setCloseReason("server shutdown")
+		t.closeSession(session.id)
+		if peer := session.getPeer(); peer != nil {
+			<-peer.Done()
+		}
+	}
+}
+
+// killSession closes session on admin request, it returns false when there is no such session.
+func (t *Tunnel) killSession(id string) bool {
+	t.mu.Lock()
+	session, ok := t.sessions[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	session.setCloseReason("killed by admin")
+	t.closeSession(id)
+	return true
+}
+
 func ParseTunnelURL(raw string) (*url.URL, error) {
 	parsed, err := url.ParseRequestURI(raw)
 	if err != nil {
@@ -297,7 +530,7 @@ func tunnelEffectivePort(parsed *url.URL) (int, error) {
 	}
 }
 
-func (t *Tunnel) bindListeners(targets []TunnelTarget) ([]*tunnelListener, []string, error) {
+func (t *Tunnel) bindListeners(targets []TunnelTarget, log util.Logger) ([]*tunnelListener, []string, error) {
 	if len(targets) == 0 {
 		return nil, nil, fmt.Errorf("tunnel targets are required")
 	}
@@ -308,27 +541,27 @@ func (t *Tunnel) bindListeners(targets []TunnelTarget) ([]*tunnelListener, []str
 
 	for _, target := range targets {
 		if err := validateTunnelTarget(target); err != nil {
-			log.Printf("rejecting tunnel target host=%q port=%d dial=%q: %v", target.ListenHost, target.ListenPort, target.DialAddr, err)
+			log.Warnf("rejecting tunnel target host=%q port=%d dial=%q: %v", target.ListenHost, target.ListenPort, target.DialAddr, err)
 			bindErrs = append(bindErrs, err)
 			continue
 		}
-		log.Printf("binding tunnel target host=%q port=%d dial=%q", target.ListenHost, target.ListenPort, target.DialAddr)
+		log.Debugf("binding tunnel target host=%q port=%d dial=%q", target.ListenHost, target.ListenPort, target.DialAddr)
 		addrs, err := tunnelListenTargets(target.ListenHost, target.ListenPort)
 		if err != nil {
 			bindErrs = append(bindErrs, err)
 			continue
 		}
 		for _, addr := range addrs {
-			listener, fallback, err := t.listenTunnelAddr(addr)
+			listener, fallback, err := t.listenTunnelAddr(addr, log)
 			if err != nil {
-				log.Printf("failed binding tunnel listener %s for dial=%q: %v", addr.String(), target.DialAddr, err)
+				log.Warnf("failed binding tunnel listener %s for dial=%q: %v", addr.String(), target.DialAddr, err)
 				bindErrs = append(bindErrs, fmt.Errorf("%s: %w", addr.String(), err))
 				continue
 			}
 			targetListener := &tunnelListener{listener: listener, addr: listener.Addr().String(), dialAddr: target.DialAddr, fallback: fallback}
 			listeners = append(listeners, targetListener)
 			listenAddrs = append(listenAddrs, targetListener.addr)
-			log.Printf("bound tunnel listener %s -> %s", targetListener.addr, targetListener.dialAddr)
+			log.Debugf("bound tunnel listener %s -> %s", targetListener.addr, targetListener.dialAddr)
 		}
 	}
 
@@ -339,7 +572,7 @@ func (t *Tunnel) bindListeners(targets []TunnelTarget) ([]*tunnelListener, []str
 	return listeners, listenAddrs, nil
 }
 
-func (t *Tunnel) listenTunnelAddr(addr *net.TCPAddr) (*net.TCPListener, bool, error) {
+func (t *Tunnel) listenTunnelAddr(addr *net.TCPAddr, log util.Logger) (*net.TCPListener, bool, error) {
 	listener, err := t.listenTCP("tcp", addr)
 	if err == nil {
 		return listener, false, nil
@@ -352,7 +585,7 @@ func (t *Tunnel) listenTunnelAddr(addr *net.TCPAddr) (*net.TCPListener, bool, er
 	if fallbackErr != nil {
 		return nil, false, errors.Join(err, fallbackErr)
 	}
-	log.Printf("tunnel listener %s unavailable, using random port %s", addr.String(), listener.Addr())
+	log.Infof("tunnel listener %s unavailable, using random port %s", addr.String(), listener.Addr())
 	return listener, true, nil
 }
 
@@ -446,13 +679,15 @@ func tunnelListenTargets(host string, port int) ([]*net.TCPAddr, error) {
 }
 
 func randomTunnelSessionID() (string, error) {
-	var raw [16]byte
-	if _, err := rand.Read(raw[:]); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(raw[:]), nil
+	return randomID()
 }
 
-func (s *tunnelSession) nextID() uint32 {
-	return atomic.AddUint32(&s.nextStreamID, 1)
+// stats describes session traffic for logs.
+func (s *tunnelSession) stats() string {
+	peer := s.getPeer()
+	if peer == nil {
+		return "streams=0"
+	}
+	st := peer.Stats()
+	return fmt.Sprintf("streams=%d opened=%d bytes_in=%d bytes_out=%d", st.Streams, st.Opened, st.BytesIn, st.BytesOut)
 }
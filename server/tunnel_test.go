@@ -203,6 +203,7 @@ func TestTunnelOpenRewritesOAuthRedirectPortOnConflict(t *testing.T) {
 func TestTunnelOpenAttachTimeoutClosesSession(t *testing.T) {
 	tn := NewTunnel()
 	tn.newSessionID = func() (string, error) { return "session", nil }
+	tn.events = &events{metrics: newMetrics(tn)}
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
@@ -221,6 +222,13 @@ func TestTunnelOpenAttachTimeoutClosesSession(t *testing.T) {
 	if ok {
 		t.Fatal("session still present after attach timeout")
 	}
+	var buf strings.Builder
+	tn.events.metrics.writeTo(&buf)
+	for _, line := range []string{"gclpr_tunnel_sessions_total 1\n", `gclpr_tunnel_closures_total{reason="attach_timeout"} 1` + "\n", "gclpr_tunnel_sessions_active 0\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("metrics do not contain %q:\n%s", line, buf.String())
+		}
+	}
 }
 
 func TestTunnelIdleTimerClosesSession(t *testing.T) {
@@ -285,3 +293,36 @@ func TestRewriteTunnelOpenURLSingleStackLocalhost(t *testing.T) {
 		t.Fatalf("rewriteTunnelOpenURL() = %q, want callback path preserved", rewritten)
 	}
 }
+
+func TestTunnelLimits(t *testing.T) {
+	tn := NewTunnel()
+	tn.limits = TunnelLimits{AttachTimeout: time.Second, IdleTimeout: 5 * time.Minute, MaxSessions: 1}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	open := func() (TunnelOpenResponse, error) {
+		var resp TunnelOpenResponse
+		err := tn.Open(TunnelOpenRequest{URL: "http://127.0.0.1:" + strconv.Itoa(port), Targets: []TunnelTarget{{ListenHost: "127.0.0.1", ListenPort: port, DialAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}}, MACKey: testTunnelMACKey}, &resp)
+		return resp, err
+	}
+	resp, err := open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { tn.closeSession(resp.SessionID) })
+	if resp.AttachTimeout != time.Second || resp.IdleTimeout != 5*time.Minute {
+		t.Fatalf("timeouts = %s/%s, want server defaults", resp.AttachTimeout, resp.IdleTimeout)
+	}
+	if _, err := open(); err == nil || !strings.Contains(err.Error(), "too many tunnel sessions") {
+		t.Fatalf("second Open err = %v", err)
+	}
+	tn.mu.Lock()
+	n := len(tn.sessions)
+	tn.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("sessions = %d, want 1", n)
+	}
+}
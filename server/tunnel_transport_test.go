@@ -5,33 +5,9 @@ import (
 	"strconv"
 	"testing"
 	"time"
-)
-
-func TestTunnelEndpointRoundTrip(t *testing.T) {
-	clientConn, serverConn := net.Pipe()
-	defer clientConn.Close()
-	defer serverConn.Close()
-
-	key := []byte("0123456789abcdef0123456789abcdef")
-	client := newTunnelEndpoint(clientConn, key)
-	server := newTunnelEndpoint(serverConn, key)
-
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- client.writeFrame(tunnelFrame{Type: tunnelFrameData, StreamID: 7, Payload: []byte("hello")})
-	}()
 
-	frame, err := server.readFrame()
-	if err != nil {
-		t.Fatalf("readFrame: %v", err)
-	}
-	if frame.Type != tunnelFrameData || frame.StreamID != 7 || string(frame.Payload) != "hello" {
-		t.Fatalf("unexpected frame: %#v", frame)
-	}
-	if err := <-errCh; err != nil {
-		t.Fatalf("writeFrame: %v", err)
-	}
-}
+	"github.com/rupor-github/gclpr/tunnel"
+)
 
 func TestTunnelAttachAndBrowserOpen(t *testing.T) {
 	origOpener := opener
@@ -62,8 +38,8 @@ func TestTunnelAttachAndBrowserOpen(t *testing.T) {
 	go tn.attach(serverConn)
 	attachConn := clientConn
 	defer attachConn.Close()
-	attachEP := newTunnelEndpoint(attachConn, key)
-	if err := attachEP.writeFrame(tunnelFrame{Type: tunnelFrameAttach, Payload: []byte(resp.SessionID)}); err != nil {
+	attachEP := tunnel.NewEndpoint(attachConn, key)
+	if err := attachEP.WriteFrame(tunnel.Frame{Type: tunnel.FrameAttach, Payload: []byte(resp.SessionID)}); err != nil {
 		t.Fatalf("attach write: %v", err)
 	}
 
@@ -73,11 +49,11 @@ func TestTunnelAttachAndBrowserOpen(t *testing.T) {
 	}
 	defer browserConn.Close()
 
-	frame, err := attachEP.readFrame()
+	frame, err := attachEP.ReadFrame()
 	if err != nil {
 		t.Fatalf("read open frame: %v", err)
 	}
-	if frame.Type != tunnelFrameOpen {
+	if frame.Type != tunnel.FrameOpen {
 		t.Fatalf("frame.Type = %d, want open", frame.Type)
 	}
 	if frame.StreamID == 0 {
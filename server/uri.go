@@ -2,19 +2,45 @@ package server
 
 import (
 	"fmt"
-	"log"
 	"net/url"
 	"strings"
 
 	"github.com/skratchdot/open-golang/open"
+
+	"github.com/rupor-github/gclpr/util"
 )
 
-// blockedSchemes lists URI schemes that should not be passed to the OS opener.
-var blockedSchemes = map[string]bool{
-	"file":       true,
-	"data":       true,
-	"javascript": true,
-	"vbscript":   true,
+// DefaultBlockedSchemes lists URI schemes that should not be passed to the OS opener.
+var DefaultBlockedSchemes = []string{"file", "data", "javascript", "vbscript"}
+
+// uriPolicy decides which URI schemes are passed to the OS opener. Nil policy blocks DefaultBlockedSchemes.
+type uriPolicy struct {
+	blocked map[string]bool
+	allowed map[string]bool // when not empty only these schemes are opened
+}
+
+var defaultURIPolicy = newURIPolicy(DefaultBlockedSchemes, nil)
+
+// newURIPolicy builds policy from lists of scheme names, host shorthand is checked as https.
+func newURIPolicy(blocked, allowed []string) *uriPolicy {
+	p := &uriPolicy{blocked: make(map[string]bool), allowed: make(map[string]bool)}
+	for _, s := range blocked {
+		p.blocked[strings.ToLower(s)] = true
+	}
+	for _, s := range allowed {
+		p.allowed[strings.ToLower(s)] = true
+	}
+	return p
+}
+
+func (p *uriPolicy) check(scheme string) error {
+	if p == nil {
+		p = defaultURIPolicy
+	}
+	if p.blocked[scheme] || (len(p.allowed) > 0 && !p.allowed[scheme]) {
+		return fmt.Errorf("URI scheme %q is not allowed", scheme)
+	}
+	return nil
 }
 
 // opener is the function used to open URIs. It defaults to open.Run and can be
@@ -23,28 +49,55 @@ var opener = open.Run
 
 // URI is used to rpc open command.
 type URI struct {
-	// placeholder
+	log     logSource
+	caller  func() callerInfo
+	policy  *uriPolicy
+	events  *events
+	approve *approver
 }
 
 // NewURI initializes URI structure.
 func NewURI() *URI {
-	return &URI{}
+	return &URI{log: fixedLog(util.NewLogger(util.SubsysRPC)), caller: noCaller}
+}
+
+// withConn returns URI which logs with log and reports caller to hooks.
+func (u *URI) withConn(log logSource, caller func() callerInfo) *URI {
+	uu := *u
+	uu.log, uu.caller = log, caller
+	return &uu
 }
 
 // Open is implementation of "lemonade" rpc "open" command.
 func (u *URI) Open(uri string, _ *struct{}) error {
-	log.Printf("URI Open received: '%s'", uri)
+	u.log().Infof("URI Open received: '%s'", uri)
 
-	parsed, err := ParseOpenURI(uri)
+	if _, err := u.policy.parse(uri); err != nil {
+		return err
+	}
+	// hooks see validated URI and may replace it, replacement has to pass the same policy
+	uri, err := u.events.beforeOpen(uri, u.caller())
+	if err != nil {
+		return err
+	}
+	parsed, err := u.policy.parse(uri)
 	if err != nil {
 		return err
 	}
+	if err := u.approve.check(util.ApproveOpen, u.caller(), describeURL(parsed)); err != nil {
+		return err
+	}
 
 	return opener(normalizeOpenURI(parsed, uri))
 }
 
 // ParseOpenURI validates that the URI can be safely passed to the OS opener.
 func ParseOpenURI(raw string) (*url.URL, error) {
+	return defaultURIPolicy.parse(raw)
+}
+
+// parse is ParseOpenURI which applies policy to URI scheme.
+func (p *uriPolicy) parse(raw string) (*url.URL, error) {
 	if isWindowsLocalPath(raw) {
 		return nil, fmt.Errorf("local paths are not allowed")
 	}
@@ -55,10 +108,10 @@ func ParseOpenURI(raw string) (*url.URL, error) {
 	}
 
 	scheme := strings.ToLower(parsed.Scheme)
-	if blockedSchemes[scheme] {
-		return nil, fmt.Errorf("URI scheme %q is not allowed", scheme)
-	}
 	if scheme != "" {
+		if err := p.check(scheme); err != nil {
+			return nil, err
+		}
 		return parsed, nil
 	}
 	if parsed.Host != "" || strings.HasPrefix(raw, "//") {
@@ -67,6 +120,10 @@ func ParseOpenURI(raw string) (*url.URL, error) {
 	if !isBrowserHostShorthand(raw) {
 		return nil, fmt.Errorf("local paths are not allowed")
 	}
+	// shorthand is opened as https
+	if err := p.check("https"); err != nil {
+		return nil, err
+	}
 
 	return parsed, nil
 }
@@ -83,3 +83,34 @@ func TestURIOpenBlocklist(t *testing.T) {
 		})
 	}
 }
+
+func TestURIPolicy(t *testing.T) {
+	allowed := newURIPolicy(nil, []string{"HTTPS", "mailto"})
+	for uri, wantErr := range map[string]string{
+		"https://example.com":     "",
+		"example.com":             "",
+		"mailto:me@example.com":   "",
+		"HTTPS://example.com/foo": "",
+		"http://example.com":      `"http" is not allowed`,
+		"javascript:alert(1)":     `"javascript" is not allowed`,
+		"/etc/passwd":             "local paths are not allowed",
+	} {
+		_, err := allowed.parse(uri)
+		if (err == nil) != (wantErr == "") || (err != nil && !strings.Contains(err.Error(), wantErr)) {
+			t.Errorf("parse(%q) err = %v, want %q", uri, err, wantErr)
+		}
+	}
+
+	// host shorthand is opened as https
+	if _, err := newURIPolicy(nil, []string{"http"}).parse("example.com"); err == nil {
+		t.Error("expected shorthand to be refused when https is not allowed")
+	}
+	// blocked list replaces defaults
+	blocked := newURIPolicy([]string{"ftp"}, nil)
+	if _, err := blocked.parse("data:text/plain,hi"); err != nil {
+		t.Errorf("data URI: %v", err)
+	}
+	if _, err := blocked.parse("ftp://example.com"); err == nil {
+		t.Error("expected ftp to be blocked")
+	}
+}
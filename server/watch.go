@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// watchInterval is how often watched clipboard is checked for changes made on server machine.
+var watchInterval = 500 * time.Millisecond
+
+// watchQueue is how many events wait for slow watcher before new ones are dropped.
+const watchQueue = 16
+
+// WatchRequest subscribes Channel of connection to clipboard changes. Content asks for text of changes
+// to be sent along.
+type WatchRequest struct {
+	Channel uint32
+	Content bool
+}
+
+// ClipboardEvent describes clipboard change, one JSON object per change is written to watch channel.
+// Key and Label are set for changes made through gclpr, Text only when watcher asked for content
+// and change is text. Concealed changes are expiring copies, they have neither Hash nor Text.
+type ClipboardEvent struct {
+	Time      time.Time
+	Type      string
+	Size      int
+	Hash      string `json:",omitempty"` // hex encoded SHA-256 of content
+	Key       string `json:",omitempty"`
+	Label     string `json:",omitempty"`
+	Text      string `json:",omitempty"`
+	Concealed bool   `json:",omitempty"`
+}
+
+// watcher tells subscribers about clipboard changes. Changes made through server are reported as they
+// happen, the rest are found by polling backend for as long as anybody watches.
+type watcher struct {
+	clip *Clipboard
+	info map[[32]byte]util.KeyInfo
+	// gate stops changes from being reported while session is locked or server is paused
+	gate *gate
+
+	mu   sync.Mutex
+	subs map[*watchSub]struct{}
+	last [32]byte // hash of the last reported content
+	gen  uint64   // counts changes made through server
+	stop chan struct{}
+}
+
+type watchSub struct {
+	content bool
+	events  chan ClipboardEvent
+}
+
+func newWatcher(clip *Clipboard) *watcher {
+	return &watcher{clip: clip, subs: make(map[*watchSub]struct{})}
+}
+
+// subscribe sends changes to ch until either side closes it.
+func (w *watcher) subscribe(ch net.Conn, content bool, log logSource) {
+	s := &watchSub{content: content, events: make(chan ClipboardEvent, watchQueue)}
+	w.mu.Lock()
+	if len(w.subs) == 0 {
+		// current content is not a change
+		_, data, _ := w.clip.current(w.clip.backend)
+		w.last, w.stop = sha256.Sum256(data), make(chan struct{})
+		go w.poll(w.stop)
+	}
+	w.subs[s] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		// client closes channel when it stops watching
+		io.Copy(io.Discard, ch)
+		w.unsubscribe(s)
+	}()
+	go func() {
+		defer ch.Close()
+		enc := json.NewEncoder(ch)
+		for ev := range s.events {
+			if err := enc.Encode(ev); err != nil {
+				log().Debugf("Clipboard watch ended: %v", err)
+				return
+			}
+		}
+	}()
+}
+
+func (w *watcher) unsubscribe(s *watchSub) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.subs[s]; !ok {
+		return
+	}
+	delete(w.subs, s)
+	close(s.events)
+	if len(w.subs) == 0 {
+		close(w.stop)
+	}
+}
+
+// close ends every subscription.
+func (w *watcher) close() {
+	w.mu.Lock()
+	subs := make([]*watchSub, 0, len(w.subs))
+	for s := range w.subs {
+		subs = append(subs, s)
+	}
+	w.mu.Unlock()
+	for _, s := range subs {
+		w.unsubscribe(s)
+	}
+}
+
+// changed reports clipboard content written by caller.
+func (w *watcher) changed(mime string, data []byte, caller callerInfo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.subs) == 0 {
+		return
+	}
+	w.last = sha256.Sum256(data)
+	w.gen++
+	w.publish(mime, data, caller, false)
+}
+
+// concealed reports expiring copy made by caller, watchers learn only its type and size. Data is copy
+// as backend reads it back.
+func (w *watcher) concealed(mime string, data []byte, caller callerInfo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.subs) == 0 {
+		return
+	}
+	w.last = sha256.Sum256(data)
+	w.gen++
+	w.publish(mime, data, caller, true)
+}
+
+func (w *watcher) poll(stop chan struct{}) {
+	t := time.NewTicker(watchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if w.gate.closed() != "" {
+			continue
+		}
+		w.mu.Lock()
+		gen := w.gen
+		w.mu.Unlock()
+		mime, data, err := w.clip.current(w.clip.backend)
+		if err != nil {
+			w.clip.log().Debugf("Unable to read watched clipboard: %v", err)
+			continue
+		}
+		// expiring copy is only reported concealed, whatever form backend gives it back in
+		if w.clip.expiring(data) {
+			continue
+		}
+		w.mu.Lock()
+		// content read before change made through server is already stale
+		if sum := sha256.Sum256(data); sum != w.last && gen == w.gen && len(w.subs) > 0 {
+			w.last = sum
+			w.publish(mime, data, callerInfo{}, false)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// publish queues event for every subscriber, must be called with w.mu held. Subscriber which does not
+// keep up misses events.
+func (w *watcher) publish(mime string, data []byte, caller callerInfo, concealed bool) {
+	if why := w.gate.closed(); why != "" {
+		w.clip.log().Debugf("Clipboard change is not reported, %s", why)
+		return
+	}
+	ev := ClipboardEvent{Time: time.Now(), Type: mime, Size: len(data), Concealed: concealed}
+	if !concealed {
+		sum := sha256.Sum256(data)
+		ev.Hash = hex.EncodeToString(sum[:])
+	}
+	if caller.known {
+		ev.Key = hex.EncodeToString(caller.key[:])
+		ev.Label = w.info[caller.key].Label
+	}
+	text := !concealed && strings.HasPrefix(mediaType(mime), "text/") && utf8.Valid(data)
+	for s := range w.subs {
+		sev := ev
+		if s.content && text {
+			sev.Text = string(data)
+		}
+		select {
+		case s.events <- sev:
+		default:
+			w.clip.log().Debugf("Clipboard watcher does not keep up, change is not reported")
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+func TestClipboardWatch(t *testing.T) {
+	clip := fakeClipboard(t, "before")
+	interval := watchInterval
+	watchInterval = 10 * time.Millisecond
+	t.Cleanup(func() { watchInterval = interval })
+
+	c := NewClipboard("", 0)
+	c.watch.gate = &gate{}
+	if err := c.Watch(WatchRequest{Channel: 1}, nil); err == nil {
+		t.Fatal("watch without channels")
+	}
+	client, srv := net.Pipe()
+	c.openChannel = func(id uint32) (net.Conn, error) {
+		if id != 7 {
+			t.Errorf("channel = %d", id)
+		}
+		return srv, nil
+	}
+	if err := c.Watch(WatchRequest{Channel: 7, Content: true}, nil); err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	dec := json.NewDecoder(client)
+	next := func() ClipboardEvent {
+		t.Helper()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var ev ClipboardEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("no event: %v", err)
+		}
+		return ev
+	}
+
+	key := [32]byte{0xcd}
+	kc := c.withConn(c.log, func() callerInfo { return callerInfo{key: key, known: true} })
+	if err := kc.Copy("copied", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); ev.Text != "copied" || ev.Size != 6 || ev.Type != MIMEText || ev.Key[:4] != "cd00" || len(ev.Hash) != 64 {
+		t.Fatalf("copy event = %+v", ev)
+	}
+	// changes made on server machine are found by polling
+	if err := clip.Write("local"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); ev.Text != "local" || ev.Key != "" {
+		t.Fatalf("local event = %+v", ev)
+	}
+	if err := copyTyped(c, "", "image/png", []byte("png")); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); ev.Text != "" || ev.Type != "image/png" || ev.Size != 3 {
+		t.Fatalf("image event = %+v", ev)
+	}
+	// expiring copy is reported without content, taking it back is a change
+	if err := copyExpiring(c, "", "secret", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); !ev.Concealed || ev.Text != "" || ev.Hash != "" || ev.Size != 6 {
+		t.Fatalf("expiring copy event = %+v", ev)
+	}
+	c.expire()
+	if ev := next(); ev.Concealed || ev.Type != "image/png" || ev.Size != 3 {
+		t.Fatalf("expired copy event = %+v", ev)
+	}
+	// nothing is reported while server is paused
+	c.watch.gate.paused.Store(true)
+	if err := clip.Write("local while paused"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * watchInterval)
+	if err := kc.Copy("copied while paused", nil); err != nil {
+		t.Fatal(err)
+	}
+	c.watch.gate.paused.Store(false)
+	if err := kc.Copy("resumed", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); ev.Text != "resumed" {
+		t.Fatalf("event after resume = %+v", ev)
+	}
+
+	client.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		c.watch.mu.Lock()
+		n := len(c.watch.subs)
+		c.watch.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed watch is still subscribed")
+		}
+	}
+}
+
+func TestClipboardWatchExpiringCopyLineEnds(t *testing.T) {
+	fakeClipboard(t, "before")
+	interval := watchInterval
+	watchInterval = 10 * time.Millisecond
+	t.Cleanup(func() { watchInterval = interval })
+
+	// backend holds copy with CRLF line ends, not the way client sent it
+	c := NewClipboard("crlf", 0)
+	c.watch.gate = &gate{}
+	client, srv := net.Pipe()
+	defer client.Close()
+	c.openChannel = func(uint32) (net.Conn, error) { return srv, nil }
+	if err := c.Watch(WatchRequest{Channel: 1, Content: true}, nil); err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	dec := json.NewDecoder(client)
+	next := func() ClipboardEvent {
+		t.Helper()
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var ev ClipboardEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("no event: %v", err)
+		}
+		return ev
+	}
+
+	if err := copyExpiring(c, "", "user\nsecret", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); !ev.Concealed || ev.Text != "" || ev.Size != len("user\r\nsecret") {
+		t.Fatalf("expiring copy event = %+v", ev)
+	}
+	// polling does not find expiring copy, the next event is the next copy
+	time.Sleep(10 * watchInterval)
+	if err := c.Copy("after", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); ev.Concealed || ev.Text != "after" {
+		t.Fatalf("event after expiring copy = %+v", ev)
+	}
+}
+
+func TestClipboardWatchNeedsApproval(t *testing.T) {
+	fakeClipboard(t, "")
+	key := [32]byte{1}
+	c := NewClipboard("", 0)
+	c.approve = newApprover(map[[32]byte]util.KeyInfo{key: {Approve: []string{util.ApprovePaste}}}, ApprovalOptions{Timeout: 50 * time.Millisecond})
+	kc := c.withConn(c.log, func() callerInfo { return callerInfo{key: key, known: true} })
+	kc.openChannel = func(uint32) (net.Conn, error) {
+		t.Error("channel is opened for watch which is not approved")
+		return nil, net.ErrClosed
+	}
+
+	// hashes of changes are enough to confirm guessed content
+	for _, content := range []bool{false, true} {
+		if err := kc.Watch(WatchRequest{Channel: 1, Content: content}, nil); err == nil || !strings.Contains(err.Error(), "not approved") {
+			t.Fatalf("Watch content=%t without approval: %v", content, err)
+		}
+	}
+}
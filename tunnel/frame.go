@@ -0,0 +1,186 @@
+// Package tunnel carries TCP streams between gclpr server, which accepts browser connections on
+// loopback listeners, and gclpr client, which dials local service those connections are meant for.
+//
+// Both peers exchange frames over a single connection (usually a channel of the signed rpc
+// connection). Every frame is sent as util.WriteFrame payload:
+//
+//	type(1) | stream id(4, big-endian) | payload | HMAC-SHA256(type | stream id | payload)
+//
+// HMAC is keyed with session MAC key, which client generates and passes to server when session
+// is reserved. Stream id 0 is used by session level frames. Frame types are:
+//
+//	FrameAttach - payload is session id, first frame of a peer connecting separately from rpc
+//	FrameOpen   - server announces new stream, payload is JSON encoded OpenPayload
+//	FrameData   - stream data, optionally compressed (see util.Compress)
+//	FrameEOF    - sender will not write to stream anymore
+//	FrameClose  - stream is gone, with stream id 0 sender is closing the whole tunnel
+//	FramePing   - keepalive, answered with FramePong
+//	FrameError  - reserved
+package tunnel
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+const (
+	// MACKeySize is the size of session MAC key.
+	MACKeySize = 32
+	// MACSize is the size of frame MAC.
+	MACSize = sha256.Size
+	// HeaderSize is the size of frame type and stream id.
+	HeaderSize = 1 + 4
+)
+
+// FrameType identifies tunnel frame.
+type FrameType byte
+
+// Tunnel frame types.
+const (
+	FrameAttach FrameType = iota + 1
+	FrameOpen
+	FrameData
+	FrameEOF
+	FrameClose
+	FramePing
+	FramePong
+	FrameError
+)
+
+// Frame is a single tunnel protocol message.
+type Frame struct {
+	Type     FrameType
+	StreamID uint32
+	Payload  []byte
+}
+
+// OpenPayload is payload of FrameOpen.
+type OpenPayload struct {
+	DialAddr string `json:"dial_addr"`
+}
+
+var (
+	// ErrShortFrame is returned for frames which could not hold header and MAC.
+	ErrShortFrame = errors.New("tunnel frame too short")
+	// ErrBadMAC is returned for frames which fail MAC verification.
+	ErrBadMAC = errors.New("tunnel frame MAC mismatch")
+)
+
+// NewMACKey generates random session MAC key.
+func NewMACKey() ([]byte, error) {
+	buf := make([]byte, MACKeySize)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// EncodeFrame returns frame body followed by its MAC.
+func EncodeFrame(frame Frame, macKey []byte) []byte {
+	body := make([]byte, HeaderSize+len(frame.Payload), HeaderSize+len(frame.Payload)+MACSize)
+	body[0] = byte(frame.Type)
+	binary.BigEndian.PutUint32(body[1:HeaderSize], frame.StreamID)
+	copy(body[HeaderSize:], frame.Payload)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(body)
+	return mac.Sum(body)
+}
+
+// DecodeFrame verifies MAC of encoded frame and decodes it.
+func DecodeFrame(raw []byte, macKey []byte) (Frame, error) {
+	if len(raw) < HeaderSize+MACSize {
+		return Frame{}, ErrShortFrame
+	}
+	body := raw[:len(raw)-MACSize]
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(body)
+	if !hmac.Equal(raw[len(raw)-MACSize:], mac.Sum(nil)) {
+		return Frame{}, ErrBadMAC
+	}
+	return Frame{
+		Type:     FrameType(body[0]),
+		StreamID: binary.BigEndian.Uint32(body[1:HeaderSize]),
+		Payload:  append([]byte(nil), body[HeaderSize:]...),
+	}, nil
+}
+
+// Endpoint reads and writes frames of a single tunnel connection. Writes are safe for concurrent use.
+type Endpoint struct {
+	conn      net.Conn
+	br        *bufio.Reader
+	macKey    []byte
+	codec     string // compression codec for data frames, empty or "none" when not negotiated
+	threshold int
+
+	mu        sync.Mutex // serializes writes
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewEndpoint creates endpoint on conn using session MAC key.
+func NewEndpoint(conn net.Conn, macKey []byte) *Endpoint {
+	return &Endpoint{conn: conn, br: bufio.NewReader(conn), macKey: append([]byte(nil), macKey...)}
+}
+
+// SetCompression makes endpoint compress data frames with codec. It has to be called before
+// endpoint is used and both peers must agree on codec.
+func (ep *Endpoint) SetCompression(codec string, threshold int) {
+	ep.codec, ep.threshold = codec, threshold
+}
+
+// compressed reports whether data frame payloads carry compression codec identifier.
+func (ep *Endpoint) compressed() bool {
+	return ep.codec != "" && ep.codec != util.CodecNone
+}
+
+// WriteFrame sends frame to peer.
+func (ep *Endpoint) WriteFrame(frame Frame) error {
+	if frame.Type == FrameData && ep.compressed() {
+		payload, err := util.Compress(ep.codec, ep.threshold, frame.Payload)
+		if err != nil {
+			return err
+		}
+		frame.Payload = payload
+	}
+	out := EncodeFrame(frame, ep.macKey)
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return util.WriteFrame(ep.conn, out)
+}
+
+// ReadFrame receives and verifies next frame. It must not be called concurrently.
+func (ep *Endpoint) ReadFrame() (Frame, error) {
+	raw, err := util.ReadFrame(ep.br)
+	if err != nil {
+		return Frame{}, err
+	}
+	frame, err := DecodeFrame(raw, ep.macKey)
+	if err != nil {
+		return Frame{}, err
+	}
+	if frame.Type == FrameData && ep.compressed() {
+		if frame.Payload, err = util.Decompress(frame.Payload); err != nil {
+			return Frame{}, fmt.Errorf("tunnel frame: %w", err)
+		}
+	}
+	return frame, nil
+}
+
+// Close closes underlying connection, pending reads and writes fail.
+func (ep *Endpoint) Close() error {
+	ep.closeOnce.Do(func() {
+		ep.closeErr = ep.conn.Close()
+	})
+	return ep.closeErr
+}
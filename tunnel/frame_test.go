@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEndpointRoundTrip(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	client := NewEndpoint(clientConn, testKey)
+	server := NewEndpoint(serverConn, testKey)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.WriteFrame(Frame{Type: FrameData, StreamID: 7, Payload: []byte("hello")})
+	}()
+
+	frame, err := server.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if frame.Type != FrameData || frame.StreamID != 7 || string(frame.Payload) != "hello" {
+		t.Fatalf("unexpected frame: %#v", frame)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+}
+
+func TestEndpointCompressedRoundTrip(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	client := NewEndpoint(clientConn, testKey)
+	client.SetCompression("zstd", 16)
+	server := NewEndpoint(serverConn, testKey)
+	server.SetCompression("zstd", 16)
+
+	payload := bytes.Repeat([]byte("compressible "), 1000)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- client.WriteFrame(Frame{Type: FrameData, StreamID: 3, Payload: payload})
+	}()
+
+	frame, err := server.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if frame.Type != FrameData || frame.StreamID != 3 || !bytes.Equal(frame.Payload, payload) {
+		t.Fatalf("unexpected frame type=%d stream=%d len=%d", frame.Type, frame.StreamID, len(frame.Payload))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	raw := EncodeFrame(Frame{Type: FrameAttach, Payload: []byte("session")}, testKey)
+	if len(raw) != HeaderSize+len("session")+MACSize {
+		t.Fatalf("encoded length = %d", len(raw))
+	}
+	frame, err := DecodeFrame(raw, testKey)
+	if err != nil || frame.Type != FrameAttach || string(frame.Payload) != "session" {
+		t.Fatalf("DecodeFrame = %#v, %v", frame, err)
+	}
+
+	if _, err := DecodeFrame(raw, []byte("another key")); !errors.Is(err, ErrBadMAC) {
+		t.Fatalf("DecodeFrame with wrong key err = %v", err)
+	}
+	raw[1] ^= 1
+	if _, err := DecodeFrame(raw, testKey); !errors.Is(err, ErrBadMAC) {
+		t.Fatalf("DecodeFrame of modified frame err = %v", err)
+	}
+	if _, err := DecodeFrame(raw[:HeaderSize], testKey); !errors.Is(err, ErrShortFrame) {
+		t.Fatalf("DecodeFrame of short frame err = %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+// Options configures Session and Client.
+type Options struct {
+	// LogAttrs are added to every message logged for tunnel, i.e. session or request id.
+	LogAttrs []any
+	// OnActivity is called whenever frame is received from peer or stream data is sent to it.
+	OnActivity func()
+	// ChunkSize limits payload of data frames sent to peer, default is 32KiB.
+	ChunkSize int
+}
+
+// Stats describes traffic carried by Session or Client.
+type Stats struct {
+	// Streams is the number of currently open streams.
+	Streams int
+	// Opened is the number of streams opened since start.
+	Opened int64
+	// BytesIn is the amount of stream data received from peer.
+	BytesIn int64
+	// BytesOut is the amount of stream data sent to peer.
+	BytesOut int64
+}
+
+// ErrClosed is returned by operations on closed Session or Client.
+var ErrClosed = errors.New("tunnel is closed")
+
+const (
+	acceptQueueSize = 16
+	closeTimeout    = time.Second
+)
+
+// peer is protocol state shared by both sides of tunnel.
+type peer struct {
+	ep   *Endpoint
+	opts Options
+	log  util.Logger
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	opened  int64
+	stopped bool // read loop is finished
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	accept    chan *Stream // streams announced by server, nil on server side
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error // valid after done is closed
+}
+
+func newPeer(ep *Endpoint, opts Options, accept bool) *peer {
+	p := &peer{
+		ep:      ep,
+		opts:    opts,
+		log:     util.NewLogger(util.SubsysTunnel).With(opts.LogAttrs...),
+		streams: make(map[uint32]*Stream),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if accept {
+		p.accept = make(chan *Stream, acceptQueueSize)
+	}
+	go p.run()
+	return p
+}
+
+func (p *peer) touch() {
+	if p.opts.OnActivity != nil {
+		p.opts.OnActivity()
+	}
+}
+
+func (p *peer) addStream(id uint32, dialAddr string) (*Stream, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil, ErrClosed
+	}
+	select {
+	case <-p.closing:
+		return nil, ErrClosed
+	default:
+	}
+	if _, ok := p.streams[id]; ok {
+		return nil, fmt.Errorf("tunnel stream %d is already open", id)
+	}
+	st := newStream(p, id, dialAddr)
+	p.streams[id] = st
+	p.opened++
+	return st, nil
+}
+
+func (p *peer) stream(id uint32) *Stream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.streams[id]
+}
+
+func (p *peer) dropStream(id uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.streams, id)
+}
+
+// run reads frames from peer until connection is gone.
+func (p *peer) run() {
+	var err error
+	for err == nil {
+		var frame Frame
+		if frame, err = p.ep.ReadFrame(); err == nil {
+			p.touch()
+			err = p.handle(frame)
+		}
+	}
+	local := false
+	select {
+	case <-p.closing:
+		local, err = true, nil
+	default:
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		p.log.Warnf("peer read failed: %v", err)
+	}
+
+	p.mu.Lock()
+	p.err = err
+	p.stopped = true
+	streams := p.streams
+	p.streams = make(map[uint32]*Stream)
+	p.mu.Unlock()
+	for _, st := range streams {
+		if local {
+			st.terminate()
+		} else {
+			// data peer managed to send before going away is still delivered
+			st.peerGone()
+		}
+	}
+	p.ep.Close()
+	close(p.done)
+}
+
+func (p *peer) handle(frame Frame) error {
+	switch frame.Type {
+	case FrameOpen:
+		if p.accept == nil {
+			return fmt.Errorf("unexpected open frame for stream %d", frame.StreamID)
+		}
+		return p.handleOpen(frame)
+	case FrameData:
+		st := p.stream(frame.StreamID)
+		if st == nil {
+			p.log.Debugf("dropping data for unknown stream %d", frame.StreamID)
+			return nil
+		}
+		p.bytesIn.Add(int64(len(frame.Payload)))
+		st.deliver(frame.Payload)
+	case FrameEOF:
+		if st := p.stream(frame.StreamID); st != nil {
+			p.log.Debugf("stream %d peer closed write side total_in=%d total_out=%d", st.id, st.BytesIn(), st.BytesOut())
+			st.remoteEOF()
+		}
+	case FrameClose:
+		if frame.StreamID == 0 {
+			p.log.Debugf("peer is closing tunnel")
+			return io.EOF
+		}
+		if st := p.stream(frame.StreamID); st != nil {
+			p.log.Debugf("stream %d peer requested close total_in=%d total_out=%d", st.id, st.BytesIn(), st.BytesOut())
+			st.terminate()
+			p.dropStream(st.id)
+		}
+	case FramePing:
+		p.log.Tracef("received ping")
+		return p.ep.WriteFrame(Frame{Type: FramePong})
+	case FrameAttach, FramePong, FrameError:
+		p.log.Debugf("received frame type %d stream %d", frame.Type, frame.StreamID)
+	default:
+		return fmt.Errorf("unknown tunnel frame type %d", frame.Type)
+	}
+	return nil
+}
+
+func (p *peer) handleOpen(frame Frame) error {
+	var payload OpenPayload
+	if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid tunnel open payload: %w", err)
+	}
+	st, err := p.addStream(frame.StreamID, payload.DialAddr)
+	if err != nil {
+		p.log.Warnf("unable to open stream %d: %v", frame.StreamID, err)
+		return p.ep.WriteFrame(Frame{Type: FrameClose, StreamID: frame.StreamID})
+	}
+	p.log.Debugf("opened stream %d dial=%s", st.id, st.dialAddr)
+	select {
+	case p.accept <- st:
+	case <-p.closing:
+	}
+	return nil
+}
+
+// close stops peer, pending and future operations fail with ErrClosed. Peer is told tunnel is closing,
+// so it can finish delivering data it already received.
+func (p *peer) close() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		p.mu.Lock()
+		stopped := p.stopped
+		p.mu.Unlock()
+		if stopped {
+			return
+		}
+		// peer which does not read anymore must not block close
+		sent := make(chan error, 1)
+		go func() { sent <- p.ep.WriteFrame(Frame{Type: FrameClose}) }()
+		select {
+		case err := <-sent:
+			if err != nil {
+				p.log.Debugf("unable to send close: %v", err)
+			}
+		case <-time.After(closeTimeout):
+			p.log.Debugf("timed out sending close")
+		}
+	})
+	return p.ep.Close()
+}
+
+func (p *peer) stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Stats{Streams: len(p.streams), Opened: p.opened, BytesIn: p.bytesIn.Load(), BytesOut: p.bytesOut.Load()}
+}
+
+func (p *peer) result() error {
+	<-p.done
+	return p.err
+}
+
+// summarize makes beginning of stream data printable for logs.
+func summarize(data []byte) string {
+	const limit = 120
+	text := strings.ReplaceAll(string(data), "\r", "\\r")
+	text = strings.ReplaceAll(text, "\n", "\\n")
+	if len(text) > limit {
+		return text[:limit] + "..."
+	}
+	return text
+}
@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Session is server side of tunnel. Server accepts connections locally and announces each of them
+// to client as a new stream.
+type Session struct {
+	p *peer
+}
+
+// NewSession starts serving tunnel peer on ep.
+func NewSession(ep *Endpoint, opts Options) *Session {
+	return &Session{p: newPeer(ep, opts, false)}
+}
+
+// OpenStream announces new stream, client is expected to connect it to dialAddr.
+func (s *Session) OpenStream(dialAddr string) (*Stream, error) {
+	s.p.mu.Lock()
+	s.p.nextID++
+	id := s.p.nextID
+	s.p.mu.Unlock()
+
+	st, err := s.p.addStream(id, dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(OpenPayload{DialAddr: dialAddr})
+	if err == nil {
+		err = s.p.ep.WriteFrame(Frame{Type: FrameOpen, StreamID: id, Payload: payload})
+	}
+	if err != nil {
+		st.terminate()
+		s.p.dropStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Close stops session and closes all its streams.
+func (s *Session) Close() error {
+	return s.p.close()
+}
+
+// Done is closed when session stops.
+func (s *Session) Done() <-chan struct{} {
+	return s.p.done
+}
+
+// Err waits for session to stop and returns the reason, it is nil when session was closed by either side.
+func (s *Session) Err() error {
+	return s.p.result()
+}
+
+// Stats returns session traffic counters.
+func (s *Session) Stats() Stats {
+	return s.p.stats()
+}
+
+// Client is client side of tunnel. It accepts streams announced by server and connects them
+// to local services.
+type Client struct {
+	p *peer
+}
+
+// NewClient starts serving tunnel peer on ep.
+func NewClient(ep *Endpoint, opts Options) *Client {
+	return &Client{p: newPeer(ep, opts, true)}
+}
+
+// AcceptStream waits for the next stream announced by server. Caller should connect it to its
+// DialAddr (see Join) or close it.
+func (c *Client) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-c.p.accept:
+		return st, nil
+	case <-c.p.closing:
+		return nil, ErrClosed
+	case <-c.p.done:
+		return nil, ErrClosed
+	}
+}
+
+// Ping sends keepalive to server.
+func (c *Client) Ping() error {
+	return c.p.ep.WriteFrame(Frame{Type: FramePing})
+}
+
+// KeepAlive pings server every interval until client stops.
+func (c *Client) KeepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.p.done:
+			return
+		case <-ticker.C:
+			if err := c.Ping(); err != nil {
+				c.p.log.Warnf("keepalive failed: %v", err)
+				return
+			}
+			c.p.log.Tracef("sent keepalive ping")
+		}
+	}
+}
+
+// Close stops client and closes all its streams.
+func (c *Client) Close() error {
+	return c.p.close()
+}
+
+// Done is closed when client stops.
+func (c *Client) Done() <-chan struct{} {
+	return c.p.done
+}
+
+// Err waits for client to stop and returns the reason, it is nil when client was closed by either side.
+func (c *Client) Err() error {
+	return c.p.result()
+}
+
+// Stats returns client traffic counters.
+func (c *Client) Stats() Stats {
+	return c.p.stats()
+}
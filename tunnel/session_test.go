@@ -0,0 +1,293 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startPair connects Session and Client with a pipe.
+func startPair(t *testing.T) (*Session, *Client) {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	s := NewSession(NewEndpoint(serverConn, testKey), Options{})
+	c := NewClient(NewEndpoint(clientConn, testKey), Options{})
+	t.Cleanup(func() {
+		s.Close()
+		c.Close()
+	})
+	return s, c
+}
+
+// listenEcho starts local service which echoes received data back until client half-closes.
+func listenEcho(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSessionClientStream(t *testing.T) {
+	s, c := startPair(t)
+	echo := listenEcho(t)
+
+	go func() {
+		for {
+			st, err := c.AcceptStream()
+			if err != nil {
+				return
+			}
+			conn, err := net.Dial("tcp", st.DialAddr())
+			if err != nil {
+				st.Close()
+				continue
+			}
+			go Join(st, conn)
+		}
+	}()
+
+	st, err := s.OpenStream(echo)
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if _, err := st.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := st.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	got, err := io.ReadAll(st)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+	st.Close()
+
+	stats := s.Stats()
+	if stats.Opened != 1 || stats.BytesIn != 5 || stats.BytesOut != 5 {
+		t.Fatalf("session stats = %+v", stats)
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Streams != 0 || s.Stats().Streams != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams left open: session %+v client %+v", s.Stats(), c.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientRemoteEOFCloseWrite(t *testing.T) {
+	s, c := startPair(t)
+
+	st, err := s.OpenStream("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	cst, err := c.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	if cst.ID() != st.ID() || cst.DialAddr() != "127.0.0.1:1" {
+		t.Fatalf("accepted stream %d %q", cst.ID(), cst.DialAddr())
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	local, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	go Join(cst, local)
+
+	st.CloseWrite()
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [1]byte
+	if _, err := remote.Read(buf[:]); err != io.EOF {
+		t.Fatalf("remote read err = %v, want EOF", err)
+	}
+
+	// local side is still writable after peer half-closed
+	if _, err := remote.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(st, got); err != nil || string(got) != "reply" {
+		t.Fatalf("read reply = %q, %v", got, err)
+	}
+}
+
+func TestClientCloseIsClean(t *testing.T) {
+	s, c := startPair(t)
+
+	c.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for client to stop")
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("client Err = %v, want nil", err)
+	}
+	if _, err := c.AcceptStream(); err != ErrClosed {
+		t.Fatalf("AcceptStream after close err = %v", err)
+	}
+
+	// server sees peer going away as a normal close
+	if err := s.Err(); err != nil {
+		t.Fatalf("session Err = %v, want nil", err)
+	}
+	if _, err := s.OpenStream("127.0.0.1:1"); err == nil {
+		t.Fatal("expected OpenStream on stopped session to fail")
+	}
+}
+
+func TestSessionClosesStreamsOnPeerClose(t *testing.T) {
+	s, c := startPair(t)
+
+	st, err := s.OpenStream("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	if _, err := c.AcceptStream(); err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	c.Close()
+	if _, err := io.ReadAll(st); err != nil {
+		t.Fatalf("ReadAll after peer close: %v", err)
+	}
+	if _, err := st.Write([]byte("x")); err == nil {
+		t.Fatal("expected write to closed stream to fail")
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	c := NewClient(NewEndpoint(clientConn, testKey), Options{})
+	defer c.Close()
+	defer serverConn.Close()
+	server := NewEndpoint(serverConn, testKey)
+
+	go c.KeepAlive(10 * time.Millisecond)
+	frame, err := server.ReadFrame()
+	if err != nil || frame.Type != FramePing {
+		t.Fatalf("ReadFrame = %#v, %v", frame, err)
+	}
+	if err := server.WriteFrame(Frame{Type: FramePing}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		frame, err := server.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type == FramePong {
+			break
+		}
+	}
+}
+
+func TestSessionCloseTellsClient(t *testing.T) {
+	s, c := startPair(t)
+
+	st, err := s.OpenStream("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	cst, err := c.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	if _, err := st.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for client to notice close")
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("client Err = %v, want nil", err)
+	}
+	// data sent before close is still delivered
+	if got, err := io.ReadAll(cst); err != nil || string(got) != "bye" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+}
+
+func TestSlowStreamDoesNotStallSession(t *testing.T) {
+	s, c := startPair(t)
+
+	slow, err := s.OpenStream("127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	cslow, err := c.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	fast, err := s.OpenStream("127.0.0.1:2")
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	cfast, err := c.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+
+	// nobody reads slow stream, peer overruns its window
+	written := make(chan error, 1)
+	go func() {
+		_, err := cslow.Write(make([]byte, streamWindow+maxChunk))
+		written <- err
+	}()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session stopped reading while slow stream is behind")
+	}
+
+	if _, err := cfast.Write([]byte("fast")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(fast, buf); err != nil || string(buf) != "fast" {
+		t.Fatalf("fast stream read = %q, %v", buf, err)
+	}
+
+	// slow stream is reset on both sides
+	if _, err := slow.Read(buf); err != io.EOF {
+		t.Fatalf("slow stream read = %v, want EOF", err)
+	}
+	select {
+	case <-cslow.done:
+	case <-time.After(time.Second):
+		t.Fatal("peer stream was not reset")
+	}
+}
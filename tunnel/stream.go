@@ -0,0 +1,248 @@
+package tunnel
+
+import (
+	"cmp"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rupor-github/gclpr/util"
+)
+
+const (
+	// maxChunk limits payload of data frames unless Options.ChunkSize is set.
+	maxChunk = 32 * 1024
+	// streamWindow is how much data received from peer stream keeps for its reader. Stream whose reader
+	// falls further behind is reset, so one slow connection never stalls other streams of the session.
+	streamWindow = 4 << 20
+)
+
+// Stream is a single connection carried by tunnel. It implements net.Conn, deadlines are not supported.
+type Stream struct {
+	id       uint32
+	dialAddr string
+	p        *peer
+
+	mu       sync.Mutex
+	queue    [][]byte // data received from peer reader has not consumed yet
+	queued   int
+	readable chan struct{}
+
+	done     chan struct{}
+	doneOnce sync.Once
+	readEOF  atomic.Bool // peer will not send more data
+	writeEOF atomic.Bool // CloseWrite was sent
+	gone     atomic.Bool // peer forgot about stream, there is no need to tell it about close
+
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	loggedIn  atomic.Bool
+	loggedOut atomic.Bool
+}
+
+func newStream(p *peer, id uint32, dialAddr string) *Stream {
+	return &Stream{id: id, dialAddr: dialAddr, p: p, readable: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// ID returns stream id.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// DialAddr returns address client side of stream should be connected to.
+func (st *Stream) DialAddr() string {
+	return st.dialAddr
+}
+
+// BytesIn returns amount of data received from peer.
+func (st *Stream) BytesIn() int64 {
+	return st.bytesIn.Load()
+}
+
+// BytesOut returns amount of data sent to peer.
+func (st *Stream) BytesOut() int64 {
+	return st.bytesOut.Load()
+}
+
+// deliver queues data received from peer, it never blocks. Stream is reset when its reader does not
+// keep up with peer.
+func (st *Stream) deliver(data []byte) {
+	if st.readEOF.Load() {
+		st.p.log.Debugf("stream %d dropping data after EOF", st.id)
+		return
+	}
+	if st.loggedIn.CompareAndSwap(false, true) && st.p.log.Enabled(util.LevelTrace) {
+		st.p.log.Tracef("stream %d in first bytes=%q", st.id, summarize(data))
+	}
+	total := st.bytesIn.Add(int64(len(data)))
+	st.p.log.Tracef("stream %d in bytes=%d total_in=%d", st.id, len(data), total)
+	st.mu.Lock()
+	if st.queued+len(data) > streamWindow {
+		st.queue, st.queued = nil, 0
+		st.mu.Unlock()
+		st.p.log.Warnf("stream %d reset: reader is behind by more than %d bytes", st.id, streamWindow)
+		st.Close()
+		return
+	}
+	st.queue = append(st.queue, data)
+	st.queued += len(data)
+	st.mu.Unlock()
+	st.wake()
+}
+
+// wake tells reader there is something new for it.
+func (st *Stream) wake() {
+	select {
+	case st.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) remoteEOF() {
+	st.mu.Lock()
+	st.readEOF.Store(true)
+	st.mu.Unlock()
+	st.wake()
+}
+
+// peerGone makes stream finish once data received so far is read.
+func (st *Stream) peerGone() {
+	st.gone.Store(true)
+	st.remoteEOF()
+}
+
+// terminate closes stream without notifying peer.
+func (st *Stream) terminate() {
+	st.gone.Store(true)
+	st.doneOnce.Do(func() { close(st.done) })
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-st.done:
+			return 0, io.EOF
+		default:
+		}
+		st.mu.Lock()
+		if len(st.queue) > 0 {
+			n := copy(b, st.queue[0])
+			if st.queue[0] = st.queue[0][n:]; len(st.queue[0]) == 0 {
+				st.queue[0] = nil
+				st.queue = st.queue[1:]
+			}
+			st.queued -= n
+			st.mu.Unlock()
+			return n, nil
+		}
+		// EOF is only reported once everything received before it is read
+		eof := st.readEOF.Load()
+		st.mu.Unlock()
+		if eof {
+			if st.gone.Load() {
+				st.doneOnce.Do(func() { close(st.done) })
+			}
+			return 0, io.EOF
+		}
+		select {
+		case <-st.readable:
+		case <-st.done:
+			return 0, io.EOF
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		select {
+		case <-st.done:
+			return written, net.ErrClosed
+		default:
+		}
+		if st.writeEOF.Load() {
+			return written, net.ErrClosed
+		}
+		chunk := b[:min(len(b), cmp.Or(st.p.opts.ChunkSize, maxChunk))]
+		if err := st.p.ep.WriteFrame(Frame{Type: FrameData, StreamID: st.id, Payload: chunk}); err != nil {
+			st.p.log.Debugf("stream %d out failed total_out=%d: %v", st.id, st.bytesOut.Load(), err)
+			return written, err
+		}
+		if st.loggedOut.CompareAndSwap(false, true) && st.p.log.Enabled(util.LevelTrace) {
+			st.p.log.Tracef("stream %d out first bytes=%q", st.id, summarize(chunk))
+		}
+		st.p.bytesOut.Add(int64(len(chunk)))
+		total := st.bytesOut.Add(int64(len(chunk)))
+		st.p.log.Tracef("stream %d out bytes=%d total_out=%d", st.id, len(chunk), total)
+		st.p.touch()
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite tells peer no more data will be written to stream.
+func (st *Stream) CloseWrite() error {
+	if !st.writeEOF.CompareAndSwap(false, true) || st.gone.Load() {
+		return nil
+	}
+	st.p.log.Debugf("stream %d closed write side total_out=%d total_in=%d", st.id, st.bytesOut.Load(), st.bytesIn.Load())
+	return st.p.ep.WriteFrame(Frame{Type: FrameEOF, StreamID: st.id})
+}
+
+// Close closes stream on both sides of tunnel.
+func (st *Stream) Close() error {
+	var err error
+	st.doneOnce.Do(func() {
+		close(st.done)
+		st.p.dropStream(st.id)
+		st.p.log.Debugf("dropping stream %d total_in=%d total_out=%d", st.id, st.bytesIn.Load(), st.bytesOut.Load())
+		if !st.gone.Load() && !(st.readEOF.Load() && st.writeEOF.Load()) {
+			err = st.p.ep.WriteFrame(Frame{Type: FrameClose, StreamID: st.id})
+		}
+	})
+	return err
+}
+
+func (st *Stream) LocalAddr() net.Addr                { return st.p.ep.conn.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr               { return st.p.ep.conn.RemoteAddr() }
+func (st *Stream) SetDeadline(_ time.Time) error      { return nil }
+func (st *Stream) SetReadDeadline(_ time.Time) error  { return nil }
+func (st *Stream) SetWriteDeadline(_ time.Time) error { return nil }
+
+// Join copies data between stream and conn until both directions are finished. Half-close is
+// passed along when conn supports it, closing either side closes both.
+func Join(st *Stream, conn net.Conn) {
+	go func() {
+		<-st.done
+		conn.Close()
+	}()
+
+	inDone := make(chan struct{})
+	go func() {
+		defer close(inDone)
+		if _, err := io.Copy(conn, st); err != nil {
+			st.Close()
+			return
+		}
+		closeWrite(conn)
+	}()
+
+	if _, err := io.Copy(st, conn); err != nil {
+		st.Close()
+	} else {
+		st.CloseWrite()
+	}
+	<-inDone
+	st.Close()
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
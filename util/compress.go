@@ -0,0 +1,144 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codecs which could be negotiated by peers. Every compressed payload
+// starts with a single byte identifying codec used for the rest of it.
+const (
+	CodecNone = "none"
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// DefaultCodecs lists supported codecs in order of preference.
+const DefaultCodecs = CodecZstd + "," + CodecGzip
+
+// DefaultCompressThreshold is the size of the smallest payload worth compressing.
+const DefaultCompressThreshold = 1024
+
+const (
+	codecIDNone byte = iota
+	codecIDGzip
+	codecIDZstd
+)
+
+var codecIDs = map[string]byte{
+	CodecNone: codecIDNone,
+	CodecGzip: codecIDGzip,
+	CodecZstd: codecIDZstd,
+}
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(MaxFrameSize))
+		return dec
+	})
+)
+
+// ParseCodecs parses comma separated list of codec names. "none" or empty string disable compression.
+func ParseCodecs(list string) ([]string, error) {
+	res := []string{}
+	for name := range strings.SplitSeq(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "", CodecNone:
+			continue
+		case CodecGzip, CodecZstd:
+			res = append(res, name)
+		default:
+			return nil, fmt.Errorf("unknown compression codec %q", name)
+		}
+	}
+	return res, nil
+}
+
+// NegotiateCodec returns first codec offered by peer which is also allowed locally or CodecNone.
+func NegotiateCodec(offered, allowed []string) string {
+	for _, o := range offered {
+		for _, a := range allowed {
+			if o == a && o != CodecNone {
+				return o
+			}
+		}
+	}
+	return CodecNone
+}
+
+// Compress prefixes data with codec identifier, compressing it with codec when data is at
+// least threshold bytes long and compression actually makes it smaller.
+func Compress(codec string, threshold int, data []byte) ([]byte, error) {
+	id, ok := codecIDs[codec]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+	if id != codecIDNone && len(data) >= threshold {
+		var packed []byte
+		switch id {
+		case codecIDGzip:
+			var buf bytes.Buffer
+			buf.WriteByte(id)
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(data); err != nil {
+				return nil, fmt.Errorf("compress: %w", err)
+			}
+			if err := zw.Close(); err != nil {
+				return nil, fmt.Errorf("compress: %w", err)
+			}
+			packed = buf.Bytes()
+		case codecIDZstd:
+			packed = zstdEncoder().EncodeAll(data, []byte{id})
+		}
+		if len(packed) < len(data)+1 {
+			return packed, nil
+		}
+	}
+	out := make([]byte, 1+len(data))
+	out[0] = codecIDNone
+	copy(out[1:], data)
+	return out, nil
+}
+
+// Decompress reverses Compress. Decompressed payload is limited to MaxFrameSize.
+func Decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("decompress: missing codec identifier")
+	}
+	switch data[0] {
+	case codecIDNone:
+		return data[1:], nil
+	case codecIDGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %w", err)
+		}
+		out, err := io.ReadAll(io.LimitReader(zr, MaxFrameSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %w", err)
+		}
+		if len(out) > MaxFrameSize {
+			return nil, fmt.Errorf("decompress: payload exceeds maximum %d", MaxFrameSize)
+		}
+		return out, nil
+	case codecIDZstd:
+		out, err := zstdDecoder().DecodeAll(data[1:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("decompress: unknown codec identifier %d", data[0])
+	}
+}
@@ -0,0 +1,89 @@
+package util
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	large := bytes.Repeat([]byte("gclpr compress "), 4096)
+	for _, codec := range []string{CodecNone, CodecGzip, CodecZstd} {
+		for _, data := range [][]byte{{}, []byte("short"), large} {
+			packed, err := Compress(codec, 64, data)
+			if err != nil {
+				t.Fatalf("Compress(%s): %v", codec, err)
+			}
+			if codec != CodecNone && len(data) == len(large) && len(packed) >= len(data) {
+				t.Errorf("Compress(%s) did not shrink payload: %d >= %d", codec, len(packed), len(data))
+			}
+			got, err := Decompress(packed)
+			if err != nil {
+				t.Fatalf("Decompress(%s): %v", codec, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("round trip mismatch for %s: got %d bytes, want %d", codec, len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestCompressBelowThreshold(t *testing.T) {
+	data := bytes.Repeat([]byte{'a'}, 100)
+	packed, err := Compress(CodecZstd, 1024, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packed[0] != codecIDNone || !bytes.Equal(packed[1:], data) {
+		t.Fatalf("payload below threshold must be stored as is")
+	}
+}
+
+func TestCompressErrors(t *testing.T) {
+	if _, err := Compress("lz4", 0, []byte("x")); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+	if _, err := Decompress(nil); err == nil {
+		t.Error("expected error for empty payload")
+	}
+	if _, err := Decompress([]byte{42, 1, 2}); err == nil {
+		t.Error("expected error for unknown codec identifier")
+	}
+	if _, err := Decompress([]byte{codecIDGzip, 1, 2}); err == nil {
+		t.Error("expected error for corrupted gzip payload")
+	}
+}
+
+func TestParseCodecs(t *testing.T) {
+	got, err := ParseCodecs(" ZSTD, gzip ,none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{CodecZstd, CodecGzip}) {
+		t.Fatalf("ParseCodecs = %v", got)
+	}
+	if got, err = ParseCodecs("none"); err != nil || len(got) != 0 {
+		t.Fatalf("ParseCodecs(none) = %v, %v", got, err)
+	}
+	if _, err = ParseCodecs("zstd,brotli"); err == nil {
+		t.Fatal("expected error for unknown codec")
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	cases := []struct {
+		offered, allowed []string
+		want             string
+	}{
+		{[]string{CodecZstd, CodecGzip}, []string{CodecGzip, CodecZstd}, CodecZstd},
+		{[]string{CodecGzip}, []string{CodecZstd, CodecGzip}, CodecGzip},
+		{[]string{CodecZstd}, []string{CodecGzip}, CodecNone},
+		{nil, []string{CodecGzip}, CodecNone},
+		{[]string{CodecNone}, []string{CodecNone}, CodecNone},
+	}
+	for _, tc := range cases {
+		if got := NegotiateCodec(tc.offered, tc.allowed); got != tc.want {
+			t.Errorf("NegotiateCodec(%v, %v) = %s, want %s", tc.offered, tc.allowed, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+//go:build linux || darwin
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrAlreadyRunning is returned by LockPidFile when another process holds the lock.
+var ErrAlreadyRunning = errors.New("already running")
+
+// RuntimeDir returns per-user directory for pid files and logs of detached processes, it is
+// $XDG_RUNTIME_DIR/gclpr or private directory in temporary location when variable is not set.
+func RuntimeDir() (string, error) {
+
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("gclpr-%d", os.Getuid()))
+	if base := os.Getenv("XDG_RUNTIME_DIR"); base != "" {
+		dir = filepath.Join(base, "gclpr")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s exists and is not a directory", dir)
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return "", fmt.Errorf("%s is not owned by current user", dir)
+	}
+	if perm := fi.Mode().Perm(); perm&077 != 0 {
+		return "", fmt.Errorf("bad permissions %o for directory %s", perm, dir)
+	}
+	return dir, nil
+}
+
+// PidFile is locked file holding pid of running process, lock is released when process exits.
+type PidFile struct {
+	path string
+	f    *os.File
+}
+
+// LockPidFile locks file and writes current pid into it. When file is locked by another process
+// error wraps ErrAlreadyRunning and names pid of that process.
+func LockPidFile(path string) (*PidFile, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			b := make([]byte, 32)
+			n, _ := f.Read(b)
+			if pid, perr := strconv.Atoi(string(bytes.TrimSpace(b[:n]))); perr == nil {
+				return nil, fmt.Errorf("%w with pid %d", ErrAlreadyRunning, pid)
+			}
+			return nil, ErrAlreadyRunning
+		}
+		return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PidFile{path: path, f: f}, nil
+}
+
+// Release removes pid file and drops the lock.
+func (p *PidFile) Release() error {
+	// remove while still locked, so the next owner never loses its file
+	err := os.Remove(p.path)
+	if cerr := p.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SdNotify sends state to service manager as described by sd_notify(3). It does nothing when
+// process is not started by systemd with notification socket.
+func SdNotify(state string) error {
+
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// abstract namespace socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,84 @@
+//go:build linux || darwin
+
+package util
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLockPidFile(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "server.pid")
+
+	pf, err := LockPidFile(fname)
+	if err != nil {
+		t.Fatalf("LockPidFile: %v", err)
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("pid file = %q, %v", data, err)
+	}
+
+	// flock locks belong to open file, so second open is refused even in the same process
+	_, err = LockPidFile(fname)
+	if !errors.Is(err, ErrAlreadyRunning) || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Fatalf("second LockPidFile err = %v", err)
+	}
+
+	if err := pf.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Fatalf("pid file is not removed: %v", err)
+	}
+	pf, err = LockPidFile(fname)
+	if err != nil {
+		t.Fatalf("LockPidFile after release: %v", err)
+	}
+	pf.Release()
+}
+
+func TestRuntimeDir(t *testing.T) {
+	base := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", base)
+
+	dir, err := RuntimeDir()
+	if err != nil || dir != filepath.Join(base, "gclpr") {
+		t.Fatalf("RuntimeDir = %q, %v", dir, err)
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RuntimeDir(); err == nil {
+		t.Fatal("expected error for directory readable by others")
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := SdNotify("READY=1"); err != nil {
+		t.Fatalf("SdNotify without socket: %v", err)
+	}
+
+	addr := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", addr)
+
+	if err := SdNotify("READY=1\nMAINPID=42"); err != nil {
+		t.Fatalf("SdNotify: %v", err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1\nMAINPID=42" {
+		t.Fatalf("notification = %q, %v", buf[:n], err)
+	}
+}
@@ -5,6 +5,7 @@ package util
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"syscall"
 )
 
@@ -27,3 +28,32 @@ func checkPermissions(fname string, readOK bool) error {
 	}
 	return nil
 }
+
+// CheckConfigFile verifies that nobody but the current user could change the file, either by writing to it
+// or by replacing it in its directory. Configuration which runs commands must pass it.
+func CheckConfigFile(fname string) error {
+
+	fi, err := os.Stat(fname)
+	if err != nil || !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file %s", fname)
+	}
+	if err := checkWritable(fname, fi); err != nil {
+		return err
+	}
+	dir := filepath.Dir(fname)
+	if fi, err = os.Stat(dir); err != nil {
+		return err
+	}
+	return checkWritable(dir, fi)
+}
+
+// checkWritable refuses file which is not owned by the current user or root, or could be written by group or others.
+func checkWritable(fname string, fi os.FileInfo) error {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() && stat.Uid != 0 {
+		return fmt.Errorf("%s is not owned by current user", fname)
+	}
+	if perm := fi.Mode().Perm(); perm&022 != 0 {
+		return fmt.Errorf("bad permissions %o for %s, it must not be writable by group or others", perm, fname)
+	}
+	return nil
+}
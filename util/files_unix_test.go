@@ -81,3 +81,47 @@ func TestCheckPermissionsDirectory(t *testing.T) {
 		t.Error("expected error for directory")
 	}
 }
+
+func TestCheckConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "server.toml")
+	if err := os.WriteFile(fname, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckConfigFile(fname); err != nil {
+		t.Fatalf("expected no error for 0644 file in 0700 directory, got: %v", err)
+	}
+
+	for _, perm := range []os.FileMode{0664, 0646} {
+		if err := os.Chmod(fname, perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckConfigFile(fname); err == nil {
+			t.Errorf("expected error for %o file", perm)
+		}
+	}
+	if err := os.Chmod(fname, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// file could be replaced through directory others write to
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckConfigFile(fname); err == nil {
+		t.Error("expected error for file in 0777 directory")
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if os.Getuid() == 0 {
+		// only root could give file away
+		if err := os.Chown(fname, 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckConfigFile(fname); err == nil {
+			t.Error("expected error for file owned by other user")
+		}
+	}
+}
@@ -166,3 +166,9 @@ func checkPermissions(fname string, readOK bool) error {
 
 	return nil
 }
+
+// CheckConfigFile verifies that nobody but administrators, system and the current user could write to the file.
+// Configuration which runs commands must pass it.
+func CheckConfigFile(fname string) error {
+	return checkPermissions(fname, true)
+}
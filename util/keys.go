@@ -7,13 +7,17 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"golang.org/x/crypto/nacl/sign"
 )
 
+// keysLog reports problems with key files.
+var keysLog = NewLogger("")
+
 // ZeroBytes overwrites a byte slice with zeros.
 func ZeroBytes(b []byte) {
 	clear(b)
@@ -92,47 +96,92 @@ func CreateKeys(home string) (*[32]byte, *[64]byte, error) {
 	return pk, k, nil
 }
 
+// KeyInfo holds optional attributes of trusted key.
+type KeyInfo struct {
+	// Label is human readable key name.
+	Label string
+	// Permissions lists extra rights granted to key, see PermAdmin.
+	Permissions []string
+	// Approve lists operations of key which have to be confirmed on server, see ApprovePaste.
+	Approve []string
+}
+
+// Permissions trusted key could be granted.
+const (
+	// PermAdmin allows key to manage running server.
+	PermAdmin = "admin"
+	// PermRelay allows key to forward requests on behalf of other keys, see HelloRequest.Origin.
+	PermRelay = "relay"
+)
+
+// Operations which could require approval.
+const (
+	ApprovePaste  = "paste"
+	ApproveOpen   = "open"
+	ApproveTunnel = "tunnel"
+)
+
+// Has reports whether key was granted permission.
+func (ki KeyInfo) Has(perm string) bool {
+	return slices.Contains(ki.Permissions, perm)
+}
+
+// NeedsApproval reports whether operation of key has to be confirmed on server.
+func (ki KeyInfo) NeedsApproval(op string) bool {
+	return slices.Contains(ki.Approve, op)
+}
+
 // ReadTrustedKeys reads list of trusted public keys from file (server).
 func ReadTrustedKeys(home string) (map[[32]byte][32]byte, error) {
+	keys, _, err := ReadTrustedKeysInfo(home)
+	return keys, err
+}
+
+// ReadTrustedKeysInfo reads list of trusted public keys along with their attributes from file (server).
+// Key may be followed by space separated attributes: label=<name>, perms=<permission>[,<permission>] and
+// approve=<operation>[,<operation>] or approve=all.
+func ReadTrustedKeysInfo(home string) (map[[32]byte][32]byte, map[[32]byte]KeyInfo, error) {
 
 	kd := filepath.Join(home, ".gclpr")
 	fi, err := os.Stat(kd)
 	if err == nil && !fi.IsDir() {
-		return nil, fmt.Errorf("%s exists and is not a directory", kd)
+		return nil, nil, fmt.Errorf("%s exists and is not a directory", kd)
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	fn := filepath.Join(kd, "trusted")
 	err = checkPermissions(fn, true)
 	if err != nil {
-		return nil, fmt.Errorf("trusted keys file permissions are too open: %w", err)
+		return nil, nil, fmt.Errorf("trusted keys file permissions are too open: %w", err)
 	}
 	content, err := os.ReadFile(fn)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read public key: %w", err)
+		return nil, nil, fmt.Errorf("unable to read public key: %w", err)
 	}
 
 	res := make(map[[32]byte][32]byte)
-	for b := range bytes.SplitSeq(bytes.ReplaceAll(content, []byte{'\r'}, []byte{'\n'}), []byte{'\n'}) {
-		b = bytes.TrimSpace(b)
-		if len(b) == 0 || b[0] == '#' {
+	info := make(map[[32]byte]KeyInfo)
+	for line := range bytes.SplitSeq(bytes.ReplaceAll(content, []byte{'\r'}, []byte{'\n'}), []byte{'\n'}) {
+		fields := bytes.Fields(line)
+		if len(fields) == 0 || fields[0][0] == '#' {
 			continue
 		}
+		b := fields[0]
 		l := hex.DecodedLen(len(b))
 		if l != 32 {
-			log.Printf("Wrong size for key %s... in trusted keys file. Ignoring\n", string(b[:min(8, l)]))
+			keysLog.Warnf("Wrong size for key %s... in trusted keys file. Ignoring", string(b[:min(8, l)]))
 			continue
 		}
 		dst := make([]byte, l)
 		n, err := hex.Decode(dst, b)
 		if err != nil {
-			log.Printf("Bad key %s... in trusted keys file: %s. Ignoring\n", string(b[:min(8, l)]), err.Error())
+			keysLog.Warnf("Bad key %s... in trusted keys file: %s. Ignoring", string(b[:min(8, l)]), err.Error())
 			continue
 		}
 		if n != 32 {
-			log.Printf("Wrong size for key %s... in trusted keys file. Ignoring\n", string(b[:min(8, l)]))
+			keysLog.Warnf("Wrong size for key %s... in trusted keys file. Ignoring", string(b[:min(8, l)]))
 			continue
 		}
 
@@ -140,11 +189,56 @@ func ReadTrustedKeys(home string) (map[[32]byte][32]byte, error) {
 		copy(k[:], dst)
 		hk := sha256.Sum256(dst) // and its hash
 		if _, ok := res[hk]; ok {
-			log.Printf("Duplicate key %s... in trusted keys file. Ignoring\n", string(b[:8]))
+			keysLog.Warnf("Duplicate key %s... in trusted keys file. Ignoring", string(b[:8]))
 		}
 		res[hk] = k
+		info[hk] = parseKeyInfo(fields[1:])
+	}
+	return res, info, nil
+}
+
+// parseKeyInfo interprets attributes following trusted key, unknown attributes are ignored.
+func parseKeyInfo(fields [][]byte) KeyInfo {
+	var ki KeyInfo
+	for _, f := range fields {
+		if f[0] == '#' {
+			break
+		}
+		name, value, _ := strings.Cut(string(f), "=")
+		switch name {
+		case "label":
+			ki.Label = value
+		case "perms":
+			for p := range strings.SplitSeq(value, ",") {
+				switch p {
+				case "":
+				case PermAdmin, PermRelay:
+					if !ki.Has(p) {
+						ki.Permissions = append(ki.Permissions, p)
+					}
+				default:
+					keysLog.Warnf("Unknown permission %q in trusted keys file. Ignoring", p)
+				}
+			}
+		case "approve":
+			for op := range strings.SplitSeq(value, ",") {
+				switch op {
+				case "":
+				case "all":
+					ki.Approve = []string{ApprovePaste, ApproveOpen, ApproveTunnel}
+				case ApprovePaste, ApproveOpen, ApproveTunnel:
+					if !ki.NeedsApproval(op) {
+						ki.Approve = append(ki.Approve, op)
+					}
+				default:
+					keysLog.Warnf("Unknown operation to approve %q in trusted keys file. Ignoring", op)
+				}
+			}
+		default:
+			keysLog.Warnf("Unknown key attribute %q in trusted keys file. Ignoring", name)
+		}
 	}
-	return res, nil
+	return ki
 }
 
 // ----------------------------------------------------------------------------
@@ -158,7 +252,7 @@ func ReadTrustedKeys(home string) (map[[32]byte][32]byte, error) {
 func bignum2bytes(num string, size int) []byte {
 	data, err := hex.DecodeString(num)
 	if err != nil {
-		log.Printf("Unable to decode [%s]: %s", num, err.Error())
+		keysLog.Warnf("Unable to decode [%s]: %s", num, err.Error())
 		return nil
 	}
 	buf := make([]byte, size)
@@ -183,7 +277,7 @@ func compute(parts []part) []byte {
 	for i := range parts {
 		// buuld Rivest's S-exp
 		if _, err := fmt.Fprintf(h, "(%d:%s%d:%s)", len(parts[i].name), parts[i].name, len(parts[i].value), parts[i].value); err != nil {
-			log.Printf("IO error in keygrip compute: %s", err.Error())
+			keysLog.Errorf("IO error in keygrip compute: %s", err.Error())
 			return nil
 		}
 	}
@@ -238,3 +238,39 @@ func TestZeroBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestReadTrustedKeysInfo(t *testing.T) {
+	home := t.TempDir()
+	kd := filepath.Join(home, ".gclpr")
+	if err := os.MkdirAll(kd, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	key1 := make([]byte, 32)
+	key2 := make([]byte, 32)
+	for i := range key1 {
+		key1[i] = byte(i)
+		key2[i] = byte(i + 100)
+	}
+
+	content := hex.EncodeToString(key1) + " label=laptop perms=admin,bogus approve=open,paste,open # trailing comment\n" +
+		hex.EncodeToString(key2) + " approve=all perms=relay\n"
+	if err := os.WriteFile(filepath.Join(kd, "trusted"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, info, err := ReadTrustedKeysInfo(home)
+	if err != nil {
+		t.Fatalf("ReadTrustedKeysInfo: %v", err)
+	}
+	if len(keys) != 2 || len(info) != 2 {
+		t.Fatalf("expected 2 trusted keys, got %d keys %d infos", len(keys), len(info))
+	}
+	ki := info[sha256.Sum256(key1)]
+	if ki.Label != "laptop" || !ki.Has(PermAdmin) || len(ki.Permissions) != 1 || len(ki.Approve) != 2 || ki.NeedsApproval(ApproveTunnel) {
+		t.Errorf("unexpected key info %+v", ki)
+	}
+	if ki := info[sha256.Sum256(key2)]; ki.Label != "" || ki.Has(PermAdmin) || !ki.Has(PermRelay) || !ki.NeedsApproval(ApproveTunnel) || !ki.NeedsApproval(ApprovePaste) {
+		t.Errorf("unexpected key info for relay key %+v", ki)
+	}
+}
@@ -0,0 +1,256 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LevelTrace is below slog.LevelDebug and is used for messages logged for every piece of data, such as tunnel chunks.
+const LevelTrace = slog.LevelDebug - 4
+
+// Subsystems log levels could be set for separately.
+const (
+	SubsysRPC       = "rpc"
+	SubsysClipboard = "clipboard"
+	SubsysTunnel    = "tunnel"
+	SubsysOAuth     = "oauth"
+	SubsysHooks     = "hooks"
+)
+
+var subsystems = []string{SubsysRPC, SubsysClipboard, SubsysTunnel, SubsysOAuth, SubsysHooks}
+
+// DefaultLogLevel is used when log levels are not configured.
+const DefaultLogLevel = slog.LevelWarn
+
+// levels holds minimal level for messages of every subsystem, messages without subsystem use def.
+type levels struct {
+	mu  sync.RWMutex
+	def slog.Level
+	sub map[string]slog.Level
+}
+
+var logLevels = &levels{def: DefaultLogLevel}
+
+func (lv *levels) enabled(subsys string, level slog.Level) bool {
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+	if least, ok := lv.sub[subsys]; ok {
+		return level >= least
+	}
+	return level >= lv.def
+}
+
+func (lv *levels) set(def slog.Level, sub map[string]slog.Level) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	lv.def, lv.sub = def, sub
+}
+
+// ParseLevel returns level by its name: error, warn, info, debug or trace.
+func ParseLevel(s string) (slog.Level, error) {
+	if strings.EqualFold(s, "trace") {
+		return LevelTrace, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// ParseLogLevels parses comma separated list of default level and subsystem=level pairs, i.e. "info,tunnel=trace".
+// When default level is not listed def is used.
+func ParseLogLevels(s string, def slog.Level) (slog.Level, map[string]slog.Level, error) {
+	sub := make(map[string]slog.Level)
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, found := strings.Cut(item, "=")
+		if !found {
+			level, err := ParseLevel(item)
+			if err != nil {
+				return 0, nil, err
+			}
+			def = level
+			continue
+		}
+		name = strings.TrimSpace(name)
+		if !slices.Contains(subsystems, name) {
+			return 0, nil, fmt.Errorf("unknown log subsystem %q, expected one of %s", name, strings.Join(subsystems, ", "))
+		}
+		level, err := ParseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return 0, nil, err
+		}
+		sub[name] = level
+	}
+	return def, sub, nil
+}
+
+// LogOptions configures logging.
+type LogOptions struct {
+	// Levels is comma separated list of default level and subsystem=level pairs, see ParseLogLevels.
+	Levels string
+	// DefaultLevel is used when Levels does not name default level.
+	DefaultLevel slog.Level
+	// JSON selects JSON records instead of key=value text.
+	JSON bool
+	// File when set receives log instead of Output, it is rotated after MaxSize bytes keeping Backups old files,
+	// see NewRotatingFile for defaults.
+	File    string
+	MaxSize int64
+	Backups int
+	// Output receives log when File is not set, log is discarded when it is nil.
+	Output io.Writer
+}
+
+// SetupLogging directs both slog and log package output according to opts. Returned closer releases log file.
+func SetupLogging(opts LogOptions) (io.Closer, error) {
+
+	def, sub, err := ParseLogLevels(opts.Levels, opts.DefaultLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	out, closer := opts.Output, io.Closer(io.NopCloser(nil))
+	if opts.File != "" {
+		rf, err := NewRotatingFile(opts.File, opts.MaxSize, opts.Backups)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = rf, rf
+	}
+	if out == nil {
+		out = io.Discard
+	}
+
+	ho := &slog.HandlerOptions{
+		// level is decided by filterHandler
+		Level: slog.Level(-1 << 10),
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey {
+				if level, ok := a.Value.Any().(slog.Level); ok && level <= LevelTrace {
+					a.Value = slog.StringValue("TRACE")
+				}
+			}
+			return a
+		},
+	}
+	var h slog.Handler
+	if opts.JSON {
+		h = slog.NewJSONHandler(out, ho)
+	} else {
+		h = slog.NewTextHandler(out, ho)
+	}
+	logLevels.set(def, sub)
+	// log package output goes to the same handler at info level
+	slog.SetDefault(slog.New(&filterHandler{next: h}))
+	return closer, nil
+}
+
+// NewLogWriter redirects all log output depending on debug parameter. When true messages of debug level and above
+// are prefixed with title and go to platform debug output, when false everything is discarded.
+func NewLogWriter(title string, debug bool) {
+	opts := LogOptions{DefaultLevel: slog.Level(1 << 10)}
+	if debug {
+		opts = LogOptions{DefaultLevel: slog.LevelDebug, Output: &prefixWriter{prefix: []byte("[" + title + "] "), out: debugOutput()}}
+	}
+	// without levels string and file there is nothing to fail
+	_, _ = SetupLogging(opts)
+}
+
+// prefixWriter prefixes every write, slog handlers write each record at once.
+type prefixWriter struct {
+	prefix []byte
+	out    io.Writer
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(append(slices.Clip(w.prefix), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// filterHandler drops records below level of their subsystem, subsystem is known when logger was
+// created with subsystem attribute.
+type filterHandler struct {
+	next   slog.Handler
+	subsys string
+}
+
+func (h *filterHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return logLevels.enabled(h.subsys, level)
+}
+
+func (h *filterHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.next.Handle(ctx, r)
+}
+
+func (h *filterHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	subsys := h.subsys
+	for _, a := range attrs {
+		if a.Key == subsysKey {
+			subsys = a.Value.String()
+		}
+	}
+	return &filterHandler{next: h.next.WithAttrs(attrs), subsys: subsys}
+}
+
+func (h *filterHandler) WithGroup(name string) slog.Handler {
+	return &filterHandler{next: h.next.WithGroup(name), subsys: h.subsys}
+}
+
+const subsysKey = "subsys"
+
+// Logger is printf style front end of slog, it logs messages of one subsystem. Zero value logs messages
+// without subsystem.
+type Logger struct {
+	subsys string
+	attrs  []any
+}
+
+// NewLogger returns logger for subsystem, empty subsystem is allowed.
+func NewLogger(subsys string) Logger {
+	return Logger{subsys: subsys}
+}
+
+// With returns logger which adds attributes to every message.
+func (l Logger) With(args ...any) Logger {
+	return Logger{subsys: l.subsys, attrs: append(slices.Clip(l.attrs), args...)}
+}
+
+// Enabled reports whether messages of level are logged, so expensive arguments could be skipped.
+func (l Logger) Enabled(level slog.Level) bool {
+	return logLevels.enabled(l.subsys, level)
+}
+
+func (l Logger) Errorf(format string, args ...any) { l.logf(slog.LevelError, format, args...) }
+func (l Logger) Warnf(format string, args ...any)  { l.logf(slog.LevelWarn, format, args...) }
+func (l Logger) Infof(format string, args ...any)  { l.logf(slog.LevelInfo, format, args...) }
+func (l Logger) Debugf(format string, args ...any) { l.logf(slog.LevelDebug, format, args...) }
+func (l Logger) Tracef(format string, args ...any) { l.logf(LevelTrace, format, args...) }
+
+func (l Logger) logf(level slog.Level, format string, args ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:]) // skip Callers, logf and level method
+	r := slog.NewRecord(time.Now(), level, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"), pcs[0])
+	if l.subsys != "" {
+		r.AddAttrs(slog.String(subsysKey, l.subsys))
+	}
+	r.Add(l.attrs...)
+	// level is already checked, default handler would check it again without knowing subsystem
+	_ = slog.Default().Handler().Handle(context.Background(), r)
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	def, sub, err := ParseLogLevels("info, tunnel=trace,oauth=DEBUG", slog.LevelWarn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def != slog.LevelInfo || len(sub) != 2 || sub[SubsysTunnel] != LevelTrace || sub[SubsysOAuth] != slog.LevelDebug {
+		t.Fatalf("ParseLogLevels = %v, %v", def, sub)
+	}
+	if def, _, err := ParseLogLevels("", slog.LevelError); err != nil || def != slog.LevelError {
+		t.Fatalf("empty levels = %v, %v", def, err)
+	}
+	for _, bad := range []string{"loud", "tunnel=loud", "network=info"} {
+		if _, _, err := ParseLogLevels(bad, slog.LevelWarn); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+// setupTestLogging directs log to buffer and restores defaults when test ends.
+func setupTestLogging(t *testing.T, opts LogOptions) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	opts.Output = &buf
+	if _, err := SetupLogging(opts); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetupLogging(LogOptions{DefaultLevel: DefaultLogLevel}) })
+	return &buf
+}
+
+func TestLoggerSubsystemLevels(t *testing.T) {
+	buf := setupTestLogging(t, LogOptions{Levels: "warn,tunnel=trace"})
+
+	NewLogger(SubsysRPC).Infof("rpc info")
+	NewLogger(SubsysRPC).Warnf("rpc warn")
+	tl := NewLogger(SubsysTunnel).With("session", "s1")
+	tl.Tracef("chunk %d", 7)
+	log.Print("bridged")
+
+	out := buf.String()
+	if strings.Contains(out, "rpc info") || strings.Contains(out, "bridged") {
+		t.Fatalf("messages below level are logged: %q", out)
+	}
+	if !strings.Contains(out, `level=WARN msg="rpc warn" subsys=rpc`) {
+		t.Fatalf("rpc warning is missing: %q", out)
+	}
+	if !strings.Contains(out, `level=TRACE msg="chunk 7" subsys=tunnel session=s1`) {
+		t.Fatalf("tunnel trace is missing: %q", out)
+	}
+	if !tl.Enabled(LevelTrace) || NewLogger("").Enabled(slog.LevelInfo) {
+		t.Fatal("Enabled does not follow subsystem levels")
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := setupTestLogging(t, LogOptions{DefaultLevel: slog.LevelInfo, JSON: true})
+
+	NewLogger(SubsysClipboard).With("req", "0123abcd").Infof("Copy request received\n")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("log is not JSON: %q: %v", buf.String(), err)
+	}
+	if rec["level"] != "INFO" || rec["msg"] != "Copy request received" || rec["subsys"] != "clipboard" || rec["req"] != "0123abcd" {
+		t.Fatalf("unexpected record %v", rec)
+	}
+}
@@ -4,18 +4,15 @@ package util
 
 import (
 	"io"
-	"log"
+	"os"
 )
 
-// NewLogWriter redirects all log output depending on debug parameter.
-// When true all output goes to stderr.
-// When false - everything is discarded.
-func NewLogWriter(title string, flags int, debug bool) {
-
-	log.SetPrefix("[" + title + "] ")
-	log.SetFlags(flags)
+// openLogFile opens file for appending.
+func openLogFile(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
 
-	if !debug {
-		log.SetOutput(io.Discard)
-	}
+// debugOutput is where NewLogWriter sends log when debugging.
+func debugOutput() io.Writer {
+	return os.Stderr
 }
@@ -4,7 +4,7 @@ package util
 
 import (
 	"io"
-	"log"
+	"os"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -12,25 +12,31 @@ import (
 
 var kernel = windows.NewLazySystemDLL("kernel32")
 
+// openLogFile opens file for appending, unlike os.OpenFile it lets file be renamed while it is open, so
+// rotation keeps writing to old file until new one is opened.
+func openLogFile(name string) (*os.File, error) {
+	p, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(p, windows.FILE_APPEND_DATA|windows.SYNCHRONIZE|windows.FILE_READ_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil, windows.OPEN_ALWAYS,
+		windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(h), name), nil
+}
+
 // DebugWriter redirects all output to OutputDebugString().
 type logWriter struct {
 	proc *windows.LazyProc
 }
 
-// NewLogWriter redirects all log output depending on debug parameter.
-// When true all output goes to OutputDebugString and you could use debugger or Sysinternals dbgview.exe to collect it.
-// When false - everything is discarded.
-func NewLogWriter(title string, flags int, debug bool) {
-
-	log.SetPrefix("[" + title + "] ")
-	log.SetFlags(flags)
-
-	if debug {
-		res := &logWriter{proc: kernel.NewProc("OutputDebugStringW")}
-		log.SetOutput(res)
-	} else {
-		log.SetOutput(io.Discard)
-	}
+// debugOutput is where NewLogWriter sends log when debugging, you could use debugger or Sysinternals dbgview.exe
+// to collect it.
+func debugOutput() io.Writer {
+	return &logWriter{proc: kernel.NewProc("OutputDebugStringW")}
 }
 
 func (l *logWriter) Write(p []byte) (n int, err error) {
@@ -0,0 +1,340 @@
+package util
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Mux message types. Every multiplexed frame starts with 4 bytes big-endian channel id
+// followed by message type and payload.
+const (
+	muxData byte = iota
+	muxClose
+	// muxWindow returns 4 bytes big-endian count of bytes reader consumed to sender of channel.
+	muxWindow
+	// muxKeepalive is sent on channel 0 while channels are open, so peer does not drop quiet connection.
+	muxKeepalive
+)
+
+// MuxKeepaliveInterval is how often Keepalive reminds peer about connection with open channels.
+const MuxKeepaliveInterval = 10 * time.Second
+
+const (
+	muxHeaderSize = 5
+	// muxMaxPayload leaves room in frame for signature and compression overhead.
+	muxMaxPayload = MaxFrameSize / 2
+	// muxWindowSize is how many bytes peer may send on channel before reader consumes them. Channel of
+	// peer which sends more is reset, so slow reader never blocks connection.
+	muxWindowSize = 1 << 20
+)
+
+var errMuxOverflow = errors.New("mux: channel is reset, peer sent more than window allows")
+
+// Mux carries independent byte streams over a single frame oriented connection. Channel 0
+// belongs to connection owner (rpc), other channels have to be opened by both peers with the
+// same id, which is agreed upon by higher level protocol.
+type Mux struct {
+	write  func([]byte) error
+	local  net.Addr
+	remote net.Addr
+
+	mu       sync.Mutex
+	channels map[uint32]*MuxChannel
+	nextID   uint32
+	closed   bool
+	done     chan struct{}
+}
+
+// NewMux creates multiplexer which sends frames to peer with write.
+func NewMux(write func([]byte) error, local, remote net.Addr) *Mux {
+	return &Mux{write: write, local: local, remote: remote, channels: make(map[uint32]*MuxChannel), done: make(chan struct{})}
+}
+
+// Keepalive sends keepalive message every interval while channels are open, it returns when mux is closed.
+// Channels may stay quiet for a long time and peer, which only sees frames, has no other way to tell
+// live connection from the one abandoned by client.
+func (m *Mux) Keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		if m.Channels() == 0 {
+			continue
+		}
+		if err := m.write(encodeMux(0, muxKeepalive, nil)); err != nil {
+			return
+		}
+	}
+}
+
+func encodeMux(id uint32, kind byte, data []byte) []byte {
+	out := make([]byte, muxHeaderSize+len(data))
+	binary.BigEndian.PutUint32(out[:4], id)
+	out[4] = kind
+	copy(out[muxHeaderSize:], data)
+	return out
+}
+
+// Wrap prepares channel 0 data for sending.
+func (m *Mux) Wrap(data []byte) []byte {
+	return encodeMux(0, muxData, data)
+}
+
+// Dispatch handles frame received from peer. Channel 0 data is returned to caller with ok
+// set, data for other channels is queued for channel reader, it never blocks.
+func (m *Mux) Dispatch(frame []byte) (data []byte, ok bool, err error) {
+	if len(frame) < muxHeaderSize {
+		return nil, false, fmt.Errorf("mux: frame too short: %d", len(frame))
+	}
+	id, kind, payload := binary.BigEndian.Uint32(frame[:4]), frame[4], frame[muxHeaderSize:]
+	if id == 0 {
+		if kind == muxKeepalive {
+			return nil, false, nil
+		}
+		if kind != muxData {
+			return nil, false, fmt.Errorf("mux: unexpected message %d on channel 0", kind)
+		}
+		return payload, true, nil
+	}
+
+	m.mu.Lock()
+	ch := m.channels[id]
+	if ch != nil && kind == muxClose {
+		delete(m.channels, id)
+	}
+	m.mu.Unlock()
+	if ch == nil {
+		// peer may still be sending to the channel we already closed
+		return nil, false, nil
+	}
+
+	switch kind {
+	case muxData:
+		if !ch.received(payload) {
+			ch.reset(errMuxOverflow)
+		}
+	case muxClose:
+		ch.mu.Lock()
+		ch.eof = true
+		ch.mu.Unlock()
+		signal(ch.readable)
+	case muxWindow:
+		if len(payload) != 4 {
+			return nil, false, fmt.Errorf("mux: bad window update of %d bytes on channel %d", len(payload), id)
+		}
+		ch.sendMu.Lock()
+		ch.credit += int(binary.BigEndian.Uint32(payload))
+		ch.sendMu.Unlock()
+		signal(ch.credited)
+	default:
+		return nil, false, fmt.Errorf("mux: unknown message %d on channel %d", kind, id)
+	}
+	return nil, false, nil
+}
+
+// signal wakes up whoever waits on ch, ch has to have room for one value.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// NextID returns channel id not used on this side of connection yet.
+func (m *Mux) NextID() uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextID++
+	return m.nextID
+}
+
+// Open registers channel with given id.
+func (m *Mux) Open(id uint32) (*MuxChannel, error) {
+	if id == 0 {
+		return nil, fmt.Errorf("mux: channel 0 is reserved")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, net.ErrClosed
+	}
+	if _, ok := m.channels[id]; ok {
+		return nil, fmt.Errorf("mux: channel %d is already open", id)
+	}
+	ch := &MuxChannel{id: id, mux: m, done: make(chan struct{}), readable: make(chan struct{}, 1), credit: muxWindowSize, credited: make(chan struct{}, 1)}
+	m.channels[id] = ch
+	return ch, nil
+}
+
+// Channels returns number of open channels.
+func (m *Mux) Channels() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.channels)
+}
+
+// Close is called when underlying connection is gone, it terminates all channels.
+func (m *Mux) Close() {
+	m.mu.Lock()
+	channels := m.channels
+	m.channels = make(map[uint32]*MuxChannel)
+	if !m.closed {
+		close(m.done)
+	}
+	m.closed = true
+	m.mu.Unlock()
+	for _, ch := range channels {
+		ch.closeOnce.Do(func() { close(ch.done) })
+	}
+}
+
+// MuxChannel is a single byte stream carried by Mux. It implements net.Conn, deadlines are not supported.
+// Sender stops once it used up window of peer and continues when peer reader reports consumed bytes.
+type MuxChannel struct {
+	id        uint32
+	mux       *Mux
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	queue    [][]byte // received data reader has not consumed yet
+	queued   int
+	consumed int  // bytes read since peer was told last time
+	eof      bool // peer closed channel
+	err      error
+	readable chan struct{}
+
+	sendMu   sync.Mutex
+	credit   int // bytes which could be sent before peer consumes more
+	credited chan struct{}
+}
+
+// ID returns channel id.
+func (c *MuxChannel) ID() uint32 {
+	return c.id
+}
+
+// received queues data from peer, it reports false when peer does not respect window.
+func (c *MuxChannel) received(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queued+len(data) > muxWindowSize {
+		return false
+	}
+	c.queue = append(c.queue, data)
+	c.queued += len(data)
+	signal(c.readable)
+	return true
+}
+
+// reset closes channel on both sides, data it has not delivered yet is dropped and reader gets err.
+func (c *MuxChannel) reset(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.queue, c.queued = nil, 0
+	c.mu.Unlock()
+	c.Close()
+}
+
+func (c *MuxChannel) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			n := copy(p, c.queue[0])
+			if c.queue[0] = c.queue[0][n:]; len(c.queue[0]) == 0 {
+				c.queue[0] = nil
+				c.queue = c.queue[1:]
+			}
+			c.queued -= n
+			c.consumed += n
+			grant := 0
+			if c.consumed >= muxWindowSize/4 {
+				grant, c.consumed = c.consumed, 0
+			}
+			c.mu.Unlock()
+			if grant > 0 {
+				// failure means connection is gone and reader learns about it next time
+				c.mux.write(encodeMux(c.id, muxWindow, binary.BigEndian.AppendUint32(nil, uint32(grant))))
+			}
+			return n, nil
+		}
+		eof, err := c.eof, c.err
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if eof {
+			return 0, io.EOF
+		}
+		select {
+		case <-c.readable:
+		case <-c.done:
+			c.mu.Lock()
+			err := c.err
+			c.mu.Unlock()
+			return 0, cmp.Or(err, io.EOF)
+		}
+	}
+}
+
+func (c *MuxChannel) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		select {
+		case <-c.done:
+			return written, net.ErrClosed
+		default:
+		}
+		c.sendMu.Lock()
+		n := min(len(p), muxMaxPayload, c.credit)
+		c.credit -= n
+		c.sendMu.Unlock()
+		if n == 0 {
+			select {
+			case <-c.credited:
+			case <-c.done:
+				return written, net.ErrClosed
+			}
+			continue
+		}
+		if err := c.mux.write(encodeMux(c.id, muxData, p[:n])); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes channel on both sides of connection.
+func (c *MuxChannel) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mux.mu.Lock()
+		_, open := c.mux.channels[c.id]
+		delete(c.mux.channels, c.id)
+		closed := c.mux.closed
+		c.mux.mu.Unlock()
+		if open && !closed {
+			err = c.mux.write(encodeMux(c.id, muxClose, nil))
+		}
+	})
+	return err
+}
+
+func (c *MuxChannel) LocalAddr() net.Addr                { return c.mux.local }
+func (c *MuxChannel) RemoteAddr() net.Addr               { return c.mux.remote }
+func (c *MuxChannel) SetDeadline(_ time.Time) error      { return nil }
+func (c *MuxChannel) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *MuxChannel) SetWriteDeadline(_ time.Time) error { return nil }
@@ -0,0 +1,248 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// pairMux connects two multiplexers, frames written by one are dispatched by the other.
+func pairMux(t *testing.T) (*Mux, *Mux, <-chan []byte, <-chan []byte) {
+	t.Helper()
+
+	toA, toB := make(chan []byte, 16), make(chan []byte, 16)
+	a := NewMux(func(frame []byte) error { toB <- frame; return nil }, nil, nil)
+	b := NewMux(func(frame []byte) error { toA <- frame; return nil }, nil, nil)
+
+	// channel 0 data is handed back to the test
+	pump := func(m *Mux, in <-chan []byte) <-chan []byte {
+		out := make(chan []byte, 16)
+		go func() {
+			for frame := range in {
+				data, ok, err := m.Dispatch(frame)
+				if err != nil {
+					t.Errorf("Dispatch: %v", err)
+					return
+				}
+				if ok {
+					out <- data
+				}
+			}
+		}()
+		return out
+	}
+	rpcA, rpcB := pump(a, toA), pump(b, toB)
+	t.Cleanup(func() {
+		close(toA)
+		close(toB)
+	})
+	return a, b, rpcA, rpcB
+}
+
+func TestMuxChannels(t *testing.T) {
+	a, b, _, rpcB := pairMux(t)
+
+	if err := a.write(a.Wrap([]byte("rpc"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-rpcB; string(got) != "rpc" {
+		t.Fatalf("channel 0 data = %q", got)
+	}
+
+	id := a.NextID()
+	chA, err := a.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chB, err := b.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Open(id); err == nil {
+		t.Fatal("expected error opening channel twice")
+	}
+	if _, err := a.Open(0); err == nil {
+		t.Fatal("expected error opening channel 0")
+	}
+
+	if _, err := chA.Write([]byte("hello ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chA.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(chB, buf); err != nil || string(buf) != "hello world" {
+		t.Fatalf("read = %q, %v", buf, err)
+	}
+
+	if _, err := chB.Write([]byte("back")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(chA)
+	if err != nil || !bytes.Equal(got, []byte("back")) {
+		t.Fatalf("read until close = %q, %v", got, err)
+	}
+	if _, err := chB.Write([]byte("x")); err == nil {
+		t.Fatal("expected write to closed channel to fail")
+	}
+	if a.Channels() != 0 || b.Channels() != 0 {
+		t.Fatalf("open channels a=%d b=%d, want none", a.Channels(), b.Channels())
+	}
+}
+
+func TestMuxCloseUnblocksReaders(t *testing.T) {
+	a, _, _, _ := pairMux(t)
+	ch, err := a.Open(a.NextID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := ch.Read(make([]byte, 1))
+		done <- err
+	}()
+	a.Close()
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Fatalf("Read err = %v, want EOF", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read was not unblocked by Close")
+	}
+	if _, err := a.Open(a.NextID()); err == nil {
+		t.Fatal("expected error opening channel on closed mux")
+	}
+}
+
+func TestMuxDispatchErrors(t *testing.T) {
+	m := NewMux(func([]byte) error { return nil }, nil, nil)
+	if _, _, err := m.Dispatch([]byte{0, 0}); err == nil {
+		t.Error("expected error for short frame")
+	}
+	if _, _, err := m.Dispatch(encodeMux(0, muxClose, nil)); err == nil {
+		t.Error("expected error closing channel 0")
+	}
+	if _, ok, err := m.Dispatch(encodeMux(5, muxData, []byte("late"))); ok || err != nil {
+		t.Errorf("data for unknown channel: ok=%t err=%v, want dropped", ok, err)
+	}
+}
+
+func TestMuxKeepalive(t *testing.T) {
+	frames := make(chan []byte, 16)
+	m := NewMux(func(frame []byte) error {
+		select {
+		case frames <- frame:
+		default:
+		}
+		return nil
+	}, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		m.Keepalive(5 * time.Millisecond)
+		close(done)
+	}()
+
+	// nothing is sent while there are no channels
+	select {
+	case frame := <-frames:
+		t.Fatalf("keepalive without channels: %x", frame)
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	if _, err := m.Open(m.NextID()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case frame := <-frames:
+		if data, ok, err := m.Dispatch(frame); data != nil || ok || err != nil {
+			t.Errorf("Dispatch(keepalive) = %q, %t, %v, want silently consumed", data, ok, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no keepalive with open channel")
+	}
+
+	m.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Keepalive did not return after Close")
+	}
+	m.Close()
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	a, b, _, rpcB := pairMux(t)
+	id := a.NextID()
+	chA, err := a.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chB, err := b.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("x"), 2*muxWindowSize)
+	written := make(chan error, 1)
+	go func() {
+		_, err := chA.Write(data)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("Write of twice the window returned before anything was read: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// channel 0 is not stalled by the channel nobody reads
+	if err := a.write(a.Wrap([]byte("rpc"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-rpcB:
+		if string(got) != "rpc" {
+			t.Fatalf("channel 0 data = %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel 0 is blocked by full channel")
+	}
+
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(chB, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("read %d bytes, %v", len(buf), err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxResetsOverflowingChannel(t *testing.T) {
+	var sent [][]byte
+	m := NewMux(func(frame []byte) error { sent = append(sent, frame); return nil }, nil, nil)
+	ch, err := m.Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// peer which ignores window must not block Dispatch
+	chunk := make([]byte, muxWindowSize/2)
+	for range 3 {
+		if _, _, err := m.Dispatch(encodeMux(1, muxData, chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != 1 || !bytes.Equal(sent[0], encodeMux(1, muxClose, nil)) {
+		t.Fatalf("sent %d frames, want channel close", len(sent))
+	}
+	if _, err := ch.Read(make([]byte, 1)); err != errMuxOverflow {
+		t.Fatalf("Read err = %v, want overflow", err)
+	}
+	if _, _, err := m.Dispatch(encodeMux(1, muxData, []byte("late"))); err != nil {
+		t.Fatalf("data for reset channel: %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// MaxRequestIDLength limits request ids accepted from peers.
+const MaxRequestIDLength = 64
+
+// NewRequestID returns random id used to correlate log lines of a single client operation.
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// ValidRequestID checks that request id received from peer is safe to put into logs.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
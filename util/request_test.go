@@ -0,0 +1,24 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	id := NewRequestID()
+	if !ValidRequestID(id) || len(id) != 16 {
+		t.Fatalf("NewRequestID = %q", id)
+	}
+	if NewRequestID() == id {
+		t.Fatal("request ids must be unique")
+	}
+	for _, bad := range []string{"", "a b", "id\nforged log line", "%s", strings.Repeat("a", MaxRequestIDLength+1)} {
+		if ValidRequestID(bad) {
+			t.Errorf("ValidRequestID(%q) = true", bad)
+		}
+	}
+	if !ValidRequestID("req-1_2.3") {
+		t.Error("ValidRequestID rejects allowed characters")
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Defaults for log file rotation.
+const (
+	DefaultLogMaxSize = 10 << 20
+	DefaultLogBackups = 3
+)
+
+// RotatingFile is append only file which is renamed to name.1 once it grows over size limit, previous
+// backups are shifted to name.2 and so on, the oldest one is removed.
+type RotatingFile struct {
+	name    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotatingFile opens file for appending, DefaultLogMaxSize is used for size not set and DefaultLogBackups
+// for negative number of backups, with zero backups file starts over once it is full.
+func NewRotatingFile(name string, maxSize int64, backups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultLogMaxSize
+	}
+	if backups < 0 {
+		backups = DefaultLogBackups
+	}
+	rf := &RotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// openRotated opens log file, it can be overridden in tests.
+var openRotated = openLogFile
+
+func (rf *RotatingFile) open() error {
+	f, err := openRotated(rf.name)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// rotate shifts backups and starts new file, current file is kept open until new one is.
+func (rf *RotatingFile) rotate() error {
+	if rf.backups == 0 {
+		// by name, file handle is append only on Windows
+		if err := os.Truncate(rf.name, 0); err != nil {
+			return err
+		}
+		rf.size = 0
+		return nil
+	}
+	for i := rf.backups - 1; i > 0; i-- {
+		// missing backups are fine
+		os.Rename(fmt.Sprintf("%s.%d", rf.name, i), fmt.Sprintf("%s.%d", rf.name, i+1))
+	}
+	if err := os.Rename(rf.name, rf.name+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	var rerr error
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if rerr = rf.rotate(); rerr != nil {
+			// nothing is lost, rotation is tried again once file grows by another maxSize
+			rf.size = 0
+			rerr = fmt.Errorf("unable to rotate %s: %w", rf.name, rerr)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, cmp.Or(err, rerr)
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.log")
+
+	rf, err := NewRotatingFile(name, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := rf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Write([]byte("late\n")); err == nil {
+		t.Fatal("expected write after close to fail")
+	}
+
+	for fname, want := range map[string]string{name: "five\n", name + ".1": "four\n", name + ".2": "three\n"} {
+		data, err := os.ReadFile(fname)
+		if err != nil || string(data) != want {
+			t.Fatalf("%s = %q, %v, want %q", filepath.Base(fname), data, err, want)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("too many backups kept: %v", err)
+	}
+
+	// size of existing file counts
+	rf, err = NewRotatingFile(name, 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Write([]byte("sixth\n"))
+	if data, _ := os.ReadFile(name); !strings.HasPrefix(string(data), "sixth") {
+		t.Fatalf("file is not rotated on reopen: %q", data)
+	}
+}
+
+func TestRotatingFileBackups(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "audit.log")
+
+	rf, err := NewRotatingFile(name, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"one\n", "two\n"} {
+		if _, err := rf.Write([]byte(s)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	rf.Close()
+	if data, err := os.ReadFile(name); err != nil || string(data) != "two\n" {
+		t.Fatalf("file without backups = %q, %v", data, err)
+	}
+	if _, err := os.Stat(name + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("backup kept with zero backups: %v", err)
+	}
+
+	if rf, err = NewRotatingFile(name, 5, -1); err != nil {
+		t.Fatal(err)
+	}
+	if rf.backups != DefaultLogBackups {
+		t.Fatalf("backups = %d, want default", rf.backups)
+	}
+	rf.Close()
+}
+
+func TestRotatingFileKeepsWritingWhenReopenFails(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.log")
+	rf, err := NewRotatingFile(name, 5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.Write([]byte("one\n"))
+
+	defer func(open func(string) (*os.File, error)) { openRotated = open }(openRotated)
+	openRotated = func(string) (*os.File, error) { return nil, os.ErrPermission }
+	if _, err := rf.Write([]byte("two\n")); err == nil || !strings.Contains(err.Error(), "unable to rotate") {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := rf.Write([]byte("3")); err != nil {
+		t.Fatalf("Write after failed rotation: %v", err)
+	}
+	if data, err := os.ReadFile(name + ".1"); err != nil || string(data) != "one\ntwo\n3" {
+		t.Fatalf("old file = %q, %v", data, err)
+	}
+}